@@ -1,15 +1,32 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/peakedshout/novelpackager/pkg/boot"
 	"github.com/peakedshout/novelpackager/pkg/web"
 	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	err := root.Execute()
-	if err != nil {
-		panic(err)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	// the first signal stops the work gracefully, unregistering then lets a second one kill the process
+	context.AfterFunc(ctx, cancel)
+	err := root.ExecuteContext(ctx)
+	switch {
+	case err == nil:
+	case errors.Is(err, context.Canceled) || ctx.Err() != nil:
+		// the download saved what it had, --resume continues from there
+		fmt.Fprintln(os.Stderr, "interrupted")
+		os.Exit(130)
+	default:
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
 	}
 }
 
@@ -17,6 +34,9 @@ var root = &cobra.Command{
 	Use:     "novelpackager",
 	Short:   "novel packager cli",
 	Version: boot.Version,
+	// main reports the error, the usage is only shown for --help
+	SilenceErrors: true,
+	SilenceUsage:  true,
 }
 
 func init() {
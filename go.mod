@@ -14,6 +14,8 @@ require (
 	github.com/peakedshout/go-pandorasbox v0.0.0-20250427001509-05d8cb8d8adf
 	github.com/spf13/cobra v1.9.1
 	github.com/spf13/pflag v1.0.6
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.33.0
 )
 
 require (
@@ -29,7 +31,6 @@ require (
 	github.com/ysmood/got v0.40.0 // indirect
 	github.com/ysmood/gson v0.7.3 // indirect
 	github.com/ysmood/leakless v0.9.0 // indirect
-	golang.org/x/net v0.33.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 )
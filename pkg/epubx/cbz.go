@@ -0,0 +1,108 @@
+package epubx
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"path"
+	"strings"
+)
+
+// buildCBZ write the pages as comic archives, one per book, volume or chapter as the package mode says.
+// The record keeps the hashes of the epubs only, so an archive is written again on every export.
+func (ec *epubContext) buildCBZ() error {
+	for _, u := range ec.comicUnits() {
+		if len(u.pages) == 0 || (ec.toFile() && !u.loaded) {
+			continue
+		}
+		_, err := ec.writeFile(path.Join(ec.output, u.name+".cbz"), func(w io.Writer) error {
+			return ec.writeCBZ(w, u)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// comicInfo the ComicInfo.xml read by the comic readers, see https://anansi-project.github.io/docs/comicinfo/intro.
+type comicInfo struct {
+	XMLName     xml.Name        `xml:"ComicInfo"`
+	XmlnsXsd    string          `xml:"xmlns:xsd,attr"`
+	XmlnsXsi    string          `xml:"xmlns:xsi,attr"`
+	Title       string          `xml:"Title,omitempty"`
+	Series      string          `xml:"Series"`
+	Number      int             `xml:"Number,omitempty"`
+	Summary     string          `xml:"Summary,omitempty"`
+	Writer      string          `xml:"Writer,omitempty"`
+	Tags        string          `xml:"Tags,omitempty"`
+	LanguageISO string          `xml:"LanguageISO,omitempty"`
+	Manga       string          `xml:"Manga,omitempty"`
+	PageCount   int             `xml:"PageCount"`
+	Pages       []comicInfoPage `xml:"Pages>Page"`
+}
+
+type comicInfoPage struct {
+	Image       int    `xml:"Image,attr"`
+	Type        string `xml:"Type,attr,omitempty"`
+	DoublePage  bool   `xml:"DoublePage,attr,omitempty"`
+	ImageSize   int    `xml:"ImageSize,attr,omitempty"`
+	ImageWidth  int    `xml:"ImageWidth,attr,omitempty"`
+	ImageHeight int    `xml:"ImageHeight,attr,omitempty"`
+	Bookmark    string `xml:"Bookmark,attr,omitempty"`
+}
+
+// writeCBZ the pages as a zip of images named by their number, then the ComicInfo.xml describing them.
+func (ec *epubContext) writeCBZ(w io.Writer, u *comicUnit) error {
+	ci := comicInfo{
+		XmlnsXsd:    "http://www.w3.org/2001/XMLSchema",
+		XmlnsXsi:    "http://www.w3.org/2001/XMLSchema-instance",
+		Series:      ec.info.Series,
+		Number:      u.number,
+		Summary:     ec.info.Description,
+		Writer:      ec.info.Author,
+		LanguageISO: ec.lang,
+		Tags:        strings.Join(ec.info.Metas, ","),
+		PageCount:   len(u.pages),
+	}
+	if ci.Series == "" {
+		ci.Series = ec.info.Name
+	}
+	if u.title != ci.Series {
+		ci.Title = u.title
+	}
+	if ec.info.Comic.RTL() {
+		ci.Manga = "YesAndRightToLeft"
+	}
+	zw := zip.NewWriter(w)
+	for n, p := range u.pages {
+		pi, err := ec.pageImage(p)
+		if err != nil {
+			return err
+		}
+		err = writeZipFile(zw, pageFile(n+1, pi.name), zip.Store, pi.data)
+		if err != nil {
+			return err
+		}
+		cp := comicInfoPage{Image: n, Type: p.kind, DoublePage: p.spread, ImageSize: len(pi.data), ImageWidth: pi.w, ImageHeight: pi.h, Bookmark: p.chapter}
+		if p.volume != "" {
+			cp.Bookmark = p.volume
+		}
+		ci.Pages = append(ci.Pages, cp)
+	}
+	fw, err := zw.Create("ComicInfo.xml")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fw, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(fw)
+	enc.Indent("", "  ")
+	err = enc.Encode(ci)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
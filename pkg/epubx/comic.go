@@ -0,0 +1,172 @@
+package epubx
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"image"
+	_ "image/gif"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ComicInfo page types.
+const (
+	pageFrontCover = "FrontCover"
+	pageInnerCover = "InnerCover"
+	pageStory      = "Story"
+)
+
+// comicUnit one package of pages: the book, a volume or a chapter depending on the package mode.
+type comicUnit struct {
+	// name the file name without its extension
+	name  string
+	title string
+	// number the volume or chapter number from 1, 0 for the book
+	number int
+	pages  []*comicPage
+	// loaded whether the record holds every page, the output dir only gets complete packages
+	loaded bool
+	// hash where the record keeps the hash of the package
+	hash *string
+}
+
+type comicPage struct {
+	id     string
+	kind   string
+	spread bool
+	// volume and chapter the titles of the volume and the chapter starting on this page, for the table of contents
+	volume  string
+	chapter string
+}
+
+// pageImage a page as packaged, the size is 0 for an image the decoders do not know.
+type pageImage struct {
+	name string
+	data []byte
+	w, h int
+}
+
+// comicUnits the packages of the selection, the pages are the covers then the images of the chapters in reading order.
+func (ec *epubContext) comicUnits() []*comicUnit {
+	fn := verifyFileName(ec.info.Name)
+	switch ec.mode {
+	case model.PackageModeVolume:
+		var units []*comicUnit
+		for i, volume := range ec.info.Volumes {
+			if !ec.vcm.Volume(i) {
+				continue
+			}
+			name := fmt.Sprintf("%s_%d_%s", fn, i+1, verifyFileName(volume.Name))
+			if cs := ec.vcm.ChapterString(i); cs != "" {
+				name += "[" + cs + "]"
+			}
+			u := &comicUnit{name: name, title: ec.info.Name + " " + volume.Name, number: i + 1, loaded: ec.volumeLoaded(i), hash: &ec.data.Volumes[i].Hash}
+			cover := volume.CoverId
+			if cover == "" {
+				cover = ec.info.CoverId
+			}
+			u.add(&comicPage{id: cover, kind: pageFrontCover})
+			ec.addVolume(u, i, false)
+			units = append(units, u)
+		}
+		return units
+	case model.PackageModeChapter:
+		var units []*comicUnit
+		for i, volume := range ec.info.Volumes {
+			if !ec.vcm.Volume(i) {
+				continue
+			}
+			for k, chapter := range volume.Chapters {
+				if !ec.vcm.Chapter(i, k) {
+					continue
+				}
+				u := &comicUnit{
+					name:   fmt.Sprintf("%s_%d_%s_%d_%s", fn, i+1, verifyFileName(volume.Name), k+1, verifyFileName(chapter.Name)),
+					title:  fmt.Sprintf("%s %s %s", ec.info.Name, volume.Name, chapter.Name),
+					number: k + 1,
+					loaded: ec.data.Volumes[i].Chapters[k].Loaded,
+					hash:   &ec.data.Volumes[i].Chapters[k].Hash,
+				}
+				ec.addChapter(u, i, k)
+				units = append(units, u)
+			}
+		}
+		return units
+	default:
+		if !ec.vcm.All() {
+			fn += "[" + verifyFileName(ec.vcm.String()) + "]"
+		}
+		u := &comicUnit{name: fn, title: ec.info.Name, loaded: true, hash: &ec.data.Hash}
+		u.add(&comicPage{id: ec.info.CoverId, kind: pageFrontCover})
+		for i := range ec.info.Volumes {
+			if ec.vcm.Volume(i) && ec.volumeLoaded(i) {
+				ec.addVolume(u, i, true)
+			}
+		}
+		return []*comicUnit{u}
+	}
+}
+
+// addVolume add the selected chapters of volume i, after its cover if withCover.
+func (ec *epubContext) addVolume(u *comicUnit, i int, withCover bool) {
+	volume := ec.info.Volumes[i]
+	start := len(u.pages)
+	if withCover {
+		u.add(&comicPage{id: volume.CoverId, kind: pageInnerCover})
+	}
+	for k := range volume.Chapters {
+		if ec.vcm.Chapter(i, k) {
+			ec.addChapter(u, i, k)
+		}
+	}
+	if withCover && len(u.pages) > start {
+		u.pages[start].volume = volume.Name
+	}
+}
+
+func (ec *epubContext) addChapter(u *comicUnit, i, k int) {
+	if !ec.chapterIncluded(i, k) {
+		return
+	}
+	chapter := ec.data.Volumes[i].Chapters[k]
+	start := len(u.pages)
+	for _, id := range ec.chapterImgs(i, k) {
+		u.add(&comicPage{id: id, kind: pageStory, spread: slices.Contains(chapter.Spreads, id)})
+	}
+	if len(u.pages) > start {
+		u.pages[start].chapter = ec.info.Volumes[i].Chapters[k].Name
+	}
+}
+
+// add the page unless it is empty or already in the unit, an image shared by two chapters is shown once.
+func (u *comicUnit) add(p *comicPage) {
+	if p.id == "" || slices.ContainsFunc(u.pages, func(o *comicPage) bool { return o.id == p.id }) {
+		return
+	}
+	if len(u.pages) == 0 && p.kind == pageInnerCover {
+		p.kind = pageFrontCover
+	}
+	u.pages = append(u.pages, p)
+}
+
+// pageImage the image of the page and its size, a landscape page is taken for a spread.
+func (ec *epubContext) pageImage(p *comicPage) (*pageImage, error) {
+	name, data, err := ec.image(ec.lc, p.id)
+	if err != nil {
+		return nil, err
+	}
+	pi := &pageImage{name: name, data: data}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == nil {
+		pi.w, pi.h = cfg.Width, cfg.Height
+		p.spread = p.spread || pi.w > pi.h
+	}
+	return pi, nil
+}
+
+// pageFile the name of page n from 1 in a package, the readers of cbz order the pages by name.
+func pageFile(n int, name string) string {
+	return fmt.Sprintf("%04d%s", n, strings.ToLower(path.Ext(name)))
+}
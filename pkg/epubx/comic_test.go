@@ -0,0 +1,179 @@
+package epubx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testPNG(t *testing.T, w, h int) []byte {
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, image.NewGray(image.Rect(0, 0, w, h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testComic a manga of 2 volumes with 2 chapters of 2 pages each, the second page of 1-2 is a landscape spread.
+func testComic(t *testing.T) (*model.BookInfo, *model.BookData, *utils.LinkCache) {
+	lc := utils.NewLinkCache()
+	set := func(name string, data []byte) string {
+		id, err := lc.SetX(name, "https://example.com/"+name, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	info := &model.BookInfo{Name: "Comic", Id: "1", Author: "A", CoverId: set("cover.png", testPNG(t, 30, 40)), Comic: &model.ComicInfo{Direction: model.DirectionRTL}}
+	data := &model.BookData{Loaded: true}
+	for i := 1; i <= 2; i++ {
+		vi := model.VolumeInfo{Name: fmt.Sprintf("V%d", i)}
+		vd := &model.VolumeData{Loaded: true, Name: vi.Name}
+		for k := 1; k <= 2; k++ {
+			cd := &model.ChapterData{Loaded: true, Name: fmt.Sprintf("C%d-%d", i, k)}
+			for n := 1; n <= 2; n++ {
+				w := 30
+				if i == 1 && k == 2 && n == 2 {
+					w = 80
+				}
+				cd.Imgs = append(cd.Imgs, set(fmt.Sprintf("p%d-%d-%d.png", i, k, n), testPNG(t, w, 40)))
+			}
+			vi.Chapters = append(vi.Chapters, model.ChapterInfo{Name: cd.Name})
+			vd.Chapters = append(vd.Chapters, cd)
+		}
+		info.Volumes = append(info.Volumes, vi)
+		data.Volumes = append(data.Volumes, vd)
+	}
+	return info, data, lc
+}
+
+func buildFiles(t *testing.T, cfg *Config) map[string][]byte {
+	files := make(map[string][]byte)
+	var bufs []*bytes.Buffer
+	var names []string
+	cfg.OutputWriter = func(name string) (io.Writer, error) {
+		buf := new(bytes.Buffer)
+		bufs = append(bufs, buf)
+		names = append(names, name)
+		return buf, nil
+	}
+	err := Build(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		files[name] = bufs[i].Bytes()
+	}
+	return files
+}
+
+func unzip(t *testing.T, bs []byte) ([]string, map[string]string) {
+	zr, err := zip.NewReader(bytes.NewReader(bs), int64(len(bs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(bs)
+	}
+	return names, files
+}
+
+func TestFixedLayout(t *testing.T) {
+	info, data, lc := testComic(t)
+	files := buildFiles(t, &Config{Info: info, Data: data, ImgCache: lc, Lang: "ja", PackageMode: model.PackageModeBook, Source: "test"})
+	bs, ok := files["Comic.epub"]
+	if !ok || len(files) != 1 {
+		t.Fatal(files)
+	}
+	names, content := unzip(t, bs)
+	if names[0] != "mimetype" || content["mimetype"] != "application/epub+zip" {
+		t.Fatal(names)
+	}
+	opf := content["EPUB/package.opf"]
+	for _, s := range []string{
+		`<meta property="rendition:layout">pre-paginated</meta>`,
+		`page-progression-direction="rtl"`,
+		// the cover and the spread are shown whole, the other pages pair up from the right
+		`idref="page0001" properties="rendition:page-spread-center"`,
+		`idref="page0002" properties="page-spread-right"`,
+		`idref="page0003" properties="page-spread-left"`,
+		`idref="page0005" properties="rendition:page-spread-center"`,
+		`idref="page0006" properties="page-spread-right"`,
+	} {
+		if !strings.Contains(opf, s) {
+			t.Fatal(s, opf)
+		}
+	}
+	// the cover and 8 pages
+	if strings.Count(opf, "<itemref") != 9 {
+		t.Fatal(opf)
+	}
+	if page := content["EPUB/xhtml/0005.xhtml"]; !strings.Contains(page, `<meta name="viewport" content="width=80, height=40"/>`) {
+		t.Fatal(page)
+	}
+	nav := content["EPUB/nav.xhtml"]
+	if !strings.Contains(nav, `<li><a href="xhtml/0002.xhtml">V1</a>`) || !strings.Contains(nav, `<li><a href="xhtml/0004.xhtml">C1-2</a></li>`) {
+		t.Fatal(nav)
+	}
+
+	err := Build(&Config{Info: info, Data: data, ImgCache: lc, PackageMode: model.PackageModeBook, Content: model.ContentText,
+		OutputWriter: func(string) (io.Writer, error) { return io.Discard, nil }})
+	if !errors.Is(err, model.ErrExportOptions) {
+		t.Fatal(err)
+	}
+}
+
+func TestComicInfo(t *testing.T) {
+	info, data, lc := testComic(t)
+	sel, err := model.ParseSelection("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := buildFiles(t, &Config{Info: info, Data: data, ImgCache: lc, VC: sel, Lang: "ja", PackageMode: model.PackageModeVolume, Format: model.FormatCBZ})
+	bs, ok := files["Comic_1_V1.cbz"]
+	if !ok || len(files) != 1 {
+		t.Fatal(files)
+	}
+	names, content := unzip(t, bs)
+	if strings.Join(names, " ") != "0001.png 0002.png 0003.png 0004.png 0005.png ComicInfo.xml" {
+		t.Fatal(names)
+	}
+	var ci comicInfo
+	err = xml.Unmarshal([]byte(content["ComicInfo.xml"]), &ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Series != "Comic" || ci.Title != "Comic V1" || ci.Number != 1 || ci.Manga != "YesAndRightToLeft" || ci.PageCount != 5 || len(ci.Pages) != 5 {
+		t.Fatal(ci)
+	}
+	if p := ci.Pages[0]; p.Type != pageFrontCover || p.DoublePage {
+		t.Fatal(p)
+	}
+	if p := ci.Pages[1]; p.Type != pageStory || p.Bookmark != "C1-1" || p.ImageWidth != 30 {
+		t.Fatal(p)
+	}
+	if p := ci.Pages[4]; !p.DoublePage || p.ImageWidth != 80 || p.ImageHeight != 40 {
+		t.Fatal(p)
+	}
+}
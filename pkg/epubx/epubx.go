@@ -1,13 +1,21 @@
 package epubx
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/go-shiori/go-epub"
 	"github.com/google/uuid"
+	"github.com/peakedshout/novelpackager/pkg/htmlx"
+	"github.com/peakedshout/novelpackager/pkg/imagex"
 	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/textx"
 	"github.com/peakedshout/novelpackager/pkg/utils"
+	"github.com/peakedshout/novelpackager/pkg/zhconv"
 	"html"
+	"io"
 	"os"
 	"path"
 	"strings"
@@ -22,30 +30,78 @@ type Config struct {
 	Info     *model.BookInfo
 	Data     *model.BookData
 	ImgCache *utils.LinkCache
-	VC       map[int]map[int]bool
+	VC       model.Selection
 
 	Lang        string
 	Output      string
 	OutputChan  chan *FBytesData
 	PackageMode model.PackageMode
 	Source      string
+
+	// OutputWriter if set, each package is streamed to the writer it returns for the file name instead of being kept in memory.
+	OutputWriter func(name string) (io.Writer, error)
+
+	// Convert the zhconv conversion applied to the packaged titles, metadata and chapter text, Info and Data are not modified.
+	Convert string
+	// Filter applied to every chapter before it is converted, on a copy.
+	Filter textx.Chain
+	// Images processes the images for the reader device, nil to embed them as downloaded.
+	Images *imagex.Processor
+	// Content model.ContentText leaves the images out, model.ContentImages packages a gallery of them.
+	Content string
+	// Format model.FormatCBZ writes comic archives of the images, model.FormatTXT plain text, instead of epubs.
+	Format string
+	// Exclude the kinds of chapters flagged by textx.Analyze to leave out.
+	Exclude textx.Exclusion
+	// Meta the metadata set by hand for the book, applied to Info before it is converted.
+	Meta *model.Metadata
+	// Tag the model.ExportOptions Tag, an output file is only skipped as unchanged when it was packaged with the same options.
+	Tag string
 }
 
 func Build(cfg *Config) error {
+	conv, err := zhconv.Get(cfg.Convert)
+	if err != nil {
+		return err
+	}
 	ec := &epubContext{
 		id:         uuid.New().String(),
-		info:       cfg.Info,
+		info:       convertInfo(conv, cfg.Meta.Apply(cfg.Info)),
+		meta:       cfg.Meta,
 		data:       cfg.Data,
 		lc:         cfg.ImgCache,
 		vcm:        cfg.VC,
 		lang:       cfg.Lang,
 		output:     cfg.Output,
 		outputChan: cfg.OutputChan,
+		writer:     cfg.OutputWriter,
 		mode:       cfg.PackageMode,
 		tmpDir:     "",
 		source:     cfg.Source,
+		conv:       conv,
+		filter:     cfg.Filter,
+		images:     cfg.Images,
+		imageNames: make(map[string]string),
+		imageData:  make(map[string][]byte),
+		content:    cfg.Content,
+		format:     cfg.Format,
+		tag:        cfg.Tag,
+		excluded:   cfg.Exclude.Excluded(cfg.Info, cfg.Data),
+	}
+	if mt := cfg.Meta.Tag(); mt != "" {
+		// the metadata changes the packages like the options do
+		ec.tag = strings.TrimPrefix(ec.tag+"_"+mt, "_")
 	}
-	err := ec.build()
+	if ec.format == model.FormatTXT {
+		ec.content = model.ContentText
+	}
+	if ec.info.Comic != nil && ec.content == model.ContentText {
+		return fmt.Errorf("%w: %s is a comic, it has no text", model.ErrExportOptions, ec.info.Name)
+	}
+	if ec.format == model.FormatCBZ || ec.info.Comic != nil {
+		ec.content = model.ContentImages
+	}
+	err = ec.build()
 	if err != nil {
 		return err
 	}
@@ -59,15 +115,30 @@ type epubContext struct {
 	data *model.BookData
 	lc   *utils.LinkCache
 
-	vcm map[int]map[int]bool
+	vcm model.Selection
 
 	lang       string
 	output     string
 	outputChan chan *FBytesData
+	writer     func(name string) (io.Writer, error)
 	mode       model.PackageMode
 
 	tmpDir string
 	source string
+	conv   *zhconv.Converter
+	filter textx.Chain
+
+	// the images as packaged, processed once per package
+	images     *imagex.Processor
+	imageNames map[string]string
+	imageData  map[string][]byte
+
+	content string
+	format  string
+	tag     string
+	meta    *model.Metadata
+	// excluded the flagged chapters left out, by volume and chapter index
+	excluded map[[2]int]bool
 }
 
 func (ec *epubContext) build() (err error) {
@@ -77,6 +148,15 @@ func (ec *epubContext) build() (err error) {
 	}
 	defer os.RemoveAll(ec.tmpDir)
 
+	switch ec.format {
+	case model.FormatCBZ:
+		return ec.buildCBZ()
+	case model.FormatTXT:
+		return ec.buildTXT()
+	}
+	if ec.info.Comic != nil {
+		return ec.buildFixed()
+	}
 	switch ec.mode {
 	case model.PackageModeBook, model.PackageModeDefault:
 		return ec.buildBookContent()
@@ -93,14 +173,17 @@ func (ec *epubContext) buildResById(ep *epub.Epub, lc *utils.LinkCache, id strin
 	if tmpMap[id] {
 		return nil
 	}
-	data := lc.Get(id)
+	name, data, err := ec.image(lc, id)
+	if err != nil {
+		return err
+	}
 
-	p := path.Join(ec.tmpDir, id)
+	p := path.Join(ec.tmpDir, name)
 	err = os.WriteFile(p, data, 0666)
 	if err != nil {
 		return err
 	}
-	_, err = ep.AddImage(p, id)
+	_, err = ep.AddImage(p, name)
 	if err != nil {
 		return err
 	}
@@ -110,22 +193,25 @@ func (ec *epubContext) buildResById(ep *epub.Epub, lc *utils.LinkCache, id strin
 
 func (ec *epubContext) buildBookContentChapter() error {
 	for i, volume := range ec.info.Volumes {
-		if !verifyVolume(ec.vcm, i) {
+		if !ec.vcm.Volume(i) {
 			continue
 		}
-		if !ec.data.Volumes[i].Loaded {
+		if !ec.volumeLoaded(i) {
 			continue
 		}
 		for k, chapter := range volume.Chapters {
-			if !verifyChapter(ec.vcm, i, k) {
+			if !ec.vcm.Chapter(i, k) {
 				continue
 			}
 
-			fp := path.Join(ec.output, fmt.Sprintf("%s_%d_%s_%d_%s.epub", verifyFileName(ec.info.Name), i+1, verifyFileName(volume.Name), k+1, verifyFileName(chapter.Name)))
-			if ec.outputChan == nil {
+			fp := path.Join(ec.output, fmt.Sprintf("%s_%d_%s_%d_%s%s.epub", verifyFileName(ec.info.Name), i+1, verifyFileName(volume.Name), k+1, verifyFileName(chapter.Name), ec.suffix()))
+			if !ec.chapterIncluded(i, k) {
+				continue
+			}
+			if ec.toFile() {
 				if ec.data.Volumes[i].Chapters[k].Loaded {
 					fh, _ := utils.FileHashSha256(fp)
-					if len(fh) != 0 && fh == ec.data.Volumes[i].Chapters[k].Hash {
+					if len(fh) != 0 && ec.tagged(fh) == ec.data.Volumes[i].Chapters[k].Hash {
 						continue
 					}
 				} else {
@@ -141,7 +227,7 @@ func (ec *epubContext) buildBookContentChapter() error {
 
 			ep.SetAuthor(ec.info.Author)
 
-			err = ep.SetCover(fmt.Sprintf("../images/%s", volume.CoverId), "")
+			err = ep.SetCover(fmt.Sprintf("../images/%s", ec.imageName(volume.CoverId)), "")
 			if err != nil {
 				return err
 			}
@@ -157,41 +243,23 @@ func (ec *epubContext) buildBookContentChapter() error {
 			cbody := fmt.Sprintf(`<h1>%s</h1>
 <h2>%s</h2>
 <h3>%s</h3>
-%s`, html.EscapeString(ec.info.Name), html.EscapeString(volume.Name), html.EscapeString(chapter.Name), strings.Join(ec.data.Volumes[i].Chapters[k].Data, "\n"))
+%s`, html.EscapeString(ec.info.Name), html.EscapeString(volume.Name), html.EscapeString(chapter.Name), ec.chapterHTML(i, k))
 			_, err = ep.AddSection(cbody, chapter.Name, fmt.Sprintf("chapter%d_%d.xhtml", i+1, k+1), "")
 			if err != nil {
 				return err
 			}
-			for _, cid := range ec.data.Volumes[i].Chapters[k].Imgs {
+			for _, cid := range ec.chapterImgs(i, k) {
 				err = ec.buildResById(ep, ec.lc, cid, tmpMap)
 				if err != nil {
 					return err
 				}
 			}
 
-			var fh string
-			if ec.outputChan != nil {
-				bs := new(bytes.Buffer)
-				_, err = ep.WriteTo(bs)
-				if err != nil {
-					return err
-				}
-				ec.outputChan <- &FBytesData{
-					Name: fp,
-					Data: bs.Bytes(),
-				}
-				fh = utils.BytesHashSha256(bs.Bytes())
-			} else {
-				err = ep.Write(fp)
-				if err != nil {
-					return err
-				}
-				fh, err = utils.FileHashSha256(fp)
-				if err != nil {
-					return err
-				}
+			fh, err := ec.write(ep, fp)
+			if err != nil {
+				return err
 			}
-			ec.data.Volumes[i].Chapters[k].Hash = fh
+			ec.data.Volumes[i].Chapters[k].Hash = ec.tagged(fh)
 		}
 	}
 	return nil
@@ -199,15 +267,19 @@ func (ec *epubContext) buildBookContentChapter() error {
 
 func (ec *epubContext) buildBookContentVolume() error {
 	for i, volume := range ec.info.Volumes {
-		if !verifyVolume(ec.vcm, i) {
+		if !ec.vcm.Volume(i) {
 			continue
 		}
 
-		fp := path.Join(ec.output, fmt.Sprintf("%s_%d_%s.epub", verifyFileName(ec.info.Name), i+1, verifyFileName(volume.Name)))
-		if ec.outputChan == nil {
-			if ec.data.Volumes[i].Loaded {
+		fn := fmt.Sprintf("%s_%d_%s", verifyFileName(ec.info.Name), i+1, verifyFileName(volume.Name))
+		if cs := ec.vcm.ChapterString(i); cs != "" {
+			fn += "[" + cs + "]"
+		}
+		fp := path.Join(ec.output, fn+ec.suffix()+".epub")
+		if ec.toFile() {
+			if ec.volumeLoaded(i) {
 				fh, _ := utils.FileHashSha256(fp)
-				if len(fh) != 0 && fh == ec.data.Volumes[i].Hash {
+				if len(fh) != 0 && ec.tagged(fh) == ec.data.Volumes[i].Hash {
 					continue
 				}
 			} else {
@@ -223,7 +295,7 @@ func (ec *epubContext) buildBookContentVolume() error {
 
 		ep.SetAuthor(ec.info.Author)
 
-		err = ep.SetCover(fmt.Sprintf("../images/%s", volume.CoverId), "")
+		err = ep.SetCover(fmt.Sprintf("../images/%s", ec.imageName(volume.CoverId)), "")
 		if err != nil {
 			return err
 		}
@@ -241,8 +313,8 @@ func (ec *epubContext) buildBookContentVolume() error {
 		if volume.Description != "" {
 			vbody += fmt.Sprintf("\n"+`<h3>%s</h3>`, html.EscapeString(volume.Description))
 		}
-		if volume.CoverId != "" {
-			vbody += fmt.Sprintf("\n"+`<img src="../images/%s" alt="%s"/>`, volume.CoverId, volume.CoverId)
+		if volume.CoverId != "" && ec.content != model.ContentText {
+			vbody += fmt.Sprintf("\n"+`<img src="../images/%s" alt="%s"/>`, ec.imageName(volume.CoverId), volume.CoverId)
 			err = ec.buildResById(ep, ec.lc, volume.CoverId, tmpMap)
 			if err != nil {
 				return err
@@ -253,21 +325,21 @@ func (ec *epubContext) buildBookContentVolume() error {
 			return err
 		}
 		for k, chapter := range volume.Chapters {
-			if !verifyChapter(ec.vcm, i, k) {
+			if !ec.vcm.Chapter(i, k) {
 				continue
 			}
-			if !ec.data.Volumes[i].Chapters[k].Loaded {
+			if !ec.chapterIncluded(i, k) {
 				continue
 			}
 			cbody := fmt.Sprintf(`<h1>%s</h1>
 <h2>%s</h2>
 <h3>%s</h3>
-%s`, html.EscapeString(ec.info.Name), html.EscapeString(volume.Name), html.EscapeString(chapter.Name), strings.Join(ec.data.Volumes[i].Chapters[k].Data, "\n"))
+%s`, html.EscapeString(ec.info.Name), html.EscapeString(volume.Name), html.EscapeString(chapter.Name), ec.chapterHTML(i, k))
 			_, err = ep.AddSubSection(vs, cbody, chapter.Name, fmt.Sprintf("chapter%d_%d.xhtml", i+1, k+1), "")
 			if err != nil {
 				return err
 			}
-			for _, cid := range ec.data.Volumes[i].Chapters[k].Imgs {
+			for _, cid := range ec.chapterImgs(i, k) {
 				err = ec.buildResById(ep, ec.lc, cid, tmpMap)
 				if err != nil {
 					return err
@@ -275,39 +347,25 @@ func (ec *epubContext) buildBookContentVolume() error {
 			}
 		}
 
-		var fh string
-		if ec.outputChan != nil {
-			bs := new(bytes.Buffer)
-			_, err = ep.WriteTo(bs)
-			if err != nil {
-				return err
-			}
-			ec.outputChan <- &FBytesData{
-				Name: fp,
-				Data: bs.Bytes(),
-			}
-			fh = utils.BytesHashSha256(bs.Bytes())
-		} else {
-			err = ep.Write(fp)
-			if err != nil {
-				return err
-			}
-			fh, err = utils.FileHashSha256(fp)
-			if err != nil {
-				return err
-			}
+		fh, err := ec.write(ep, fp)
+		if err != nil {
+			return err
 		}
-		ec.data.Volumes[i].Hash = fh
+		ec.data.Volumes[i].Hash = ec.tagged(fh)
 	}
 	return nil
 }
 
 func (ec *epubContext) buildBookContent() error {
-	fp := path.Join(ec.output, fmt.Sprintf("%s.epub", verifyFileName(ec.info.Name)))
-	if ec.outputChan == nil {
+	fn := verifyFileName(ec.info.Name)
+	if !ec.vcm.All() {
+		fn += "[" + verifyFileName(ec.vcm.String()) + "]"
+	}
+	fp := path.Join(ec.output, fn+ec.suffix()+".epub")
+	if ec.toFile() {
 		if ec.data.Loaded {
 			fh, _ := utils.FileHashSha256(fp)
-			if len(fh) != 0 && fh == ec.data.Hash {
+			if len(fh) != 0 && ec.tagged(fh) == ec.data.Hash {
 				return nil
 			}
 		}
@@ -326,7 +384,7 @@ func (ec *epubContext) buildBookContent() error {
 	if err != nil {
 		return err
 	}
-	err = ep.SetCover(fmt.Sprintf("../images/%s", ec.info.CoverId), "")
+	err = ep.SetCover(fmt.Sprintf("../images/%s", ec.imageName(ec.info.CoverId)), "")
 	if err != nil {
 		return err
 	}
@@ -336,10 +394,10 @@ func (ec *epubContext) buildBookContent() error {
 	ep.SetIdentifier(fmt.Sprintf("%s_%s", ec.source, ec.id))
 
 	for i, volume := range ec.info.Volumes {
-		if !verifyVolume(ec.vcm, i) {
+		if !ec.vcm.Volume(i) {
 			continue
 		}
-		if !ec.data.Volumes[i].Loaded {
+		if !ec.volumeLoaded(i) {
 			continue
 		}
 		vbody := fmt.Sprintf(`<h1>%s</h1>
@@ -347,8 +405,8 @@ func (ec *epubContext) buildBookContent() error {
 		if volume.Description != "" {
 			vbody += fmt.Sprintf("\n"+`<h3>%s</h3>`, html.EscapeString(volume.Description))
 		}
-		if volume.CoverId != "" {
-			vbody += fmt.Sprintf("\n"+`<img src="../images/%s" alt="%s"/>`, volume.CoverId, volume.CoverId)
+		if volume.CoverId != "" && ec.content != model.ContentText {
+			vbody += fmt.Sprintf("\n"+`<img src="../images/%s" alt="%s"/>`, ec.imageName(volume.CoverId), volume.CoverId)
 			err = ec.buildResById(ep, ec.lc, volume.CoverId, tmpMap)
 			if err != nil {
 				return err
@@ -359,21 +417,21 @@ func (ec *epubContext) buildBookContent() error {
 			return err
 		}
 		for k, chapter := range volume.Chapters {
-			if !verifyChapter(ec.vcm, i, k) {
+			if !ec.vcm.Chapter(i, k) {
 				continue
 			}
-			if !ec.data.Volumes[i].Chapters[k].Loaded {
+			if !ec.chapterIncluded(i, k) {
 				continue
 			}
 			cbody := fmt.Sprintf(`<h1>%s</h1>
 <h2>%s</h2>
 <h3>%s</h3>
-%s`, html.EscapeString(ec.info.Name), html.EscapeString(volume.Name), html.EscapeString(chapter.Name), strings.Join(ec.data.Volumes[i].Chapters[k].Data, "\n"))
+%s`, html.EscapeString(ec.info.Name), html.EscapeString(volume.Name), html.EscapeString(chapter.Name), ec.chapterHTML(i, k))
 			_, err = ep.AddSubSection(vs, cbody, chapter.Name, fmt.Sprintf("chapter%d_%d.xhtml", i+1, k+1), "")
 			if err != nil {
 				return err
 			}
-			for _, cid := range ec.data.Volumes[i].Chapters[k].Imgs {
+			for _, cid := range ec.chapterImgs(i, k) {
 				err = ec.buildResById(ep, ec.lc, cid, tmpMap)
 				if err != nil {
 					return err
@@ -382,60 +440,283 @@ func (ec *epubContext) buildBookContent() error {
 		}
 	}
 
-	var fh string
-	if ec.outputChan != nil {
-		bs := new(bytes.Buffer)
-		_, err = ep.WriteTo(bs)
-		if err != nil {
-			return err
+	fh, err := ec.write(ep, fp)
+	if err != nil {
+		return err
+	}
+	ec.data.Hash = ec.tagged(fh)
+	return nil
+}
+
+// convertInfo a converted copy of the book info, the info of the record is left as it is.
+func convertInfo(conv *zhconv.Converter, info *model.BookInfo) *model.BookInfo {
+	if conv == nil {
+		return info
+	}
+	ci := *info
+	ci.Name = conv.Convert(info.Name)
+	ci.Author = conv.Convert(info.Author)
+	ci.Series = conv.Convert(info.Series)
+	ci.Description = conv.Convert(info.Description)
+	ci.Metas = make([]string, len(info.Metas))
+	for i, meta := range info.Metas {
+		ci.Metas[i] = conv.Convert(meta)
+	}
+	ci.Volumes = make([]model.VolumeInfo, len(info.Volumes))
+	for i, volume := range info.Volumes {
+		volume.Name = conv.Convert(volume.Name)
+		volume.Description = conv.Convert(volume.Description)
+		chapters := make([]model.ChapterInfo, len(volume.Chapters))
+		for k, chapter := range volume.Chapters {
+			chapter.Name = conv.Convert(chapter.Name)
+			chapters[k] = chapter
 		}
-		ec.outputChan <- &FBytesData{
-			Name: fp,
-			Data: bs.Bytes(),
+		volume.Chapters = chapters
+		ci.Volumes[i] = volume
+	}
+	return &ci
+}
+
+// chapterHTML the packaged body of chapter k of volume i.
+func (ec *epubContext) chapterHTML(i, k int) string {
+	chapter := ec.filter.Apply(ec.data.Volumes[i].Chapters[k])
+	data := chapter.Data
+	if ec.content != model.ContentAll {
+		data = nil
+		for _, item := range chapter.Data {
+			if htmlx.IsImage(item) == (ec.content == model.ContentImages) {
+				data = append(data, item)
+			}
 		}
-		fh = utils.BytesHashSha256(bs.Bytes())
-	} else {
-		err = ep.Write(fp)
-		if err != nil {
+	}
+	body := strings.Join(outline(data), "\n")
+	for _, id := range chapter.Imgs {
+		if name := ec.imageName(id); name != id {
+			body = strings.ReplaceAll(body, `src="../images/`+id+`"`, `src="../images/`+name+`"`)
+		}
+	}
+	return ec.conv.ConvertHTML(body)
+}
+
+// outline give the headings of a chapter anchors, under the h3 of the chapter name, and list them at its top
+// when there are several.
+func outline(data []string) []string {
+	var toc []string
+	out := make([]string, 0, len(data)+1)
+	for _, item := range data {
+		level, inner, ok := htmlx.ParseHeading(item)
+		if !ok {
+			out = append(out, item)
+			continue
+		}
+		n := len(toc) + 1
+		tag := fmt.Sprintf("h%d", min(level+3, 6))
+		out = append(out, fmt.Sprintf(`<%s id="s%d">%s</%s>`, tag, n, inner, tag))
+		toc = append(toc, fmt.Sprintf(`<li><a href="#s%d">%s</a></li>`, n, html.EscapeString(htmlx.Text(inner))))
+	}
+	if len(toc) < 2 {
+		return out
+	}
+	return append([]string{`<nav class="toc"><ol>` + strings.Join(toc, "") + `</ol></nav>`}, out...)
+}
+
+// image the name and the data of image id as packaged, its extension follows the format the processor chose.
+func (ec *epubContext) image(lc *utils.LinkCache, id string) (string, []byte, error) {
+	if name, ok := ec.imageNames[id]; ok {
+		return name, ec.imageData[id], nil
+	}
+	raw := lc.Get(id)
+	if id != "" && id == ec.meta.CoverId() {
+		// the cover set by hand is not in the cache
+		raw = ec.meta.Cover
+	}
+	data, ext, err := ec.images.Process(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("image %s: %w", id, err)
+	}
+	name := id
+	if ext != "" {
+		name = strings.TrimSuffix(id, path.Ext(id)) + ext
+	}
+	ec.imageNames[id] = name
+	ec.imageData[id] = data
+	return name, data, nil
+}
+
+// imageName the name image id is packaged under, a failure is reported when the image itself is added.
+func (ec *epubContext) imageName(id string) string {
+	name, _, err := ec.image(ec.lc, id)
+	if err != nil {
+		return id
+	}
+	return name
+}
+
+// chapterIncluded whether chapter k of volume i is loaded and has something to package, a gallery skips the chapters without images.
+// The excluded chapters are left out.
+func (ec *epubContext) chapterIncluded(i, k int) bool {
+	chapter := ec.data.Volumes[i].Chapters[k]
+	return chapter.Loaded && (ec.content != model.ContentImages || len(chapter.Imgs) != 0) && !ec.excluded[[2]int{i, k}]
+}
+
+// chapterImgs the images of chapter k of volume i to add to the package.
+func (ec *epubContext) chapterImgs(i, k int) []string {
+	if ec.content == model.ContentText {
+		return nil
+	}
+	return ec.data.Volumes[i].Chapters[k].Imgs
+}
+
+// suffix of the file names of a text-only or a gallery package, so they sit next to the complete one.
+func (ec *epubContext) suffix() string {
+	if ec.content == model.ContentAll {
+		return ""
+	}
+	return "[" + ec.content + "]"
+}
+
+// tagged the hash of a package as kept in the record, with the tag of the options it was packaged with.
+func (ec *epubContext) tagged(hash string) string {
+	if ec.tag == "" {
+		return hash
+	}
+	return hash + "_" + ec.tag
+}
+
+// volumeLoaded whether the selected chapters of volume i are all loaded.
+func (ec *epubContext) volumeLoaded(i int) bool {
+	if len(ec.vcm[i]) == 0 {
+		return ec.data.Volumes[i].Loaded
+	}
+	for k := range ec.vcm[i] {
+		if k >= len(ec.data.Volumes[i].Chapters) || !ec.data.Volumes[i].Chapters[k].Loaded {
+			return false
+		}
+	}
+	return true
+}
+
+// toFile whether the packages are written to the output dir, where unchanged ones are skipped.
+func (ec *epubContext) toFile() bool {
+	return ec.outputChan == nil && ec.writer == nil
+}
+
+// write output the package and return its hash. go-epub has no series nor subjects, they are added to its
+// package document on the way out.
+func (ec *epubContext) write(ep *epub.Epub, fp string) (string, error) {
+	extra := ec.opfMetadata()
+	return ec.writeFile(fp, func(w io.Writer) error {
+		if extra == "" {
+			_, err := ep.WriteTo(w)
 			return err
 		}
-		fh, err = utils.FileHashSha256(fp)
+		buf := new(bytes.Buffer)
+		_, err := ep.WriteTo(buf)
 		if err != nil {
 			return err
 		}
-	}
-	ec.data.Hash = fh
-	return nil
+		return addOPFMetadata(w, buf.Bytes(), extra)
+	})
 }
 
-func verifyVolume(VC map[int]map[int]bool, v int) bool {
-	if len(VC) == 0 {
-		return true
+// opfMetadata the series and the tags of the book as elements of the metadata of the package document.
+func (ec *epubContext) opfMetadata() string {
+	var sb strings.Builder
+	if ec.info.Series != "" {
+		series := html.EscapeString(ec.info.Series)
+		fmt.Fprintf(&sb, `    <meta property="belongs-to-collection" id="series">%s</meta>`+"\n", series)
+		sb.WriteString(`    <meta refines="#series" property="collection-type">series</meta>` + "\n")
+		// the readers of epub2 metadata, such as calibre, only know their own
+		fmt.Fprintf(&sb, `    <meta name="calibre:series" content="%s"/>`+"\n", series)
 	}
-	if _, ok := VC[v]; ok {
-		return true
+	for _, tag := range ec.info.Metas {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			fmt.Fprintf(&sb, "    <dc:subject>%s</dc:subject>\n", html.EscapeString(tag))
+		}
 	}
-	return false
+	return sb.String()
 }
 
-func verifyChapter(VC map[int]map[int]bool, v, c int) bool {
-	if len(VC) == 0 {
-		return true
+// addOPFMetadata copy the epub to w with extra inserted at the end of the metadata of its package document,
+// the other files are copied as they are and in their order, so the mimetype stays first.
+func addOPFMetadata(w io.Writer, epubData []byte, extra string) error {
+	zr, err := zip.NewReader(bytes.NewReader(epubData), int64(len(epubData)))
+	if err != nil {
+		return err
 	}
-	if cm, ok := VC[v]; ok {
-		return verifyChapter2(cm, c)
+	zw := zip.NewWriter(w)
+	for _, f := range zr.File {
+		if path.Ext(f.Name) != ".opf" {
+			err = zw.Copy(f)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		opf, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		i := bytes.LastIndex(opf, []byte("</metadata>"))
+		if i < 0 {
+			return fmt.Errorf("%s: no metadata", f.Name)
+		}
+		// keep the indentation of the closing tag
+		i = bytes.LastIndexByte(opf[:i], '\n') + 1
+		opf = append(opf[:i:i], append([]byte(extra), opf[i:]...)...)
+		err = writeZipFile(zw, f.Name, f.Method, opf)
+		if err != nil {
+			return err
+		}
 	}
-	return false
+	return zw.Close()
 }
 
-func verifyChapter2(cm map[int]bool, c int) bool {
-	if len(cm) == 0 {
-		return true
-	}
-	if _, ok := cm[c]; ok {
-		return true
+// writeFile output the file fp written by fn, to the writer, the channel or the output dir, and return its hash.
+func (ec *epubContext) writeFile(fp string, fn func(w io.Writer) error) (string, error) {
+	switch {
+	case ec.writer != nil:
+		w, err := ec.writer(path.Base(fp))
+		if err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		err = fn(io.MultiWriter(w, h))
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	case ec.outputChan != nil:
+		bs := new(bytes.Buffer)
+		err := fn(bs)
+		if err != nil {
+			return "", err
+		}
+		ec.outputChan <- &FBytesData{
+			Name: fp,
+			Data: bs.Bytes(),
+		}
+		return utils.BytesHashSha256(bs.Bytes()), nil
+	default:
+		f, err := os.Create(fp)
+		if err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		err = fn(io.MultiWriter(f, h))
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
 	}
-	return false
 }
 
 func verifyFileName(fp string) string {
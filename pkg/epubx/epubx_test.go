@@ -0,0 +1,103 @@
+package epubx
+
+import (
+	"errors"
+	"github.com/peakedshout/novelpackager/pkg/htmlx"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOutline(t *testing.T) {
+	got := outline([]string{"<p>序</p>", "<h1>上</h1>", "<p>一</p>", "<h2><ruby>下<rt>げ</rt></ruby></h2>", "<hr/>", "<h5>附</h5>"})
+	want := []string{
+		`<nav class="toc"><ol><li><a href="#s1">上</a></li><li><a href="#s2">下</a></li><li><a href="#s3">附</a></li></ol></nav>`,
+		"<p>序</p>", `<h4 id="s1">上</h4>`, "<p>一</p>", `<h5 id="s2"><ruby>下<rt>げ</rt></ruby></h5>`, "<hr/>", `<h6 id="s3">附</h6>`,
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("\n got: %q\nwant: %q", got, want)
+	}
+	// a single heading needs no contents
+	if got = outline([]string{"<h2>上</h2>", "<p>一</p>"}); !slices.Equal(got, []string{`<h5 id="s1">上</h5>`, "<p>一</p>"}) {
+		t.Fatal(got)
+	}
+}
+
+// TestRuby a ruby reads as ruby in the epub and as 漢字(かんじ) in the plain text.
+func TestRuby(t *testing.T) {
+	lc := utils.NewLinkCache()
+	cover, err := lc.SetX("cover.png", "https://example.com/cover.png", testPNG(t, 30, 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &model.BookInfo{Name: "Book", Author: "A", CoverId: cover, Volumes: []model.VolumeInfo{{Name: "V1", Chapters: []model.ChapterInfo{{Name: "C1"}}}}}
+	data := &model.BookData{Loaded: true, Volumes: []*model.VolumeData{{Loaded: true, Chapters: []*model.ChapterData{{Loaded: true, Data: []string{
+		"<h2>一</h2>",
+		"<p><ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>を<em>読む</em>。</p>",
+		htmlx.HR,
+		`<img src="../images/a.png" alt="a.png"/>`,
+		"<p>終わり</p>",
+	}}}}}}
+
+	files := buildFiles(t, &Config{Info: info, Data: data, PackageMode: model.PackageModeBook, ImgCache: lc, Format: model.FormatTXT})
+	want := "Book\nA\n\n\nV1\n\n\nC1\n\n\n一\n\n漢字(かんじ)を読む。\n* * *\n終わり\n"
+	if got := string(files["Book.txt"]); got != want {
+		t.Fatalf("\n got: %q\nwant: %q", got, want)
+	}
+
+	files = buildFiles(t, &Config{Info: info, Data: data, ImgCache: lc, PackageMode: model.PackageModeBook})
+	_, content := unzip(t, files["Book.epub"])
+	if chapter := content["EPUB/xhtml/chapter1_1.xhtml"]; !strings.Contains(chapter, "<ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>") {
+		t.Fatal(chapter)
+	}
+}
+
+// TestMetadata the metadata set by hand is packaged in place of the scraped one, the info is left as it is.
+func TestMetadata(t *testing.T) {
+	lc := utils.NewLinkCache()
+	cover, err := lc.SetX("cover.png", "https://example.com/cover.png", testPNG(t, 30, 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &model.BookInfo{Name: "Book", Author: "A", CoverId: cover, Metas: []string{"old"}, Volumes: []model.VolumeInfo{{Name: "V1", Chapters: []model.ChapterInfo{{Name: "C1"}}}}}
+	data := &model.BookData{Loaded: true, Volumes: []*model.VolumeData{{Loaded: true, Chapters: []*model.ChapterData{{Loaded: true, Data: []string{"<p>一</p>"}}}}}}
+	meta := &model.Metadata{Name: "Renamed", Series: "S & T", Tags: []string{"fantasy", "school"}, Volumes: map[int]string{1: "First", 2: "None"}, Cover: testPNG(t, 50, 60)}
+	if err = meta.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := buildFiles(t, &Config{Info: info, Data: data, ImgCache: lc, PackageMode: model.PackageModeBook, Meta: meta})
+	names, content := unzip(t, files["Renamed.epub"])
+	if len(names) == 0 || names[0] != "mimetype" {
+		t.Fatal(names)
+	}
+	opf := content["EPUB/package.opf"]
+	for _, s := range []string{"<dc:title>Renamed</dc:title>", `<meta name="calibre:series" content="S &amp; T"/>`, "<dc:subject>fantasy</dc:subject>", "cover_meta.png"} {
+		if !strings.Contains(opf, s) {
+			t.Fatalf("%s not in\n%s", s, opf)
+		}
+	}
+	if strings.Contains(opf, "<dc:subject>old</dc:subject>") {
+		t.Fatal(opf)
+	}
+	if _, ok := content["EPUB/images/cover_meta.png"]; !ok {
+		t.Fatal(names)
+	}
+	if !strings.Contains(content["EPUB/nav.xhtml"], "First") {
+		t.Fatal(content["EPUB/nav.xhtml"])
+	}
+	if info.Name != "Book" || info.Volumes[0].Name != "V1" || info.CoverId != cover {
+		t.Fatal(info)
+	}
+
+	files = buildFiles(t, &Config{Info: info, Data: data, ImgCache: lc, PackageMode: model.PackageModeBook, Meta: meta, Format: model.FormatTXT})
+	if got, want := string(files["Renamed.txt"]), "Renamed\nS & T\nA\n\n\nFirst\n\n\nC1\n\n一\n"; got != want {
+		t.Fatalf("\n got: %q\nwant: %q", got, want)
+	}
+
+	if err = (&model.Metadata{Cover: []byte("not an image")}).Validate(); !errors.Is(err, model.ErrMetadata) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,236 @@
+package epubx
+
+import (
+	"archive/zip"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"html"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// fallbackWidth and fallbackHeight the viewport of a page whose image size is unknown.
+	fallbackWidth  = 1200
+	fallbackHeight = 1800
+)
+
+var mediaTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".svg":  "image/svg+xml",
+}
+
+// buildFixed write the pages of a comic as fixed-layout epub3, one page per image with its viewport set to the
+// size of the image and the spine in the reading direction. Unchanged packages are skipped like the text epubs.
+func (ec *epubContext) buildFixed() error {
+	for _, u := range ec.comicUnits() {
+		if len(u.pages) == 0 {
+			continue
+		}
+		fp := path.Join(ec.output, u.name+".epub")
+		if ec.toFile() {
+			if !u.loaded {
+				continue
+			}
+			fh, _ := utils.FileHashSha256(fp)
+			if len(fh) != 0 && ec.tagged(fh) == *u.hash {
+				continue
+			}
+		}
+		fh, err := ec.writeFile(fp, func(w io.Writer) error {
+			return ec.writeFixed(w, u)
+		})
+		if err != nil {
+			return err
+		}
+		*u.hash = ec.tagged(fh)
+	}
+	return nil
+}
+
+type navEntry struct {
+	title    string
+	href     string
+	children []*navEntry
+}
+
+func (ec *epubContext) writeFixed(w io.Writer, u *comicUnit) error {
+	zw := zip.NewWriter(w)
+	// the mimetype goes first, uncompressed and without extra fields, the readers look for it at a fixed offset
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fw, "application/epub+zip")
+	if err != nil {
+		return err
+	}
+	err = writeZipFile(zw, "META-INF/container.xml", zip.Deflate, []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="EPUB/package.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`))
+	if err != nil {
+		return err
+	}
+
+	rtl := ec.info.Comic.RTL()
+	var manifest, spine strings.Builder
+	var nav []*navEntry
+	// the side the next single page goes on, a spread or a cover shown whole starts a new pair
+	first, second := "page-spread-left", "page-spread-right"
+	if rtl {
+		first, second = second, first
+	}
+	side := first
+	for n, p := range u.pages {
+		pi, err := ec.pageImage(p)
+		if err != nil {
+			return err
+		}
+		img := pageFile(n+1, pi.name)
+		mt, ok := mediaTypes[path.Ext(img)]
+		if !ok {
+			return fmt.Errorf("page %s: unsupported image type", p.id)
+		}
+		err = writeZipFile(zw, "EPUB/images/"+img, zip.Store, pi.data)
+		if err != nil {
+			return err
+		}
+		width, height := pi.w, pi.h
+		if width == 0 || height == 0 {
+			width, height = fallbackWidth, fallbackHeight
+		}
+		page := fmt.Sprintf("%04d.xhtml", n+1)
+		err = writeZipFile(zw, "EPUB/xhtml/"+page, zip.Deflate, []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+<title>%s</title>
+<meta name="viewport" content="width=%d, height=%d"/>
+<style>html, body { margin: 0; padding: 0; } img { display: block; width: %dpx; height: %dpx; }</style>
+</head>
+<body>
+<img src="../images/%s" alt="%d"/>
+</body>
+</html>
+`, html.EscapeString(u.title), width, height, width, height, img, n+1)))
+		if err != nil {
+			return err
+		}
+
+		props := ""
+		if n == 0 {
+			props = ` properties="cover-image"`
+		}
+		fmt.Fprintf(&manifest, `    <item id="img%04d" href="images/%s" media-type="%s"%s/>`+"\n", n+1, img, mt, props)
+		fmt.Fprintf(&manifest, `    <item id="page%04d" href="xhtml/%s" media-type="application/xhtml+xml"/>`+"\n", n+1, page)
+		spread := side
+		if p.spread || p.kind == pageFrontCover {
+			spread, side = "rendition:page-spread-center", first
+		} else if side == first {
+			side = second
+		} else {
+			side = first
+		}
+		fmt.Fprintf(&spine, `    <itemref idref="page%04d" properties="%s"/>`+"\n", n+1, spread)
+
+		href := "xhtml/" + page
+		if p.volume != "" {
+			nav = append(nav, &navEntry{title: p.volume, href: href})
+		}
+		if p.chapter != "" {
+			e := &navEntry{title: p.chapter, href: href}
+			// the chapters of a book go under their volume
+			if u.number == 0 && len(nav) > 0 {
+				nav[len(nav)-1].children = append(nav[len(nav)-1].children, e)
+			} else {
+				nav = append(nav, e)
+			}
+		}
+	}
+	if len(nav) == 0 {
+		nav = append(nav, &navEntry{title: u.title, href: "xhtml/0001.xhtml"})
+	}
+
+	ppd := "ltr"
+	if rtl {
+		ppd = "rtl"
+	}
+	err = writeZipFile(zw, "EPUB/package.opf", zip.Deflate, []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="pub-id" prefix="rendition: http://www.idpf.org/vocab/rendition/#">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="pub-id">%s</dc:identifier>
+    <dc:title>%s</dc:title>
+    <dc:creator>%s</dc:creator>
+    <dc:description>%s</dc:description>
+    <dc:language>%s</dc:language>
+    <meta property="dcterms:modified">%s</meta>
+    <meta property="rendition:layout">pre-paginated</meta>
+    <meta property="rendition:orientation">auto</meta>
+    <meta property="rendition:spread">landscape</meta>
+    <meta name="cover" content="img0001"/>
+%s  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+%s  </manifest>
+  <spine page-progression-direction="%s">
+%s  </spine>
+</package>
+`, html.EscapeString(fmt.Sprintf("%s_%s", ec.source, ec.id)), html.EscapeString(u.title), html.EscapeString(ec.info.Author),
+		html.EscapeString(ec.info.Description), html.EscapeString(ec.lang), time.Now().UTC().Format(time.RFC3339), ec.opfMetadata(), manifest.String(), ppd, spine.String())))
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	writeNav(&sb, nav)
+	err = writeZipFile(zw, "EPUB/nav.xhtml", zip.Deflate, []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+<title>%s</title>
+</head>
+<body>
+<nav epub:type="toc" id="toc">
+<h1>%s</h1>
+%s</nav>
+</body>
+</html>
+`, html.EscapeString(u.title), html.EscapeString(u.title), sb.String())))
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeNav(sb *strings.Builder, entries []*navEntry) {
+	sb.WriteString("<ol>\n")
+	for _, e := range entries {
+		fmt.Fprintf(sb, `<li><a href="%s">%s</a>`, e.href, html.EscapeString(e.title))
+		if len(e.children) > 0 {
+			sb.WriteString("\n")
+			writeNav(sb, e.children)
+		}
+		sb.WriteString("</li>\n")
+	}
+	sb.WriteString("</ol>\n")
+}
+
+// writeZipFile add a file to the zip, the images are stored as they are since they are compressed already.
+func writeZipFile(zw *zip.Writer, name string, method uint16, data []byte) error {
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
@@ -0,0 +1,131 @@
+package epubx
+
+import (
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/htmlx"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"io"
+	"path"
+	"strings"
+)
+
+// sceneBreak how an `<hr/>` reads in plain text.
+const sceneBreak = "* * *"
+
+// buildTXT write the text as plain utf-8 files, one per book, volume or chapter as the package mode says.
+// The record keeps the hashes of the epubs only, so a file is written again on every export.
+func (ec *epubContext) buildTXT() error {
+	fn := verifyFileName(ec.info.Name)
+	switch ec.mode {
+	case model.PackageModeVolume:
+		for i, volume := range ec.info.Volumes {
+			if !ec.vcm.Volume(i) || (ec.toFile() && !ec.volumeLoaded(i)) {
+				continue
+			}
+			name := fmt.Sprintf("%s_%d_%s", fn, i+1, verifyFileName(volume.Name))
+			if cs := ec.vcm.ChapterString(i); cs != "" {
+				name += "[" + cs + "]"
+			}
+			err := ec.writeTXT(name, func(sb *strings.Builder) {
+				ec.bookText(sb)
+				ec.volumeText(sb, i)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	case model.PackageModeChapter:
+		for i, volume := range ec.info.Volumes {
+			if !ec.vcm.Volume(i) {
+				continue
+			}
+			for k, chapter := range volume.Chapters {
+				if !ec.vcm.Chapter(i, k) || !ec.chapterIncluded(i, k) {
+					continue
+				}
+				name := fmt.Sprintf("%s_%d_%s_%d_%s", fn, i+1, verifyFileName(volume.Name), k+1, verifyFileName(chapter.Name))
+				err := ec.writeTXT(name, func(sb *strings.Builder) {
+					ec.chapterText(sb, i, k)
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		if !ec.vcm.All() {
+			fn += "[" + verifyFileName(ec.vcm.String()) + "]"
+		}
+		return ec.writeTXT(fn, func(sb *strings.Builder) {
+			ec.bookText(sb)
+			for i := range ec.info.Volumes {
+				if ec.vcm.Volume(i) && ec.volumeLoaded(i) {
+					ec.volumeText(sb, i)
+				}
+			}
+		})
+	}
+	return nil
+}
+
+func (ec *epubContext) writeTXT(name string, fn func(sb *strings.Builder)) error {
+	var sb strings.Builder
+	fn(&sb)
+	_, err := ec.writeFile(path.Join(ec.output, name+".txt"), func(w io.Writer) error {
+		_, err := io.WriteString(w, sb.String())
+		return err
+	})
+	return err
+}
+
+// bookText the title page: the name, the series, the author and the description.
+func (ec *epubContext) bookText(sb *strings.Builder) {
+	sb.WriteString(ec.info.Name + "\n")
+	if ec.info.Series != "" && ec.info.Series != ec.info.Name {
+		sb.WriteString(ec.info.Series + "\n")
+	}
+	if ec.info.Author != "" {
+		sb.WriteString(ec.info.Author + "\n")
+	}
+	if ec.info.Description != "" {
+		sb.WriteString("\n" + ec.info.Description + "\n")
+	}
+}
+
+func (ec *epubContext) volumeText(sb *strings.Builder, i int) {
+	volume := ec.info.Volumes[i]
+	sb.WriteString("\n\n" + volume.Name + "\n")
+	if volume.Description != "" {
+		sb.WriteString("\n" + volume.Description + "\n")
+	}
+	for k := range volume.Chapters {
+		if ec.vcm.Chapter(i, k) && ec.chapterIncluded(i, k) {
+			sb.WriteString("\n\n")
+			ec.chapterText(sb, i, k)
+		}
+	}
+}
+
+// chapterText the chapter name and its blocks one per line, the images are left out.
+func (ec *epubContext) chapterText(sb *strings.Builder, i, k int) {
+	chapter := ec.filter.Apply(ec.data.Volumes[i].Chapters[k])
+	sb.WriteString(ec.info.Volumes[i].Chapters[k].Name + "\n\n")
+	var text strings.Builder
+	for _, item := range chapter.Data {
+		switch {
+		case htmlx.IsImage(item):
+			continue
+		case item == htmlx.HR:
+			text.WriteString(sceneBreak + "\n")
+		case item == htmlx.BR:
+			text.WriteString("\n")
+		default:
+			if _, inner, ok := htmlx.ParseHeading(item); ok {
+				text.WriteString("\n" + htmlx.Plain(inner) + "\n\n")
+				continue
+			}
+			text.WriteString(htmlx.Plain(item) + "\n")
+		}
+	}
+	sb.WriteString(ec.conv.Convert(text.String()))
+}
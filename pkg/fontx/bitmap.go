@@ -0,0 +1,139 @@
+package fontx
+
+import (
+	"bytes"
+	"math"
+	"slices"
+)
+
+const (
+	// inkLevel the coverage from which a pixel is part of the glyph, below it is anti-aliasing noise.
+	inkLevel = 32
+	// normSize the side of the grid the glyphs are compared on.
+	normSize = 16
+)
+
+// Bitmap a rasterised glyph, Pix holds the coverage of each pixel (0 to 255) row by row.
+type Bitmap struct {
+	W, H int
+	Pix  []byte
+}
+
+func (b Bitmap) Equal(o Bitmap) bool {
+	return b.W == o.W && b.H == o.H && bytes.Equal(b.Pix, o.Pix)
+}
+
+// Blank whether the glyph draws nothing.
+func (b Bitmap) Blank() bool {
+	_, _, _, _, ok := b.bounds()
+	return !ok
+}
+
+func (b Bitmap) at(x, y int) byte {
+	if x < 0 || y < 0 || x >= b.W || y >= b.H {
+		return 0
+	}
+	return b.Pix[y*b.W+x]
+}
+
+// bounds the box of the inked pixels, [x0, x1) x [y0, y1).
+func (b Bitmap) bounds() (x0, y0, x1, y1 int, ok bool) {
+	x0, y0 = b.W, b.H
+	for y := 0; y < b.H; y++ {
+		for x := 0; x < b.W; x++ {
+			if b.at(x, y) < inkLevel {
+				continue
+			}
+			x0, y0 = min(x0, x), min(y0, y)
+			x1, y1 = max(x1, x+1), max(y1, y+1)
+		}
+	}
+	return x0, y0, x1, y1, x1 > x0
+}
+
+// normalize crop the glyph to its ink and scale it into a normSize square keeping its aspect ratio,
+// so that two fonts drawing the same character at different sizes and offsets line up.
+func (b Bitmap) normalize() []byte {
+	x0, y0, x1, y1, ok := b.bounds()
+	if !ok {
+		return nil
+	}
+	w, h := x1-x0, y1-y0
+	side := max(w, h)
+	// center the box in the square
+	ox := float64(x0) - float64(side-w)/2
+	oy := float64(y0) - float64(side-h)/2
+	cell := float64(side) / normSize
+	out := make([]byte, normSize*normSize)
+	for gy := 0; gy < normSize; gy++ {
+		for gx := 0; gx < normSize; gx++ {
+			sx0, sy0 := ox+float64(gx)*cell, oy+float64(gy)*cell
+			sx1, sy1 := sx0+cell, sy0+cell
+			sum, n := 0, 0
+			for y := int(math.Floor(sy0)); float64(y) < sy1; y++ {
+				for x := int(math.Floor(sx0)); float64(x) < sx1; x++ {
+					sum += int(b.at(x, y))
+					n++
+				}
+			}
+			if n > 0 {
+				out[gy*normSize+gx] = byte(sum / n)
+			}
+		}
+	}
+	return out
+}
+
+type reference struct {
+	r    rune
+	norm []byte
+	// aspect the ratio of the ink box, very different shapes are not worth comparing pixel by pixel
+	aspect float64
+}
+
+// Matcher find the candidate a glyph looks most like.
+type Matcher struct {
+	refs []reference
+}
+
+func NewMatcher(candidates map[rune]Bitmap) *Matcher {
+	m := &Matcher{}
+	for r, b := range candidates {
+		norm := b.normalize()
+		if norm == nil {
+			continue
+		}
+		m.refs = append(m.refs, reference{r: r, norm: norm, aspect: aspect(b)})
+	}
+	// the same input always gets the same answer, whatever the order of the map
+	slices.SortFunc(m.refs, func(a, b reference) int { return int(a.r - b.r) })
+	return m
+}
+
+func aspect(b Bitmap) float64 {
+	x0, y0, x1, y1, _ := b.bounds()
+	return float64(x1-x0) / float64(y1-y0)
+}
+
+// Match the closest candidate and its distance, 0 for a pixel-exact match after normalisation.
+func (m *Matcher) Match(b Bitmap) (rune, float64) {
+	norm := b.normalize()
+	if norm == nil || len(m.refs) == 0 {
+		return 0, math.Inf(1)
+	}
+	ar := aspect(b)
+	best, bestD := rune(0), math.Inf(1)
+	for _, ref := range m.refs {
+		d := 0.0
+		for i := range norm {
+			d += math.Abs(float64(norm[i]) - float64(ref.norm[i]))
+		}
+		d /= float64(len(norm) * 255)
+		// a glyph squeezed into another shape still fills the square, penalise the difference in proportions
+		d += math.Abs(math.Log(ar/ref.aspect)) / 4
+		if d < bestD {
+			best, bestD = ref.r, d
+		}
+	}
+	return best, bestD
+}
@@ -0,0 +1,260 @@
+package fontx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// DefaultDir where the mappings are kept when no dir is configured.
+const DefaultDir = ".np_cache/fonts"
+
+// Mapping how the characters drawn by an obfuscation font read, a character mapped to "" is drawn blank and dropped.
+type Mapping map[rune]string
+
+// Decode the text as it is shown, the characters not in the mapping are kept.
+func (m Mapping) Decode(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for _, r := range s {
+		v, ok := m[r]
+		if !ok {
+			sb.WriteRune(r)
+			continue
+		}
+		sb.WriteString(v)
+	}
+	return sb.String()
+}
+
+// Hash identify a font by its bytes, a rotated font gets a new mapping.
+func Hash(font []byte) string {
+	return utils.BytesHashSha256(font)
+}
+
+// Store the mappings rebuilt so far, one file per font hash.
+// A mapping only holds the characters met in the text, it grows as more chapters are decoded.
+type Store struct {
+	dir string
+
+	mux sync.Mutex
+	mem map[string]Mapping
+}
+
+type mappingFile struct {
+	Hash string            `json:"hash"`
+	Map  map[string]string `json:"map"`
+}
+
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Store{dir: dir, mem: make(map[string]Mapping)}
+}
+
+// Get a copy of the mapping of the font hash, empty if the font was never seen.
+func (s *Store) Get(hash string) (Mapping, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m, err := s.load(hash)
+	if err != nil {
+		return nil, err
+	}
+	cp := make(Mapping, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp, nil
+}
+
+// Put merge the characters into the mapping of the font hash and save it.
+func (s *Store) Put(hash string, add Mapping) error {
+	if len(add) == 0 {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m, err := s.load(hash)
+	if err != nil {
+		return err
+	}
+	for k, v := range add {
+		m[k] = v
+	}
+	mf := mappingFile{Hash: hash, Map: make(map[string]string, len(m))}
+	for k, v := range m {
+		mf.Map[string(k)] = v
+	}
+	bs, err := json.Marshal(mf)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// write aside and rename, the other processes sharing the dir never read half a file
+	p := s.file(hash)
+	err = os.WriteFile(p+".tmp", bs, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// load the mapping of the hash into memory, must be called with the lock held.
+func (s *Store) load(hash string) (Mapping, error) {
+	if m, ok := s.mem[hash]; ok {
+		return m, nil
+	}
+	m := make(Mapping)
+	bs, err := os.ReadFile(s.file(hash))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var mf mappingFile
+		err = json.Unmarshal(bs, &mf)
+		if err != nil {
+			return nil, fmt.Errorf("font mapping %s: %w", hash, err)
+		}
+		for k, v := range mf.Map {
+			for _, r := range k {
+				m[r] = v
+				break
+			}
+		}
+	}
+	s.mem[hash] = m
+	return m, nil
+}
+
+func (s *Store) file(hash string) string {
+	return path.Join(s.dir, hash+".json")
+}
+
+// Rasterizer draw characters the way the reader sees them.
+type Rasterizer interface {
+	// Rasterize draw every rune with the font, falling back to the default font for the runes it lacks;
+	// a nil font draws with the default font only.
+	Rasterize(font []byte, runes []rune) (map[rune]Bitmap, error)
+}
+
+type DecoderConfig struct {
+	// Dir where the mappings are stored, DefaultDir if empty.
+	Dir string
+	// Reference the font the glyphs are matched against, the default font of the rasterizer if nil.
+	// The closer it is to the font the obfuscation was made from, the fewer mistakes.
+	Reference []byte
+	// Candidates the characters a glyph can be matched to.
+	Candidates []rune
+}
+
+// Decoder rebuild the mapping of an obfuscation font from its glyphs: a character the font draws like the
+// default font is not obfuscated, a blank one is dropped and any other is matched against the candidates
+// drawn with the reference font.
+type Decoder struct {
+	store      *Store
+	reference  []byte
+	candidates []rune
+
+	mux     sync.Mutex
+	matcher *Matcher
+}
+
+func NewDecoder(cfg DecoderConfig) *Decoder {
+	candidates := slices.Clone(cfg.Candidates)
+	slices.Sort(candidates)
+	return &Decoder{
+		store:      NewStore(cfg.Dir),
+		reference:  cfg.Reference,
+		candidates: slices.Compact(candidates),
+	}
+}
+
+// Decode the text drawn with the font, the characters missing from the stored mapping are rasterised and matched first.
+func (d *Decoder) Decode(r Rasterizer, font []byte, text string) (string, error) {
+	hash := Hash(font)
+	m, err := d.store.Get(hash)
+	if err != nil {
+		return "", err
+	}
+	var missing []rune
+	for _, c := range text {
+		if _, ok := m[c]; ok || c < 0x80 || unicode.IsSpace(c) {
+			continue
+		}
+		if !slices.Contains(missing, c) {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		add, err := d.rebuild(r, font, missing)
+		if err != nil {
+			return "", err
+		}
+		err = d.store.Put(hash, add)
+		if err != nil {
+			return "", err
+		}
+		for k, v := range add {
+			m[k] = v
+		}
+	}
+	return m.Decode(text), nil
+}
+
+func (d *Decoder) rebuild(r Rasterizer, font []byte, runes []rune) (Mapping, error) {
+	drawn, err := r.Rasterize(font, runes)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := r.Rasterize(nil, runes)
+	if err != nil {
+		return nil, err
+	}
+	m := make(Mapping, len(runes))
+	for _, c := range runes {
+		b := drawn[c]
+		switch {
+		case b.Equal(plain[c]):
+			m[c] = string(c)
+		case b.Blank():
+			m[c] = ""
+		default:
+			matcher, err := d.getMatcher(r)
+			if err != nil {
+				return nil, err
+			}
+			match, _ := matcher.Match(b)
+			m[c] = string(match)
+		}
+	}
+	return m, nil
+}
+
+// getMatcher rasterise the candidates once, they are the same for every font.
+func (d *Decoder) getMatcher(r Rasterizer) (*Matcher, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.matcher != nil {
+		return d.matcher, nil
+	}
+	if len(d.candidates) == 0 {
+		return nil, errors.New("no candidates to match the glyphs against")
+	}
+	refs, err := r.Rasterize(d.reference, d.candidates)
+	if err != nil {
+		return nil, err
+	}
+	d.matcher = NewMatcher(refs)
+	return d.matcher, nil
+}
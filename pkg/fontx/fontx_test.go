@@ -0,0 +1,120 @@
+package fontx
+
+import (
+	"errors"
+	"testing"
+)
+
+// draw a glyph made of the filled rectangles, each given as x0, y0, x1, y1.
+func draw(rects ...[4]int) Bitmap {
+	b := Bitmap{W: rasterSize, H: rasterSize, Pix: make([]byte, rasterSize*rasterSize)}
+	for _, r := range rects {
+		for y := r[1]; y < r[3]; y++ {
+			for x := r[0]; x < r[2]; x++ {
+				b.Pix[y*b.W+x] = 255
+			}
+		}
+	}
+	return b
+}
+
+// fakeRasterizer the default font draws the glyphs of plain, the font "obf" those of obf and falls back to plain.
+type fakeRasterizer struct {
+	plain, obf map[rune]Bitmap
+	calls      int
+}
+
+func (fr *fakeRasterizer) Rasterize(font []byte, runes []rune) (map[rune]Bitmap, error) {
+	fr.calls++
+	out := make(map[rune]Bitmap)
+	for _, r := range runes {
+		b, ok := fr.obf[r]
+		if !ok || string(font) != "obf" {
+			b = fr.plain[r]
+		}
+		out[r] = b
+	}
+	return out, nil
+}
+
+type failRasterizer struct{}
+
+func (failRasterizer) Rasterize([]byte, []rune) (map[rune]Bitmap, error) {
+	return nil, errors.New("no browser")
+}
+
+func TestDecoder(t *testing.T) {
+	fr := &fakeRasterizer{
+		plain: map[rune]Bitmap{
+			'一': draw([4]int{4, 14, 28, 18}),
+			'丨': draw([4]int{14, 4, 18, 28}),
+			'十': draw([4]int{4, 14, 28, 18}, [4]int{14, 4, 18, 28}),
+			'口': draw([4]int{4, 4, 28, 8}, [4]int{4, 24, 28, 28}, [4]int{4, 4, 8, 28}, [4]int{24, 4, 28, 28}),
+		},
+		obf: map[rune]Bitmap{
+			// the same shapes, smaller and elsewhere on the canvas
+			'\ue000': draw([4]int{2, 8, 14, 10}, [4]int{7, 2, 9, 14}),
+			'\ue001': draw(),
+			'\ue002': draw([4]int{10, 20, 22, 22}),
+		},
+	}
+	dir := t.TempDir()
+	d := NewDecoder(DecoderConfig{Dir: dir, Candidates: []rune("一丨十口")})
+	font := []byte("obf")
+
+	got, err := d.Decode(fr, font, "\ue000\ue001口 a\ue002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "十口 a一" {
+		t.Fatal(got)
+	}
+
+	// the mapping is stored, a new decoder does not need the rasterizer for the same characters
+	d = NewDecoder(DecoderConfig{Dir: dir, Candidates: []rune("一丨十口")})
+	got, err = d.Decode(failRasterizer{}, font, "\ue002\ue000")
+	if err != nil || got != "一十" {
+		t.Fatal(got, err)
+	}
+	// an unknown character needs it
+	_, err = d.Decode(failRasterizer{}, font, "\ue003")
+	if err == nil {
+		t.Fatal("decoded without rasterizing")
+	}
+	// another font is another mapping
+	got, err = d.Decode(fr, []byte("other"), "\ue000")
+	if err != nil || got != "\ue000" {
+		t.Fatal(got, err)
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	m := NewMatcher(map[rune]Bitmap{
+		'一': draw([4]int{4, 14, 28, 18}),
+		'丨': draw([4]int{14, 4, 18, 28}),
+		'二': draw([4]int{6, 8, 26, 11}, [4]int{4, 22, 28, 25}),
+	})
+	tests := []struct {
+		b    Bitmap
+		want rune
+	}{
+		{draw([4]int{0, 0, 30, 5}), '一'},
+		{draw([4]int{20, 2, 23, 31}), '丨'},
+		{draw([4]int{8, 4, 20, 6}, [4]int{6, 14, 22, 16}), '二'},
+	}
+	for _, tt := range tests {
+		if r, _ := m.Match(tt.b); r != tt.want {
+			t.Fatal(string(r), string(tt.want))
+		}
+	}
+	if r, _ := m.Match(draw()); r != 0 {
+		t.Fatal(string(r))
+	}
+}
+
+func TestMappingDecode(t *testing.T) {
+	m := Mapping{'\ue000': "狼", '一': ""}
+	if got := m.Decode("一\ue000a一"); got != "狼a" {
+		t.Fatal(got)
+	}
+}
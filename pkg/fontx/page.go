@@ -0,0 +1,146 @@
+package fontx
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/go-rod/rod"
+)
+
+const (
+	// rasterSize the side of the canvas a character is drawn on.
+	rasterSize = 32
+	// rasterBatch the characters drawn per evaluation, the results of one batch travel back as one message.
+	rasterBatch = 512
+	// defaultFamily the fallback of every font, and the font drawn when there is none.
+	defaultFamily = "sans-serif"
+)
+
+// PageRasterizer draw the characters on a canvas of the page, the fonts are loaded from their bytes
+// so the glyphs are those of the captured font whatever the page itself loads or blocks.
+type PageRasterizer struct {
+	Page *rod.Page
+}
+
+func (pr *PageRasterizer) Rasterize(font []byte, runes []rune) (map[rune]Bitmap, error) {
+	family := defaultFamily
+	if font != nil {
+		family = "np-" + Hash(font)[:16]
+		_, err := pr.Page.Eval(`async (family, data) => {
+			if (window.npFonts && window.npFonts[family]) {
+				return;
+			}
+			const bin = Uint8Array.from(atob(data), c => c.charCodeAt(0));
+			const face = new FontFace(family, bin);
+			await face.load();
+			document.fonts.add(face);
+			window.npFonts = window.npFonts || {};
+			window.npFonts[family] = true;
+		}`, family, base64.StdEncoding.EncodeToString(font))
+		if err != nil {
+			return nil, fmt.Errorf("load font: %w", err)
+		}
+		family = fmt.Sprintf(`"%s", %s`, family, defaultFamily)
+	}
+	out := make(map[rune]Bitmap, len(runes))
+	for i := 0; i < len(runes); i += rasterBatch {
+		batch := runes[i:min(i+rasterBatch, len(runes))]
+		text := make([]string, len(batch))
+		for k, r := range batch {
+			text[k] = string(r)
+		}
+		res, err := pr.Page.Eval(`(family, size, chars) => {
+			const canvas = document.createElement('canvas');
+			canvas.width = size;
+			canvas.height = size;
+			const c = canvas.getContext('2d', {willReadFrequently: true});
+			c.font = Math.round(size * 0.8) + 'px ' + family;
+			c.textAlign = 'center';
+			c.textBaseline = 'middle';
+			c.fillStyle = '#000';
+			return chars.map(ch => {
+				c.clearRect(0, 0, size, size);
+				c.fillText(ch, size / 2, size / 2);
+				const px = c.getImageData(0, 0, size, size).data;
+				let s = '';
+				for (let i = 3; i < px.length; i += 4) {
+					s += String.fromCharCode(px[i]);
+				}
+				return btoa(s);
+			});
+		}`, family, rasterSize, text)
+		if err != nil {
+			return nil, fmt.Errorf("rasterize: %w", err)
+		}
+		arr := res.Value.Arr()
+		if len(arr) != len(batch) {
+			return nil, errors.New("rasterize: unexpected result")
+		}
+		for k, v := range arr {
+			pix, err := base64.StdEncoding.DecodeString(v.Str())
+			if err != nil {
+				return nil, fmt.Errorf("rasterize: %w", err)
+			}
+			out[batch[k]] = Bitmap{W: rasterSize, H: rasterSize, Pix: pix}
+		}
+	}
+	return out, nil
+}
+
+// FontURL the url of the web font the element matched by selector is drawn with,
+// empty when the element uses no font of the page's stylesheets.
+func FontURL(page *rod.Page, selector string) (string, error) {
+	res, err := page.Eval(`(selector) => {
+		const el = document.querySelector(selector);
+		if (!el) {
+			return '';
+		}
+		const unquote = s => s.trim().replace(/^["']|["']$/g, '');
+		const families = getComputedStyle(el).fontFamily.split(',').map(unquote);
+		for (const sheet of document.styleSheets) {
+			let rules;
+			try {
+				rules = sheet.cssRules;
+			} catch (e) {
+				continue;
+			}
+			for (const rule of rules) {
+				if (!(rule instanceof CSSFontFaceRule)) {
+					continue;
+				}
+				if (!families.includes(unquote(rule.style.getPropertyValue('font-family')))) {
+					continue;
+				}
+				const m = rule.style.getPropertyValue('src').match(/url\(\s*["']?([^"')]+)["']?\s*\)/);
+				if (m) {
+					return new URL(m[1], sheet.href || location.href).href;
+				}
+			}
+		}
+		return '';
+	}`, selector)
+	if err != nil {
+		return "", fmt.Errorf("font url: %w", err)
+	}
+	return res.Value.Str(), nil
+}
+
+// Fetch the font from the page itself, so the cookies and the referer are those of the site.
+func Fetch(page *rod.Page, url string) ([]byte, error) {
+	res, err := page.Eval(`async (url) => {
+		const res = await fetch(url);
+		if (!res.ok) {
+			throw new Error(url + ': ' + res.status);
+		}
+		const bin = new Uint8Array(await res.arrayBuffer());
+		let s = '';
+		for (let i = 0; i < bin.length; i++) {
+			s += String.fromCharCode(bin[i]);
+		}
+		return btoa(s);
+	}`, url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch font: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(res.Value.Str())
+}
@@ -0,0 +1,243 @@
+package htmlx
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"strings"
+)
+
+// inline the elements kept inside a block: emphasis, ruby annotations and line breaks.
+// The other elements are unwrapped, their text is kept without them.
+var inline = map[atom.Atom]bool{
+	atom.Em:     true,
+	atom.Strong: true,
+	atom.B:      true,
+	atom.I:      true,
+	atom.U:      true,
+	atom.S:      true,
+	atom.Sub:    true,
+	atom.Sup:    true,
+	atom.Ruby:   true,
+	atom.Rb:     true,
+	atom.Rt:     true,
+	atom.Rp:     true,
+	atom.Br:     true,
+}
+
+// dropped the elements whose content is not text of the chapter.
+var dropped = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Iframe:   true,
+	atom.Object:   true,
+	atom.Img:      true,
+}
+
+// parse the fragment as the content of a block.
+func parse(fragment string) []*html.Node {
+	nodes, err := html.ParseFragment(strings.NewReader(fragment), &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div})
+	if err != nil {
+		// the parser only fails on reading, which a string never does
+		return []*html.Node{{Type: html.TextNode, Data: fragment}}
+	}
+	return nodes
+}
+
+// Inline sanitise the fragment to the inline subset the chapters are kept in: the text escaped, the inline elements
+// without attributes and nothing else. It is the content of a `<p>`, a heading or a caption.
+func Inline(fragment string) string {
+	var sb strings.Builder
+	for _, n := range parse(fragment) {
+		writeInline(&sb, n)
+	}
+	return sb.String()
+}
+
+func writeInline(sb *strings.Builder, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		sb.WriteString(html.EscapeString(n.Data))
+	case html.ElementNode:
+		if dropped[n.DataAtom] {
+			return
+		}
+		if n.DataAtom == atom.Br {
+			sb.WriteString("<br/>")
+			return
+		}
+		var inner strings.Builder
+		// the readers without ruby show the parentheses around the reading
+		fallback := n.DataAtom == atom.Ruby && !hasChild(n, atom.Rp)
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if fallback && c.Type == html.ElementNode && c.DataAtom == atom.Rt {
+				var rt strings.Builder
+				writeInline(&rt, c)
+				if rt.Len() > 0 {
+					inner.WriteString("<rp>(</rp>" + rt.String() + "<rp>)</rp>")
+				}
+				continue
+			}
+			writeInline(&inner, c)
+		}
+		if !inline[n.DataAtom] {
+			sb.WriteString(inner.String())
+			return
+		}
+		if inner.Len() == 0 {
+			// an empty emphasis shows nothing
+			return
+		}
+		sb.WriteString("<" + n.Data + ">")
+		sb.WriteString(inner.String())
+		sb.WriteString("</" + n.Data + ">")
+	}
+}
+
+func hasChild(n *html.Node, a atom.Atom) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == a {
+			return true
+		}
+	}
+	return false
+}
+
+// Text the text of a sanitised fragment as it reads, without the ruby annotations.
+func Text(fragment string) string {
+	if !HasMarkup(fragment) {
+		return html.UnescapeString(fragment)
+	}
+	var sb strings.Builder
+	for _, n := range parse(fragment) {
+		writeText(&sb, n)
+	}
+	return sb.String()
+}
+
+func writeText(sb *strings.Builder, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		sb.WriteString(n.Data)
+	case html.ElementNode:
+		if n.DataAtom == atom.Rt || n.DataAtom == atom.Rp || dropped[n.DataAtom] {
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			writeText(sb, c)
+		}
+	}
+}
+
+// Plain the text of a sanitised fragment for the plain-text outputs: the ruby annotations read 漢字(かんじ)
+// and the line breaks are new lines.
+func Plain(fragment string) string {
+	if !HasMarkup(fragment) {
+		return html.UnescapeString(fragment)
+	}
+	var sb strings.Builder
+	for _, n := range parse(fragment) {
+		writePlain(&sb, n)
+	}
+	return sb.String()
+}
+
+func writePlain(sb *strings.Builder, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		sb.WriteString(n.Data)
+	case html.ElementNode:
+		switch {
+		case n.DataAtom == atom.Rp || dropped[n.DataAtom]:
+			return
+		case n.DataAtom == atom.Br:
+			sb.WriteString("\n")
+			return
+		case n.DataAtom == atom.Rt:
+			sb.WriteString("(")
+			defer sb.WriteString(")")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			writePlain(sb, c)
+		}
+	}
+}
+
+// MapText rewrite every text node of a sanitised fragment by fn, the markup is kept as it is.
+func MapText(fragment string, fn func(text string) string) string {
+	if !HasMarkup(fragment) {
+		return html.EscapeString(fn(html.UnescapeString(fragment)))
+	}
+	var sb strings.Builder
+	for _, n := range parse(fragment) {
+		mapText(n, fn)
+		writeInline(&sb, n)
+	}
+	return sb.String()
+}
+
+func mapText(n *html.Node, fn func(text string) string) {
+	if n.Type == html.TextNode {
+		n.Data = fn(n.Data)
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		mapText(c, fn)
+	}
+}
+
+// HasMarkup whether the fragment holds elements besides its text.
+func HasMarkup(fragment string) bool {
+	return strings.ContainsRune(fragment, '<')
+}
+
+// The blocks of a chapter, each item of ChapterData.Data is one of them.
+const (
+	// HR a scene break.
+	HR = "<hr/>"
+	// BR an empty line.
+	BR = "<br/>"
+)
+
+// Paragraph the `<p>` block of the fragment.
+func Paragraph(fragment string) string {
+	return "<p>" + Inline(fragment) + "</p>"
+}
+
+// Heading the `<h1>` to `<h6>` block of the fragment, empty if it has no text.
+func Heading(level int, fragment string) string {
+	level = min(max(level, 1), 6)
+	inner := Inline(fragment)
+	if strings.TrimSpace(Text(inner)) == "" {
+		return ""
+	}
+	tag := "h" + string(rune('0'+level))
+	return "<" + tag + ">" + inner + "</" + tag + ">"
+}
+
+// ParseHeading the level and the content of a heading block, ok is false for the other blocks.
+func ParseHeading(item string) (level int, inner string, ok bool) {
+	if len(item) < 9 || item[0] != '<' || item[1] != 'h' || item[2] < '1' || item[2] > '6' || item[3] != '>' {
+		return 0, "", false
+	}
+	if !strings.HasSuffix(item, "</"+item[1:4]) {
+		return 0, "", false
+	}
+	return int(item[2] - '0'), item[4 : len(item)-5], true
+}
+
+// Image the block of an image, with its caption if it has one.
+func Image(src, alt, caption string) string {
+	img := `<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(alt) + `"/>`
+	caption = Inline(caption)
+	if strings.TrimSpace(Text(caption)) == "" {
+		return img
+	}
+	return "<figure>" + img + "<figcaption>" + caption + "</figcaption></figure>"
+}
+
+// IsImage whether the block is an image, captioned or not.
+func IsImage(item string) bool {
+	return strings.HasPrefix(item, "<img") || strings.HasPrefix(item, "<figure>")
+}
@@ -0,0 +1,84 @@
+package htmlx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain &amp; simple", "plain &amp; simple"},
+		{`<span class="x" style="color:red">他<em onclick="x()">说</em></span>`, "他<em>说</em>"},
+		{`<ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>`, "<ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>"},
+		{"a<script>alert(1)</script><style>p{}</style>b", "ab"},
+		{"<strong></strong>x<br>y", "x<br/>y"},
+		{`<a href="https://example.com">link</a><img src="x">`, "link"},
+		{"1 < 2 & 3 > 2", "1 &lt; 2 &amp; 3 &gt; 2"},
+		{"<b>unclosed", "<b>unclosed</b>"},
+		// the parentheses for the readers without ruby
+		{"<ruby>漢<rt>かん</rt>字<rt>じ</rt></ruby>", "<ruby>漢<rp>(</rp><rt>かん</rt><rp>)</rp>字<rp>(</rp><rt>じ</rt><rp>)</rp></ruby>"},
+	}
+	for _, tt := range tests {
+		if got := Inline(tt.in); got != tt.want {
+			t.Fatalf("Inline(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		// sanitising again changes nothing
+		if got := Inline(tt.want); got != tt.want {
+			t.Fatalf("Inline(%q) = %q", tt.want, got)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	if got := Text("<ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>を<em>読む</em> &amp;"); got != "漢字を読む &" {
+		t.Fatal(got)
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"<ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>を読む", "漢字(かんじ)を読む"},
+		{"<ruby>漢<rt>かん</rt>字<rt>じ</rt></ruby>", "漢(かん)字(じ)"},
+		{"<ruby><rb>東京</rb><rt>とうきょう</rt></ruby>", "東京(とうきょう)"},
+		{"一<br/>二 &amp;", "一\n二 &"},
+	}
+	for _, tt := range tests {
+		if got := Plain(tt.in); got != tt.want {
+			t.Fatalf("Plain(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	got := MapText("a<em>b</em>c &lt;", strings.ToUpper)
+	if got != "A<em>B</em>C &lt;" {
+		t.Fatal(got)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	if got := Paragraph(`<span>他</span><i>说</i>`); got != "<p>他<i>说</i></p>" {
+		t.Fatal(got)
+	}
+	if got := Heading(2, "<b>第一节</b>"); got != "<h2><b>第一节</b></h2>" {
+		t.Fatal(got)
+	}
+	if got := Heading(9, " "); got != "" {
+		t.Fatal(got)
+	}
+	level, inner, ok := ParseHeading("<h2><b>第一节</b></h2>")
+	if !ok || level != 2 || inner != "<b>第一节</b>" {
+		t.Fatal(level, inner, ok)
+	}
+	for _, item := range []string{"<p>x</p>", "<h2>x</h3>", "<hr/>", "<h7>x</h7>"} {
+		if _, _, ok := ParseHeading(item); ok {
+			t.Fatal(item)
+		}
+	}
+	img := Image("../images/a.jpg", "a.jpg", "")
+	if img != `<img src="../images/a.jpg" alt="a.jpg"/>` || !IsImage(img) {
+		t.Fatal(img)
+	}
+	fig := Image("../images/a.jpg", "a.jpg", `<div><img src="a.jpg">插图<em>一</em></div>`)
+	if fig != `<figure><img src="../images/a.jpg" alt="a.jpg"/><figcaption>插图<em>一</em></figcaption></figure>` || !IsImage(fig) {
+		t.Fatal(fig)
+	}
+}
@@ -0,0 +1,38 @@
+package htmlx
+
+import (
+	"fmt"
+	"github.com/go-rod/rod"
+)
+
+// Visible the inner html of the element as the reader sees it: the hidden nodes, which the sites fill with
+// text to trip copies up, are left out and the elements lose their attributes. The result is to be sanitised.
+func Visible(el *rod.Element) (string, error) {
+	res, err := el.Eval(`function () {
+		const esc = s => s.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
+		const walk = node => {
+			let s = '';
+			for (const c of node.childNodes) {
+				if (c.nodeType === Node.TEXT_NODE) {
+					s += esc(c.textContent);
+					continue;
+				}
+				if (c.nodeType !== Node.ELEMENT_NODE) {
+					continue;
+				}
+				const style = getComputedStyle(c);
+				if (style.display === 'none' || style.visibility === 'hidden') {
+					continue;
+				}
+				const tag = c.tagName.toLowerCase();
+				s += tag === 'br' ? '<br>' : '<' + tag + '>' + walk(c) + '</' + tag + '>';
+			}
+			return s;
+		};
+		return walk(this);
+	}`)
+	if err != nil {
+		return "", fmt.Errorf("visible html: %w", err)
+	}
+	return res.Value.Str(), nil
+}
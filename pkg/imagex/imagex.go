@@ -0,0 +1,302 @@
+package imagex
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultDir where the processed images are kept.
+const DefaultDir = ".np_cache/images"
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+
+	defaultQuality = 85
+)
+
+var ErrImageSpec = errors.New("invalid image spec")
+
+// Options how the images are processed. The zero value only converts webp, which many readers cannot show, to jpeg.
+type Options struct {
+	// Format the format of every image, empty keeps the format of each image.
+	Format string
+	// Width and Height the box the images are scaled down to fit in, 0 for no limit.
+	Width, Height int
+	// Gray convert to grayscale.
+	Gray bool
+	// Dither the gray levels the images are dithered to, for e-ink screens; 0 for no dithering.
+	Dither int
+	// Quality of the jpeg encoder, 1 to 100.
+	Quality int
+}
+
+// presets the common reader devices, the sizes are those of their screens in portrait.
+var presets = map[string]Options{
+	"kindle": {Format: FormatJPEG, Width: 1072, Height: 1448, Gray: true, Quality: 75},
+	"kobo":   {Format: FormatJPEG, Width: 1264, Height: 1680, Gray: true, Quality: 80},
+	"eink":   {Format: FormatPNG, Width: 1072, Height: 1448, Gray: true, Dither: 16},
+	"tablet": {Format: FormatJPEG, Width: 1536, Height: 2048, Quality: 85},
+	"compat": {Quality: 90},
+}
+
+// Presets the names of the device presets.
+func Presets() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Parse a spec, the items separated by commas: a preset name (first item only), `jpeg` or `png`, a size `1072x1448`,
+// `gray`, `dither=16` and `q=80`. The items after a preset override it, e.g. `kindle,q=60`. "" returns nil.
+func Parse(spec string) (*Options, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	var o Options
+	for i, item := range strings.Split(spec, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		key, value, hasValue := strings.Cut(item, "=")
+		if p, ok := presets[item]; ok && i == 0 {
+			o = p
+			continue
+		}
+		switch {
+		case item == FormatJPEG || item == "jpg":
+			o.Format = FormatJPEG
+		case item == FormatPNG:
+			o.Format = FormatPNG
+		case item == "gray" || item == "grey":
+			o.Gray = true
+		case key == "dither":
+			o.Gray = true
+			o.Dither = 16
+			if hasValue {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 2 || n > 256 {
+					return nil, fmt.Errorf("%w %q: dither levels go from 2 to 256", ErrImageSpec, item)
+				}
+				o.Dither = n
+			}
+		case key == "q" || key == "quality":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 100 {
+				return nil, fmt.Errorf("%w %q: quality goes from 1 to 100", ErrImageSpec, item)
+			}
+			o.Quality = n
+		case strings.Contains(item, "x"):
+			ws, hs, _ := strings.Cut(item, "x")
+			w, err1 := strconv.Atoi(ws)
+			h, err2 := strconv.Atoi(hs)
+			if err1 != nil || err2 != nil || w < 0 || h < 0 {
+				return nil, fmt.Errorf("%w %q: the size is WIDTHxHEIGHT", ErrImageSpec, item)
+			}
+			o.Width, o.Height = w, h
+		default:
+			return nil, fmt.Errorf("%w: unknown item %q", ErrImageSpec, item)
+		}
+	}
+	return &o, nil
+}
+
+// String the canonical spec of the options, two specs processing the same way have the same string.
+func (o *Options) String() string {
+	var items []string
+	if o.Format != "" {
+		items = append(items, o.Format)
+	}
+	if o.Width > 0 || o.Height > 0 {
+		items = append(items, fmt.Sprintf("%dx%d", o.Width, o.Height))
+	}
+	if o.Gray {
+		items = append(items, "gray")
+	}
+	if o.Dither > 0 {
+		items = append(items, "dither="+strconv.Itoa(o.Dither))
+	}
+	if o.Quality > 0 {
+		items = append(items, "q="+strconv.Itoa(o.Quality))
+	}
+	return strings.Join(items, ",")
+}
+
+// Processor apply the options to the images of a package. The results are cached on disk by the hash of the image
+// and the options, so that every export of a book after the first one reuses them.
+type Processor struct {
+	opts Options
+	key  string
+	dir  string
+}
+
+// NewProcessor the processor of the spec (see Parse), nil for "" which embeds the images as downloaded.
+func NewProcessor(spec string, dir string) (*Processor, error) {
+	o, err := Parse(spec)
+	if err != nil || o == nil {
+		return nil, err
+	}
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Processor{opts: *o, key: utils.BytesHashSha256([]byte(o.String()))[:16], dir: dir}, nil
+}
+
+// Process the image, ext is the extension of the format of the result. An image that cannot be decoded,
+// or needs no change, is returned as it is with an empty ext.
+func (p *Processor) Process(data []byte) (out []byte, ext string, err error) {
+	if p == nil {
+		return data, "", nil
+	}
+	name := utils.BytesHashSha256(data) + "_" + p.key
+	for _, e := range []string{".jpg", ".png", ".none"} {
+		bs, err := os.ReadFile(path.Join(p.dir, name+e))
+		if err != nil {
+			continue
+		}
+		if e == ".none" {
+			return data, "", nil
+		}
+		return bs, e, nil
+	}
+	out, ext, err = p.process(data)
+	if err != nil {
+		return nil, "", err
+	}
+	err = os.MkdirAll(p.dir, os.ModePerm)
+	if err != nil {
+		return nil, "", err
+	}
+	if ext == "" {
+		// remember that the image stays as it is, without keeping a copy
+		return data, "", os.WriteFile(path.Join(p.dir, name+".none"), nil, 0644)
+	}
+	tmp := path.Join(p.dir, name+ext+".tmp")
+	err = os.WriteFile(tmp, out, 0644)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, ext, os.Rename(tmp, path.Join(p.dir, name+ext))
+}
+
+func (p *Processor) process(data []byte) ([]byte, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		// not an image the decoders know, let the reader deal with it
+		return data, "", nil
+	}
+	o := p.opts
+	target := o.Format
+	if target == "" {
+		switch format {
+		case "webp":
+			target = FormatJPEG
+			if o.Dither > 0 {
+				target = FormatPNG
+			}
+		case "gif":
+			// an animation would be left with its first frame
+			return data, "", nil
+		default:
+			target = format
+		}
+	}
+
+	changed := target != format
+	if scaled, ok := fit(img, o.Width, o.Height); ok {
+		img, changed = scaled, true
+	}
+	if o.Gray {
+		img, changed = toGray(img, o.Dither), true
+	}
+	if !changed && !(target == FormatJPEG && o.Quality > 0) {
+		return data, "", nil
+	}
+
+	buf := new(bytes.Buffer)
+	switch target {
+	case FormatJPEG:
+		q := o.Quality
+		if q == 0 {
+			q = defaultQuality
+		}
+		err = jpeg.Encode(buf, flatten(img), &jpeg.Options{Quality: q})
+		if err == nil && format == FormatJPEG && !changed && buf.Len() >= len(data) {
+			// recompressing did not make it smaller
+			return data, "", nil
+		}
+		return buf.Bytes(), ".jpg", err
+	case FormatPNG:
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(buf, img)
+		return buf.Bytes(), ".png", err
+	default:
+		return nil, "", fmt.Errorf("%w: cannot encode %s", ErrImageSpec, target)
+	}
+}
+
+// fit scale the image down into the box keeping its aspect ratio, ok is false when it already fits.
+func fit(img image.Image, w, h int) (image.Image, bool) {
+	b := img.Bounds()
+	scale := 1.0
+	if w > 0 && b.Dx() > w {
+		scale = float64(w) / float64(b.Dx())
+	}
+	if h > 0 && float64(b.Dy())*scale > float64(h) {
+		scale = float64(h) / float64(b.Dy())
+	}
+	if scale == 1 {
+		return img, false
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, max(1, int(float64(b.Dx())*scale+0.5)), max(1, int(float64(b.Dy())*scale+0.5))))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst, true
+}
+
+// toGray convert the image to grayscale over a white background,
+// dithered with Floyd-Steinberg to the gray levels if levels is not 0.
+func toGray(img image.Image, levels int) image.Image {
+	src := flatten(img)
+	if levels == 0 {
+		gray := image.NewGray(src.Bounds())
+		draw.Draw(gray, gray.Bounds(), src, src.Bounds().Min, draw.Src)
+		return gray
+	}
+	palette := make(color.Palette, levels)
+	for i := range palette {
+		v := uint8(i * 255 / (levels - 1))
+		palette[i] = color.Gray{Y: v}
+	}
+	dst := image.NewPaletted(src.Bounds(), palette)
+	draw.FloydSteinberg.Draw(dst, dst.Bounds(), src, src.Bounds().Min)
+	return dst
+}
+
+// flatten draw the image over white, jpeg has no transparency and the readers show a white page.
+func flatten(img image.Image) image.Image {
+	if _, ok := img.(*image.Gray); ok {
+		return img
+	}
+	if _, ok := img.(*image.YCbCr); ok {
+		return img
+	}
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,127 @@
+package imagex
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"kindle", "jpeg,1072x1448,gray,q=75"},
+		{"kindle,q=60", "jpeg,1072x1448,gray,q=60"},
+		{"PNG, 800x0, dither=4", "png,800x0,gray,dither=4"},
+		{"compat", "q=90"},
+		{"dither", "gray,dither=16"},
+	}
+	for _, tt := range tests {
+		o, err := Parse(tt.in)
+		if err != nil {
+			t.Fatal(tt.in, err)
+		}
+		if o.String() != tt.out {
+			t.Fatal(tt.in, o.String())
+		}
+	}
+	if o, err := Parse(""); o != nil || err != nil {
+		t.Fatal(o, err)
+	}
+	for _, in := range []string{"x", "q=0", "dither=1", "axb", "jpeg,kindle"} {
+		_, err := Parse(in)
+		if !errors.Is(err, ErrImageSpec) {
+			t.Fatal(in, err)
+		}
+	}
+}
+
+func testPNG(t *testing.T, w, h int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcess(t *testing.T) {
+	dir := t.TempDir()
+	webp, err := os.ReadFile("testdata/blue-purple-pink.lossy.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// webp is converted even without any other option
+	p, err := NewProcessor("compat", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, ext, err := p.Process(webp)
+	if err != nil || ext != ".jpg" {
+		t.Fatal(ext, err)
+	}
+	if _, err = jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatal(err)
+	}
+	// a png that fits is left alone
+	src := testPNG(t, 40, 30)
+	out, ext, err = p.Process(src)
+	if err != nil || ext != "" || !bytes.Equal(out, src) {
+		t.Fatal(ext, err)
+	}
+
+	p, err = NewProcessor("png,20x20,dither=4", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, ext, err = p.Process(src)
+	if err != nil || ext != ".png" {
+		t.Fatal(ext, err)
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 15 {
+		t.Fatal(b)
+	}
+	levels := make(map[color.Color]bool)
+	for y := 0; y < 15; y++ {
+		for x := 0; x < 20; x++ {
+			c := img.At(x, y)
+			if _, ok := c.(color.Gray); !ok {
+				c = color.GrayModel.Convert(c)
+			}
+			levels[c] = true
+		}
+	}
+	if len(levels) > 4 {
+		t.Fatal(len(levels))
+	}
+
+	// the second time comes from the cache, even for another processor with the same options
+	p, _ = NewProcessor("png, 20x20, gray, dither=4", dir)
+	again, ext, err := p.Process(src)
+	if err != nil || ext != ".png" || !bytes.Equal(again, out) {
+		t.Fatal(ext, err)
+	}
+
+	// not an image
+	out, ext, err = p.Process([]byte("text"))
+	if err != nil || ext != "" || string(out) != "text" {
+		t.Fatal(ext, err)
+	}
+}
@@ -0,0 +1,25 @@
+package model
+
+type EventType string
+
+const (
+	EventJobStarted  EventType = "job_started"
+	EventChapter     EventType = "chapter"
+	EventImage       EventType = "image"
+	EventRetry       EventType = "retry"
+	EventError       EventType = "error"
+	EventJobFinished EventType = "job_finished"
+)
+
+// Event what happened while downloading a book, volume and chapter are indexed from 1.
+type Event struct {
+	Type     EventType `json:"type"`
+	Volume   int       `json:"volume,omitempty"`
+	Chapter  int       `json:"chapter,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Url      string    `json:"url,omitempty"`
+	Size     int       `json:"size,omitempty"`
+	Attempt  int       `json:"attempt,omitempty"`
+	Err      string    `json:"err,omitempty"`
+	Progress string    `json:"progress,omitempty"`
+}
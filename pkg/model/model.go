@@ -1,5 +1,20 @@
 package model
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrExportOptions = errors.New("invalid export options")
+	ErrMetadata      = errors.New("invalid metadata")
+)
+
 type PackageMode = int8
 
 const (
@@ -15,12 +30,74 @@ type PackageConfig struct {
 	KeepRecord  bool   `json:"keepRecord" Barg:"kRecord,k" Harg:"Keep downloading cache files. If this parameter is not enabled, the files will be deleted directly after downloading is completed."`
 	OutputPath  string `json:"output" Barg:"output,o" Harg:"The output folder path and packaged file name do not support customization."`
 	DisSyncData bool   `json:"disSyncData" Barg:"disSyncData,s" Harg:"Disable updating the index and use cached data directly."`
+	Resume      bool   `json:"resume" Barg:"resume,r" Harg:"Continue an interrupted download from its record, report the remaining chapters and do not update the index."`
 
 	PackageMode PackageMode `json:"packageMode" Barg:"pMode,p" Harg:"Packaging Mode.（0,1. Package into one file; 2. Package by volume; 3. Package by chapter; -1. Do not package）"`
 
-	VolumeSelect []int `json:"volumeSelect" Barg:"vSelect,l" Harg:"Select the volume you want to download, select according to the index."`
+	VolumeSelect string `json:"volumeSelect" Barg:"vSelect,l" Harg:"Select the volumes and chapters you want to download, indexes count from 1, e.g. 1-3,5:2-10,7:* (volumes 1 to 3, chapters 2 to 10 of volume 5, all of volume 7)."`
 
 	Lang string `json:"lang" Barg:"lang" Harg:"Set the language attribute of the packaged epub. (The data of the download source will not be modified)"`
+
+	ExportOptions
+}
+
+// ExportOptions how the cached text is turned into a package, the record always keeps the text of the source.
+type ExportOptions struct {
+	Convert string   `json:"convert,omitempty" Barg:"convert" Harg:"Convert the packaged titles, metadata and text between Traditional and Simplified Chinese. (t2s, s2t)"`
+	Filters []string `json:"filters,omitempty" Barg:"filter" Harg:"Filters applied to the packaged text in order. (watermark, heading, punct, merge)"`
+	Rules   string   `json:"rules,omitempty" Barg:"rules" Harg:"A file of regex replacement rules applied to the packaged text after the filters, one 'pattern<TAB>replacement' per line."`
+	Image   string   `json:"image,omitempty" Barg:"image" Harg:"Process the images for the reader device: a preset (kindle, kobo, eink, tablet, compat) and/or settings, e.g. 'kindle,q=60' or 'png,1072x1448,dither=16'. WebP is always converted when set."`
+	Content string   `json:"content,omitempty" Barg:"content" Harg:"What is packaged: everything by default, text (the images are left out) or images (a gallery of the covers and illustrations)."`
+	Format  string   `json:"format,omitempty" Barg:"format" Harg:"The package format: epub (default), cbz which only holds the images or txt which only holds the text."`
+	Exclude []string `json:"exclude,omitempty" Barg:"exclude" Harg:"Leave out the chapters flagged as duplicate, similar (a near copy of an earlier chapter), placeholder or short."`
+}
+
+const (
+	ContentAll    = ""
+	ContentText   = "text"
+	ContentImages = "images"
+
+	FormatEpub = "epub"
+	FormatCBZ  = "cbz"
+	FormatTXT  = "txt"
+)
+
+// Validate check the content and the format, the other options are checked by the packages applying them.
+func (o ExportOptions) Validate() error {
+	switch o.Content {
+	case ContentAll, ContentText, ContentImages:
+	default:
+		return fmt.Errorf("%w: unknown content %q", ErrExportOptions, o.Content)
+	}
+	switch o.Format {
+	case "", FormatEpub:
+	case FormatCBZ:
+		if o.Content == ContentText {
+			return fmt.Errorf("%w: a cbz holds no text", ErrExportOptions)
+		}
+	case FormatTXT:
+		if o.Content == ContentImages {
+			return fmt.Errorf("%w: a txt holds no images", ErrExportOptions)
+		}
+	default:
+		return fmt.Errorf("%w: unknown format %q", ErrExportOptions, o.Format)
+	}
+	return nil
+}
+
+// Tag a fingerprint of the options changing what is packaged, empty for the defaults.
+// A package written with other options is not taken for an unchanged one.
+func (o ExportOptions) Tag() string {
+	if o.Convert == "" && len(o.Filters) == 0 && o.Rules == "" && o.Image == "" && o.Content == "" && len(o.Exclude) == 0 {
+		return ""
+	}
+	parts := []string{o.Convert, strings.Join(o.Filters, ","), o.Rules, o.Image, o.Content}
+	if len(o.Exclude) != 0 {
+		// only when set, the packages of the options before it keep their tag
+		parts = append(parts, strings.Join(o.Exclude, ","))
+	}
+	h := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(h[:4])
 }
 
 type BookInfo struct {
@@ -31,10 +108,131 @@ type BookInfo struct {
 	CoverId     string   `json:"coverId"`
 	Description string   `json:"description"`
 	Metas       []string `json:"metas"`
+	// Series the series the book belongs to, empty if the source does not tell.
+	Series string `json:"series,omitempty"`
+	// Comic set by the sources of comics, whose chapters are sequences of pages.
+	Comic *ComicInfo `json:"comic,omitempty"`
 
 	Volumes []VolumeInfo `json:"volumes"`
 }
 
+// Metadata the book information set by hand, kept next to the record and applied in place of what the source
+// scraped in every package. The empty fields keep the values of the source.
+type Metadata struct {
+	Name        string `json:"name,omitempty"`
+	Author      string `json:"author,omitempty"`
+	Series      string `json:"series,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Tags replace the Metas of the source.
+	Tags []string `json:"tags,omitempty"`
+	// Volumes the titles of the volumes by their number from 1.
+	Volumes map[int]string `json:"volumes,omitempty"`
+	// Cover the image packaged as the cover of the book.
+	Cover []byte `json:"cover,omitempty"`
+}
+
+// Empty whether nothing is overridden.
+func (m *Metadata) Empty() bool {
+	return m == nil || (m.Name == "" && m.Author == "" && m.Series == "" && m.Description == "" &&
+		len(m.Tags) == 0 && len(m.Volumes) == 0 && len(m.Cover) == 0)
+}
+
+// Validate check the volume numbers and the cover, the volumes the book does not have are left alone when applied.
+func (m *Metadata) Validate() error {
+	if m == nil {
+		return nil
+	}
+	for n := range m.Volumes {
+		if n < 1 {
+			return fmt.Errorf("%w: volume %d, volumes count from 1", ErrMetadata, n)
+		}
+	}
+	if len(m.Cover) != 0 && coverTypes[http.DetectContentType(m.Cover)] == "" {
+		return fmt.Errorf("%w: the cover is not a jpeg, png, gif or webp image", ErrMetadata)
+	}
+	return nil
+}
+
+// Tag a fingerprint of the metadata, empty when nothing is overridden. Like the ExportOptions Tag, a package
+// written with other metadata is not taken for an unchanged one.
+func (m *Metadata) Tag() string {
+	if m.Empty() {
+		return ""
+	}
+	bs, _ := json.Marshal(m)
+	h := sha256.Sum256(bs)
+	return hex.EncodeToString(h[:4])
+}
+
+// coverTypes the extensions of the images a cover may be, the ones every reader shows.
+var coverTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// CoverId the id of the Cover as the packagers look it up, empty if the cover is not overridden.
+func (m *Metadata) CoverId() string {
+	if m == nil || len(m.Cover) == 0 {
+		return ""
+	}
+	return "cover_meta" + coverTypes[http.DetectContentType(m.Cover)]
+}
+
+// Apply a copy of the info with the overrides, info itself is not modified. The Cover replaces the cover under
+// the id CoverId, it is not in the image cache.
+func (m *Metadata) Apply(info *BookInfo) *BookInfo {
+	if m.Empty() || info == nil {
+		return info
+	}
+	ci := *info
+	if m.Name != "" {
+		ci.Name = m.Name
+	}
+	if m.Author != "" {
+		ci.Author = m.Author
+	}
+	if m.Series != "" {
+		ci.Series = m.Series
+	}
+	if m.Description != "" {
+		ci.Description = m.Description
+	}
+	if len(m.Tags) != 0 {
+		ci.Metas = append([]string(nil), m.Tags...)
+	}
+	if len(m.Cover) != 0 {
+		ci.Cover, ci.CoverId = m.Cover, m.CoverId()
+	}
+	if len(m.Volumes) != 0 {
+		ci.Volumes = append([]VolumeInfo(nil), info.Volumes...)
+		for n, name := range m.Volumes {
+			if n >= 1 && n <= len(ci.Volumes) && name != "" {
+				ci.Volumes[n-1].Name = name
+			}
+		}
+	}
+	return &ci
+}
+
+const (
+	DirectionLTR = "ltr"
+	DirectionRTL = "rtl"
+)
+
+// ComicInfo how the pages of a comic are read. The pages of a chapter are its Imgs in reading order,
+// they are packaged as a fixed-layout epub or a cbz rather than as text.
+type ComicInfo struct {
+	// Direction the reading direction, DirectionRTL for manga; DirectionLTR if empty.
+	Direction string `json:"direction,omitempty"`
+}
+
+// RTL whether the pages are read from right to left.
+func (c *ComicInfo) RTL() bool {
+	return c != nil && c.Direction == DirectionRTL
+}
+
 type VolumeInfo struct {
 	Name        string `json:"name"`
 	Id          string `json:"id"`
@@ -71,9 +269,25 @@ type ChapterData struct {
 	Loaded bool   `json:"loaded,omitempty"`
 	Hash   string `json:"hash,omitempty"`
 
-	Name string   `json:"name,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Data the blocks of the chapter in the html subset of htmlx: paragraphs with inline emphasis and ruby,
+	// headings, scene breaks, line breaks and images with their captions.
 	Data []string `json:"data,omitempty"`
 	Imgs []string `json:"imgs,omitempty"`
+	// Spreads the pages of Imgs drawn across two pages, shown whole rather than as one side of the spread.
+	// The landscape pages are taken for spreads too.
+	Spreads []string `json:"spreads,omitempty"`
+
+	// Pages the checkpoints of a partially fetched chapter, Next is the ahref of the page to fetch next.
+	// Both are cleared once the chapter is complete and Data/Imgs are assembled.
+	Pages []*PageData `json:"pages,omitempty"`
+	Next  string      `json:"next,omitempty"`
+}
+
+type PageData struct {
+	Ahref string   `json:"ahref,omitempty"`
+	Data  []string `json:"data,omitempty"`
+	Imgs  []string `json:"imgs,omitempty"`
 }
 
 type SearchResult struct {
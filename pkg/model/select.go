@@ -0,0 +1,237 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var ErrSelection = errors.New("invalid selection")
+
+const (
+	// MaxSelectVolume and MaxSelectChapter the largest indexes a selection may name, the ranges are expanded
+	// so they must stay small whatever the request says.
+	MaxSelectVolume  = 10000
+	MaxSelectChapter = 100000
+	// maxSelected how many indexes a selection may expand to, the overlapping items included.
+	maxSelected = 1000000
+)
+
+// Selection the volumes and chapters chosen for downloading and packaging.
+// The keys count from 0 like the slices of BookInfo, the text form (see ParseSelection) counts from 1 like
+// everything shown to the user. An empty chapter set selects the whole volume and an empty Selection the whole book.
+type Selection map[int]map[int]bool
+
+// ParseSelection parse a selection such as `1-3,5:2-10,7:*`. Items are separated by commas, an item is a volume
+// or a volume range, optionally followed by `:` and the chapters of that volume (a chapter, a chapter range or `*`).
+// "" and `*` select the whole book. The indexes are bounded by MaxSelectVolume and MaxSelectChapter,
+// use Validate to check them against the book.
+func ParseSelection(s string) (Selection, error) {
+	sel := make(Selection)
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" {
+		return sel, nil
+	}
+	left := maxSelected
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		vs, cs, hasChapters := strings.Cut(item, ":")
+		vFrom, vTo, err := parseRange(vs, MaxSelectVolume)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %v", ErrSelection, item, err)
+		}
+		if !hasChapters || strings.TrimSpace(cs) == "*" {
+			left -= vTo - vFrom + 1
+			if left < 0 {
+				return nil, fmt.Errorf("%w: more than %d indexes", ErrSelection, maxSelected)
+			}
+			for v := vFrom; v <= vTo; v++ {
+				sel[v-1] = make(map[int]bool)
+			}
+			continue
+		}
+		if vFrom != vTo {
+			return nil, fmt.Errorf("%w %q: chapters can only be selected in one volume", ErrSelection, item)
+		}
+		cFrom, cTo, err := parseRange(cs, MaxSelectChapter)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %v", ErrSelection, item, err)
+		}
+		left -= cTo - cFrom + 1
+		if left < 0 {
+			return nil, fmt.Errorf("%w: more than %d indexes", ErrSelection, maxSelected)
+		}
+		cm, ok := sel[vFrom-1]
+		if ok && len(cm) == 0 {
+			// the whole volume is already selected
+			continue
+		}
+		if !ok {
+			cm = make(map[int]bool)
+			sel[vFrom-1] = cm
+		}
+		for c := cFrom; c <= cTo; c++ {
+			cm[c-1] = true
+		}
+	}
+	return sel, nil
+}
+
+// All whether the whole book is selected.
+func (sel Selection) All() bool {
+	return len(sel) == 0
+}
+
+// Volume whether volume v is selected, wholly or in part.
+func (sel Selection) Volume(v int) bool {
+	if len(sel) == 0 {
+		return true
+	}
+	_, ok := sel[v]
+	return ok
+}
+
+// Chapter whether chapter c of volume v is selected.
+func (sel Selection) Chapter(v, c int) bool {
+	if len(sel) == 0 {
+		return true
+	}
+	cm, ok := sel[v]
+	if !ok {
+		return false
+	}
+	return len(cm) == 0 || cm[c]
+}
+
+// Validate check that every selected volume and chapter exists in the book.
+func (sel Selection) Validate(info *BookInfo) error {
+	for _, v := range sel.volumes() {
+		if v >= len(info.Volumes) {
+			return fmt.Errorf("%w: volume %d is out of range, book %s has %d volumes",
+				ErrSelection, v+1, info.Id, len(info.Volumes))
+		}
+		n := len(info.Volumes[v].Chapters)
+		for _, c := range indexes(sel[v]) {
+			if c >= n {
+				return fmt.Errorf("%w: chapter %d is out of range, volume %d of book %s has %d chapters",
+					ErrSelection, c+1, v+1, info.Id, n)
+			}
+		}
+	}
+	return nil
+}
+
+// Count the number of selected chapters in the book.
+func (sel Selection) Count(info *BookInfo) int64 {
+	var n int64
+	for i, volume := range info.Volumes {
+		for k := range volume.Chapters {
+			if sel.Chapter(i, k) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Only the part of the selection in volume v, as packaged into the file of that volume.
+func (sel Selection) Only(v int) Selection {
+	return Selection{v: sel[v]}
+}
+
+// String the canonical text of the selection, ParseSelection(sel.String()) selects the same chapters.
+func (sel Selection) String() string {
+	vols := sel.volumes()
+	var items []string
+	for i := 0; i < len(vols); {
+		if len(sel[vols[i]]) != 0 {
+			// one item per chapter range, a comma inside the chapters would start a new volume
+			for _, r := range ranges(indexes(sel[vols[i]])) {
+				items = append(items, strconv.Itoa(vols[i]+1)+":"+r)
+			}
+			i++
+			continue
+		}
+		// merge the consecutive whole volumes into one range
+		k := i
+		for k+1 < len(vols) && vols[k+1] == vols[k]+1 && len(sel[vols[k+1]]) == 0 {
+			k++
+		}
+		items = append(items, formatRange(vols[i], vols[k]))
+		i = k + 1
+	}
+	return strings.Join(items, ",")
+}
+
+// ChapterString the selected chapters of volume v as 1-based ranges, e.g. `2-10,12`; empty for the whole volume.
+func (sel Selection) ChapterString(v int) string {
+	return strings.Join(ranges(indexes(sel[v])), ",")
+}
+
+func (sel Selection) volumes() []int {
+	vols := make([]int, 0, len(sel))
+	for v := range sel {
+		vols = append(vols, v)
+	}
+	slices.Sort(vols)
+	return vols
+}
+
+func indexes(set map[int]bool) []int {
+	idx := make([]int, 0, len(set))
+	for i, ok := range set {
+		if ok {
+			idx = append(idx, i)
+		}
+	}
+	slices.Sort(idx)
+	return idx
+}
+
+func ranges(idx []int) []string {
+	var items []string
+	for i := 0; i < len(idx); {
+		k := i
+		for k+1 < len(idx) && idx[k+1] == idx[k]+1 {
+			k++
+		}
+		items = append(items, formatRange(idx[i], idx[k]))
+		i = k + 1
+	}
+	return items
+}
+
+func formatRange(from, to int) string {
+	if from == to {
+		return strconv.Itoa(from + 1)
+	}
+	return strconv.Itoa(from+1) + "-" + strconv.Itoa(to+1)
+}
+
+// parseRange a 1-based index or range of indexes, none over limit.
+func parseRange(s string, limit int) (from, to int, err error) {
+	fs, ts, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	from, err = strconv.Atoi(strings.TrimSpace(fs))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid number %q", fs)
+	}
+	to = from
+	if isRange {
+		to, err = strconv.Atoi(strings.TrimSpace(ts))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid number %q", ts)
+		}
+	}
+	if from <= 0 {
+		return 0, 0, fmt.Errorf("invalid index %d, indexes count from 1", from)
+	}
+	if to < from {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	if to > limit {
+		return 0, 0, fmt.Errorf("index %d is out of range, at most %d", to, limit)
+	}
+	return from, to, nil
+}
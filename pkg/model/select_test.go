@@ -0,0 +1,132 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSelection(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"", ""},
+		{"*", ""},
+		{"1", "1"},
+		{"1,2,3,5", "1-3,5"},
+		{"1-3,5:2-10,7:*", "1-3,5:2-10,7"},
+		{" 3 , 1-2 ", "1-3"},
+		{"5:2-10,5:12,4", "4,5:2-10,5:12"},
+		{"5:3,5", "5"},
+		{"5,5:3", "5"},
+		{"2:1,2:2,2:3", "2:1-3"},
+		// overlaps
+		{"1-3,2-5", "1-5"},
+		{"3-4,1-3", "1-4"},
+		{"1:1-5,1:3-8", "1:1-8"},
+		{"1:2-4,1:*", "1"},
+		{"1:*,1:2-4", "1"},
+		// the bounds
+		{"10000", "10000"},
+		{"1:100000", "1:100000"},
+		{"9999-10000:*", "9999-10000"},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelection(tt.in)
+		if err != nil {
+			t.Fatal(tt.in, err)
+		}
+		if sel.String() != tt.out {
+			t.Fatal(tt.in, sel.String(), tt.out)
+		}
+		again, err := ParseSelection(sel.String())
+		if err != nil || again.String() != sel.String() {
+			t.Fatal(tt.in, again.String(), err)
+		}
+	}
+
+	for _, in := range []string{
+		// malformed
+		"0", "3-1", "a", "1-2:3", "1:0", "1:", ",", "-1", "1-", "-", "1--2", "1:a", "1:3-2", "1:2:3", "1,,2",
+		"1-2-3", "99999999999999999999",
+		// out of the bounds
+		"10001", "1-2000000000", "1:100001", "1:1-2000000000", "10001:1",
+		strings.Repeat("1:1-100000,", 11),
+	} {
+		start := time.Now()
+		_, err := ParseSelection(in)
+		if !errors.Is(err, ErrSelection) {
+			t.Fatal(in, err)
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("slow to refuse", in)
+		}
+	}
+}
+
+func TestSelectionIndexes(t *testing.T) {
+	sel, err := ParseSelection("1,3:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the text counts from 1, the selection from 0 like BookInfo.Volumes
+	if !sel.Volume(0) || sel.Volume(1) || !sel.Volume(2) {
+		t.Fatal(sel)
+	}
+	if !sel.Chapter(0, 5) || sel.Chapter(2, 0) || !sel.Chapter(2, 1) || sel.Chapter(1, 1) {
+		t.Fatal(sel)
+	}
+	if sel.ChapterString(2) != "2" || sel.ChapterString(0) != "" {
+		t.Fatal(sel.ChapterString(2), sel.ChapterString(0))
+	}
+	if only := sel.Only(2); len(only) != 1 || !only.Chapter(2, 1) || only.Volume(0) {
+		t.Fatal(only)
+	}
+
+	all := Selection{}
+	if !all.All() || !all.Volume(9) || !all.Chapter(9, 9) {
+		t.Fatal(all)
+	}
+}
+
+func TestSelectionValidate(t *testing.T) {
+	info := &BookInfo{Id: "1", Volumes: []VolumeInfo{
+		{Chapters: make([]ChapterInfo, 3)},
+		{Chapters: make([]ChapterInfo, 2)},
+	}}
+	tests := []struct {
+		in    string
+		ok    bool
+		count int64
+	}{
+		{"", true, 5},
+		{"1-2", true, 5},
+		{"2", true, 2},
+		{"1:2-3", true, 2},
+		{"1:3,2:1", true, 2},
+		{"3", false, 0},
+		{"1-3", false, 0},
+		{"2:3", false, 0},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelection(tt.in)
+		if err != nil {
+			t.Fatal(tt.in, err)
+		}
+		err = sel.Validate(info)
+		if (err == nil) != tt.ok {
+			t.Fatal(tt.in, err)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrSelection) {
+				t.Fatal(tt.in, err)
+			}
+			continue
+		}
+		if sel.Count(info) != tt.count {
+			t.Fatal(tt.in, sel.Count(info), tt.count)
+		}
+	}
+}
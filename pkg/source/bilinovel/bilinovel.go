@@ -10,6 +10,8 @@ import (
 	"github.com/go-rod/rod/lib/input"
 	"github.com/go-rod/rod/lib/proto"
 	"github.com/peakedshout/go-pandorasbox/logger"
+	"github.com/peakedshout/novelpackager/pkg/fontx"
+	"github.com/peakedshout/novelpackager/pkg/htmlx"
 	"github.com/peakedshout/novelpackager/pkg/model"
 	"github.com/peakedshout/novelpackager/pkg/rodx"
 	"github.com/peakedshout/novelpackager/pkg/utils"
@@ -18,6 +20,7 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -39,6 +42,10 @@ var (
 type Config struct {
 	Timeout  int `json:"timeout" Barg:"timeout,t" Harg:"Automation timeout.(s)"`
 	RetryNum int `json:"retryNum" Barg:"retryNum,n" Harg:"Number of automated retries."`
+
+	FontDir    string `json:"fontDir" Barg:"fontDir" Harg:"Dir of the mappings rebuilt from the obfuscation fonts of the site. (default .np_cache/fonts)"`
+	FontRef    string `json:"fontRef" Barg:"fontRef" Harg:"A font file the glyphs of the obfuscation font are matched against, the default font of the browser if empty."`
+	FontStatic bool   `json:"fontStatic" Barg:"fontStatic" Harg:"Only decode the obfuscation font with the built-in table instead of rebuilding the mapping from the font served."`
 }
 
 type Packager struct {
@@ -47,6 +54,11 @@ type Packager struct {
 	timeout  time.Duration
 	retryNum uint
 
+	// fonts rebuild the mapping of the obfuscation font, nil to only use the built-in table
+	fonts    *fontx.Decoder
+	fontMux  sync.Mutex
+	fontData map[string][]byte
+
 	logger logger.Logger
 }
 
@@ -66,6 +78,10 @@ func NewPackager(ctx *rodx.RodContext, cfg *Config) *Packager {
 	} else if cfg.RetryNum < 0 {
 		p.retryNum = 0
 	}
+	if !cfg.FontStatic {
+		p.fonts = newFontDecoder(cfg, p.logger)
+		p.fontData = make(map[string][]byte)
+	}
 	return p
 }
 
@@ -101,6 +117,11 @@ func (p *Packager) Search(ctx context.Context, name string, full bool, noImg boo
 }
 
 func (p *Packager) Download(ctx context.Context, id string, pcfg *model.PackageConfig) error {
+	return p.DownloadWithProgress(ctx, id, pcfg, utils.NewProgress(-1))
+}
+
+// DownloadWithProgress the same as Download, reporting to pr.
+func (p *Packager) DownloadWithProgress(ctx context.Context, id string, pcfg *model.PackageConfig, pr *utils.Progress) error {
 	sess, err := p.rc.NewSession(ctx)
 	if err != nil {
 		return err
@@ -108,9 +129,10 @@ func (p *Packager) Download(ctx context.Context, id string, pcfg *model.PackageC
 	defer sess.Close()
 	defer blockURLs(sess.Browser())()
 	return p.download(sess, &downloadContext{
+		ctx:    ctx,
 		id:     id,
 		pcfg:   pcfg,
-		pr:     utils.NewProgress(-1),
+		pr:     pr,
 		record: nil,
 		lc:     nil,
 	})
@@ -365,19 +387,47 @@ func (p *Packager) refreshToken(page *rod.Page, volume *model.VolumeInfo) error
 	return nil
 }
 
+// resumePage the ahref of the page to fetch first: the one after the checkpointed pages of the chapter,
+// or its first page, with the data reset, when they belong to another chapter or there are none.
+func resumePage(info *model.ChapterInfo, data *model.ChapterData) string {
+	if data.Next != "" && len(data.Pages) > 0 && data.Pages[0].Ahref == info.Ahref {
+		return data.Next
+	}
+	*data = model.ChapterData{}
+	return info.Ahref
+}
+
+// finishChapter assemble the checkpointed pages into the chapter and mark it loaded.
+func finishChapter(info *model.ChapterInfo, data *model.ChapterData) {
+	hash := sha256.New()
+
+	for _, pd := range data.Pages {
+		data.Data = append(data.Data, pd.Data...)
+		data.Imgs = append(data.Imgs, pd.Imgs...)
+	}
+	for _, datum := range data.Data {
+		hash.Write([]byte(datum))
+	}
+
+	data.Pages = nil
+	data.Next = ""
+	data.Name = info.Name
+	data.Hash = hex.EncodeToString(hash.Sum(nil))
+	data.Loaded = true
+}
+
 func (p *Packager) checkoutChapter(page *rod.Page, info *model.ChapterInfo, data *model.ChapterData, ctx *downloadContext) error {
-	turl := UrlRoot + info.Ahref
+	cur := resumePage(info, data)
+	if cur != info.Ahref {
+		p.logger.Infof("Resuming chapter %s from page %d", info.Name, len(data.Pages)+1)
+	}
+	turl := absUrl(cur)
 	err := page.Navigate(turl)
 	if err != nil {
 		p.logger.Warnf("Failed to create page for URL %s: %v", turl, err)
 		return model.ErrPage.Errorf(turl, err)
 	}
 
-	*data = model.ChapterData{}
-
-	hash := sha256.New()
-
-	count := 0
 	for {
 		err = p.waitAndCheck404(page, turl)
 		if err != nil {
@@ -386,7 +436,51 @@ func (p *Packager) checkoutChapter(page *rod.Page, info *model.ChapterInfo, data
 
 		//p.logger.Info("Fetching checkout info from URL:", turl, "wait load over")
 
-		result, err := page.Eval(`() => {
+		pd, err := p.checkoutPage(page, turl, ctx)
+		if err != nil {
+			return err
+		}
+		pd.Ahref = cur
+
+		nextE, err := page.Element("#footlink > a:nth-child(4)")
+		if err != nil {
+			p.logger.Warnf("Failed to find next element for URL %s: %v", turl, err)
+			return err
+		}
+		hasNext := nextE.MustText() == "下一頁"
+		next := ""
+		if hasNext {
+			href, err := nextE.Attribute("href")
+			if err != nil {
+				p.logger.Warnf("Failed to get next href for URL %s: %v", turl, err)
+				return err
+			}
+			if href != nil && *href != "" && *href != "#" && !strings.HasPrefix(*href, "javascript") {
+				next, _ = strings.CutPrefix(*href, UrlRoot)
+			}
+		}
+
+		// checkpoint, a retry starts from the next page instead of the first one
+		data.Pages = append(data.Pages, pd)
+		data.Next = next
+		ctx.cpr.Update(int64(len(data.Pages)))
+		p.logger.Infof("[%s] Fetched page %d of chapter %s", ctx.pr.String(), len(data.Pages), info.Name)
+
+		if !hasNext {
+			break
+		}
+		utils.UpdateExpireClose(page, p.timeout)
+		time.Sleep(1 * time.Second)
+		nextE.MustClick()
+		cur = next
+		turl = absUrl(next)
+	}
+	finishChapter(info, data)
+	return nil
+}
+
+func (p *Packager) checkoutPage(page *rod.Page, turl string, ctx *downloadContext) (*model.PageData, error) {
+	result, err := page.Eval(`() => {
         for (let sheet of document.styleSheets) {
             try {
                 for (let rule of sheet.cssRules) {
@@ -400,92 +494,123 @@ func (p *Packager) checkoutChapter(page *rod.Page, info *model.ChapterInfo, data
         }
         return false;
     }`)
-		if err != nil {
-			return err
-		}
-
-		pFont := result.Value.Bool()
-
-		ael, err := page.Element("#acontent")
-		if err != nil {
-			p.logger.Warnf("Failed to find acontent element for URL %s: %v", turl, err)
-			return err
-		}
-
-		_, _ = ael.Eval(`() => this.removeAttribute('style')`)
-
-		el, err := page.Elements("#acontent > *")
-		if err != nil {
-			p.logger.Warnf("Failed to find elements for URL %s: %v", turl, err)
-			return err
-		}
-
-		var lastP *rod.Element
-		var countP int
+	if err != nil {
+		return nil, err
+	}
 
-		for _, element := range el {
-			switch utils.ElementType(element) {
-			case "p":
-				count++
-				countP = count
-				lastP = element
+	pFont := result.Value.Bool()
 
-				data.Data = append(data.Data, fmt.Sprintf("<p>%s</p>", html.EscapeString(element.MustText())))
+	ael, err := page.Element("#acontent")
+	if err != nil {
+		p.logger.Warnf("Failed to find acontent element for URL %s: %v", turl, err)
+		return nil, err
+	}
 
-			case "br":
-				count++
-				data.Data = append(data.Data, "<br/>")
-			case "img":
-				count++
+	_, _ = ael.Eval(`() => this.removeAttribute('style')`)
 
-				utils.UpdateExpireClose(page, p.timeout)
+	el, err := page.Elements("#acontent > *")
+	if err != nil {
+		p.logger.Warnf("Failed to find elements for URL %s: %v", turl, err)
+		return nil, err
+	}
 
-				bs, src, err := waitImgDataSrc(element)
+	pd := &model.PageData{}
+	var lastP *rod.Element
+	var countP int
+
+	for _, element := range el {
+		tag := utils.ElementType(element)
+		switch tag {
+		case "p":
+			lastP = element
+			pd.Data = append(pd.Data, htmlx.Paragraph(p.visible(element)))
+			countP = len(pd.Data)
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			if item := htmlx.Heading(int(tag[1]-'0'), p.visible(element)); item != "" {
+				pd.Data = append(pd.Data, item)
+			}
+		case "hr":
+			pd.Data = append(pd.Data, htmlx.HR)
+		case "br":
+			pd.Data = append(pd.Data, htmlx.BR)
+		case "img":
+			id, err := p.checkoutImg(page, turl, element, ctx)
+			if err != nil {
+				return nil, err
+			}
+			pd.Data = append(pd.Data, htmlx.Image("../images/"+id, id, ""))
+			pd.Imgs = append(pd.Imgs, id)
+		case "figure", "div":
+			// an illustration in a box, the text around it is its caption; the other boxes are ads
+			imgs, err := element.Elements("img")
+			if err != nil || len(imgs) == 0 || (tag == "div" && !isImageBox(element)) {
+				p.logger.Debug("Unknown element type:", tag, "for URL:", turl)
+				continue
+			}
+			for i, img := range imgs {
+				id, err := p.checkoutImg(page, turl, img, ctx)
 				if err != nil {
-					p.logger.Warnf("Failed to find img element for URL %s: %v", turl, err)
-					return err
+					return nil, err
 				}
-
-				id, err := ctx.lc.Set(src, bs)
-				if err != nil {
-					p.logger.Warnf("Failed to set resource in cache for URL %s: %v", turl, err)
-					return err
+				caption := ""
+				if i == len(imgs)-1 {
+					caption = p.visible(element)
 				}
-				data.Data = append(data.Data, fmt.Sprintf(`<img src="../images/%s" alt="%s"/>`, id, id))
-				data.Imgs = append(data.Imgs, id)
-			default:
-				p.logger.Debug("Unknown element type:", utils.ElementType(element), "for URL:", turl)
-				continue
+				pd.Data = append(pd.Data, htmlx.Image("../images/"+id, id, caption))
+				pd.Imgs = append(pd.Imgs, id)
 			}
+		default:
+			p.logger.Debug("Unknown element type:", tag, "for URL:", turl)
+			continue
 		}
+	}
 
-		if lastP != nil && pFont {
-			data.Data[countP-1] = fmt.Sprintf(`<p>%s</p>`, decryptionFont(html.EscapeString(lastP.MustText())))
-		}
+	if lastP != nil && pFont {
+		// decode the text around the markup, a ruby keeps its reading
+		pd.Data[countP-1] = "<p>" + htmlx.MapText(htmlx.Inline(p.visible(lastP)), func(text string) string {
+			return p.decodeFont(page, text)
+		}) + "</p>"
+	}
+	return pd, nil
+}
 
-		nextE, err := page.Element("#footlink > a:nth-child(4)")
-		if err != nil {
-			p.logger.Warnf("Failed to find next element for URL %s: %v", turl, err)
-			return err
-		}
-		if nextE.MustText() == "下一頁" {
-			utils.UpdateExpireClose(page, p.timeout)
-			time.Sleep(1 * time.Second)
-			nextE.MustClick()
-		} else {
-			break
-		}
+// checkoutImg download the image into the cache and return its id.
+func (p *Packager) checkoutImg(page *rod.Page, turl string, element *rod.Element, ctx *downloadContext) (string, error) {
+	utils.UpdateExpireClose(page, p.timeout)
 
+	bs, src, err := waitImgDataSrc(element)
+	if err != nil {
+		p.logger.Warnf("Failed to find img element for URL %s: %v", turl, err)
+		return "", err
 	}
 
-	for _, datum := range data.Data {
-		hash.Write([]byte(datum))
+	id, err := ctx.lc.Set(src, bs)
+	if err != nil {
+		p.logger.Warnf("Failed to set resource in cache for URL %s: %v", turl, err)
+		return "", err
 	}
+	ctx.cpr.AddBytes(int64(len(bs)))
+	ctx.event(model.Event{Type: model.EventImage, Url: src, Size: len(bs)})
+	return id, nil
+}
 
-	data.Hash = hex.EncodeToString(hash.Sum(nil))
-	data.Loaded = true
+// isImageBox whether the div is one the site wraps its illustrations in.
+func isImageBox(element *rod.Element) bool {
+	class, err := element.Attribute("class")
+	if err != nil || class == nil {
+		return false
+	}
+	return strings.Contains(*class, "image") || strings.Contains(*class, "img")
+}
 
-	return nil
+// visible the markup of the element as shown, its text if the page cannot tell.
+func (p *Packager) visible(element *rod.Element) string {
+	s, err := htmlx.Visible(element)
+	if err != nil {
+		p.logger.Debug("Failed to read the markup of an element, keeping its text:", err)
+		return html.EscapeString(element.MustText())
+	}
+	return s
 }
 
 func (p *Packager) searchList(sess *rodx.RodSession, name string, full bool, noImg bool) ([]model.SearchResult, error) {
@@ -854,6 +979,11 @@ func blockURLs(b *rod.Browser) func() {
 	router := b.HijackRequests()
 	router.MustAdd("*", func(hijack *rod.Hijack) {
 		u := hijack.Request.URL()
+		if isFont(u.Path) {
+			// the obfuscation font is fetched by fontx, see decodeFont
+			hijack.ContinueRequest(&proto.FetchContinueRequest{})
+			return
+		}
 		for _, str := range ls {
 			if strings.HasPrefix(u.String(), str) {
 				hijack.Response.Fail(proto.NetworkErrorReasonAborted)
@@ -899,6 +1029,13 @@ func waitImgDataSrc(element *rod.Element) ([]byte, string, error) {
 	return bs, *src, nil
 }
 
+func absUrl(ahref string) string {
+	if strings.HasPrefix(ahref, "http://") || strings.HasPrefix(ahref, "https://") {
+		return ahref
+	}
+	return UrlRoot + ahref
+}
+
 func getCachePath(ctx *downloadContext) string {
 	return path.Join(ctx.pcfg.OutputPath, fmt.Sprintf(CacheFile, ctx.id))
 }
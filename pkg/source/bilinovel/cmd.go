@@ -1,16 +1,17 @@
 package bilinovel
 
 import (
-	"context"
 	"fmt"
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/jedib0t/go-pretty/v6/text"
 	"github.com/peakedshout/novelpackager/pkg/model"
 	"github.com/peakedshout/novelpackager/pkg/rodx"
+	"github.com/peakedshout/novelpackager/pkg/textx"
 	"github.com/peakedshout/novelpackager/pkg/utils"
 	"github.com/spf13/cobra"
 	"os"
 	"strings"
+	"time"
 )
 
 const Version = `v0.1.0`
@@ -30,6 +31,10 @@ func init() {
 	utils.BindKey(downloadCmd, "rodx", new(rodx.RodConfig))
 	utils.BindKey(downloadCmd, "bcfg", new(Config))
 	utils.BindKey(downloadCmd, "args", new(model.PackageConfig))
+	utils.BindKey(downloadCmd, "dargs", new(downloadArgs))
+
+	rootCmd.AddCommand(checkCmd)
+	utils.BindKey(checkCmd, "args", new(checkArgs))
 
 	utils.RegisterCommand(rootCmd)
 }
@@ -63,7 +68,7 @@ var searchCmd = &cobra.Command{
 		}
 		defer rc.Close()
 		pr := NewPackager(rc, pcfg)
-		results, err := pr.Search(context.Background(), args[0], sas.Full, sas.NoImg)
+		results, err := pr.Search(cmd.Context(), args[0], sas.Full, sas.NoImg)
 		if err != nil {
 			return err
 		}
@@ -121,7 +126,7 @@ var infoCmd = &cobra.Command{
 
 		ias := utils.GetKeyT[infoArgs](cmd, "args")
 
-		info, err := pr.GetInfo(context.Background(), args[0], ias.Full)
+		info, err := pr.GetInfo(cmd.Context(), args[0], ias.Full)
 		if err != nil {
 			return err
 		}
@@ -159,6 +164,10 @@ var infoCmd = &cobra.Command{
 	},
 }
 
+type downloadArgs struct {
+	Bar bool `json:"bar,omitempty" Barg:"bar" Harg:"Draw a progress bar with rate and ETA on the terminal."`
+}
+
 var downloadCmd = &cobra.Command{
 	Use:   "download id",
 	Short: "download by id",
@@ -176,13 +185,66 @@ var downloadCmd = &cobra.Command{
 		pr := NewPackager(rc, pcfg)
 
 		pas := utils.GetKeyT[model.PackageConfig](cmd, "args")
+		das := utils.GetKeyT[downloadArgs](cmd, "dargs")
 
-		err = pr.Download(context.Background(), args[0], pas)
+		progress := utils.NewProgress(-1)
+		if das.Bar {
+			stop := utils.RenderProgressBar(os.Stderr, progress, 500*time.Millisecond)
+			defer stop()
+		}
+		err = pr.DownloadWithProgress(cmd.Context(), args[0], pas, progress)
 
 		return err
 	},
 }
 
+type checkArgs struct {
+	OutputPath string `json:"output" Barg:"output,o" Harg:"The output folder the book was downloaded to with its record kept."`
+}
+
+var checkCmd = &cobra.Command{
+	Use:   "check id",
+	Short: "list the duplicate, placeholder and too short chapters in the record",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cas := utils.GetKeyT[checkArgs](cmd, "args")
+		if cas.OutputPath == "" {
+			cas.OutputPath = "./"
+		}
+		list, err := RecordIssues(cas.OutputPath, args[0])
+		if err != nil {
+			return err
+		}
+
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.SetStyle(table.StyleColoredBright)
+		tableSetColColor(t, []text.Colors{
+			{text.FgHiCyan},
+			{text.FgHiCyan},
+			{text.FgHiWhite},
+			{text.FgHiYellow},
+			{text.FgHiBlue},
+		})
+
+		wmax := []int{7, 7, 30, 12, 45}
+		t.AppendHeader(table.Row{"Volume", "Chapter", "Name", "Issue", "Detail"})
+		for _, is := range list {
+			detail := ""
+			switch is.Kind {
+			case textx.IssueDuplicate:
+				detail = fmt.Sprintf("same as %d:%d %s", is.OfVolume, is.OfChapter, is.OfName)
+			case textx.IssueSimilar:
+				detail = fmt.Sprintf("%.0f%% the same as %d:%d %s", is.Similarity*100, is.OfVolume, is.OfChapter, is.OfName)
+			}
+			tableAppendRow(t, wmax, table.Row{is.Volume, is.Chapter, is.Name, is.Kind, detail})
+		}
+		t.AppendFooter(table.Row{"TOTAL", len(list)}, table.RowConfig{AutoMerge: true})
+		t.Render()
+		return nil
+	},
+}
+
 func tableSetColColor(t table.Writer, wcs []text.Colors) {
 	cc := make([]table.ColumnConfig, 0, len(wcs))
 	for i, wc := range wcs {
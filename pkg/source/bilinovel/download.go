@@ -1,16 +1,19 @@
 package bilinovel
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/go-rod/rod"
 	"github.com/peakedshout/novelpackager/pkg/epubx"
+	"github.com/peakedshout/novelpackager/pkg/imagex"
 	"github.com/peakedshout/novelpackager/pkg/model"
 	"github.com/peakedshout/novelpackager/pkg/rodx"
+	"github.com/peakedshout/novelpackager/pkg/textx"
 	"github.com/peakedshout/novelpackager/pkg/utils"
+	"github.com/peakedshout/novelpackager/pkg/zhconv"
 	"os"
 	"path"
-	"slices"
 	"time"
 )
 
@@ -28,11 +31,47 @@ func (p *Packager) downloadOver(out, id string) bool {
 }
 
 type downloadContext struct {
+	ctx    context.Context
 	id     string
 	pcfg   *model.PackageConfig
 	pr     *utils.Progress
 	record *utils.Record
 	lc     *utils.LinkCache
+	// sel the volumes and chapters to download and package, checked against the book info
+	sel model.Selection
+	// filter applied to the packaged text
+	filter textx.Chain
+	// images processes the packaged images
+	images *imagex.Processor
+	// exclude the kinds of flagged chapters left out of the packages
+	exclude textx.Exclusion
+	// meta the metadata set by hand, applied to the packages
+	meta *model.Metadata
+
+	// log mirror the progress lines somewhere else, e.g. the web job log.
+	log func(format string, a ...any)
+	// emit report structured events, e.g. to the web event stream.
+	emit func(e model.Event)
+
+	// the volume and chapter being fetched, indexed from 0, and their progress
+	vIndex, cIndex int
+	vpr, cpr       *utils.Progress
+}
+
+func (ctx *downloadContext) logf(format string, a ...any) {
+	if ctx.log != nil {
+		ctx.log(format, a...)
+	}
+}
+
+func (ctx *downloadContext) event(e model.Event) {
+	if ctx.emit == nil {
+		return
+	}
+	if e.Volume == 0 && e.Chapter == 0 {
+		e.Volume, e.Chapter = ctx.vIndex+1, ctx.cIndex+1
+	}
+	ctx.emit(e)
 }
 
 func (p *Packager) download(sess *rodx.RodSession, ctx *downloadContext) (err error) {
@@ -57,12 +96,40 @@ func (p *Packager) download(sess *rodx.RodSession, ctx *downloadContext) (err er
 	}
 
 	rPath := path.Join(ctx.pcfg.OutputPath, fmt.Sprintf(CacheFile, ctx.id))
+	// held until the last save, a cache gc or purge in between would be lost or lose this download
+	unlock, err := utils.LockFile(rPath)
+	if err != nil {
+		p.logger.Warnf("Failed to lock record for book %s: %v", ctx.id, err)
+		return err
+	}
+	defer unlock()
 	record, err := utils.LoadRecord(rPath)
 	if err != nil {
+		if ctx.pcfg.Resume {
+			p.logger.Warnf("Failed to load record for book %s to resume: %v", ctx.id, err)
+			return fmt.Errorf("no record to resume for book %s: %w", ctx.id, err)
+		}
 		p.logger.Warnf("Failed to load record for book %s: %v", ctx.id, err)
 		record = &utils.Record{}
 	}
 	ctx.record = record
+	ctx.meta, err = utils.LoadMetadata(rPath)
+	if err != nil {
+		p.logger.Warnf("Failed to load metadata for book %s: %v", ctx.id, err)
+		return err
+	}
+	defer func() {
+		// interrupted or failed, flush what we have so that --resume continues from here
+		if err == nil || record.Info == nil || record.Data == nil {
+			return
+		}
+		if ferr := utils.SaveRecord(rPath, record, ctx.lc); ferr != nil {
+			p.logger.Warnf("Failed to flush record for book %s: %v", ctx.id, ferr)
+			return
+		}
+		ctx.logf("record flushed: %v", err)
+		p.logger.Infof("Record for book %s flushed, use --resume to continue", ctx.id)
+	}()
 	if ctx.pcfg.Lang == "" {
 		ctx.pcfg.Lang = "zh"
 	}
@@ -71,8 +138,32 @@ func (p *Packager) download(sess *rodx.RodSession, ctx *downloadContext) (err er
 	default:
 		return fmt.Errorf("invalid package mode %d", ctx.pcfg.PackageMode)
 	}
+	ctx.sel, err = model.ParseSelection(ctx.pcfg.VolumeSelect)
+	if err != nil {
+		return err
+	}
+	err = ctx.pcfg.ExportOptions.Validate()
+	if err != nil {
+		return err
+	}
+	_, err = zhconv.Get(ctx.pcfg.Convert)
+	if err != nil {
+		return err
+	}
+	ctx.filter, err = textx.New(ctx.pcfg.Filters, ctx.pcfg.Rules)
+	if err != nil {
+		return err
+	}
+	ctx.images, err = imagex.NewProcessor(ctx.pcfg.Image, "")
+	if err != nil {
+		return err
+	}
+	ctx.exclude, err = textx.NewExclusion(ctx.pcfg.Exclude)
+	if err != nil {
+		return err
+	}
 
-	if record.Info == nil || !ctx.pcfg.DisSyncData {
+	if record.Info == nil || !(ctx.pcfg.DisSyncData || ctx.pcfg.Resume) {
 		record.Info, err = p.getBookInfo(sess, ctx.id)
 		if err != nil {
 			p.logger.Warnf("Failed to get book info for book %s: %v", ctx.id, err)
@@ -94,11 +185,18 @@ func (p *Packager) download(sess *rodx.RodSession, ctx *downloadContext) (err er
 		p.logger.Warnf("Failed to get book info for book %s: %v", ctx.id, err)
 		return err
 	}
+	err = ctx.sel.Validate(record.Info)
+	if err != nil {
+		return err
+	}
 	err = p.downloadCheck(ctx)
 	if err != nil {
 		p.logger.Warnf("Failed to download check book for book %s: %v", ctx.id, err)
 		return err
 	}
+	if ctx.pcfg.Resume {
+		p.reportRemaining(ctx)
+	}
 	err = p.downloadBook(sess, ctx)
 	if err != nil {
 		p.logger.Warnf("Failed to download book for book %s: %v", ctx.id, err)
@@ -107,6 +205,7 @@ func (p *Packager) download(sess *rodx.RodSession, ctx *downloadContext) (err er
 	if !ctx.pcfg.KeepRecord {
 		_ = os.RemoveAll(rPath)
 	}
+	ctx.logf("download book %s success", ctx.id)
 	p.logger.Info("Download book %s success", ctx.id)
 	return nil
 }
@@ -118,17 +217,8 @@ func (p *Packager) downloadCheck(ctx *downloadContext) error {
 	ctx.record.Data.Loaded = true
 
 	var t int64
-	var load bool
 
 	for i, volume := range ctx.record.Info.Volumes {
-		if len(ctx.pcfg.VolumeSelect) == 0 {
-			load = true
-		} else if slices.Contains(ctx.pcfg.VolumeSelect, i) {
-			load = true
-		} else {
-			load = false
-		}
-
 		if i >= len(ctx.record.Data.Volumes) {
 			ctx.record.Data.Loaded = false
 			ctx.record.Data.Volumes = append(ctx.record.Data.Volumes, &model.VolumeData{})
@@ -146,14 +236,14 @@ func (p *Packager) downloadCheck(ctx *downloadContext) error {
 				ctx.record.Data.Volumes[i].Chapters = append(ctx.record.Data.Volumes[i].Chapters, &model.ChapterData{})
 			}
 
-			if chapter.Name != volume.Chapters[k].Name {
+			cData := ctx.record.Data.Volumes[i].Chapters[k]
+			if cData.Name != chapter.Name || !cData.Loaded {
+				// a partially fetched chapter keeps its page checkpoints but is not loaded yet
 				ctx.record.Data.Loaded = false
 				ctx.record.Data.Volumes[i].Loaded = false
-				ctx.record.Data.Volumes[i].Chapters[k].Loaded = false
-			} else {
-				ctx.record.Data.Volumes[i].Chapters[k].Loaded = true
+				cData.Loaded = false
 			}
-			if load {
+			if ctx.sel.Chapter(i, k) {
 				t++
 			}
 		}
@@ -172,13 +262,54 @@ func (p *Packager) downloadCheck(ctx *downloadContext) error {
 	return nil
 }
 
+func (p *Packager) reportRemaining(ctx *downloadContext) {
+	var remain []string
+	for i, volume := range ctx.record.Info.Volumes {
+		for k, chapter := range volume.Chapters {
+			if !ctx.sel.Chapter(i, k) {
+				continue
+			}
+			cData := ctx.record.Data.Volumes[i].Chapters[k]
+			if cData.Loaded && cData.Name == chapter.Name {
+				continue
+			}
+			line := fmt.Sprintf("volume %d chapter %d: %s %s", i+1, k+1, volume.Name, chapter.Name)
+			if len(cData.Pages) > 0 && cData.Next != "" {
+				line += fmt.Sprintf(" (from page %d)", len(cData.Pages)+1)
+			}
+			remain = append(remain, line)
+		}
+	}
+	p.logger.Infof("Resume book %s, %d chapters remaining", ctx.id, len(remain))
+	for _, line := range remain {
+		p.logger.Info("Remaining", line)
+	}
+}
+
+// reportIssues log the chapters of the record that look duplicated, placeholders or too short, see textx.Analyze.
+func (p *Packager) reportIssues(ctx *downloadContext) {
+	list := textx.Analyze(ctx.record.Info, ctx.record.Data)
+	if len(list) == 0 {
+		return
+	}
+	p.logger.Warnf("Book %s has %d suspicious chapters", ctx.id, len(list))
+	for _, is := range list {
+		excluded := ""
+		if ctx.exclude[is.Kind] {
+			excluded = " (excluded)"
+		}
+		ctx.logf("%s%s", is, excluded)
+		p.logger.Warn("Suspicious", is.String()+excluded)
+	}
+}
+
 func (p *Packager) downloadBook(sess *rodx.RodSession, ctx *downloadContext) (err error) {
 	lc := utils.NewLinkCache()
 	lc.Import(ctx.record.Cache)
 	ctx.lc = lc
 	ctx.record.Info.CoverId, _ = lc.SetX("cover", "cover"+path.Ext(ctx.record.Info.CoverId), ctx.record.Info.Cover)
 	for i, info := range ctx.record.Info.Volumes {
-		if len(ctx.pcfg.VolumeSelect) != 0 && !slices.Contains(ctx.pcfg.VolumeSelect, i+1) {
+		if !ctx.sel.Volume(i) {
 			continue
 		}
 		err = p.downloadVolume(sess, i, ctx)
@@ -187,20 +318,25 @@ func (p *Packager) downloadBook(sess *rodx.RodSession, ctx *downloadContext) (er
 			return err
 		}
 	}
+	p.reportIssues(ctx)
 	if ctx.pcfg.PackageMode == model.PackageModeDefault || ctx.pcfg.PackageMode == model.PackageModeBook {
-		vc := map[int]map[int]bool{}
-		for _, index := range ctx.pcfg.VolumeSelect {
-			vc[index-1] = make(map[int]bool)
-		}
 		err = epubx.Build(&epubx.Config{
 			Info:        ctx.record.Info,
 			Data:        ctx.record.Data,
 			ImgCache:    lc,
-			VC:          vc,
+			VC:          ctx.sel,
 			Lang:        ctx.pcfg.Lang,
 			Output:      ctx.pcfg.OutputPath,
 			PackageMode: ctx.pcfg.PackageMode,
 			Source:      Source,
+			Convert:     ctx.pcfg.Convert,
+			Filter:      ctx.filter,
+			Images:      ctx.images,
+			Content:     ctx.pcfg.Content,
+			Format:      ctx.pcfg.Format,
+			Exclude:     ctx.exclude,
+			Meta:        ctx.meta,
+			Tag:         ctx.pcfg.ExportOptions.Tag(),
 		})
 		if err != nil {
 			return err
@@ -213,17 +349,7 @@ func (p *Packager) downloadBook(sess *rodx.RodSession, ctx *downloadContext) (er
 	}
 
 	// clear
-	cls := []string{ctx.record.Info.CoverId}
-	for _, volume := range ctx.record.Info.Volumes {
-		cls = append(cls, volume.CoverId)
-	}
-	rls := [][]string{cls}
-	for _, volume := range ctx.record.Data.Volumes {
-		for _, chapter := range volume.Chapters {
-			rls = append(rls, chapter.Imgs)
-		}
-	}
-	lc.Clear(rls)
+	lc.Clear(utils.RecordResIds(ctx.record))
 	err = p.downloadCheck(ctx)
 	if err != nil {
 		p.logger.Warnf("Failed to save record for book %s: %v", ctx.record.Info.Name, err)
@@ -240,27 +366,65 @@ func (p *Packager) downloadVolume(sess *rodx.RodSession, index int, ctx *downloa
 	volume := &ctx.record.Info.Volumes[index]
 	volume.CoverId, _ = ctx.lc.SetX(vcid, vcid+path.Ext(volume.CoverId), volume.Cover)
 
+	var total int64
+	for i := range volume.Chapters {
+		if ctx.sel.Chapter(index, i) {
+			total++
+		}
+	}
+	ctx.vpr = ctx.pr.Child(volume.Name, total)
+	defer ctx.vpr.Done()
 	for i := range volume.Chapters {
+		if err := ctx.ctx.Err(); err != nil {
+			return err
+		}
+		if !ctx.sel.Chapter(index, i) {
+			continue
+		}
+		cData := ctx.record.Data.Volumes[index].Chapters[i]
+		loaded := cData.Loaded && cData.Name == volume.Chapters[i].Name
 		err := p.downloadChapter(sess, index, i, ctx)
 		if err != nil {
+			ctx.logf("failed to download volume %d chapter %d: %v", index+1, i+1, err)
 			p.logger.Warnf("Failed to download chapter %d for volume %d for book %s: %v", i+1, index+1, ctx.record.Info.Id, err)
 			return err
 		}
+		if loaded {
+			ctx.pr.Skip(1)
+			ctx.vpr.Skip(1)
+			continue
+		}
 		ctx.pr.Add(1)
-		p.logger.Infof("[%s] Successfully downloaded chapter %d for volume %d for book %s", ctx.pr.String(), i+1, index+1, ctx.record.Info.Id)
+		ctx.vpr.Add(1)
+		ps := ctx.pr.Snapshot().String()
+		ctx.logf("[%s] downloaded volume %d chapter %d", ps, index+1, i+1)
+		ctx.event(model.Event{
+			Type:     model.EventChapter,
+			Volume:   index + 1,
+			Chapter:  i + 1,
+			Name:     volume.Chapters[i].Name,
+			Progress: ctx.pr.String(),
+		})
+		p.logger.Infof("[%s] Successfully downloaded chapter %d for volume %d for book %s", ps, i+1, index+1, ctx.record.Info.Id)
 	}
 	if ctx.pcfg.PackageMode == model.PackageModeVolume {
 		err := epubx.Build(&epubx.Config{
-			Info:     ctx.record.Info,
-			Data:     ctx.record.Data,
-			ImgCache: ctx.lc,
-			VC: map[int]map[int]bool{
-				index: {},
-			},
+			Info:        ctx.record.Info,
+			Data:        ctx.record.Data,
+			ImgCache:    ctx.lc,
+			VC:          ctx.sel.Only(index),
 			Lang:        ctx.pcfg.Lang,
 			Output:      ctx.pcfg.OutputPath,
 			PackageMode: ctx.pcfg.PackageMode,
 			Source:      Source,
+			Convert:     ctx.pcfg.Convert,
+			Filter:      ctx.filter,
+			Images:      ctx.images,
+			Content:     ctx.pcfg.Content,
+			Format:      ctx.pcfg.Format,
+			Exclude:     ctx.exclude,
+			Meta:        ctx.meta,
+			Tag:         ctx.pcfg.ExportOptions.Tag(),
 		})
 		if err != nil {
 			return err
@@ -283,7 +447,19 @@ func (p *Packager) downloadChapter(sess *rodx.RodSession, index, jndex int, ctx
 	cInfo := &ctx.record.Info.Volumes[index].Chapters[jndex]
 	cData := ctx.record.Data.Volumes[index].Chapters[jndex]
 	if !cData.Loaded || cData.Name != cInfo.Name {
+		ctx.vIndex, ctx.cIndex = index, jndex
+		ctx.cpr = ctx.vpr.Child(cInfo.Name, -1)
+		defer ctx.cpr.Done()
+		attempt := 0
+		var lastErr error
 		err := sess.PageLoop().DoWithNumX(func(page *rod.Page) (err error) {
+			attempt++
+			if attempt > 1 && lastErr != nil {
+				ctx.event(model.Event{Type: model.EventRetry, Name: cInfo.Name, Attempt: attempt, Err: lastErr.Error()})
+			}
+			defer func() {
+				lastErr = err
+			}()
 			sess.Browser().MustSetCookies()
 			time.Sleep(1 * time.Second)
 			defer utils.ExpireClose(page, p.timeout)()
@@ -315,7 +491,7 @@ func (p *Packager) downloadChapter(sess *rodx.RodSession, index, jndex int, ctx
 			Info:     ctx.record.Info,
 			Data:     ctx.record.Data,
 			ImgCache: ctx.lc,
-			VC: map[int]map[int]bool{
+			VC: model.Selection{
 				index: {
 					jndex: true,
 				},
@@ -324,6 +500,14 @@ func (p *Packager) downloadChapter(sess *rodx.RodSession, index, jndex int, ctx
 			Output:      ctx.pcfg.OutputPath,
 			PackageMode: ctx.pcfg.PackageMode,
 			Source:      Source,
+			Convert:     ctx.pcfg.Convert,
+			Filter:      ctx.filter,
+			Images:      ctx.images,
+			Content:     ctx.pcfg.Content,
+			Format:      ctx.pcfg.Format,
+			Exclude:     ctx.exclude,
+			Meta:        ctx.meta,
+			Tag:         ctx.pcfg.ExportOptions.Tag(),
 		})
 		if err != nil {
 			return err
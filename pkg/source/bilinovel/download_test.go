@@ -0,0 +1,340 @@
+package bilinovel
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/textx"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"image"
+	"image/png"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testRecord a fully loaded book of 3 volumes with 3 chapters each.
+func testRecord(t *testing.T) (*utils.Record, *utils.LinkCache) {
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := utils.NewLinkCache()
+	lc.SetRaw("cover.png", buf.Bytes())
+
+	info := &model.BookInfo{Name: "Book", Id: "1", CoverId: "cover.png"}
+	data := &model.BookData{}
+	for i := 1; i <= 3; i++ {
+		vi := model.VolumeInfo{Name: fmt.Sprintf("V%d", i), Id: fmt.Sprintf("v%d", i), CoverId: "cover.png"}
+		vd := &model.VolumeData{Name: vi.Name, Id: vi.Id}
+		for k := 1; k <= 3; k++ {
+			name := fmt.Sprintf("C%d-%d", i, k)
+			vi.Chapters = append(vi.Chapters, model.ChapterInfo{Name: name})
+			vd.Chapters = append(vd.Chapters, &model.ChapterData{Loaded: true, Name: name, Data: []string{"<p>" + name + "</p>"}})
+		}
+		info.Volumes = append(info.Volumes, vi)
+		data.Volumes = append(data.Volumes, vd)
+	}
+	return &utils.Record{Info: info, Data: data}, lc
+}
+
+func epubChapters(t *testing.T, bs []byte) []string {
+	zr, err := zip.NewReader(bytes.NewReader(bs), int64(len(bs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sl []string
+	for _, f := range zr.File {
+		name := path.Base(f.Name)
+		if strings.HasPrefix(name, "chapter") {
+			sl = append(sl, strings.TrimSuffix(name, ".xhtml"))
+		}
+	}
+	slices.Sort(sl)
+	return sl
+}
+
+// TestSelection the same chapters are counted by the download and packaged from the record.
+func TestSelection(t *testing.T) {
+	dir := t.TempDir()
+	record, lc := testRecord(t)
+	p := &Packager{}
+
+	sel, err := model.ParseSelection("2,3:1-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sel.Validate(record.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &downloadContext{
+		id:     "1",
+		pcfg:   &model.PackageConfig{OutputPath: dir, VolumeSelect: "2,3:1-2"},
+		pr:     utils.NewProgress(-1),
+		record: record,
+		lc:     lc,
+		sel:    sel,
+	}
+	err = p.downloadCheck(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := ctx.pr.Snapshot().Total; total != 5 {
+		t.Fatal(total)
+	}
+	if !record.Data.Loaded {
+		t.Fatal("record not loaded")
+	}
+
+	fd, err := p.RecordExtract(dir, "1", "2,3:1-2", model.ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Base(fd.Name) != "Book[2,3_1-2].epub" {
+		t.Fatal(fd.Name)
+	}
+	got := epubChapters(t, fd.Data)
+	want := []string{"chapter2_1", "chapter2_2", "chapter2_3", "chapter3_1", "chapter3_2"}
+	if !slices.Equal(got, want) {
+		t.Fatal(got)
+	}
+
+	fd, err = p.RecordExtract(dir, "1", "3:2", model.ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Base(fd.Name) != "Book_3_V3[2].epub" {
+		t.Fatal(fd.Name)
+	}
+	if got = epubChapters(t, fd.Data); !slices.Equal(got, []string{"chapter3_2"}) {
+		t.Fatal(got)
+	}
+
+	fd, err = p.RecordExtract(dir, "1", "", model.ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Base(fd.Name) != "Book.epub" || len(epubChapters(t, fd.Data)) != 9 {
+		t.Fatal(fd.Name)
+	}
+
+	for _, s := range []string{"4", "1:4", "0"} {
+		_, err = p.RecordExtract(dir, "1", s, model.ExportOptions{})
+		if !errors.Is(err, model.ErrSelection) {
+			t.Fatal(s, err)
+		}
+	}
+}
+
+func zipNames(t *testing.T, bs []byte) []string {
+	zr, err := zip.NewReader(bytes.NewReader(bs), int64(len(bs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sl []string
+	for _, f := range zr.File {
+		sl = append(sl, f.Name)
+	}
+	return sl
+}
+
+// TestContent the text-only and the illustration-only variants of a book with one illustrated chapter.
+func TestContent(t *testing.T) {
+	dir := t.TempDir()
+	record, lc := testRecord(t)
+	lc.SetRaw("ill.png", lc.Get("cover.png"))
+	chapter := record.Data.Volumes[0].Chapters[1]
+	chapter.Imgs = []string{"ill.png"}
+	chapter.Data = append(chapter.Data, `<img src="../images/ill.png" alt="ill.png"/>`)
+	record.Data.Loaded = true
+	for _, vd := range record.Data.Volumes {
+		vd.Loaded = true
+	}
+	err := utils.SaveRecord(path.Join(dir, fmt.Sprintf(CacheFile, "1")), record, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Packager{}
+	// the cover stays the cover of the package, only the illustrations come and go
+	hasImages := func(bs []byte) bool {
+		return slices.ContainsFunc(zipNames(t, bs), func(s string) bool { return strings.HasSuffix(s, "images/ill.png") })
+	}
+
+	fd, err := p.RecordExtract(dir, "1", "1", model.ExportOptions{Content: model.ContentText})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Base(fd.Name) != "Book_1_V1[text].epub" || len(epubChapters(t, fd.Data)) != 3 || hasImages(fd.Data) {
+		t.Fatal(fd.Name, zipNames(t, fd.Data))
+	}
+
+	fd, err = p.RecordExtract(dir, "1", "", model.ExportOptions{Content: model.ContentImages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := epubChapters(t, fd.Data); path.Base(fd.Name) != "Book[images].epub" || !slices.Equal(got, []string{"chapter1_2"}) || !hasImages(fd.Data) {
+		t.Fatal(fd.Name, got)
+	}
+
+	fd, err = p.RecordExtract(dir, "1", "", model.ExportOptions{Format: model.FormatCBZ})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := zipNames(t, fd.Data); path.Base(fd.Name) != "Book.cbz" || !slices.Equal(got, []string{"0001.png", "0002.png", "ComicInfo.xml"}) {
+		t.Fatal(fd.Name, got)
+	}
+
+	for _, opts := range []model.ExportOptions{{Content: "all"}, {Format: "pdf"}, {Format: model.FormatCBZ, Content: model.ContentText}} {
+		_, err = p.RecordExtract(dir, "1", "", opts)
+		if !errors.Is(err, model.ErrExportOptions) {
+			t.Fatal(opts, err)
+		}
+	}
+}
+
+// TestExclude the flagged chapters are reported and left out of the package when asked.
+func TestExclude(t *testing.T) {
+	dir := t.TempDir()
+	record, lc := testRecord(t)
+	for _, vd := range record.Data.Volumes {
+		for _, cd := range vd.Chapters {
+			cd.Data = []string{"<p>" + strings.Repeat(cd.Name+"的故事从这里开始，", 10) + "</p>"}
+		}
+		vd.Loaded = true
+	}
+	record.Data.Loaded = true
+	record.Data.Volumes[0].Chapters[2].Data = record.Data.Volumes[0].Chapters[0].Data
+	record.Data.Volumes[1].Chapters[0].Data = []string{"<p>本章内容更新中，敬请期待</p>"}
+	err := utils.SaveRecord(path.Join(dir, fmt.Sprintf(CacheFile, "1")), record, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := RecordIssues(dir, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Kind != textx.IssueDuplicate || list[0].OfChapter != 1 || list[1].Kind != textx.IssuePlaceholder {
+		t.Fatal(list)
+	}
+
+	p := &Packager{}
+	fd, err := p.RecordExtract(dir, "1", "", model.ExportOptions{Exclude: []string{"duplicate,placeholder"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := epubChapters(t, fd.Data)
+	if len(got) != 7 || slices.Contains(got, "chapter1_3") || slices.Contains(got, "chapter2_1") {
+		t.Fatal(got)
+	}
+
+	_, err = p.RecordExtract(dir, "1", "", model.ExportOptions{Exclude: []string{"other"}})
+	if !errors.Is(err, textx.ErrUnknownIssue) {
+		t.Fatal(err)
+	}
+}
+
+// TestMetadata the metadata set next to the record names the exports until it is removed.
+func TestMetadata(t *testing.T) {
+	dir := t.TempDir()
+	record, lc := testRecord(t)
+	record.Data.Loaded = true
+	for _, vd := range record.Data.Volumes {
+		vd.Loaded = true
+	}
+	rPath := path.Join(dir, fmt.Sprintf(CacheFile, "1"))
+	err := utils.SaveRecord(rPath, record, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = utils.SaveMetadata(rPath, &model.Metadata{Name: "Renamed", Volumes: map[int]string{2: "Second"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Packager{}
+	fd, err := p.RecordExtract(dir, "1", "2", model.ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Base(fd.Name) != "Renamed_2_Second.epub" {
+		t.Fatal(fd.Name)
+	}
+
+	err = utils.SaveMetadata(rPath, &model.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := utils.LoadMetadata(rPath)
+	if err != nil || m != nil {
+		t.Fatal(m, err)
+	}
+	fd, err = p.RecordExtract(dir, "1", "2", model.ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Base(fd.Name) != "Book_2_V2.epub" {
+		t.Fatal(fd.Name)
+	}
+}
+
+// TestResumeAfterGC the images of the pages checkpointed before an interruption survive a gc of the record,
+// the resumed chapter is assembled with them.
+func TestResumeAfterGC(t *testing.T) {
+	dir := t.TempDir()
+	record, lc := testRecord(t)
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 2, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, name := range []string{"p1", "stale"} {
+		id, err := lc.SetX(name, "https://example.com/"+name+".png", buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	info := &record.Info.Volumes[0].Chapters[1]
+	info.Ahref = "/novel/1/2.html"
+	record.Data.Volumes[0].Chapters[1] = &model.ChapterData{
+		Pages: []*model.PageData{{Ahref: info.Ahref, Data: []string{"<p>one</p>", `<img src="../images/` + ids[0] + `"/>`}, Imgs: ids[:1]}},
+		Next:  "/novel/1/2_2.html",
+	}
+	rPath := path.Join(dir, fmt.Sprintf(CacheFile, "1"))
+	err = utils.SaveRecord(rPath, record, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := utils.GCRecord(rPath)
+	if err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+
+	record, err = utils.LoadRecord(rPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := record.Data.Volumes[0].Chapters[1]
+	if cur := resumePage(info, data); cur != "/novel/1/2_2.html" || len(data.Pages) != 1 {
+		t.Fatal(cur, data)
+	}
+	data.Pages = append(data.Pages, &model.PageData{Ahref: "/novel/1/2_2.html", Data: []string{"<p>two</p>"}})
+	finishChapter(info, data)
+	lc = utils.NewLinkCache()
+	lc.Import(record.Cache)
+	if !data.Loaded || !slices.Equal(data.Imgs, ids[:1]) || len(data.Data) != 3 || lc.Get(ids[0]) == nil || lc.Get(ids[1]) != nil {
+		t.Fatal(data)
+	}
+
+	// a checkpoint of another chapter is dropped
+	if cur := resumePage(&record.Info.Volumes[0].Chapters[0], &model.ChapterData{Pages: data.Pages, Next: "x"}); cur != "" {
+		t.Fatal(cur)
+	}
+}
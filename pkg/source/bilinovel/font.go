@@ -1,9 +1,19 @@
 package bilinovel
 
 import (
+	"github.com/go-rod/rod"
+	"github.com/peakedshout/go-pandorasbox/logger"
+	"github.com/peakedshout/novelpackager/pkg/fontx"
+	"os"
+	"path"
 	"slices"
+	"strings"
 )
 
+// fontSelector the element the site draws with its obfuscation font.
+const fontSelector = `#acontent > p:last-of-type`
+
+// decryptionFont decode with the built-in table, made from one version of the font of the site.
 func decryptionFont(str string) string {
 	var data string
 	for _, r := range str {
@@ -20,3 +30,64 @@ func decryptionFont(str string) string {
 	}
 	return data
 }
+
+func newFontDecoder(cfg *Config, l logger.Logger) *fontx.Decoder {
+	var ref []byte
+	if cfg.FontRef != "" {
+		bs, err := os.ReadFile(cfg.FontRef)
+		if err != nil {
+			l.Warnf("Failed to read reference font %s, using the default font of the browser: %v", cfg.FontRef, err)
+		} else {
+			ref = bs
+		}
+	}
+	// the characters of the built-in table are those the site obfuscates, a rotated font draws them again
+	candidates := make([]rune, 0, len(fontSecretMap))
+	for _, v := range fontSecretMap {
+		for _, r := range v {
+			candidates = append(candidates, r)
+		}
+	}
+	return fontx.NewDecoder(fontx.DecoderConfig{Dir: cfg.FontDir, Reference: ref, Candidates: candidates})
+}
+
+// decodeFont read the text drawn with the obfuscation font of the page. The mapping is rebuilt from the font served,
+// the built-in table is the fallback when the font cannot be captured or drawn.
+func (p *Packager) decodeFont(page *rod.Page, str string) string {
+	if p.fonts == nil {
+		return decryptionFont(str)
+	}
+	u, err := fontx.FontURL(page, fontSelector)
+	if err != nil || u == "" {
+		p.logger.Warnf("Failed to find the obfuscation font, using the built-in table: %v", err)
+		return decryptionFont(str)
+	}
+	p.fontMux.Lock()
+	font, ok := p.fontData[u]
+	p.fontMux.Unlock()
+	if !ok {
+		font, err = fontx.Fetch(page, u)
+		if err != nil {
+			p.logger.Warnf("Failed to capture the obfuscation font, using the built-in table: %v", err)
+			return decryptionFont(str)
+		}
+		p.fontMux.Lock()
+		p.fontData[u] = font
+		p.fontMux.Unlock()
+	}
+	data, err := p.fonts.Decode(&fontx.PageRasterizer{Page: page}, font, str)
+	if err != nil {
+		p.logger.Warnf("Failed to decode the obfuscation font %s, using the built-in table: %v", u, err)
+		return decryptionFont(str)
+	}
+	return data
+}
+
+func isFont(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".woff2", ".woff", ".ttf", ".otf":
+		return true
+	default:
+		return false
+	}
+}
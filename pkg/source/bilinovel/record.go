@@ -1,54 +1,110 @@
 package bilinovel
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/peakedshout/novelpackager/pkg/epubx"
+	"github.com/peakedshout/novelpackager/pkg/imagex"
 	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/textx"
 	"github.com/peakedshout/novelpackager/pkg/utils"
+	"io"
 	"path"
 )
 
-func (p *Packager) RecordExtract(out, id string, vols ...int) (*epubx.FBytesData, error) {
+// RecordExtract package the book in the record into memory, sel is parsed by model.ParseSelection.
+func (p *Packager) RecordExtract(out, id string, sel string, opts model.ExportOptions) (*epubx.FBytesData, error) {
+	selection, err := model.ParseSelection(sel)
+	if err != nil {
+		return nil, err
+	}
+	fd := &epubx.FBytesData{}
+	buf := new(bytes.Buffer)
+	err = p.RecordExport(out, id, selection, opts, func(name string) (io.Writer, error) {
+		fd.Name = path.Join(out, name)
+		return buf, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fd.Data = buf.Bytes()
+	return fd, nil
+}
+
+// RecordExport stream the selected part of the book in the record as one epub, open is called with the file name
+// before anything is written. A selection of one whole volume is named like the volumes packaged by download.
+func (p *Packager) RecordExport(out, id string, sel model.Selection, opts model.ExportOptions, open func(name string) (io.Writer, error)) error {
 	rPath := path.Join(out, fmt.Sprintf(CacheFile, id))
 	record, err := utils.LoadRecord(rPath)
 	if err != nil {
 		p.logger.Warnf("Failed to load record for book %s: %v", id, err)
-		return nil, err
+		return err
 	}
 	if record.Info == nil {
-		return nil, fmt.Errorf("book %s not loaded", id)
+		return fmt.Errorf("book %s not loaded", id)
 	}
 
-	vc := map[int]map[int]bool{}
-	for _, index := range vols {
-		if index > len(record.Info.Volumes) || index <= 0 {
-			return nil, fmt.Errorf("book %s volume %d not found", id, index)
-		}
-		vc[index-1] = make(map[int]bool)
+	err = sel.Validate(record.Info)
+	if err != nil {
+		return err
+	}
+	err = opts.Validate()
+	if err != nil {
+		return err
+	}
+	filter, err := textx.New(opts.Filters, opts.Rules)
+	if err != nil {
+		return err
+	}
+	images, err := imagex.NewProcessor(opts.Image, "")
+	if err != nil {
+		return err
+	}
+	exclude, err := textx.NewExclusion(opts.Exclude)
+	if err != nil {
+		return err
+	}
+	meta, err := utils.LoadMetadata(rPath)
+	if err != nil {
+		return err
 	}
 	pm := model.PackageModeDefault
-	if len(vols) == 1 {
+	if len(sel) == 1 {
 		pm = model.PackageModeVolume
 	}
 
 	if record.Data == nil || record.Data.Loaded == false {
-		return nil, fmt.Errorf("book %s not loaded", id)
+		return fmt.Errorf("book %s not loaded", id)
 	}
 	lc := utils.NewLinkCache()
 	lc.Import(record.Cache)
-	ch := make(chan *epubx.FBytesData, 1)
-	err = epubx.Build(&epubx.Config{
-		Info:        record.Info,
-		Data:        record.Data,
-		ImgCache:    lc,
-		VC:          vc,
-		Lang:        "zh",
-		OutputChan:  ch,
-		PackageMode: pm,
-		Source:      Source,
+	return epubx.Build(&epubx.Config{
+		Info:         record.Info,
+		Data:         record.Data,
+		ImgCache:     lc,
+		VC:           sel,
+		Lang:         "zh",
+		PackageMode:  pm,
+		Source:       Source,
+		OutputWriter: open,
+		Convert:      opts.Convert,
+		Filter:       filter,
+		Images:       images,
+		Content:      opts.Content,
+		Format:       opts.Format,
+		Exclude:      exclude,
+		Meta:         meta,
 	})
+}
+
+// RecordIssues the suspicious chapters of the book in the record, see textx.Analyze.
+func RecordIssues(out, id string) ([]textx.Issue, error) {
+	record, err := utils.LoadRecord(path.Join(out, fmt.Sprintf(CacheFile, id)))
 	if err != nil {
 		return nil, err
 	}
-	return <-ch, nil
+	if record.Info == nil || record.Data == nil {
+		return nil, fmt.Errorf("book %s not loaded", id)
+	}
+	return textx.Analyze(record.Info, record.Data), nil
 }
@@ -3,52 +3,44 @@ package bilinovel
 import (
 	"context"
 	"fmt"
-	"github.com/peakedshout/novelpackager/pkg/epubx"
 	"github.com/peakedshout/novelpackager/pkg/model"
 	"github.com/peakedshout/novelpackager/pkg/utils"
 	"github.com/peakedshout/novelpackager/pkg/web"
+	"io"
 	"path"
-	"sync"
 	"time"
 )
 
 func init() {
+	web.RegisterRecord(Source, CacheFile)
 	web.Register(func(ctx *web.BuildContext) web.Source {
 		lr := utils.NewLimiter(ctx.Ctx)
 		lr.Add("GetInfo", 1)
 		lr.Add("Search", 1)
-		lr.Add("Cache", 1)
 		lr.Add("Download", 3)
 		p := NewPackager(ctx.RodContext, &Config{})
 		return &WebSource{
-			ctx: ctx.Ctx,
-			p:   p,
+			p: p,
 			pcfg: &model.PackageConfig{
 				KeepRecord:   true,
 				OutputPath:   ctx.CacheDir,
 				DisSyncData:  false,
 				PackageMode:  model.PackageModeNone,
-				VolumeSelect: nil,
+				VolumeSelect: "",
 				Lang:         "",
 			},
 			kvCache: ctx.Cache,
-			prMap:   make(map[string]*utils.Progress),
 			limiter: lr,
 		}
 	})
 }
 
 type WebSource struct {
-	ctx context.Context
-
 	p    *Packager
 	pcfg *model.PackageConfig
 
 	kvCache utils.KVCache
 
-	prMux sync.Mutex
-	prMap map[string]*utils.Progress
-
 	limiter *utils.Limiter
 }
 
@@ -92,29 +84,7 @@ func (w *WebSource) Search(ctx context.Context, name string, full bool, noImg bo
 	return sl, nil
 }
 
-func (w *WebSource) Progress(ctx context.Context) map[string]string {
-	w.prMux.Lock()
-	defer w.prMux.Unlock()
-	m := make(map[string]string, len(w.prMap))
-	for k, v := range w.prMap {
-		m[k] = v.String()
-	}
-	return m
-}
-
-func (w *WebSource) Caching(ctx context.Context, id string) error {
-	fn, err := w.limiter.LimitTimeout("Cache", 3*time.Second)
-	if err != nil {
-		return err
-	}
-	go func() {
-		defer fn()
-		_ = w.caching(w.ctx, id)
-	}()
-	return nil
-}
-
-func (w *WebSource) caching(ctx context.Context, id string) (err error) {
+func (w *WebSource) Cache(ctx context.Context, id string, job *web.Job) error {
 	sess, err := w.p.rc.NewSession(ctx)
 	if err != nil {
 		return err
@@ -122,28 +92,15 @@ func (w *WebSource) caching(ctx context.Context, id string) (err error) {
 	defer sess.Close()
 	defer blockURLs(sess.Browser())()
 
-	w.prMux.Lock()
-	pr, ok := w.prMap[id]
-	if ok && (pr.Error() == nil && pr.Percent() != 1) {
-		w.prMux.Unlock()
-		return fmt.Errorf("already caching %s", id)
-	}
-	pr = utils.NewProgress(-1)
-	w.prMap[id] = pr
-	w.prMux.Unlock()
-
-	defer func() {
-		if err != nil {
-			pr.SetError(err)
-		}
-	}()
-
 	return w.p.download(sess, &downloadContext{
+		ctx:    ctx,
 		id:     id,
 		pcfg:   w.pcfg,
-		pr:     pr,
+		pr:     job.Pr(),
 		record: nil,
 		lc:     nil,
+		log:    job.Logf,
+		emit:   job.Emit,
 	})
 }
 
@@ -151,10 +108,10 @@ func (w *WebSource) EnableDownload(ctx context.Context, id string) ([]string, er
 	rPath := path.Join(w.pcfg.OutputPath, fmt.Sprintf(CacheFile, id))
 	record, err := utils.LoadRecord(rPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load record for book %s: %v", id, err)
+		return nil, fmt.Errorf("failed to load record for book %s: %w", id, err)
 	}
 	if record.Data == nil || !record.Data.Loaded {
-		return nil, fmt.Errorf("record for book %s is not loaded", id)
+		return nil, fmt.Errorf("%w: record for book %s is not loaded", web.ErrNotCached, id)
 	}
 	var sl []string
 	for _, volume := range record.Data.Volumes {
@@ -163,11 +120,11 @@ func (w *WebSource) EnableDownload(ctx context.Context, id string) ([]string, er
 	return sl, nil
 }
 
-func (w *WebSource) Download(ctx context.Context, id string, vols ...int) (*epubx.FBytesData, error) {
+func (w *WebSource) Export(ctx context.Context, id string, sel model.Selection, opts model.ExportOptions, open func(name string) (io.Writer, error)) error {
 	fn, err := w.limiter.LimitTimeout("Download", 3*time.Second)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer fn()
-	return w.p.RecordExtract(w.pcfg.OutputPath, id, vols...)
+	return w.p.RecordExport(w.pcfg.OutputPath, id, sel, opts, open)
 }
@@ -0,0 +1,323 @@
+package textx
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/htmlx"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// The kinds of the chapters flagged by Analyze.
+const (
+	// IssueDuplicate the chapter has the same text and images as an earlier one, the site lists it twice.
+	IssueDuplicate = "duplicate"
+	// IssueSimilar the chapter is nearly the same as an earlier one, e.g. a second copy with a few lines changed.
+	IssueSimilar = "similar"
+	// IssuePlaceholder the chapter is a notice standing in for the text, such as "coming soon".
+	IssuePlaceholder = "placeholder"
+	// IssueShort the chapter has next to no text and no images.
+	IssueShort = "short"
+)
+
+var ErrUnknownIssue = errors.New("unknown issue")
+
+var issues = []string{IssueDuplicate, IssueSimilar, IssuePlaceholder, IssueShort}
+
+// Issues the kinds of issues Analyze reports.
+func Issues() []string {
+	return slices.Clone(issues)
+}
+
+const (
+	// shingle the length in letters of the overlapping pieces the texts are compared by.
+	shingle = 5
+	// similarity the share of pieces two chapters have in common to be similar.
+	similarity = 0.8
+	// minHashes the buckets of the signatures estimating the share, it is only counted exactly for the close ones.
+	minHashes = 64
+	// shortText a chapter with fewer letters and no image is short.
+	shortText = 50
+	// placeholderText a placeholder notice has fewer letters.
+	placeholderText = 200
+)
+
+// placeholders the notices of the chapters not written or not published yet, compared without spaces and punctuation.
+var placeholders = []string{
+	"敬请期待", "敬請期待", "待更新", "尚未更新", "暂无内容", "暫無內容", "内容更新中", "內容更新中",
+	"章节内容正在", "章節內容正在", "正在手打", "手打中", "comingsoon", "tobeupdated", "notavailableyet",
+}
+
+// Issue a chapter flagged by Analyze, the volumes and chapters count from 1 like model.Event.
+type Issue struct {
+	Kind    string `json:"kind"`
+	Volume  int    `json:"volume"`
+	Chapter int    `json:"chapter"`
+	Name    string `json:"name"`
+
+	// OfVolume, OfChapter and OfName the earlier chapter a duplicate or a similar chapter repeats.
+	OfVolume  int    `json:"ofVolume,omitempty"`
+	OfChapter int    `json:"ofChapter,omitempty"`
+	OfName    string `json:"ofName,omitempty"`
+	// Similarity the share of the text the chapters have in common, from 0 to 1.
+	Similarity float64 `json:"similarity,omitempty"`
+}
+
+func (is Issue) String() string {
+	s := fmt.Sprintf("volume %d chapter %d %s: %s", is.Volume, is.Chapter, is.Name, is.Kind)
+	switch is.Kind {
+	case IssueDuplicate:
+		s += fmt.Sprintf(" of volume %d chapter %d %s", is.OfVolume, is.OfChapter, is.OfName)
+	case IssueSimilar:
+		s += fmt.Sprintf(" to volume %d chapter %d %s (%.0f%%)", is.OfVolume, is.OfChapter, is.OfName, is.Similarity*100)
+	}
+	return s
+}
+
+// chapterPrint what a chapter is compared by: its letters, a hash of them with its images, the signature of
+// its pieces and, once it is close to another chapter, the sorted hashes of its pieces.
+type chapterPrint struct {
+	volume, chapter int
+	text            []rune
+	sum             [sha256.Size]byte
+	signature       [minHashes]uint64
+	shingles        []uint64
+}
+
+// Analyze flag the loaded chapters that repeat an earlier one, word for word or nearly, and the ones that are
+// placeholders or have next to no text, in reading order. A chapter gets one issue at most, the copies are
+// flagged and the first one is kept.
+func Analyze(info *model.BookInfo, data *model.BookData) []Issue {
+	if info == nil || data == nil {
+		return nil
+	}
+	var list []Issue
+	var kept []*chapterPrint
+	sums := make(map[[sha256.Size]byte]*chapterPrint)
+	for i, volume := range info.Volumes {
+		if i >= len(data.Volumes) || data.Volumes[i] == nil {
+			break
+		}
+		vd := data.Volumes[i]
+		for k, chapter := range volume.Chapters {
+			if k >= len(vd.Chapters) || vd.Chapters[k] == nil || !vd.Chapters[k].Loaded {
+				continue
+			}
+			cd := vd.Chapters[k]
+			cp := newChapterPrint(i, k, cd)
+			issue := Issue{Volume: i + 1, Chapter: k + 1, Name: chapter.Name}
+			switch {
+			case len(cd.Imgs) == 0 && len(cp.text) < placeholderText && isPlaceholder(cp.text):
+				issue.Kind = IssuePlaceholder
+			case len(cd.Imgs) == 0 && len(cp.text) < shortText:
+				issue.Kind = IssueShort
+			case sums[cp.sum] != nil:
+				issue.Kind = IssueDuplicate
+				issue.of(info, sums[cp.sum])
+				issue.Similarity = 1
+			default:
+				if of, s := cp.similar(kept); of != nil {
+					issue.Kind = IssueSimilar
+					issue.of(info, of)
+					issue.Similarity = s
+				}
+			}
+			if issue.Kind != "" {
+				list = append(list, issue)
+				continue
+			}
+			sums[cp.sum] = cp
+			kept = append(kept, cp)
+		}
+	}
+	return list
+}
+
+func (is *Issue) of(info *model.BookInfo, cp *chapterPrint) {
+	is.OfVolume, is.OfChapter = cp.volume+1, cp.chapter+1
+	is.OfName = info.Volumes[cp.volume].Chapters[cp.chapter].Name
+}
+
+func newChapterPrint(i, k int, cd *model.ChapterData) *chapterPrint {
+	cp := &chapterPrint{volume: i, chapter: k}
+	for _, item := range cd.Data {
+		inner, ok := paragraph(item)
+		if !ok {
+			_, inner, ok = htmlx.ParseHeading(item)
+		}
+		if ok {
+			cp.text = append(cp.text, letters(htmlx.Text(inner))...)
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte(string(cp.text)))
+	for _, id := range cd.Imgs {
+		h.Write([]byte{0})
+		h.Write([]byte(id))
+	}
+	h.Sum(cp.sum[:0])
+
+	if len(cp.text) < shortText {
+		return cp
+	}
+	for j := range cp.signature {
+		cp.signature[j] = ^uint64(0)
+	}
+	// one hash split into buckets, the minimum of each bucket stands for the minimum of one more hash
+	for n := 0; n+shingle <= len(cp.text); n++ {
+		m := mix(hashRunes(cp.text[n : n+shingle]))
+		j := m % minHashes
+		cp.signature[j] = min(cp.signature[j], m)
+	}
+	return cp
+}
+
+// similar the kept chapter sharing the most pieces with this one, if they share enough.
+func (cp *chapterPrint) similar(kept []*chapterPrint) (*chapterPrint, float64) {
+	if len(cp.text) < shortText {
+		return nil, 0
+	}
+	var best *chapterPrint
+	var share float64
+	for _, o := range kept {
+		if len(o.text) < shortText {
+			continue
+		}
+		// the share is at most the ratio of the lengths
+		a, b := len(cp.text), len(o.text)
+		if float64(min(a, b)) < similarity*float64(max(a, b)) {
+			continue
+		}
+		var same, used int
+		for j := range cp.signature {
+			if cp.signature[j] == ^uint64(0) && o.signature[j] == ^uint64(0) {
+				continue
+			}
+			used++
+			if cp.signature[j] == o.signature[j] {
+				same++
+			}
+		}
+		// the estimate is off by a few buckets, count the close ones
+		if float64(same) < (similarity-0.15)*float64(used) {
+			continue
+		}
+		if s := jaccard(cp.pieces(), o.pieces()); s >= similarity && s > share {
+			best, share = o, s
+		}
+	}
+	return best, share
+}
+
+// pieces the sorted hashes of the pieces of the text, without repeats.
+func (cp *chapterPrint) pieces() []uint64 {
+	if cp.shingles != nil {
+		return cp.shingles
+	}
+	for n := 0; n+shingle <= len(cp.text); n++ {
+		cp.shingles = append(cp.shingles, hashRunes(cp.text[n:n+shingle]))
+	}
+	slices.Sort(cp.shingles)
+	cp.shingles = slices.Compact(cp.shingles)
+	return cp.shingles
+}
+
+// jaccard the share of the two sorted sets in common.
+func jaccard(a, b []uint64) float64 {
+	var same, i, j int
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			same++
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return float64(same) / float64(len(a)+len(b)-same)
+}
+
+// hashRunes the fnv-1a hash of the runes.
+func hashRunes(rs []rune) uint64 {
+	h := uint64(14695981039346656037)
+	for _, r := range rs {
+		h ^= uint64(r)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// mix the finaliser of splitmix64, spreading the bits of x.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// letters the letters and digits of the text in lower case, the spaces and punctuation do not tell chapters apart.
+func letters(text string) []rune {
+	var rs []rune
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			rs = append(rs, unicode.ToLower(r))
+		}
+	}
+	return rs
+}
+
+func isPlaceholder(text []rune) bool {
+	s := string(text)
+	for _, p := range placeholders {
+		if strings.Contains(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Exclusion the kinds of flagged chapters left out of the packages.
+type Exclusion map[string]bool
+
+// NewExclusion the exclusion of the named kinds, each name may be a comma separated list like the filters.
+func NewExclusion(names []string) (Exclusion, error) {
+	var e Exclusion
+	for _, name := range names {
+		for _, name = range strings.Split(name, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !slices.Contains(issues, name) {
+				return nil, fmt.Errorf("%w: %s", ErrUnknownIssue, name)
+			}
+			if e == nil {
+				e = make(Exclusion)
+			}
+			e[name] = true
+		}
+	}
+	return e, nil
+}
+
+// Excluded the chapters of the book to leave out, keyed by their volume and chapter indexes from 0.
+func (e Exclusion) Excluded(info *model.BookInfo, data *model.BookData) map[[2]int]bool {
+	if len(e) == 0 {
+		return nil
+	}
+	m := make(map[[2]int]bool)
+	for _, is := range Analyze(info, data) {
+		if e[is.Kind] {
+			m[[2]int{is.Volume - 1, is.Chapter - 1}] = true
+		}
+	}
+	return m
+}
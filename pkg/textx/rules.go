@@ -0,0 +1,75 @@
+package textx
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Rule a user-defined replacement, Replace may refer to the groups of Pattern as ${1} or ${name}
+// (the braces are needed before a letter, Chinese characters included).
+type Rule struct {
+	Pattern *regexp.Regexp
+	Replace string
+}
+
+// Rules the replacements applied in order to the text of every paragraph.
+type Rules []Rule
+
+// LoadRules read the rules of a file, see ParseRules.
+func LoadRules(file string) (Rules, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rs, err := ParseRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return rs, nil
+}
+
+// ParseRules one rule per line, the regular expression and the replacement separated by a tab;
+// a line without a tab deletes what the expression matches. Empty lines and lines starting with # are skipped.
+func ParseRules(r io.Reader) (Rules, error) {
+	var rs Rules
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		pattern, replace, _ := strings.Cut(text, "\t")
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rs = append(rs, Rule{Pattern: re, Replace: replace})
+	}
+	return rs, sc.Err()
+}
+
+// Filter apply the rules to the text of every paragraph, a paragraph left empty is dropped.
+// The rules apply to each run of text of a paragraph with markup, they do not match across its elements.
+func (rs Rules) Filter(cd *model.ChapterData) {
+	rewrite(cd, func(text string) (string, bool) {
+		text = rs.replace(text)
+		return text, strings.TrimSpace(text) != ""
+	}, func(string) func(run string) string {
+		return rs.replace
+	})
+}
+
+func (rs Rules) replace(text string) string {
+	for _, rule := range rs {
+		text = rule.Pattern.ReplaceAllString(text, rule.Replace)
+	}
+	return text
+}
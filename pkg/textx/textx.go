@@ -0,0 +1,284 @@
+package textx
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/htmlx"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Watermark drop the lines the site inserts into the text, such as its name, address and page notices.
+	Watermark = "watermark"
+	// Punct normalise the whitespace, the ellipses and the half-width punctuation next to Chinese text.
+	Punct = "punct"
+	// Merge join the paragraphs broken in the middle of a sentence, mostly at the page boundaries of a chapter.
+	Merge = "merge"
+	// Heading drop the paragraphs repeating the chapter name, the package already has its own heading.
+	Heading = "heading"
+)
+
+var ErrUnknownFilter = errors.New("unknown filter")
+
+// Filter rewrite the text of a chapter in place. The items of ChapterData.Data are the blocks of htmlx,
+// the filters touch the text of the `<p>` items, keeping their markup, and leave the other blocks as they are.
+type Filter func(cd *model.ChapterData)
+
+var filters = map[string]Filter{
+	Watermark: StripWatermarks,
+	Punct:     NormalizePunct,
+	Merge:     MergeParagraphs,
+	Heading:   StripHeadings,
+}
+
+// Names the built-in filters in the order they are best applied.
+func Names() []string {
+	return []string{Watermark, Heading, Punct, Merge}
+}
+
+// Chain the filters applied to every chapter between the record and the exporters.
+type Chain []Filter
+
+// New the chain of the named filters, followed by the replacement rules of the file if it is not empty.
+func New(names []string, rules string) (Chain, error) {
+	var chain Chain
+	for _, name := range names {
+		for _, name = range strings.Split(name, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			f, ok := filters[name]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", ErrUnknownFilter, name)
+			}
+			chain = append(chain, f)
+		}
+	}
+	if rules != "" {
+		rs, err := LoadRules(rules)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, rs.Filter)
+	}
+	return chain, nil
+}
+
+// Apply the chain to a copy of the chapter, cd itself belongs to the record and is never modified.
+func (c Chain) Apply(cd *model.ChapterData) *model.ChapterData {
+	if len(c) == 0 || cd == nil {
+		return cd
+	}
+	cp := *cd
+	cp.Data = append([]string(nil), cd.Data...)
+	for _, f := range c {
+		f(&cp)
+	}
+	return &cp
+}
+
+// paragraph the content of a `<p>` item, ok is false for the other items.
+func paragraph(item string) (inner string, ok bool) {
+	if !strings.HasPrefix(item, "<p>") || !strings.HasSuffix(item, "</p>") {
+		return "", false
+	}
+	return item[3 : len(item)-4], true
+}
+
+func toParagraph(text string) string {
+	return "<p>" + html.EscapeString(text) + "</p>"
+}
+
+// rewrite replace the text of every paragraph by fn, the paragraphs it returns false for are dropped.
+// A paragraph with markup keeps it, the runs of text between its elements are rewritten by the function
+// runs returns for the text of the paragraph, or kept as they are if runs is nil.
+func rewrite(cd *model.ChapterData, fn func(text string) (string, bool), runs func(text string) func(run string) string) {
+	data := cd.Data[:0]
+	for _, item := range cd.Data {
+		inner, ok := paragraph(item)
+		if !ok {
+			data = append(data, item)
+			continue
+		}
+		text, ok := fn(htmlx.Text(inner))
+		if !ok {
+			continue
+		}
+		if !htmlx.HasMarkup(inner) {
+			data = append(data, toParagraph(text))
+			continue
+		}
+		if runs != nil {
+			inner = htmlx.MapText(inner, runs(htmlx.Text(inner)))
+		}
+		data = append(data, "<p>"+inner+"</p>")
+	}
+	cd.Data = data
+}
+
+var watermarks = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)bilinovel|linovelib|w{3}\.|\.(com|net|org|cc)\b`),
+	regexp.MustCompile(`嗶哩輕小說|哔哩轻小说|嗶哩嗶哩輕小說`),
+	regexp.MustCompile(`本章未完|點擊下一頁|点击下一页|請點擊|请点击`),
+	regexp.MustCompile(`內容加載失敗|内容加载失败|請重載|请重载|更換瀏覽器|更换浏览器`),
+	regexp.MustCompile(`(記住|记住)本站|手機版|手机版|最新章節|最新章节|(最新最全|最全最新)`),
+}
+
+// StripWatermarks drop the paragraphs matching the notices of the site.
+func StripWatermarks(cd *model.ChapterData) {
+	rewrite(cd, func(text string) (string, bool) {
+		for _, re := range watermarks {
+			if re.MatchString(text) {
+				return "", false
+			}
+		}
+		return text, true
+	}, nil)
+}
+
+var (
+	spaces   = regexp.MustCompile(`[\s\x{3000}\x{00a0}]+`)
+	ellipsis = regexp.MustCompile(`\.{3,}|。{3,}|・{3,}|…+`)
+)
+
+var fullWidth = map[rune]rune{
+	',': '，',
+	'!': '！',
+	'?': '？',
+	';': '；',
+	':': '：',
+}
+
+// NormalizePunct trim the full-width and other spaces around a paragraph and collapse the ones inside,
+// write the ellipses as "……" and the half-width punctuation following a Chinese character as full-width.
+func NormalizePunct(cd *model.ChapterData) {
+	rewrite(cd, func(text string) (string, bool) {
+		text = strings.TrimSpace(spaces.ReplaceAllString(text, " "))
+		if text == "" {
+			return "", false
+		}
+		text, _ = punct(text, hasHan(text), 0)
+		return text, true
+	}, func(text string) func(run string) string {
+		// the runs are parts of one text, the last character of a run decides for the first one of the next
+		han := hasHan(text)
+		var last rune
+		return func(run string) string {
+			run, last = punct(spaces.ReplaceAllString(run, " "), han, last)
+			return run
+		}
+	})
+}
+
+// punct normalise the ellipses and the half-width punctuation of the text following the character last,
+// han tells whether the text is Chinese. It returns the text and its last character.
+func punct(text string, han bool, last rune) (string, rune) {
+	text = ellipsis.ReplaceAllStringFunc(text, func(s string) string {
+		if strings.HasPrefix(s, ".") && !han {
+			// an english ellipsis
+			return s
+		}
+		return "……"
+	})
+	var sb strings.Builder
+	sb.Grow(len(text))
+	for _, r := range text {
+		if fw, ok := fullWidth[r]; ok && unicode.Is(unicode.Han, last) {
+			r = fw
+		}
+		sb.WriteRune(r)
+		last = r
+	}
+	return sb.String(), last
+}
+
+func hasHan(s string) bool {
+	for _, r := range s {
+		if unicode.Is(unicode.Han, r) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// sentenceBreaks the punctuation a sentence goes on after
+	sentenceBreaks = "，、"
+	sentenceOpen   = "「『“‘（(【《〈—"
+)
+
+// MergeParagraphs join a paragraph that does not end a sentence with the paragraph right after it,
+// unless that one opens a quote. Only Chinese text is merged, the lines of other languages are left alone.
+func MergeParagraphs(cd *model.ChapterData) {
+	data := cd.Data[:0]
+	merging := -1
+	for _, item := range cd.Data {
+		inner, ok := paragraph(item)
+		if !ok {
+			merging = -1
+			data = append(data, item)
+			continue
+		}
+		text := htmlx.Text(inner)
+		if merging >= 0 {
+			first, _ := utf8.DecodeRuneInString(text)
+			if !strings.ContainsRune(sentenceOpen, first) {
+				prev, _ := paragraph(data[merging])
+				inner = prev + inner
+				data[merging] = "<p>" + inner + "</p>"
+				if !brokenSentence(htmlx.Text(inner)) {
+					merging = -1
+				}
+				continue
+			}
+		}
+		data = append(data, item)
+		merging = -1
+		if brokenSentence(text) {
+			merging = len(data) - 1
+		}
+	}
+	cd.Data = data
+}
+
+func brokenSentence(text string) bool {
+	text = strings.TrimRightFunc(text, unicode.IsSpace)
+	last, _ := utf8.DecodeLastRuneInString(text)
+	return unicode.Is(unicode.Han, last) || strings.ContainsRune(sentenceBreaks, last)
+}
+
+// StripHeadings drop the paragraphs and the headings whose text is the chapter name,
+// the sites repeat it at the top of every page.
+func StripHeadings(cd *model.ChapterData) {
+	name := compact(cd.Name)
+	if name == "" {
+		return
+	}
+	rewrite(cd, func(text string) (string, bool) {
+		return text, compact(text) != name
+	}, nil)
+	data := cd.Data[:0]
+	for _, item := range cd.Data {
+		if _, inner, ok := htmlx.ParseHeading(item); ok && compact(htmlx.Text(inner)) == name {
+			continue
+		}
+		data = append(data, item)
+	}
+	cd.Data = data
+}
+
+// compact the text without any whitespace.
+func compact(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,165 @@
+package textx
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func chapter(name string, items ...string) *model.ChapterData {
+	cd := &model.ChapterData{Name: name}
+	for _, item := range items {
+		if strings.HasPrefix(item, "<") {
+			cd.Data = append(cd.Data, item)
+		} else {
+			cd.Data = append(cd.Data, toParagraph(item))
+		}
+	}
+	return cd
+}
+
+func check(t *testing.T, f Filter, in, want *model.ChapterData) {
+	t.Helper()
+	f(in)
+	if !slices.Equal(in.Data, want.Data) {
+		t.Fatalf("\n got: %q\nwant: %q", in.Data, want.Data)
+	}
+}
+
+func TestStripWatermarks(t *testing.T) {
+	check(t, StripWatermarks,
+		chapter("", "他走了。", "（本章未完，請點擊下一頁繼續閱讀）", "<br/>", "嗶哩輕小說 www.bilinovel.com", "她笑了。"),
+		chapter("", "他走了。", "<br/>", "她笑了。"))
+}
+
+func TestNormalizePunct(t *testing.T) {
+	check(t, NormalizePunct,
+		chapter("", "　　他说,走吧!", "  ", "等等...", "Wait...", "真的。。。  是吗?"),
+		chapter("", "他说，走吧！", "等等……", "Wait...", "真的…… 是吗？"))
+}
+
+func TestMergeParagraphs(t *testing.T) {
+	check(t, MergeParagraphs,
+		chapter("", "他站在门", "口，看着", "远方。", "「走吧。」", "她说", "「好」", `<img src="../images/a" alt="a"/>`, "English line"),
+		chapter("", "他站在门口，看着远方。", "「走吧。」", "她说", "「好」", `<img src="../images/a" alt="a"/>`, "English line"))
+}
+
+func TestStripHeadings(t *testing.T) {
+	check(t, StripHeadings,
+		chapter("第一章 开始", "<h2>第一章　开始</h2>", "第一章　开始", "正文。", "第一章 开始", "第一章开始了。", "<h2>尾声</h2>"),
+		chapter("", "正文。", "第一章开始了。", "<h2>尾声</h2>"))
+}
+
+// TestMarkup the filters rewrite the text of a paragraph around its markup.
+func TestMarkup(t *testing.T) {
+	check(t, NormalizePunct,
+		chapter("", "<p>他说,<em>走吧</em>!</p>", "<p><ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>...</p>"),
+		chapter("", "<p>他说，<em>走吧</em>！</p>", "<p><ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>……</p>"))
+	check(t, MergeParagraphs,
+		chapter("", "<p>他站在<strong>门</strong></p>", "口。"),
+		chapter("", "<p>他站在<strong>门</strong>口。</p>"))
+	check(t, StripWatermarks,
+		chapter("", "<p>嗶哩<em>輕小說</em></p>", "<p>正文<em>。</em></p>"),
+		chapter("", "<p>正文<em>。</em></p>"))
+}
+
+func TestRules(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader("# comment\n\n(\\d+)号\t${1}號\n广告.*\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, rs.Filter,
+		chapter("", "3号房间", "广告位招租", "<br/>", "a&b<c>"),
+		chapter("", "3號房间", "<br/>", "a&b<c>"))
+
+	_, err = ParseRules(strings.NewReader("ok\n(\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatal(err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	chain, err := New([]string{"watermark,heading", Merge}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd := chapter("序章", "序章", "请记住本站", "天", "亮了。")
+	got := chain.Apply(cd)
+	if !slices.Equal(got.Data, []string{"<p>天亮了。</p>"}) {
+		t.Fatal(got.Data)
+	}
+	// the record keeps its text
+	if len(cd.Data) != 4 {
+		t.Fatal(cd.Data)
+	}
+
+	_, err = New([]string{"x"}, "")
+	if !errors.Is(err, ErrUnknownFilter) {
+		t.Fatal(err)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	long := func(seed string) []string {
+		var sl []string
+		for n := 0; n < 20; n++ {
+			sl = append(sl, fmt.Sprintf("<p>第%d段，%s走过长长的街道，看见了许多从未见过的东西。</p>", n, seed))
+		}
+		return sl
+	}
+	edited := long("他")
+	edited[3] = "<p>這一段被網站改過了。</p>"
+	chapters := [][]string{
+		long("他"),
+		long("她"),
+		// the same text listed again under another name
+		long("他"),
+		edited,
+		{"<p>本章節內容正在手打中，敬請期待！</p>"},
+		{"<p>待續</p>"},
+		// an illustration page has no text but is not short
+		{`<img src="../images/a.png" alt="a.png"/>`},
+	}
+	info := &model.BookInfo{Volumes: []model.VolumeInfo{{Name: "V1"}, {Name: "V2"}}}
+	data := &model.BookData{Volumes: []*model.VolumeData{{}, {}}}
+	for n, items := range chapters {
+		v := n / 4
+		name := fmt.Sprintf("C%d", n+1)
+		info.Volumes[v].Chapters = append(info.Volumes[v].Chapters, model.ChapterInfo{Name: name})
+		cd := &model.ChapterData{Loaded: true, Name: name, Data: items}
+		if n == 6 {
+			cd.Imgs = []string{"a.png"}
+		}
+		data.Volumes[v].Chapters = append(data.Volumes[v].Chapters, cd)
+	}
+
+	var got []string
+	for _, is := range Analyze(info, data) {
+		got = append(got, is.String())
+	}
+	want := []string{
+		"volume 1 chapter 3 C3: duplicate of volume 1 chapter 1 C1",
+		"volume 1 chapter 4 C4: similar to volume 1 chapter 1 C1 (83%)",
+		"volume 2 chapter 1 C5: placeholder",
+		"volume 2 chapter 2 C6: short",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("\n got: %q\nwant: %q", got, want)
+	}
+
+	e, err := NewExclusion([]string{"duplicate,short"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	excluded := e.Excluded(info, data)
+	if len(excluded) != 2 || !excluded[[2]int{0, 2}] || !excluded[[2]int{1, 1}] {
+		t.Fatal(excluded)
+	}
+	_, err = NewExclusion([]string{"missing"})
+	if !errors.Is(err, ErrUnknownIssue) {
+		t.Fatal(err)
+	}
+}
@@ -94,6 +94,10 @@ func BindArgs(cmd *cobra.Command, a any) {
 	for i := 0; i < valueOf.NumField(); i++ {
 		field := typeOf.Field(i)
 		fieldv := valueOf.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			BindArgs(cmd, fieldv.Addr().Interface())
+			continue
+		}
 		value := field.Tag.Get(bindTag)
 		if value == "" {
 			continue
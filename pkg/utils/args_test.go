@@ -66,3 +66,25 @@ func TestBindKey(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestBindArgsEmbed(t *testing.T) {
+	cmd := &cobra.Command{
+		Use: "",
+	}
+	type EmbedStruct struct {
+		A string `Barg:"xa,a" Harg:"EmbedStruct A string"`
+	}
+	type testStruct struct {
+		EmbedStruct
+		B int `Barg:"xb,b" Harg:"testStruct B int"`
+	}
+	ts := testStruct{}
+	BindArgs(cmd, &ts)
+	err := cmd.Flags().Parse([]string{"-a", "hhhh", "-b", "666"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.A != "hhhh" || ts.B != 666 {
+		t.Fatalf("%#v", ts)
+	}
+}
@@ -18,6 +18,7 @@ type KVCache interface {
 	Del(key string) error
 	Range(fn func(key string, data []byte) error) error
 	Flush() error
+	GC() (int, error)
 }
 
 var (
@@ -25,13 +26,27 @@ var (
 	ErrFailed   = xerror.New("kv: failed %v")
 )
 
+func NewMemKVCache(bsMax int64) KVCache {
+	return &kvCache{
+		kvMap: make(map[string]*ExpiredData[[]byte]),
+		bsMax: bsMax,
+	}
+}
+
+// NewKVCache the KVCache flushed to flushFile, the file is locked for the life of the process since
+// another process flushing it would overwrite the entries of this one.
 func NewKVCache(flushFile string, bsMax int64) (KVCache, error) {
+	unlock, err := LockFile(flushFile)
+	if err != nil {
+		return nil, err
+	}
 	kv := &kvCache{
 		flushFile: flushFile,
+		unlock:    unlock,
 		kvMap:     make(map[string]*ExpiredData[[]byte]),
 		bsMax:     bsMax,
 	}
-	err := kv.init()
+	err = kv.init()
 	return kv, err
 }
 
@@ -40,6 +55,9 @@ type kvCache struct {
 	rw        sync.RWMutex
 	kvMap     map[string]*ExpiredData[[]byte]
 	bsMax     int64
+
+	// unlock release the lock of flushFile, held as long as the cache
+	unlock func()
 }
 
 func (kv *kvCache) Get(key string) ([]byte, error) {
@@ -87,6 +105,22 @@ func (kv *kvCache) Range(fn func(key string, data []byte) error) error {
 	return nil
 }
 
+func (kv *kvCache) GC() (int, error) {
+	defer kv.lock()()
+	t := time.Now()
+	count := 0
+	for k, v := range kv.kvMap {
+		if !v.TD.IsZero() && t.After(v.TD) {
+			delete(kv.kvMap, k)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return count, kv.flush(false)
+}
+
 func (kv *kvCache) init() error {
 	file, err := os.Open(kv.flushFile)
 	if err != nil {
@@ -107,6 +141,9 @@ func (kv *kvCache) flush(lock bool) error {
 	if lock {
 		defer kv.lock()()
 	}
+	if kv.flushFile == "" {
+		return kv.flushMem()
+	}
 	file, err := os.Create(kv.flushFile)
 	if err != nil {
 		return err
@@ -138,6 +175,23 @@ func (kv *kvCache) flush(lock bool) error {
 	return nil
 }
 
+func (kv *kvCache) flushMem() error {
+	if kv.bsMax <= 0 {
+		return nil
+	}
+	for len(kv.kvMap) != 0 {
+		var size int64
+		for k, v := range kv.kvMap {
+			size += int64(len(k) + len(v.Data))
+		}
+		if size <= kv.bsMax {
+			break
+		}
+		kv.clear()
+	}
+	return nil
+}
+
 func (kv *kvCache) clear() {
 	l := len(kv.kvMap)
 	newMap := make(map[string]*ExpiredData[[]byte], l)
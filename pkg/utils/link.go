@@ -125,8 +125,8 @@ func (lc *LinkCache) Clear(ids [][]string) {
 	if lc == nil {
 		return
 	}
-	lc.mux.RLock()
-	defer lc.mux.RUnlock()
+	lc.mux.Lock()
+	defer lc.mux.Unlock()
 	idm := make(map[string]bool)
 	for _, l := range ids {
 		for _, id := range l {
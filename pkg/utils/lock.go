@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrLocked = errors.New("in use by another process or job")
+
+// LockFile take the lock of the file p without waiting, held until unlock is called or the process exits.
+// The lock lives in p+".lock" and is shared by the processes of the host, so that a cli command and a running
+// web server do not write the same file at once.
+func LockFile(p string) (unlock func(), err error) {
+	f, err := os.OpenFile(p+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := tryLock(f)
+	if err != nil || !ok {
+		_ = f.Close()
+		if err == nil {
+			err = ErrLocked
+		}
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return func() {
+		// closing releases the lock
+		_ = f.Close()
+	}, nil
+}
@@ -2,14 +2,27 @@ package utils
 
 import (
 	"fmt"
+	"io"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Progress a counter of done/total items, it can have children for the finer steps (book → volume → chapter → page),
+// the transferred bytes are summed up to the root.
 type Progress struct {
 	mux     sync.RWMutex
+	name    string
 	total   int64
 	current int64
+	skipped int64
+	bytes   int64
 	err     error
+	start   time.Time
+
+	parent   *Progress
+	children []*Progress
 }
 
 func (p *Progress) Error() error {
@@ -43,6 +56,23 @@ func (p *Progress) Add(c int64) {
 	p.current += c
 }
 
+// Skip count items that were already done before, they are left out of the rate.
+func (p *Progress) Skip(c int64) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.current += c
+	p.skipped += c
+}
+
+// AddBytes count transferred bytes on the progress and all its parents.
+func (p *Progress) AddBytes(n int64) {
+	for q := p; q != nil; q = q.parent {
+		q.mux.Lock()
+		q.bytes += n
+		q.mux.Unlock()
+	}
+}
+
 func (p *Progress) Update(current int64) {
 	p.mux.Lock()
 	defer p.mux.Unlock()
@@ -62,17 +92,18 @@ func (p *Progress) Current() int64 {
 }
 
 func (p *Progress) Percent() float64 {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.percent()
+}
+
+func (p *Progress) percent() float64 {
 	if p.total < 0 {
 		return -1
 	}
 	if p.total == 0 {
 		return 0
 	}
-	if p.current >= p.total {
-		return 1
-	}
-	p.mux.RLock()
-	defer p.mux.RUnlock()
 	f := float64(p.current) / float64(p.total)
 	if f > 1 {
 		f = 1
@@ -88,15 +119,168 @@ func (p *Progress) String() string {
 	if p.err != nil {
 		return fmt.Errorf("err: %w", p.err).Error()
 	}
-	f := p.Percent()
+	f := p.percent()
 	if f < 0 {
 		return "null"
 	}
 	return fmt.Sprintf("%.2f%%", f*100)
 }
 
+// Child start a sub progress, call Done on it when the step is over.
+func (p *Progress) Child(name string, total int64) *Progress {
+	c := &Progress{name: name, total: total, start: time.Now(), parent: p}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.children = append(p.children, c)
+	return c
+}
+
+// Done detach the progress from its parent, the bytes stay counted there.
+func (p *Progress) Done() {
+	if p.parent == nil {
+		return
+	}
+	p.parent.mux.Lock()
+	defer p.parent.mux.Unlock()
+	p.parent.children = slices.DeleteFunc(p.parent.children, func(c *Progress) bool {
+		return c == p
+	})
+}
+
+func (p *Progress) Snapshot() *ProgressSnapshot {
+	p.mux.RLock()
+	s := &ProgressSnapshot{
+		Name:    p.name,
+		Current: p.current,
+		Total:   p.total,
+		Percent: p.percent(),
+		Bytes:   p.bytes,
+		Elapsed: time.Since(p.start).Seconds(),
+		ETA:     -1,
+	}
+	if p.err != nil {
+		s.Err = p.err.Error()
+	}
+	if s.Elapsed > 0 {
+		s.Rate = float64(p.current-p.skipped) / s.Elapsed
+		s.ByteRate = float64(p.bytes) / s.Elapsed
+	}
+	if s.Rate > 0 && p.total >= 0 {
+		s.ETA = float64(max(p.total-p.current, 0)) / s.Rate
+	}
+	children := slices.Clone(p.children)
+	p.mux.RUnlock()
+
+	for _, c := range children {
+		s.Children = append(s.Children, c.Snapshot())
+	}
+	return s
+}
+
 func NewProgress(total int64) *Progress {
 	return &Progress{
 		total: total,
+		start: time.Now(),
+	}
+}
+
+// ProgressSnapshot the state of a progress at one moment, Rate is items/s, ByteRate bytes/s, Elapsed and ETA are seconds (ETA -1 if unknown).
+type ProgressSnapshot struct {
+	Name     string              `json:"name,omitempty"`
+	Current  int64               `json:"current"`
+	Total    int64               `json:"total"`
+	Percent  float64             `json:"percent"`
+	Bytes    int64               `json:"bytes"`
+	Rate     float64             `json:"rate"`
+	ByteRate float64             `json:"byteRate"`
+	Elapsed  float64             `json:"elapsed"`
+	ETA      float64             `json:"eta"`
+	Err      string              `json:"err,omitempty"`
+	Children []*ProgressSnapshot `json:"children,omitempty"`
+}
+
+// String e.g. "42.00% 21/50 1.2MiB 300.0KiB/s eta 1m2s".
+func (s *ProgressSnapshot) String() string {
+	if s.Err != "" {
+		return "err: " + s.Err
+	}
+	var sb strings.Builder
+	if s.Percent < 0 {
+		sb.WriteString("null")
+	} else {
+		_, _ = fmt.Fprintf(&sb, "%.2f%% %d/%d", s.Percent*100, s.Current, s.Total)
+	}
+	if s.Bytes > 0 {
+		_, _ = fmt.Fprintf(&sb, " %s %s/s", FormatBytes(s.Bytes), FormatBytes(int64(s.ByteRate)))
+	}
+	if s.ETA >= 0 {
+		_, _ = fmt.Fprintf(&sb, " eta %s", (time.Duration(s.ETA) * time.Second).String())
+	}
+	return sb.String()
+}
+
+// Path the names of the deepest running step, e.g. "Volume 1 > Chapter 3".
+func (s *ProgressSnapshot) Path() string {
+	var names []string
+	for c := s; len(c.Children) > 0; {
+		c = c.Children[len(c.Children)-1]
+		if c.Name != "" {
+			names = append(names, c.Name)
+		}
+	}
+	return strings.Join(names, " > ")
+}
+
+// Bar render the snapshot as a single terminal line with a bar of width cells.
+func (s *ProgressSnapshot) Bar(width int) string {
+	f := max(s.Percent, 0)
+	n := int(f * float64(width))
+	bar := strings.Repeat("=", n) + strings.Repeat(" ", width-n)
+	line := fmt.Sprintf("[%s] %s", bar, s.String())
+	if p := s.Path(); p != "" {
+		line += "  " + p
+	}
+	return line
+}
+
+// RenderProgressBar redraw the bar of the progress on w every interval until the returned stop is called.
+func RenderProgressBar(w io.Writer, p *Progress, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	over := make(chan struct{})
+	draw := func() {
+		_, _ = fmt.Fprintf(w, "\r%s\x1b[K", p.Snapshot().Bar(30))
+	}
+	go func() {
+		defer close(over)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				draw()
+				_, _ = fmt.Fprintln(w)
+				return
+			case <-ticker.C:
+				draw()
+			}
+		}
+	}()
+	return sync.OnceFunc(func() {
+		close(done)
+		<-over
+	})
+}
+
+// FormatBytes e.g. 1.5KiB.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
 	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	pr := NewProgress(-1)
+	if pr.String() != "null" {
+		t.Fatal(pr.String())
+	}
+	pr.Init(4)
+	pr.Skip(2)
+	vpr := pr.Child("v1", 2)
+	cpr := vpr.Child("c1", -1)
+	cpr.AddBytes(100)
+	cpr.Update(3)
+	pr.Add(1)
+
+	s := pr.Snapshot()
+	if s.Current != 3 || s.Total != 4 || s.Bytes != 100 || pr.String() != "75.00%" {
+		t.Fatal(s, pr.String())
+	}
+	if s.Path() != "v1 > c1" || s.Children[0].Bytes != 100 {
+		t.Fatal(s.Path())
+	}
+	if s.Rate <= 0 || s.ETA < 0 {
+		t.Fatal(s.Rate, s.ETA)
+	}
+
+	cpr.Done()
+	s = pr.Snapshot()
+	if s.Path() != "v1" || s.Bytes != 100 {
+		t.Fatal(s.Path())
+	}
+}
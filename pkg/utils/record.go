@@ -1,9 +1,16 @@
 package utils
 
 import (
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/peakedshout/novelpackager/pkg/model"
 	"os"
+	"slices"
+	"time"
 )
 
 type Record struct {
@@ -17,13 +24,24 @@ func SaveRecord(p string, r *Record, lc *LinkCache) error {
 	if lc != nil {
 		r.Cache = lc.Export()
 	}
-	file, err := os.Create(p)
+	// write aside and rename, an interrupted save never leaves a torn record behind
+	tmp := p + ".tmp"
+	file, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	return gob.NewEncoder(file).Encode(r)
+	err = gob.NewEncoder(file).Encode(r)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
 }
 
 func LoadRecord(p string) (*Record, error) {
@@ -40,3 +58,193 @@ func LoadRecord(p string) (*Record, error) {
 	}
 	return r, nil
 }
+
+// MetadataPath the file of the metadata set by hand for the record at p, it is kept when the record is
+// downloaded again or removed.
+func MetadataPath(p string) string {
+	return p + ".meta.json"
+}
+
+// LoadMetadata the metadata of the record at p, nil if none was set.
+func LoadMetadata(p string) (*model.Metadata, error) {
+	bs, err := os.ReadFile(MetadataPath(p))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m := new(model.Metadata)
+	err = json.Unmarshal(bs, m)
+	if err != nil {
+		return nil, fmt.Errorf("metadata of %s: %w", p, err)
+	}
+	return m, nil
+}
+
+// SaveMetadata write the metadata of the record at p, an empty one removes the file.
+func SaveMetadata(p string, m *model.Metadata) error {
+	if m.Empty() {
+		err := os.Remove(MetadataPath(p))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	err := m.Validate()
+	if err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := MetadataPath(p) + ".tmp"
+	err = os.WriteFile(tmp, bs, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, MetadataPath(p))
+}
+
+type RecordStat struct {
+	Path           string    `json:"path"`
+	Size           int64     `json:"size"`
+	ModTime        time.Time `json:"modTime"`
+	Name           string    `json:"name"`
+	Loaded         bool      `json:"loaded"`
+	Volumes        int       `json:"volumes"`
+	Chapters       int       `json:"chapters"`
+	LoadedChapters int       `json:"loadedChapters"`
+	Images         int       `json:"images"`
+	ImageBs        int64     `json:"imageBs"`
+}
+
+func StatRecord(p string) (*RecordStat, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	r, err := LoadRecord(p)
+	if err != nil {
+		return nil, err
+	}
+	rs := &RecordStat{
+		Path:    p,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Images:  len(r.Cache),
+	}
+	if r.Info != nil {
+		rs.Name = r.Info.Name
+		rs.Volumes = len(r.Info.Volumes)
+		for _, volume := range r.Info.Volumes {
+			rs.Chapters += len(volume.Chapters)
+		}
+	}
+	if r.Data != nil {
+		rs.Loaded = r.Data.Loaded
+		for _, volume := range r.Data.Volumes {
+			for _, chapter := range volume.Chapters {
+				if chapter.Loaded && chapter.Name != "" {
+					rs.LoadedChapters++
+				}
+			}
+		}
+	}
+	for _, ec := range r.Cache {
+		rs.ImageBs += int64(len(ec.Data))
+	}
+	return rs, nil
+}
+
+// RecordResIds the resource ids still referenced by the record, grouped the way LinkCache.Clear expects.
+// The images of the checkpointed pages of a partial chapter count, a resume assembles the chapter from them.
+func RecordResIds(r *Record) [][]string {
+	var cls []string
+	if r.Info != nil {
+		cls = append(cls, r.Info.CoverId)
+		for _, volume := range r.Info.Volumes {
+			cls = append(cls, volume.CoverId)
+		}
+	}
+	rls := [][]string{cls}
+	if r.Data != nil {
+		for _, volume := range r.Data.Volumes {
+			for _, chapter := range volume.Chapters {
+				if chapter == nil {
+					continue
+				}
+				rls = append(rls, chapter.Imgs)
+				for _, pd := range chapter.Pages {
+					rls = append(rls, pd.Imgs)
+				}
+			}
+		}
+	}
+	return rls
+}
+
+// GCRecord drop cached resources which are no longer referenced by the record, return the number removed.
+// A record being downloaded is locked, ErrLocked is returned for it.
+func GCRecord(p string) (int, error) {
+	unlock, err := LockFile(p)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	r, err := LoadRecord(p)
+	if err != nil {
+		return 0, err
+	}
+	lc := NewLinkCache()
+	lc.Import(r.Cache)
+	before := len(r.Cache)
+	lc.Clear(RecordResIds(r))
+	cache := lc.Export()
+	if len(cache) == before {
+		// saved again the record would change on disk for nothing
+		return 0, nil
+	}
+	r.Cache = cache
+	err = SaveRecord(p, r, nil)
+	if err != nil {
+		return 0, err
+	}
+	return before - len(cache), nil
+}
+
+// HashRecord the sha256 of what an export of the record at p is made of: the info, the data and the
+// resources they reference. Unlike the hash of the file, it stays the same when the record is saved again
+// or its unreferenced resources are dropped.
+func HashRecord(p string) (string, error) {
+	r, err := LoadRecord(p)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	enc := gob.NewEncoder(h)
+	err = enc.Encode(r.Info)
+	if err == nil {
+		err = enc.Encode(r.Data)
+	}
+	if err != nil {
+		return "", err
+	}
+	var ids []string
+	for _, l := range RecordResIds(r) {
+		for _, id := range l {
+			if _, ok := r.Cache[id]; ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	for _, id := range ids {
+		ec := r.Cache[id]
+		dh := sha256.Sum256(ec.Data)
+		_, _ = fmt.Fprintf(h, "%s\x00%s\x00%x\x00", id, ec.Src, dh)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHashRecord(t *testing.T) {
+	p := path.Join(t.TempDir(), "test_1.np")
+	lc := NewLinkCache()
+	img, err := lc.SetX("img", "https://example.com/img.png", []byte("image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Record{
+		Info: &model.BookInfo{Name: "Book", Volumes: []model.VolumeInfo{{Name: "V1", Chapters: []model.ChapterInfo{{Name: "C1"}}}}},
+		Data: &model.BookData{Loaded: true, Volumes: []*model.VolumeData{{Name: "V1", Loaded: true,
+			Chapters: []*model.ChapterData{{Name: "C1", Loaded: true, Data: []string{"<p>text</p>"}, Imgs: []string{img}}}}}},
+	}
+	err = SaveRecord(p, r, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashRecord(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// saved again with an unreferenced image, the content exported is the same
+	for i := 0; i < 3; i++ {
+		_, err = lc.SetX(fmt.Sprintf("unused%d", i), fmt.Sprintf("https://example.com/unused%d.png", i), []byte("unused"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = SaveRecord(p, r, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := HashRecord(p); err != nil || h != hash {
+		t.Fatal("the hash changed with the unreferenced images", err)
+	}
+	n, err := GCRecord(p)
+	if err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+	if h, err := HashRecord(p); err != nil || h != hash {
+		t.Fatal("the hash changed with the gc", err)
+	}
+
+	// nothing to collect, the file is left alone
+	before, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = GCRecord(p)
+	if err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	after, err := os.ReadFile(p)
+	if err != nil || string(after) != string(before) {
+		t.Fatal("the record was saved again", err)
+	}
+
+	// the exported content changes
+	r, err = LoadRecord(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc = NewLinkCache()
+	lc.Import(r.Cache)
+	_, err = lc.SetX("img", "https://example.com/img.png", []byte("other image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SaveRecord(p, r, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := HashRecord(p); err != nil || h == hash {
+		t.Fatal("the hash did not change with a referenced image", err)
+	}
+	r.Data.Volumes[0].Chapters[0].Data = []string{"<p>other</p>"}
+	err = SaveRecord(p, r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := HashRecord(p)
+	if err != nil || h2 == hash {
+		t.Fatal("the hash did not change with the text", err)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	p := path.Join(t.TempDir(), "test_1.np")
+	err := SaveRecord(p, &Record{}, NewLinkCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := LockFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LockFile(p); !errors.Is(err, ErrLocked) {
+		t.Fatal(err)
+	}
+	if _, err = GCRecord(p); !errors.Is(err, ErrLocked) {
+		t.Fatal("a locked record is collected", err)
+	}
+	unlock()
+	if _, err = GCRecord(p); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrResp = errors.New("resp: protocol error")
+
+type RespError string
+
+func (e RespError) Error() string {
+	return "resp: " + string(e)
+}
+
+type RespConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+	// Timeout of dialing and of each command, 5s if not set
+	Timeout time.Duration
+}
+
+// NewRespKVCache the KVCache backed by a RESP (redis protocol) server, so that several instances can share it.
+func NewRespKVCache(cfg *RespConfig) (KVCache, error) {
+	kv := &respKVCache{
+		cfg: *cfg,
+	}
+	if kv.cfg.Timeout <= 0 {
+		kv.cfg.Timeout = 5 * time.Second
+	}
+	_, err := kv.do("PING")
+	if err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+type respKVCache struct {
+	cfg RespConfig
+
+	mux  sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func (kv *respKVCache) Get(key string) ([]byte, error) {
+	reply, err := kv.do("GET", kv.cfg.Prefix+key)
+	if err != nil {
+		return nil, ErrFailed.Errorf(err)
+	}
+	bs, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrNotFound.Errorf(key)
+	}
+	return bs, nil
+}
+
+func (kv *respKVCache) Set(key string, data []byte, expired ...time.Duration) error {
+	args := []any{"SET", kv.cfg.Prefix + key, data}
+	if len(expired) > 0 && expired[0] > 0 {
+		// rounded up, PX 0 is refused and would otherwise keep the key forever
+		args = append(args, "PX", int64((expired[0]+time.Millisecond-1)/time.Millisecond))
+	}
+	_, err := kv.do(args...)
+	if err != nil {
+		return ErrFailed.Errorf(err)
+	}
+	return nil
+}
+
+func (kv *respKVCache) Del(key string) error {
+	_, err := kv.do("DEL", kv.cfg.Prefix+key)
+	if err != nil {
+		return ErrFailed.Errorf(err)
+	}
+	return nil
+}
+
+func (kv *respKVCache) Range(fn func(key string, data []byte) error) error {
+	cursor := "0"
+	for {
+		reply, err := kv.do("SCAN", cursor, "MATCH", kv.cfg.Prefix+"*", "COUNT", 100)
+		if err != nil {
+			return ErrFailed.Errorf(err)
+		}
+		sl, ok := reply.([]any)
+		if !ok || len(sl) != 2 {
+			return ErrFailed.Errorf(ErrResp)
+		}
+		next, ok1 := sl[0].([]byte)
+		keys, ok2 := sl[1].([]any)
+		if !ok1 || !ok2 {
+			return ErrFailed.Errorf(ErrResp)
+		}
+		for _, k := range keys {
+			kb, ok := k.([]byte)
+			if !ok {
+				continue
+			}
+			key, _ := strings.CutPrefix(string(kb), kv.cfg.Prefix)
+			data, err := kv.Get(key)
+			if err != nil {
+				// expired between SCAN and GET
+				continue
+			}
+			err = fn(key, data)
+			if err != nil {
+				return err
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+func (kv *respKVCache) Flush() error {
+	return nil
+}
+
+// GC the server expires keys by itself.
+func (kv *respKVCache) GC() (int, error) {
+	return 0, nil
+}
+
+func (kv *respKVCache) do(args ...any) (any, error) {
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	if kv.conn == nil {
+		err := kv.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+	reply, err := kv.exec(args...)
+	if err != nil {
+		var re RespError
+		if !errors.As(err, &re) {
+			_ = kv.conn.Close()
+			kv.conn = nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (kv *respKVCache) dial() error {
+	conn, err := net.DialTimeout("tcp", kv.cfg.Addr, kv.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	kv.conn = conn
+	kv.rd = bufio.NewReader(conn)
+	if kv.cfg.Password != "" {
+		_, err = kv.exec("AUTH", kv.cfg.Password)
+		if err != nil {
+			_ = conn.Close()
+			kv.conn = nil
+			return err
+		}
+	}
+	if kv.cfg.DB != 0 {
+		_, err = kv.exec("SELECT", kv.cfg.DB)
+		if err != nil {
+			_ = conn.Close()
+			kv.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (kv *respKVCache) exec(args ...any) (any, error) {
+	err := kv.conn.SetDeadline(time.Now().Add(kv.cfg.Timeout))
+	if err != nil {
+		return nil, err
+	}
+	_, err = kv.conn.Write(RespEncode(args...))
+	if err != nil {
+		return nil, err
+	}
+	return RespRead(kv.rd)
+}
+
+// RespEncode encode args as a RESP array of bulk strings.
+func RespEncode(args ...any) []byte {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		var bs []byte
+		switch a := arg.(type) {
+		case []byte:
+			bs = a
+		case string:
+			bs = []byte(a)
+		default:
+			bs = []byte(fmt.Sprint(a))
+		}
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(bs))...)
+		buf = append(buf, bs...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+// RespRead read one RESP value; bulk strings are []byte, integers are int64, arrays are []any and nil is nil.
+func RespRead(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, ErrResp
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RespError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ErrResp
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		bs := make([]byte, n+2)
+		_, err = io.ReadFull(rd, bs)
+		if err != nil {
+			return nil, err
+		}
+		return bs[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ErrResp
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		sl := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := RespRead(rd)
+			if err != nil {
+				return nil, err
+			}
+			sl = append(sl, v)
+		}
+		return sl, nil
+	default:
+		return nil, ErrResp
+	}
+}
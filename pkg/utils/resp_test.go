@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respStandIn a tiny in-process RESP server, just enough commands for respKVCache.
+type respStandIn struct {
+	ln  net.Listener
+	mux sync.Mutex
+	m   map[string]*ExpiredData[[]byte]
+}
+
+func newRespStandIn(t *testing.T) *respStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &respStandIn{ln: ln, m: make(map[string]*ExpiredData[[]byte])}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return s
+}
+
+func (s *respStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		v, err := RespRead(rd)
+		if err != nil {
+			return
+		}
+		sl, _ := v.([]any)
+		args := make([]string, 0, len(sl))
+		for _, a := range sl {
+			bs, _ := a.([]byte)
+			args = append(args, string(bs))
+		}
+		_, err = conn.Write(s.handle(args))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *respStandIn) handle(args []string) []byte {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(args) == 0 {
+		return []byte("-ERR empty\r\n")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING", "AUTH", "SELECT":
+		return []byte("+OK\r\n")
+	case "GET":
+		v, ok := s.m[args[1]]
+		if !ok || (!v.TD.IsZero() && time.Now().After(v.TD)) {
+			return []byte("$-1\r\n")
+		}
+		return append([]byte("$"+strconv.Itoa(len(v.Data))+"\r\n"), append(v.Data, "\r\n"...)...)
+	case "SET":
+		ed := &ExpiredData[[]byte]{Key: args[1], Data: []byte(args[2])}
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			if ms <= 0 {
+				return []byte("-ERR invalid expire time in 'set' command\r\n")
+			}
+			ed.TD = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.m[args[1]] = ed
+		return []byte("+OK\r\n")
+	case "DEL":
+		delete(s.m, args[1])
+		return []byte(":1\r\n")
+	case "SCAN":
+		var keys []any
+		for k := range s.m {
+			if strings.HasPrefix(k, strings.TrimSuffix(args[3], "*")) {
+				keys = append(keys, k)
+			}
+		}
+		return append([]byte("*2\r\n$1\r\n0\r\n"), RespEncode(keys...)...)
+	default:
+		return []byte("-ERR unknown command\r\n")
+	}
+}
+
+func testKVCache(t *testing.T, kv KVCache) {
+	err := kv.Set("a/b", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := kv.Get("a/b")
+	if err != nil || string(bs) != "hello" {
+		t.Fatal(string(bs), err)
+	}
+	err = kv.Set("a/c", []byte("bye"), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	_, err = kv.Get("a/c")
+	if err == nil {
+		t.Fatal("expect expired")
+	}
+	count := 0
+	err = kv.Range(func(key string, data []byte) error {
+		count++
+		if key != "a/b" {
+			return errors.New("unexpected key " + key)
+		}
+		return nil
+	})
+	if err != nil || count != 1 {
+		t.Fatal(count, err)
+	}
+	err = kv.Del("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kv.Get("a/b")
+	if err == nil {
+		t.Fatal("expect not found")
+	}
+}
+
+func TestMemKVCache(t *testing.T) {
+	testKVCache(t, NewMemKVCache(0))
+}
+
+func TestKVCacheLock(t *testing.T) {
+	p := path.Join(t.TempDir(), ".web.KVCache")
+	kv, err := NewKVCache(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKVCache(t, kv)
+	// another process, or a cli command, would flush over the entries
+	_, err = NewKVCache(p, 0)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatal(err)
+	}
+}
+
+func TestRespKVCache(t *testing.T) {
+	s := newRespStandIn(t)
+	kv, err := NewRespKVCache(&RespConfig{Addr: s.ln.Addr().String(), Password: "p", DB: 1, Prefix: "np:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKVCache(t, kv)
+
+	// less than a millisecond still expires
+	err = kv.Set("a/d", []byte("soon"), 100*time.Microsecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	_, err = kv.Get("a/d")
+	if err == nil {
+		t.Fatal("expect expired")
+	}
+}
+
+func TestRespTimeout(t *testing.T) {
+	// a server that accepts and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		<-done
+		_ = conn.Close()
+	}()
+	start := time.Now()
+	_, err = NewRespKVCache(&RespConfig{Addr: ln.Addr().String(), Timeout: 50 * time.Millisecond})
+	if err == nil || time.Since(start) > time.Second {
+		t.Fatal(time.Since(start), err)
+	}
+}
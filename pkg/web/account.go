@@ -0,0 +1,304 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type LoginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type LoginResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type PasswordRequest struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+type KeyRequest struct {
+	Name string `json:"name"`
+}
+
+type KeyResponse struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type UserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     Role   `json:"role"`
+	Quota    *Quota `json:"quota,omitempty"`
+}
+
+func decodeBody(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return badRequest(fmt.Errorf("invalid body: %w", err))
+	}
+	return nil
+}
+
+func (sr *server) userRoutes() []*apiRoute {
+	return []*apiRoute{
+		{
+			Method: http.MethodPost, Pattern: "/login", Id: "login", Tag: "account",
+			Summary: "open a session, the token is also set as a cookie", Body: LoginRequest{}, Resp: LoginResponse{},
+			Public: true,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				var req LoginRequest
+				err := decodeBody(r, &req)
+				if err != nil {
+					return nil, err
+				}
+				token, expires, err := sr.um.Login(req.Name, req.Password)
+				if err != nil {
+					return nil, err
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name: tokenCookie, Value: token, Path: "/", Expires: expires,
+					HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: r.TLS != nil,
+				})
+				return LoginResponse{Token: token, Expires: expires}, nil
+			},
+		},
+		{
+			Method: http.MethodPost, Pattern: "/logout", Id: "logout", Tag: "account",
+			Summary: "close the current session", Status: http.StatusNoContent,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				http.SetCookie(w, &http.Cookie{Name: tokenCookie, Path: "/", MaxAge: -1})
+				token := requestToken(r)
+				if token == "" {
+					return nil, nil
+				}
+				return nil, sr.um.Logout(token)
+			},
+		},
+		{
+			Method: http.MethodGet, Pattern: "/me", Id: "getMe", Tag: "account",
+			Summary: "the calling user with its followed books and download history", Resp: User{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				u := userFrom(r)
+				if u.Name == "" {
+					return u, nil
+				}
+				return sr.um.Get(u.Name)
+			},
+		},
+		{
+			Method: http.MethodPut, Pattern: "/me/password", Id: "changePassword", Tag: "account",
+			Summary: "change the password of the calling user", Body: PasswordRequest{}, Status: http.StatusNoContent,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				var req PasswordRequest
+				err := decodeBody(r, &req)
+				if err != nil {
+					return nil, err
+				}
+				u, err := sr.um.Get(userFrom(r).Name)
+				if err != nil {
+					return nil, err
+				}
+				if !u.Password.match(req.Old) {
+					return nil, ErrForbidden
+				}
+				err = checkPassword(req.New)
+				if err != nil {
+					return nil, badRequest(err)
+				}
+				return nil, sr.um.SetPassword(u.Name, req.New)
+			},
+		},
+		{
+			Method: http.MethodPost, Pattern: "/me/keys", Id: "createKey", Tag: "account",
+			Summary: "create an api key, it is only shown once", Body: KeyRequest{}, Resp: KeyResponse{},
+			Status: http.StatusCreated,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				var req KeyRequest
+				err := decodeBody(r, &req)
+				if err != nil {
+					return nil, err
+				}
+				if req.Name == "" {
+					return nil, badRequest(errors.New("name is required"))
+				}
+				key, err := sr.um.AddKey(userFrom(r).Name, req.Name)
+				if err != nil {
+					return nil, err
+				}
+				return KeyResponse{Name: req.Name, Key: key}, nil
+			},
+		},
+		{
+			Method: http.MethodDelete, Pattern: "/me/keys/{name}", Id: "deleteKey", Tag: "account",
+			Summary: "revoke an api key", Status: http.StatusNoContent,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return nil, sr.um.RemoveKey(userFrom(r).Name, r.PathValue("name"))
+			},
+		},
+		{
+			Method: http.MethodGet, Pattern: "/me/follows", Id: "listFollows", Tag: "account",
+			Summary: "the books followed by the calling user", Resp: []BookRef{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				u, err := sr.um.Get(userFrom(r).Name)
+				if err != nil {
+					return nil, err
+				}
+				return u.Follows, nil
+			},
+		},
+		{
+			Method: http.MethodPut, Pattern: "/me/follows/{source}/{id}", Id: "follow", Tag: "account",
+			Summary: "follow a book", Status: http.StatusNoContent,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				s, err := getSource(r.PathValue("source"))
+				if err != nil {
+					return nil, err
+				}
+				ref := BookRef{Source: s.Name(), Id: r.PathValue("id")}
+				if info, err := s.GetInfo(r.Context(), ref.Id, false); err == nil {
+					ref.Name = info.Name
+				}
+				return nil, sr.um.Follow(userFrom(r).Name, ref)
+			},
+		},
+		{
+			Method: http.MethodDelete, Pattern: "/me/follows/{source}/{id}", Id: "unfollow", Tag: "account",
+			Summary: "unfollow a book", Status: http.StatusNoContent,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return nil, sr.um.Unfollow(userFrom(r).Name, r.PathValue("source"), r.PathValue("id"))
+			},
+		},
+		{
+			Method: http.MethodGet, Pattern: "/me/history", Id: "listHistory", Tag: "account",
+			Summary: "the download history of the calling user", Resp: []DownloadEntry{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				u, err := sr.um.Get(userFrom(r).Name)
+				if err != nil {
+					return nil, err
+				}
+				return u.History, nil
+			},
+		},
+		{
+			Method: http.MethodGet, Pattern: "/me/reading", Id: "listReading", Tag: "account",
+			Summary: "where the calling user stopped reading, the latest read book first", Resp: []ReadPosition{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				u, err := sr.um.Get(userFrom(r).Name)
+				if err != nil {
+					return nil, err
+				}
+				return u.Reading, nil
+			},
+		},
+		{
+			Method: http.MethodPut, Pattern: "/me/reading/{source}/{id}", Id: "saveReading", Tag: "account",
+			Summary: "save the reading position of a book, used by the web reader", Body: ReadPosition{},
+			Status: http.StatusNoContent,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				var pos ReadPosition
+				err := decodeBody(r, &pos)
+				if err != nil {
+					return nil, err
+				}
+				if pos.Vol <= 0 || pos.Chapter <= 0 {
+					return nil, badRequest(errors.New("vol and chapter count from 1"))
+				}
+				pos.Source, pos.Id = r.PathValue("source"), r.PathValue("id")
+				return nil, sr.um.SetPosition(userFrom(r).Name, pos)
+			},
+		},
+		{
+			Method: http.MethodGet, Pattern: "/users", Id: "listUsers", Tag: "users",
+			Summary: "list the accounts", Resp: []User{}, Admin: true,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return sr.um.List(), nil
+			},
+		},
+		{
+			Method: http.MethodPost, Pattern: "/users", Id: "createUser", Tag: "users",
+			Summary: "create an account", Body: UserRequest{}, Resp: User{}, Status: http.StatusCreated, Admin: true,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				var req UserRequest
+				err := decodeBody(r, &req)
+				if err != nil {
+					return nil, err
+				}
+				err = checkPassword(req.Password)
+				if err != nil {
+					return nil, badRequest(err)
+				}
+				if req.Role == "" {
+					req.Role = RoleReader
+				}
+				u, err := sr.um.Add(req.Name, req.Password, req.Role)
+				if err != nil {
+					if errors.Is(err, ErrUserExists) {
+						return nil, err
+					}
+					return nil, badRequest(err)
+				}
+				if req.Quota != nil {
+					err = sr.um.SetQuota(u.Name, *req.Quota)
+					if err != nil {
+						return nil, err
+					}
+				}
+				return sr.um.Get(u.Name)
+			},
+		},
+		{
+			Method: http.MethodPatch, Pattern: "/users/{name}", Id: "updateUser", Tag: "users",
+			Summary: "change the password, role or quota of an account, empty fields are kept",
+			Body:    UserRequest{}, Resp: User{}, Admin: true,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				var req UserRequest
+				err := decodeBody(r, &req)
+				if err != nil {
+					return nil, err
+				}
+				name := r.PathValue("name")
+				if req.Password != "" {
+					err = checkPassword(req.Password)
+					if err != nil {
+						return nil, badRequest(err)
+					}
+					err = sr.um.SetPassword(name, req.Password)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if req.Role != "" {
+					if !req.Role.valid() {
+						return nil, badRequest(fmt.Errorf("invalid role: %q", req.Role))
+					}
+					err = sr.um.SetRole(name, req.Role)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if req.Quota != nil {
+					err = sr.um.SetQuota(name, *req.Quota)
+					if err != nil {
+						return nil, err
+					}
+				}
+				return sr.um.Get(name)
+			},
+		},
+		{
+			Method: http.MethodDelete, Pattern: "/users/{name}", Id: "deleteUser", Tag: "users",
+			Summary: "remove an account", Status: http.StatusNoContent, Admin: true,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return nil, sr.um.Remove(r.PathValue("name"))
+			},
+		},
+	}
+}
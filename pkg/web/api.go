@@ -0,0 +1,489 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/imagex"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/textx"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"github.com/peakedshout/novelpackager/pkg/zhconv"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+)
+
+const apiV1 = "/api/v1"
+
+var ErrNotCached = errors.New("book is not cached")
+
+// APIError the body of every failed /api/v1 response.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+func badRequest(err error) error {
+	return &apiError{status: http.StatusBadRequest, code: "bad_request", err: err}
+}
+
+func toAPIError(err error) (int, APIError) {
+	var ae *apiError
+	switch {
+	case errors.As(err, &ae):
+		return ae.status, APIError{Code: ae.code, Message: ae.Error()}
+	case errors.Is(err, ErrUnknownFormat), errors.Is(err, model.ErrSelection), errors.Is(err, zhconv.ErrUnknownConversion),
+		errors.Is(err, textx.ErrUnknownFilter), errors.Is(err, imagex.ErrImageSpec), errors.Is(err, model.ErrExportOptions),
+		errors.Is(err, textx.ErrUnknownIssue), errors.Is(err, model.ErrMetadata):
+		return http.StatusBadRequest, APIError{Code: "bad_request", Message: err.Error()}
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized, APIError{Code: "unauthorized", Message: err.Error()}
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden, APIError{Code: "forbidden", Message: err.Error()}
+	case errors.Is(err, ErrQuota):
+		return http.StatusTooManyRequests, APIError{Code: "quota_exceeded", Message: err.Error()}
+	case errors.Is(err, ErrUnknownSource), errors.Is(err, ErrJobNotFound), errors.Is(err, ErrUserNotFound),
+		errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound, APIError{Code: "not_found", Message: err.Error()}
+	case errors.Is(err, ErrJobExists), errors.Is(err, ErrJobState), errors.Is(err, ErrUserExists),
+		errors.Is(err, ErrNoAccounts), errors.Is(err, ErrLastAdmin), errors.Is(err, utils.ErrLocked):
+		return http.StatusConflict, APIError{Code: "conflict", Message: err.Error()}
+	case errors.Is(err, ErrNotCached):
+		return http.StatusConflict, APIError{Code: "not_cached", Message: err.Error()}
+	default:
+		return http.StatusInternalServerError, APIError{Code: "internal", Message: err.Error()}
+	}
+}
+
+type apiQuery struct {
+	Name string
+	Type string
+	Desc string
+}
+
+// apiRoute one entry of the /api/v1 route table, which drives both the routing and the OpenAPI document.
+type apiRoute struct {
+	Method  string
+	Pattern string
+	Id      string
+	Tag     string
+	Summary string
+	Query   []apiQuery
+
+	// Body and Resp are samples of the request and response types, for the document.
+	Body any
+	Resp any
+	// ContentTypes the media types of non json responses, the handler writes them by itself.
+	ContentTypes []string
+	Status       int
+
+	// Public routes skip authentication, Admin routes need the admin role.
+	Public bool
+	Admin  bool
+
+	Handle func(w http.ResponseWriter, r *http.Request) (any, error)
+}
+
+func (route *apiRoute) status() int {
+	if route.Status != 0 {
+		return route.Status
+	}
+	return http.StatusOK
+}
+
+type JobRequest struct {
+	Source   string `json:"source"`
+	BookId   string `json:"bookId"`
+	Priority int    `json:"priority"`
+}
+
+func (sr *server) apiRoutes() []*apiRoute {
+	cacheQuery := []apiQuery{
+		{Name: "source", Type: "string", Desc: "only the given source"},
+		{Name: "type", Type: "string", Desc: "only the given type (Record, BookInfo, SearchResult ...)"},
+		{Name: "id", Type: "string", Desc: "only the given book id or search key"},
+	}
+	jobAction := func(action string, fn func(id string) error) *apiRoute {
+		return &apiRoute{
+			Method: http.MethodPost, Pattern: "/jobs/{job}/" + action, Id: action + "Job", Tag: "jobs",
+			Summary: action + " the job", Resp: Job{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				id := r.PathValue("job")
+				err := sr.manageJob(userFrom(r), id, fn)
+				if err != nil {
+					return nil, err
+				}
+				return sr.jm.Get(id)
+			},
+		}
+	}
+	return append([]*apiRoute{
+		{
+			Method: http.MethodGet, Pattern: "/sources", Id: "listSources", Tag: "sources",
+			Summary: "list the sources", Resp: []string{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return sourceNames(), nil
+			},
+		},
+		{
+			Method: http.MethodGet, Pattern: "/sources/{source}/search", Id: "search", Tag: "sources",
+			Summary: "search books by name",
+			Query: []apiQuery{
+				{Name: "name", Type: "string", Desc: "search key"},
+				{Name: "full", Type: "boolean", Desc: "list all results"},
+			},
+			Resp:   []model.SearchResult{},
+			Handle: sr.apiSearch,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/books/{source}/{id}", Id: "getBook", Tag: "books",
+			Summary: "get the book info",
+			Query:   []apiQuery{{Name: "full", Type: "boolean", Desc: "with the chapters of every volume"}},
+			Resp:    model.BookInfo{},
+			Handle:  sr.apiGetBook,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/books/{source}/{id}/volumes", Id: "listCachedVolumes", Tag: "books",
+			Summary: "list the volumes that can be exported from the cache", Resp: []string{},
+			Handle: sr.apiVolumes,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/books/{source}/{id}/issues", Id: "listIssues", Tag: "books",
+			Summary: "list the cached chapters that look duplicated, placeholders or too short", Resp: []textx.Issue{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return sr.bookIssues(r.PathValue("source"), r.PathValue("id"))
+			},
+		},
+		{
+			Method: http.MethodGet, Pattern: "/books/{source}/{id}/meta", Id: "getMeta", Tag: "books",
+			Summary: "get the metadata set by hand for the cached book, applied to every export", Resp: model.Metadata{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return loadMetadata(sr.cm.dir, r.PathValue("source"), r.PathValue("id"))
+			},
+		},
+		{
+			Method: http.MethodPut, Pattern: "/books/{source}/{id}/meta", Id: "setMeta", Tag: "books",
+			Summary: "replace the metadata of the cached book, an empty one removes it", Body: model.Metadata{}, Resp: model.Metadata{},
+			Admin: true,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				m := new(model.Metadata)
+				err := decodeBody(r, m)
+				if err != nil {
+					return nil, err
+				}
+				err = saveMetadata(sr.cm.dir, r.PathValue("source"), r.PathValue("id"), m)
+				if err != nil {
+					return nil, err
+				}
+				return m, nil
+			},
+		},
+		{
+			Method: http.MethodGet, Pattern: "/exports/{source}/{id}", Id: "exportBook", Tag: "exports",
+			Summary: "export the cached book as epub, cbz or txt",
+			Query: []apiQuery{
+				{Name: "vols", Type: "string", Desc: "volumes and chapters from 1, e.g. 1-3,5:2-10,7:*, all if empty"},
+				{Name: "convert", Type: "string", Desc: "convert between Traditional and Simplified Chinese, t2s or s2t"},
+				{Name: "filter", Type: "string", Desc: "text filters applied in order, comma separated or repeated: watermark, heading, punct, merge"},
+				{Name: "image", Type: "string", Desc: "image processing, a device preset (kindle, kobo, eink, tablet, compat) and/or settings, e.g. kindle,q=60"},
+				{Name: "format", Type: "string", Desc: "the package format, epub (default), cbz which holds the images only or txt which holds the text only"},
+				{Name: "content", Type: "string", Desc: "what is packaged, all if empty, text without the images or images for a gallery of the illustrations"},
+				{Name: "exclude", Type: "string", Desc: "leave out the flagged chapters, comma separated or repeated: duplicate, similar, placeholder, short"},
+			},
+			ContentTypes: []string{formatTypes[FormatEpub], formatTypes[FormatCBZ], formatTypes[FormatTXT]},
+			Handle:       sr.apiExport,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/jobs", Id: "listJobs", Tag: "jobs",
+			Summary: "list the caching jobs",
+			Query: []apiQuery{
+				{Name: "source", Type: "string", Desc: "only the given source"},
+				{Name: "state", Type: "string", Desc: "only the given state"},
+			},
+			Resp: []Job{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return sr.listJobs(r.URL.Query()), nil
+			},
+		},
+		{
+			Method: http.MethodPost, Pattern: "/jobs", Id: "createJob", Tag: "jobs",
+			Summary: "queue a caching job for a book", Body: JobRequest{}, Resp: Job{}, Status: http.StatusCreated,
+			Handle: sr.apiCreateJob,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/jobs/{job}", Id: "getJob", Tag: "jobs",
+			Summary: "get the job with its log", Resp: Job{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return sr.jm.Get(r.PathValue("job"))
+			},
+		},
+		{
+			Method: http.MethodDelete, Pattern: "/jobs/{job}", Id: "deleteJob", Tag: "jobs",
+			Summary: "cancel the job", Resp: Job{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				id := r.PathValue("job")
+				err := sr.manageJob(userFrom(r), id, sr.jm.Cancel)
+				if err != nil {
+					return nil, err
+				}
+				return sr.jm.Get(id)
+			},
+		},
+		jobAction("pause", sr.jm.Pause),
+		jobAction("resume", sr.jm.Resume),
+		jobAction("retry", sr.jm.Retry),
+		{
+			Method: http.MethodGet, Pattern: "/events", Id: "streamEvents", Tag: "jobs",
+			Summary: "stream the job events (server-sent events)",
+			Query: []apiQuery{
+				{Name: "source", Type: "string", Desc: "only the given source"},
+				{Name: "id", Type: "string", Desc: "only the given book id"},
+				{Name: "job", Type: "string", Desc: "only the given job"},
+				{Name: "lastEventId", Type: "integer", Desc: "replay the events after this seq"},
+			},
+			ContentTypes: []string{"text/event-stream"},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				// the stream has started, a broken connection is not an api error
+				_ = sr.streamEvents(w, r)
+				return nil, nil
+			},
+		},
+		{
+			Method: http.MethodGet, Pattern: "/cache", Id: "listCache", Tag: "cache",
+			Summary: "list cached records and kv entries", Query: cacheQuery, Resp: CacheList{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return sr.cm.List(cacheFilter(r.URL.Query()))
+			},
+		},
+		{
+			Method: http.MethodDelete, Pattern: "/cache", Id: "purgeCache", Tag: "cache",
+			Summary: "remove the cached records and kv entries matched by the filter", Query: cacheQuery, Resp: 0,
+			Admin: true,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				filter := cacheFilter(r.URL.Query())
+				if filter.Empty() {
+					return nil, badRequest(errors.New("purge everything is only allowed from the cli"))
+				}
+				return sr.cm.Purge(filter)
+			},
+		},
+		{
+			Method: http.MethodGet, Pattern: "/cache/stat", Id: "statCache", Tag: "cache",
+			Summary: "summarize the cache usage", Resp: CacheStat{},
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return sr.cm.Stat()
+			},
+		},
+		{
+			Method: http.MethodPost, Pattern: "/cache/gc", Id: "gcCache", Tag: "cache",
+			Summary: "drop expired kv entries and unreferenced record images", Resp: CacheGC{},
+			Admin: true,
+			Handle: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return sr.cm.GC()
+			},
+		},
+	}, sr.userRoutes()...)
+}
+
+// apiHandler route /api/v1 by the route table, the OpenAPI document is served at /api/v1/openapi.json.
+func (sr *server) apiHandler() http.Handler {
+	routes := sr.apiRoutes()
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		mux.HandleFunc(route.Method+" "+apiV1+route.Pattern, func(w http.ResponseWriter, r *http.Request) {
+			if !route.Public {
+				u, err := sr.authenticate(r)
+				if err != nil {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="novelpackager"`)
+					writeAPIError(w, err)
+					return
+				}
+				if route.Admin && !u.IsAdmin() {
+					writeAPIError(w, ErrForbidden)
+					return
+				}
+				r = withUser(r, u)
+			}
+			v, err := route.Handle(w, r)
+			if err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			switch {
+			case len(route.ContentTypes) != 0:
+			case route.status() == http.StatusNoContent:
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				writeJSON(w, route.status(), v)
+			}
+		})
+	}
+	doc := openAPI(apiV1, routes)
+	// the document is public so that clients can be generated before having an account
+	mux.HandleFunc(http.MethodGet+" "+apiV1+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, doc)
+	})
+	// the same patterns without methods, to tell 405 from 404
+	paths := http.NewServeMux()
+	seen := make(map[string]bool)
+	for _, route := range routes {
+		if !seen[route.Pattern] {
+			seen[route.Pattern] = true
+			paths.HandleFunc(apiV1+route.Pattern, func(w http.ResponseWriter, r *http.Request) {})
+		}
+	}
+	mux.HandleFunc(apiV1+"/", func(w http.ResponseWriter, r *http.Request) {
+		if _, p := paths.Handler(r); p != "" {
+			writeJSON(w, http.StatusMethodNotAllowed, APIError{Code: "method_not_allowed", Message: r.Method + " " + r.URL.Path + " not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusNotFound, APIError{Code: "not_found", Message: r.Method + " " + r.URL.Path + " not found"})
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeTextError the api error as plain text, for the pages and feeds that are not json.
+func writeTextError(w http.ResponseWriter, err error) {
+	status, ae := toAPIError(err)
+	http.Error(w, ae.Message, status)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status, ae := toAPIError(err)
+	writeJSON(w, status, ae)
+}
+
+func queryBool(q url.Values, key string) (bool, error) {
+	s := q.Get(key)
+	if s == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, badRequest(fmt.Errorf("invalid %s: %w", key, err))
+	}
+	return b, nil
+}
+
+func (sr *server) apiSearch(w http.ResponseWriter, r *http.Request) (any, error) {
+	s, err := getSource(r.PathValue("source"))
+	if err != nil {
+		return nil, err
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return nil, badRequest(errors.New("name is required"))
+	}
+	full, err := queryBool(r.URL.Query(), "full")
+	if err != nil {
+		return nil, err
+	}
+	return s.Search(r.Context(), name, full, false)
+}
+
+func (sr *server) apiGetBook(w http.ResponseWriter, r *http.Request) (any, error) {
+	s, err := getSource(r.PathValue("source"))
+	if err != nil {
+		return nil, err
+	}
+	full, err := queryBool(r.URL.Query(), "full")
+	if err != nil {
+		return nil, err
+	}
+	return s.GetInfo(r.Context(), r.PathValue("id"), full)
+}
+
+func (sr *server) apiVolumes(w http.ResponseWriter, r *http.Request) (any, error) {
+	s, err := getSource(r.PathValue("source"))
+	if err != nil {
+		return nil, err
+	}
+	return s.EnableDownload(r.Context(), r.PathValue("id"))
+}
+
+func (sr *server) apiExport(w http.ResponseWriter, r *http.Request) (any, error) {
+	s, err := getSource(r.PathValue("source"))
+	if err != nil {
+		return nil, err
+	}
+	sel, err := parseSelect(r.URL.Query().Get("vols"))
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	format, err := parseFormat(r.URL.Query())
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	opts, err := parseOptions(r.URL.Query())
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	return nil, sr.serveArtifact(w, r, ArtifactKey{Source: s.Name(), Id: r.PathValue("id"), Select: sel, Format: format, Options: opts})
+}
+
+func (sr *server) apiCreateJob(w http.ResponseWriter, r *http.Request) (any, error) {
+	var req JobRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return nil, badRequest(fmt.Errorf("invalid body: %w", err))
+	}
+	if req.BookId == "" {
+		return nil, badRequest(errors.New("bookId is required"))
+	}
+	_, err = getSource(req.Source)
+	if err != nil {
+		return nil, err
+	}
+	u := userFrom(r)
+	return sr.jm.Submit(req, u.Name, u.Quota.MaxJobs)
+}
+
+func (sr *server) listJobs(q url.Values) []*Job {
+	list := sr.jm.List(q.Get("source"))
+	if state := JobState(q.Get("state")); state != "" {
+		list = slices.DeleteFunc(list, func(job *Job) bool {
+			return job.State != state
+		})
+	}
+	return list
+}
+
+func cacheFilter(q url.Values) CacheFilter {
+	return CacheFilter{
+		Source: q.Get("source"),
+		Type:   q.Get("type"),
+		Id:     q.Get("id"),
+	}
+}
+
+func sourceNames() []string {
+	sl := make([]string, 0, len(sourceMap))
+	for k := range sourceMap {
+		sl = append(sl, k)
+	}
+	slices.Sort(sl)
+	return sl
+}
@@ -0,0 +1,510 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ArtifactType = "Artifact"
+	FormatEpub   = model.FormatEpub
+	FormatCBZ    = model.FormatCBZ
+	FormatTXT    = model.FormatTXT
+
+	artifactDir   = ".web.Artifacts"
+	artifactQueue = 64
+)
+
+const (
+	PrebuildNone    = "none"
+	PrebuildBook    = "book"
+	PrebuildVolumes = "volumes"
+)
+
+var ErrUnknownFormat = errors.New("unknown format")
+
+var formatTypes = map[string]string{
+	FormatEpub: "application/epub+zip",
+	FormatCBZ:  "application/vnd.comicbook+zip",
+	FormatTXT:  "text/plain; charset=utf-8",
+}
+
+// ArtifactKey what an export is built from besides the record, Options holds the encoded model.ExportOptions.
+type ArtifactKey struct {
+	Source  string `json:"source"`
+	Id      string `json:"id"`
+	Select  string `json:"select,omitempty"`
+	Format  string `json:"format"`
+	Options string `json:"options,omitempty"`
+}
+
+// encodeOptions the options as a query string, the fields left empty are omitted so the default options encode to "".
+func encodeOptions(opts model.ExportOptions) string {
+	v := url.Values{}
+	if opts.Convert != "" {
+		v.Set("convert", opts.Convert)
+	}
+	for _, f := range opts.Filters {
+		v.Add("filter", f)
+	}
+	if opts.Image != "" {
+		v.Set("image", opts.Image)
+	}
+	if opts.Content != "" {
+		v.Set("content", opts.Content)
+	}
+	for _, e := range opts.Exclude {
+		v.Add("exclude", e)
+	}
+	return v.Encode()
+}
+
+func decodeOptions(s string) (model.ExportOptions, error) {
+	v, err := url.ParseQuery(s)
+	if err != nil {
+		return model.ExportOptions{}, err
+	}
+	return model.ExportOptions{Convert: v.Get("convert"), Filters: v["filter"], Image: v.Get("image"), Content: v.Get("content"), Exclude: v["exclude"]}, nil
+}
+
+func (k ArtifactKey) name() string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s", k.Source, k.Id, k.Select, k.Format, k.Options)))
+	return hex.EncodeToString(h[:8])
+}
+
+// Artifact a stored export, it is current while RecordHash matches the record on disk.
+type Artifact struct {
+	ArtifactKey
+	Name       string    `json:"name"`
+	RecordHash string    `json:"recordHash"`
+	Size       int64     `json:"size"`
+	Built      time.Time `json:"built"`
+}
+
+func (a *Artifact) file() string {
+	return a.ArtifactKey.name() + "_" + a.RecordHash[:16]
+}
+
+type recordHash struct {
+	modTime time.Time
+	size    int64
+	// metaTime and metaSize of the metadata file, zero without one
+	metaTime time.Time
+	metaSize int64
+	hash     string
+}
+
+// ArtifactStore the exports built from the records. They are built on the first download or in the background
+// once a book is cached, and replaced as soon as the record they were built from changes.
+type ArtifactStore struct {
+	cacheDir string
+	dir      string
+
+	mux     sync.Mutex
+	hashes  map[string]recordHash
+	pending map[string]bool
+	queue   chan prebuildTask
+}
+
+type prebuildTask struct {
+	key  ArtifactKey
+	logf func(format string, a ...any)
+}
+
+func newArtifactStore(cacheDir string) *ArtifactStore {
+	return &ArtifactStore{
+		cacheDir: cacheDir,
+		dir:      path.Join(cacheDir, artifactDir),
+		hashes:   make(map[string]recordHash),
+		pending:  make(map[string]bool),
+		queue:    make(chan prebuildTask, artifactQueue),
+	}
+}
+
+// recordHash the sha256 of the record content and of the metadata set for it, only recomputed when a file changes.
+func (as *ArtifactStore) recordHash(source, id string) (string, error) {
+	rp, err := recordPath(as.cacheDir, source, id)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(rp)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s %s", ErrNotCached, source, id)
+	}
+	cur := recordHash{modTime: fi.ModTime(), size: fi.Size()}
+	if mi, err := os.Stat(utils.MetadataPath(rp)); err == nil {
+		cur.metaTime, cur.metaSize = mi.ModTime(), mi.Size()
+	}
+	as.mux.Lock()
+	rh, ok := as.hashes[rp]
+	as.mux.Unlock()
+	if ok && rh.modTime.Equal(cur.modTime) && rh.size == cur.size && rh.metaTime.Equal(cur.metaTime) && rh.metaSize == cur.metaSize {
+		return rh.hash, nil
+	}
+	cur.hash, err = utils.HashRecord(rp)
+	if err != nil {
+		return "", err
+	}
+	if !cur.metaTime.IsZero() {
+		// the artifacts packaged with the old metadata are stale
+		mh, err := utils.FileHashSha256(utils.MetadataPath(rp))
+		if err != nil {
+			return "", err
+		}
+		cur.hash = utils.BytesHashSha256([]byte(cur.hash + mh))
+	}
+	as.mux.Lock()
+	as.hashes[rp] = cur
+	as.mux.Unlock()
+	return cur.hash, nil
+}
+
+// Get the current artifact of the key, nil if it was never built or the record changed since.
+func (as *ArtifactStore) Get(key ArtifactKey) (*Artifact, error) {
+	hash, err := as.recordHash(key.Source, key.Id)
+	if err != nil {
+		return nil, err
+	}
+	a := &Artifact{ArtifactKey: key, RecordHash: hash}
+	bs, err := os.ReadFile(path.Join(as.dir, a.file()+".json"))
+	if err != nil {
+		return nil, nil
+	}
+	err = json.Unmarshal(bs, a)
+	if err != nil {
+		return nil, nil
+	}
+	return a, nil
+}
+
+func (as *ArtifactStore) Open(a *Artifact) (*os.File, error) {
+	return os.Open(path.Join(as.dir, a.file()+"."+a.Format))
+}
+
+// Build export the key into the store, tee (if not nil) receives the same bytes while they are written.
+func (as *ArtifactStore) Build(ctx context.Context, key ArtifactKey, tee func(name string) (io.Writer, error)) (*Artifact, error) {
+	if _, ok := formatTypes[key.Format]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, key.Format)
+	}
+	s, err := getSource(key.Source)
+	if err != nil {
+		return nil, err
+	}
+	sel, err := model.ParseSelection(key.Select)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := decodeOptions(key.Options)
+	if err != nil {
+		return nil, err
+	}
+	opts.Format = key.Format
+	hash, err := as.recordHash(key.Source, key.Id)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(as.dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	a := &Artifact{ArtifactKey: key, RecordHash: hash}
+	tmp, err := os.CreateTemp(as.dir, a.file()+"_*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	err = s.Export(ctx, key.Id, sel, opts, func(name string) (io.Writer, error) {
+		a.Name = name
+		if tee == nil {
+			return tmp, nil
+		}
+		w, err := tee(name)
+		if err != nil {
+			return nil, err
+		}
+		return io.MultiWriter(w, tmp), nil
+	})
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	a.Size = fi.Size()
+	a.Built = time.Now()
+	bs, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	// the versions built from older records go before this one takes their place
+	err = as.remove(key.name() + "_*")
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmp.Name(), path.Join(as.dir, a.file()+"."+a.Format))
+	if err != nil {
+		return nil, err
+	}
+	return a, os.WriteFile(path.Join(as.dir, a.file()+".json"), bs, 0644)
+}
+
+// Prebuild queue the artifacts the web ui and the opds feed offer for a book that was just cached,
+// the builds that fail are reported to logf.
+func (as *ArtifactStore) Prebuild(ctx context.Context, mode, source, id string, logf func(format string, a ...any)) {
+	if mode == "" || mode == PrebuildNone {
+		return
+	}
+	keys := []ArtifactKey{{Source: source, Id: id, Format: FormatEpub}}
+	if mode == PrebuildVolumes {
+		s, err := getSource(source)
+		if err != nil {
+			return
+		}
+		vols, err := s.EnableDownload(ctx, id)
+		if err != nil {
+			return
+		}
+		for i := range vols {
+			keys = append(keys, ArtifactKey{Source: source, Id: id, Select: strconv.Itoa(i + 1), Format: FormatEpub})
+		}
+	}
+	as.mux.Lock()
+	defer as.mux.Unlock()
+	for _, key := range keys {
+		if as.pending[key.name()] {
+			continue
+		}
+		select {
+		case as.queue <- prebuildTask{key: key, logf: logf}:
+			as.pending[key.name()] = true
+		default:
+			// the queue is full, the artifact will be built on its first download instead
+		}
+	}
+}
+
+// Run build the queued artifacts one by one until ctx is done, a record is decoded whole for every build.
+func (as *ArtifactStore) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case task := <-as.queue:
+			a, err := as.Get(task.key)
+			if err == nil && a == nil {
+				_, err = as.Build(ctx, task.key, nil)
+			}
+			if err != nil && ctx.Err() == nil {
+				task.logf("prebuild %s [%s]: %v", task.key.Format, task.key.Select, err)
+			}
+			as.mux.Lock()
+			delete(as.pending, task.key.name())
+			as.mux.Unlock()
+		}
+	}
+}
+
+// List the stored artifacts matched by the filter.
+func (as *ArtifactStore) List(filter CacheFilter) ([]*Artifact, error) {
+	files, err := filepath.Glob(path.Join(as.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var list []*Artifact
+	for _, file := range files {
+		bs, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		a := new(Artifact)
+		err = json.Unmarshal(bs, a)
+		if err != nil || len(a.RecordHash) < 16 {
+			continue
+		}
+		if filter.match(a.Source, ArtifactType, a.Id) {
+			list = append(list, a)
+		}
+	}
+	slices.SortFunc(list, func(a, b *Artifact) int {
+		return strings.Compare(a.Source+"/"+a.Id+"/"+a.file(), b.Source+"/"+b.Id+"/"+b.file())
+	})
+	return list, nil
+}
+
+// Purge remove the artifacts matched by the filter, return the number removed.
+func (as *ArtifactStore) Purge(filter CacheFilter) (int, error) {
+	list, err := as.List(filter)
+	if err != nil {
+		return 0, err
+	}
+	for i, a := range list {
+		err = as.remove(a.file() + ".*")
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(list), nil
+}
+
+// GC remove the artifacts whose record is gone or changed since they were built.
+func (as *ArtifactStore) GC() (int, error) {
+	list, err := as.List(CacheFilter{})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, a := range list {
+		hash, err := as.recordHash(a.Source, a.Id)
+		if err == nil && hash == a.RecordHash {
+			continue
+		}
+		err = as.remove(a.file() + ".*")
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (as *ArtifactStore) remove(pattern string) error {
+	files, err := filepath.Glob(path.Join(as.dir, pattern))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, ".tmp") {
+			continue
+		}
+		err = os.Remove(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveArtifact send the export of the key. A stored artifact is served with Range and ETag,
+// otherwise it is streamed to the client while being stored; a range request or HEAD waits for the build.
+// The bytes sent are counted against the download quota of the user, so resuming with ranges is no way around it.
+func (sr *server) serveArtifact(w http.ResponseWriter, r *http.Request, key ArtifactKey) error {
+	as := sr.cm.Artifacts()
+	a, err := as.Get(key)
+	if err != nil {
+		return err
+	}
+	user := userFrom(r).Name
+	if a == nil && (r.Header.Get("Range") != "" || r.Method == http.MethodHead) {
+		a, err = as.Build(r.Context(), key, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if a != nil {
+		f, err := as.Open(a)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		etag := `"` + a.file() + `"`
+		if r.Method != http.MethodHead && r.Header.Get("If-None-Match") != etag {
+			err = sr.um.CheckDownload(user)
+			if err != nil {
+				return err
+			}
+		}
+		setArtifactHeaders(w, a.Name, key.Format)
+		w.Header().Set("ETag", etag)
+		cw := &countWriter{ResponseWriter: w}
+		http.ServeContent(cw, r, "", a.Built, f)
+		sr.recordDownload(user, DownloadEntry{Source: key.Source, Id: key.Id, Name: a.Name, Select: key.Select, Bytes: cw.n, Size: a.Size})
+		return nil
+	}
+
+	var cw *countWriter
+	a, err = as.Build(r.Context(), key, func(name string) (io.Writer, error) {
+		err := sr.um.CheckDownload(user)
+		if err != nil {
+			return nil, err
+		}
+		setArtifactHeaders(w, name, key.Format)
+		cw = &countWriter{ResponseWriter: w, name: name}
+		return cw, nil
+	})
+	if cw == nil {
+		return err
+	}
+	entry := DownloadEntry{Source: key.Source, Id: key.Id, Name: cw.name, Select: key.Select, Bytes: cw.n}
+	if a != nil {
+		entry.Size = a.Size
+	}
+	sr.recordDownload(user, entry)
+	if err != nil {
+		// the status is already sent, close the connection so the client does not keep a truncated file
+		fmt.Fprintf(os.Stderr, "export %s %s: %v\n", key.Source, key.Id, err)
+		rc := http.NewResponseController(w)
+		_ = rc.Flush()
+		conn, _, herr := rc.Hijack()
+		if herr == nil {
+			_ = conn.Close()
+		}
+	}
+	return nil
+}
+
+// recordDownload add the bytes sent to the history of the user, the body is already sent so an error is only logged.
+func (sr *server) recordDownload(user string, entry DownloadEntry) {
+	if entry.Bytes == 0 {
+		return
+	}
+	err := sr.um.Download(user, entry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "download history of %s: %v\n", user, err)
+	}
+}
+
+// countWriter count the bytes of the body written to the client.
+type countWriter struct {
+	http.ResponseWriter
+	name string
+	n    int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// setArtifactHeaders send the export as an attachment, the name given by the source already carries the selection.
+func setArtifactHeaders(w http.ResponseWriter, name string, format string) {
+	w.Header().Set("Content-Type", formatTypes[format])
+	// quoted and escaped as needed, a name that is not ascii is sent as filename*
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+}
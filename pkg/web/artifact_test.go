@@ -0,0 +1,441 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// artifactGet call serveArtifact as the user.
+func artifactGet(t *testing.T, sr *server, r *http.Request, u *User, key ArtifactKey) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	err := sr.serveArtifact(w, withUser(r, u), key)
+	return w, err
+}
+
+func TestServeArtifact(t *testing.T) {
+	sr, ts := newTestServer(t)
+	writeTestRecord(t, sr.cm.dir, "1", "Book")
+	u, err := sr.um.Add("reader", "password", RoleReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sr.um.SetQuota("reader", Quota{DailyDownloads: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ArtifactKey{Source: testSourceName, Id: "1", Format: FormatEpub}
+	want := testExport("Book", "")
+	downloads := func() (int, float64) {
+		u, err := sr.um.Get("reader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(u.History), u.downloads(time.Now().Add(-time.Hour))
+	}
+	counted := func(entries int, n float64) {
+		t.Helper()
+		e, d := downloads()
+		if e != entries || d < n-1e-9 || d > n+1e-9 {
+			t.Fatal("downloads", e, d, "want", entries, n)
+		}
+	}
+
+	// the first download streams the export while storing it
+	w, err := artifactGet(t, sr, httptest.NewRequest(http.MethodGet, "/", nil), u, key)
+	if err != nil || w.Body.String() != want || ts.exports.Load() != 1 {
+		t.Fatal(err, ts.exports.Load())
+	}
+	if w.Header().Get("Content-Type") != formatTypes[FormatEpub] || w.Header().Get("Content-Disposition") != `attachment; filename=Book.epub` {
+		t.Fatal(w.Header())
+	}
+	counted(1, 1)
+
+	// then it is served from the store
+	w, err = artifactGet(t, sr, httptest.NewRequest(http.MethodGet, "/", nil), u, key)
+	etag := w.Header().Get("ETag")
+	if err != nil || w.Code != http.StatusOK || w.Body.String() != want || etag == "" || ts.exports.Load() != 1 {
+		t.Fatal(err, w.Code, etag, ts.exports.Load())
+	}
+	counted(2, 2)
+
+	// revalidating sends nothing and does not count
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	w, err = artifactGet(t, sr, r, u, key)
+	if err != nil || w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatal(err, w.Code)
+	}
+	counted(2, 2)
+
+	// a range of an artifact not built yet waits for the build, only its bytes count
+	vol := ArtifactKey{Source: testSourceName, Id: "1", Select: "1", Format: FormatEpub}
+	volSize := float64(len(testExport("Book", "1")))
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=0-9")
+	w, err = artifactGet(t, sr, r, u, vol)
+	if err != nil || w.Code != http.StatusPartialContent || w.Body.String() != testExport("Book", "1")[:10] || ts.exports.Load() != 2 {
+		t.Fatal(err, w.Code, ts.exports.Load())
+	}
+	counted(3, 2+10/volSize)
+
+	// a download resumed in ranges adds up to one
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=100-")
+	w, err = artifactGet(t, sr, r, u, key)
+	if err != nil || w.Code != http.StatusPartialContent || w.Body.String() != want[100:] {
+		t.Fatal(err, w.Code)
+	}
+	counted(4, 2+10/volSize+float64(len(want)-100)/float64(len(want)))
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=0-99")
+	w, err = artifactGet(t, sr, r, u, key)
+	if err != nil || w.Code != http.StatusPartialContent || w.Body.String() != want[:100] {
+		t.Fatal(err, w.Code)
+	}
+	counted(4, 3+10/volSize)
+
+	// ranges are refused too once the quota is used
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=0-9")
+	_, err = artifactGet(t, sr, r, u, key)
+	if !errors.Is(err, ErrQuota) {
+		t.Fatal(err)
+	}
+	_, err = artifactGet(t, sr, httptest.NewRequest(http.MethodGet, "/", nil), u, key)
+	if !errors.Is(err, ErrQuota) {
+		t.Fatal(err)
+	}
+}
+
+func TestServeArtifactAbort(t *testing.T) {
+	sr, ts := newTestServer(t)
+	writeTestRecord(t, sr.cm.dir, "1", "Book")
+	key := ArtifactKey{Source: testSourceName, Id: "1", Format: FormatEpub}
+
+	// the client leaves after the first bytes
+	ctx, cancel := context.WithCancel(context.Background())
+	ts.export = func(ctx context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, "partial")
+		if err != nil {
+			return err
+		}
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	w, err := artifactGet(t, sr, r, anonymous, key)
+	if err != nil || w.Body.String() != "partial" {
+		t.Fatal("the truncated response was reported", err, w.Body.String())
+	}
+	a, err := sr.cm.Artifacts().Get(key)
+	if err != nil || a != nil {
+		t.Fatal("the truncated export was stored", a, err)
+	}
+	if n := artifactFiles(t, sr.cm.Artifacts()); n != 0 {
+		t.Fatal(n)
+	}
+
+	// the export fails after the first bytes, the connection is closed instead of ending the body
+	ts.export = func(ctx context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, "partial")
+		if err != nil {
+			return err
+		}
+		return errors.New("export failed")
+	}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := sr.serveArtifact(w, withUser(r, anonymous), key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	defer hs.Close()
+	resp, err := http.Get(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err == nil || resp.StatusCode != http.StatusOK || string(bs) != "partial" {
+		t.Fatal("the truncated response was not cut", resp.StatusCode, string(bs), err)
+	}
+
+	ts.export = nil
+	w, err = artifactGet(t, sr, httptest.NewRequest(http.MethodGet, "/", nil), anonymous, key)
+	if err != nil || w.Body.String() != testExport("Book", "") {
+		t.Fatal(err)
+	}
+}
+
+func TestArtifactHeaders(t *testing.T) {
+	for _, name := range []string{"Book.epub", `A "quoted"; name.epub`, "小说 第1卷.epub"} {
+		w := httptest.NewRecorder()
+		setArtifactHeaders(w, name, FormatEpub)
+		typ, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+		if err != nil || typ != "attachment" || params["filename"] != name {
+			t.Fatal(w.Header().Get("Content-Disposition"), params, err)
+		}
+	}
+}
+
+func readArtifact(t *testing.T, as *ArtifactStore, key ArtifactKey) string {
+	t.Helper()
+	a, err := as.Get(key)
+	if err != nil || a == nil {
+		t.Fatal("the artifact is not current", key, err)
+	}
+	f, err := as.Open(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	bs, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func artifactFiles(t *testing.T, as *ArtifactStore) int {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(as.dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestArtifactPrebuild(t *testing.T) {
+	sr, ts := newTestServer(t)
+	writeTestRecord(t, sr.cm.dir, "1", "Book")
+	as := sr.cm.Artifacts()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		as.Run(ctx)
+		close(done)
+	}()
+	wait := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			as.mux.Lock()
+			n := len(as.pending)
+			as.mux.Unlock()
+			if n == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the prebuilds are not done")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	logf := func(format string, a ...any) {
+		t.Errorf(format, a...)
+	}
+
+	as.Prebuild(ctx, PrebuildNone, testSourceName, "1", logf)
+	as.Prebuild(ctx, PrebuildVolumes, testSourceName, "1", logf)
+	wait()
+	if ts.exports.Load() != 3 {
+		t.Fatal(ts.exports.Load())
+	}
+	for _, sel := range []string{"", "1", "2"} {
+		key := ArtifactKey{Source: testSourceName, Id: "1", Select: sel, Format: FormatEpub}
+		if readArtifact(t, as, key) != testExport("Book", sel) {
+			t.Fatal("wrong artifact", sel)
+		}
+	}
+
+	// the current artifacts are not built again
+	as.Prebuild(ctx, PrebuildBook, testSourceName, "1", logf)
+	wait()
+	if ts.exports.Load() != 3 {
+		t.Fatal(ts.exports.Load())
+	}
+
+	cancel()
+	<-done
+}
+
+// TestArtifactInvalidate a change of the record or of its metadata makes the artifacts stale, the rebuilt one
+// replaces the stale one and GC drops the others.
+func TestArtifactInvalidate(t *testing.T) {
+	sr, ts := newTestServer(t)
+	p := writeTestRecord(t, sr.cm.dir, "1", "Book")
+	as := sr.cm.Artifacts()
+	ctx := context.Background()
+	book := ArtifactKey{Source: testSourceName, Id: "1", Format: FormatEpub}
+	vol := ArtifactKey{Source: testSourceName, Id: "1", Select: "1", Format: FormatEpub}
+	for _, key := range []ArtifactKey{book, vol} {
+		_, err := as.Build(ctx, key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := as.GC(); err != nil || n != 0 {
+		t.Fatal("current artifacts are collected", n, err)
+	}
+
+	// the record is cached again
+	writeTestRecord(t, sr.cm.dir, "1", "Book 2")
+	later := time.Now().Add(time.Minute)
+	err := os.Chtimes(p, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []ArtifactKey{book, vol} {
+		a, err := as.Get(key)
+		if err != nil || a != nil {
+			t.Fatal("a stale artifact is current", a, err)
+		}
+	}
+	_, err = as.Build(ctx, book, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.exports.Load() != 3 || readArtifact(t, as, book) != testExport("Book 2", "") {
+		t.Fatal(ts.exports.Load())
+	}
+	// the rebuilt book and the stale volume
+	if n := artifactFiles(t, as); n != 4 {
+		t.Fatal(n)
+	}
+	if n, err := as.GC(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if n := artifactFiles(t, as); n != 2 {
+		t.Fatal(n)
+	}
+
+	// the metadata is edited, twice
+	for i, name := range []string{"Renamed", "Renamed again"} {
+		err = saveMetadata(sr.cm.dir, testSourceName, "1", &model.Metadata{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		later = later.Add(time.Minute)
+		err = os.Chtimes(utils.MetadataPath(p), later, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := as.Get(book)
+		if err != nil || a != nil {
+			t.Fatal("a stale artifact is current", a, err)
+		}
+		_, err = as.Build(ctx, book, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts.exports.Load() != int32(4+i) || readArtifact(t, as, book) != testExport(name, "") || artifactFiles(t, as) != 2 {
+			t.Fatal(i, ts.exports.Load(), artifactFiles(t, as))
+		}
+	}
+
+	// the record is removed
+	err = os.Remove(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := as.GC(); err != nil || n != 1 || artifactFiles(t, as) != 0 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestArtifactPurge(t *testing.T) {
+	sr, _ := newTestServer(t)
+	as := sr.cm.Artifacts()
+	for _, id := range []string{"1", "2"} {
+		writeTestRecord(t, sr.cm.dir, id, "Book "+id)
+		for _, sel := range []string{"", "1"} {
+			_, err := as.Build(context.Background(), ArtifactKey{Source: testSourceName, Id: id, Select: sel, Format: FormatEpub}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	list, err := as.List(CacheFilter{})
+	if err != nil || len(list) != 4 {
+		t.Fatal(list, err)
+	}
+	if n, err := as.Purge(CacheFilter{Type: RecordType}); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if n, err := as.Purge(CacheFilter{Source: testSourceName, Id: "1"}); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	list, err = as.List(CacheFilter{})
+	if err != nil || len(list) != 2 || list[0].Id != "2" || list[1].Id != "2" || artifactFiles(t, as) != 4 {
+		t.Fatal(list, err)
+	}
+	if n, err := as.Purge(CacheFilter{Type: ArtifactType}); err != nil || n != 2 || artifactFiles(t, as) != 0 {
+		t.Fatal(n, err)
+	}
+}
+
+// TestArtifactCacheGC a cache gc drops the unreferenced images of a record without making its artifacts stale.
+func TestArtifactCacheGC(t *testing.T) {
+	sr, ts := newTestServer(t)
+	p := writeTestRecord(t, sr.cm.dir, "1", "Book")
+	as := sr.cm.Artifacts()
+	key := ArtifactKey{Source: testSourceName, Id: "1", Format: FormatEpub}
+
+	// enough images that the order of the saved cache varies
+	r, err := utils.LoadRecord(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := utils.NewLinkCache()
+	lc.Import(r.Cache)
+	chapter := r.Data.Volumes[0].Chapters[1]
+	for i := 0; i < 8; i++ {
+		img, err := lc.SetX(fmt.Sprintf("img%d", i), fmt.Sprintf("https://example.com/img%d.png", i), []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chapter.Imgs = append(chapter.Imgs, img)
+	}
+	err = utils.SaveRecord(p, r, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = as.Build(context.Background(), key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an image left behind by an earlier download
+	_, err = lc.SetX("old", "https://example.com/old.png", []byte("old image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = utils.SaveRecord(p, r, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, images := range []int{1, 0} {
+		gc, err := sr.cm.GC()
+		if err != nil || gc.Images != images || gc.Artifacts != 0 {
+			t.Fatal(gc, err)
+		}
+		if readArtifact(t, as, key) != testExport("Book", "") || ts.exports.Load() != 1 {
+			t.Fatal(ts.exports.Load())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package web
+
+import (
+	"context"
+	"github.com/peakedshout/go-pandorasbox/xnet/xtool/xhttp"
+	"net/http"
+	"strings"
+)
+
+const tokenCookie = "np_token"
+
+type userKey struct{}
+
+// authenticate find the caller by a bearer token or api key, the session cookie, or basic auth.
+// Without any account every caller is the anonymous admin.
+func (sr *server) authenticate(r *http.Request) (*User, error) {
+	if !sr.um.Enabled() {
+		return anonymous, nil
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return sr.um.Token(token)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return sr.um.Token(key)
+	}
+	if c, err := r.Cookie(tokenCookie); err == nil {
+		return sr.um.Token(c.Value)
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		return sr.um.Basic(name, password)
+	}
+	return nil, ErrUnauthorized
+}
+
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if c, err := r.Cookie(tokenCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func withUser(r *http.Request, u *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, u))
+}
+
+func userFrom(r *http.Request) *User {
+	u, ok := r.Context().Value(userKey{}).(*User)
+	if !ok {
+		return anonymous
+	}
+	return u
+}
+
+// canManage whether the user may act on something owned by owner.
+func canManage(u *User, owner string) bool {
+	return u.IsAdmin() || (owner != "" && owner == u.Name)
+}
+
+type userHandler func(context *xhttp.Context, u *User) error
+
+func plain(fn func(context *xhttp.Context) error) userHandler {
+	return func(context *xhttp.Context, u *User) error {
+		return fn(context)
+	}
+}
+
+// handle register a legacy handler behind authentication, a failure asks the browser for basic auth.
+func (sr *server) handle(path string, admin bool, fn userHandler) {
+	sr.Set(path, func(context *xhttp.Context) error {
+		w, r := context.Raw()
+		u, err := sr.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="novelpackager"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return nil
+		}
+		if admin && !u.IsAdmin() {
+			http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+			return nil
+		}
+		return fn(context, u)
+	})
+}
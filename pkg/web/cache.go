@@ -0,0 +1,371 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const RecordType = "Record"
+
+var recordMap = make(map[string]string)
+
+// RegisterRecord tell the cache manager how the source names its record files, format must contain one %s for the book id.
+func RegisterRecord(source string, format string) {
+	recordMap[source] = format
+}
+
+func recordPath(dir, source, id string) (string, error) {
+	format, ok := recordMap[source]
+	if !ok {
+		return "", fmt.Errorf("unknown source: %s", source)
+	}
+	return path.Join(dir, fmt.Sprintf(format, id)), nil
+}
+
+// loadMetadata the metadata set by hand for the cached book, empty if none was set.
+func loadMetadata(dir, source, id string) (*model.Metadata, error) {
+	rp, err := recordPath(dir, source, id)
+	if err != nil {
+		return nil, err
+	}
+	m, err := utils.LoadMetadata(rp)
+	if err != nil || m != nil {
+		return m, err
+	}
+	return &model.Metadata{}, nil
+}
+
+// saveMetadata replace the metadata of the cached book, the artifacts packaged with the old one are rebuilt on
+// their next download. An empty metadata removes it.
+func saveMetadata(dir, source, id string, m *model.Metadata) error {
+	rp, err := recordPath(dir, source, id)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(rp)
+	if err != nil {
+		return fmt.Errorf("%w: %s %s", ErrNotCached, source, id)
+	}
+	return utils.SaveMetadata(rp, m)
+}
+
+func parseRecordName(name string) (source string, id string, ok bool) {
+	for s, format := range recordMap {
+		prefix, suffix, found := strings.Cut(format, "%s")
+		if !found {
+			continue
+		}
+		after, b1 := strings.CutPrefix(name, prefix)
+		before, b2 := strings.CutSuffix(after, suffix)
+		if b1 && b2 && before != "" {
+			return s, before, true
+		}
+	}
+	return "", "", false
+}
+
+type CacheFilter struct {
+	Source string `json:"source,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Id     string `json:"id,omitempty"`
+}
+
+func (f CacheFilter) Empty() bool {
+	return f.Source == "" && f.Type == "" && f.Id == ""
+}
+
+func (f CacheFilter) match(source, typ, id string) bool {
+	if f.Source != "" && f.Source != source {
+		return false
+	}
+	if f.Type != "" && f.Type != typ {
+		return false
+	}
+	if f.Id != "" && f.Id != id {
+		return false
+	}
+	return true
+}
+
+type CacheRecord struct {
+	Source string `json:"source"`
+	Id     string `json:"id"`
+	*utils.RecordStat
+}
+
+type CacheEntry struct {
+	Source string `json:"source"`
+	Type   string `json:"type"`
+	Id     string `json:"id"`
+	Size   int    `json:"size"`
+}
+
+type CacheList struct {
+	Records   []CacheRecord `json:"records"`
+	Entries   []CacheEntry  `json:"entries"`
+	Artifacts []*Artifact   `json:"artifacts"`
+}
+
+type CacheStat struct {
+	Records  int                       `json:"records"`
+	RecordBs int64                     `json:"recordBs"`
+	Images   int                       `json:"images"`
+	ImageBs  int64                     `json:"imageBs"`
+	Entries  map[string]map[string]int `json:"entries"`
+	EntryBs  int64                     `json:"entryBs"`
+
+	Artifacts  int   `json:"artifacts"`
+	ArtifactBs int64 `json:"artifactBs"`
+}
+
+type CacheGC struct {
+	Entries   int `json:"entries"`
+	Images    int `json:"images"`
+	Artifacts int `json:"artifacts"`
+}
+
+type CacheManager struct {
+	kv  utils.KVCache
+	dir string
+	as  *ArtifactStore
+}
+
+func NewCacheManager(kv utils.KVCache, dir string) *CacheManager {
+	return &CacheManager{kv: kv, dir: dir, as: newArtifactStore(dir)}
+}
+
+// Artifacts the exports built from the records of the cache dir.
+func (cm *CacheManager) Artifacts() *ArtifactStore {
+	return cm.as
+}
+
+func (cm *CacheManager) List(filter CacheFilter) (*CacheList, error) {
+	cl := &CacheList{}
+	if filter.Type == "" || filter.Type == RecordType {
+		records, err := cm.records(filter)
+		if err != nil {
+			return nil, err
+		}
+		cl.Records = records
+	}
+	if filter.Type == "" || filter.Type == ArtifactType {
+		artifacts, err := cm.as.List(filter)
+		if err != nil {
+			return nil, err
+		}
+		cl.Artifacts = artifacts
+	}
+	if filter.Type != RecordType && filter.Type != ArtifactType {
+		err := cm.kv.Range(func(key string, data []byte) error {
+			source, typ, id := splitEntryKey(key)
+			if filter.match(source, typ, id) {
+				cl.Entries = append(cl.Entries, CacheEntry{Source: source, Type: typ, Id: id, Size: len(data)})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		slices.SortFunc(cl.Entries, func(a, b CacheEntry) int {
+			return strings.Compare(a.Source+"/"+a.Type+"/"+a.Id, b.Source+"/"+b.Type+"/"+b.Id)
+		})
+	}
+	return cl, nil
+}
+
+func (cm *CacheManager) Stat() (*CacheStat, error) {
+	cl, err := cm.List(CacheFilter{})
+	if err != nil {
+		return nil, err
+	}
+	cs := &CacheStat{
+		Records: len(cl.Records),
+		Entries: make(map[string]map[string]int),
+	}
+	for _, record := range cl.Records {
+		cs.RecordBs += record.Size
+		cs.Images += record.Images
+		cs.ImageBs += record.ImageBs
+	}
+	for _, entry := range cl.Entries {
+		m, ok := cs.Entries[entry.Source]
+		if !ok {
+			m = make(map[string]int)
+			cs.Entries[entry.Source] = m
+		}
+		m[entry.Type]++
+		cs.EntryBs += int64(entry.Size)
+	}
+	for _, a := range cl.Artifacts {
+		cs.Artifacts++
+		cs.ArtifactBs += a.Size
+	}
+	return cs, nil
+}
+
+// Purge remove the kv entries, record files and artifacts matched by the filter, return the number removed.
+// The artifacts of a purged record go with it.
+func (cm *CacheManager) Purge(filter CacheFilter) (int, error) {
+	var keys []string
+	if filter.Type != RecordType && filter.Type != ArtifactType {
+		err := cm.kv.Range(func(key string, data []byte) error {
+			if filter.match(splitEntryKey(key)) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	count := 0
+	for _, key := range keys {
+		err := cm.kv.Del(key)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	if filter.Type == "" || filter.Type == RecordType {
+		records, err := cm.records(filter)
+		if err != nil {
+			return count, err
+		}
+		for _, record := range records {
+			err = removeRecord(record.Path)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	if filter.Type == "" || filter.Type == RecordType || filter.Type == ArtifactType {
+		af := filter
+		af.Type = ""
+		n, err := cm.as.Purge(af)
+		if err != nil {
+			return count, err
+		}
+		if filter.Type != RecordType {
+			count += n
+		}
+	}
+	return count, nil
+}
+
+// GC drop expired kv entries and the resources no longer referenced by the records.
+func (cm *CacheManager) GC() (*CacheGC, error) {
+	gc := &CacheGC{}
+	n, err := cm.kv.GC()
+	if err != nil {
+		return nil, err
+	}
+	gc.Entries = n
+	records, err := cm.records(CacheFilter{})
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		n, err = utils.GCRecord(record.Path)
+		if errors.Is(err, utils.ErrLocked) {
+			// being downloaded, collected by a later gc
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		gc.Images += n
+	}
+	gc.Artifacts, err = cm.as.GC()
+	if err != nil {
+		return nil, err
+	}
+	return gc, nil
+}
+
+// removeRecord remove the record unless it is being downloaded, its lock goes with it.
+func removeRecord(p string) error {
+	unlock, err := utils.LockFile(p)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(p)
+	if err != nil {
+		return err
+	}
+	// fails where an open file can not be removed, the lock file is then left for the next download
+	_ = os.Remove(p + ".lock")
+	return nil
+}
+
+func (cm *CacheManager) records(filter CacheFilter) ([]CacheRecord, error) {
+	files, err := cm.recordFiles(filter)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]CacheRecord, 0, len(files))
+	for _, rf := range files {
+		rs, err := utils.StatRecord(rf.Path)
+		if err != nil {
+			return nil, fmt.Errorf("record %s: %w", path.Base(rf.Path), err)
+		}
+		list = append(list, CacheRecord{Source: rf.Source, Id: rf.Id, RecordStat: rs})
+	}
+	return list, nil
+}
+
+// recordFile a record file of the cache dir, found without decoding it.
+type recordFile struct {
+	Source  string
+	Id      string
+	Path    string
+	ModTime time.Time
+}
+
+// recordFiles the record files matched by the filter, only stat'ed.
+func (cm *CacheManager) recordFiles(filter CacheFilter) ([]recordFile, error) {
+	entries, err := os.ReadDir(cm.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []recordFile
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		source, id, ok := parseRecordName(entry.Name())
+		if !ok || !filter.match(source, RecordType, id) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			// removed since the dir was read
+			continue
+		}
+		list = append(list, recordFile{Source: source, Id: id, Path: path.Join(cm.dir, entry.Name()), ModTime: fi.ModTime()})
+	}
+	return list, nil
+}
+
+func splitEntryKey(key string) (source, typ, id string) {
+	sl := strings.SplitN(key, "/", 3)
+	switch len(sl) {
+	case 3:
+		return sl[0], sl[1], sl[2]
+	case 2:
+		return sl[0], sl[1], ""
+	default:
+		return "", "", key
+	}
+}
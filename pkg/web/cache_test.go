@@ -0,0 +1,44 @@
+package web
+
+import (
+	"errors"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// TestCacheLocked a record being downloaded is left out of a gc and can not be purged.
+func TestCacheLocked(t *testing.T) {
+	sr, _ := newTestServer(t)
+	p := writeTestRecord(t, sr.cm.dir, "1", "Book")
+	unlock, err := utils.LockFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc, err := sr.cm.GC()
+	if err != nil || gc.Images != 0 {
+		t.Fatal(gc, err)
+	}
+	_, err = sr.cm.Purge(CacheFilter{Type: RecordType})
+	if !errors.Is(err, utils.ErrLocked) {
+		t.Fatal(err)
+	}
+	if status, _ := toAPIError(err); status != http.StatusConflict {
+		t.Fatal(status)
+	}
+	if _, err = os.Stat(p); err != nil {
+		t.Fatal("the locked record is removed", err)
+	}
+
+	unlock()
+	n, err := sr.cm.Purge(CacheFilter{Type: RecordType})
+	if err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	for _, f := range []string{p, p + ".lock"} {
+		if _, err = os.Stat(f); !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(f, err)
+		}
+	}
+}
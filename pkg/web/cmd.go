@@ -0,0 +1,171 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+type cacheFilterArgs struct {
+	Source string `json:"source" Barg:"source" Harg:"only the given source"`
+	Type   string `json:"type" Barg:"type" Harg:"only the given type (Record, Artifact, BookInfo, SearchResult ...)"`
+	Id     string `json:"id" Barg:"id" Harg:"only the given book id or search key"`
+}
+
+func (a *cacheFilterArgs) filter() CacheFilter {
+	return CacheFilter{Source: a.Source, Type: a.Type, Id: a.Id}
+}
+
+type cachePurgeArgs struct {
+	All bool `json:"all" Barg:"all" Harg:"allow purging everything when no filter is given"`
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "inspect and clean the web cache",
+}
+
+var cacheLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "list cached records, artifacts and kv entries",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cm, err := cacheManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		fa := utils.GetKeyT[cacheFilterArgs](cmd, "args")
+		cl, err := cm.List(fa.filter())
+		if err != nil {
+			return err
+		}
+		t := newTable()
+		t.AppendHeader(table.Row{"Source", "Type", "Id", "Name", "Size", "Images", "Chapters", "ModTime"})
+		for _, r := range cl.Records {
+			t.AppendRow(table.Row{r.Source, RecordType, r.Id, r.Name, utils.FormatBytes(r.Size), r.Images,
+				fmt.Sprintf("%d/%d", r.LoadedChapters, r.Chapters), r.ModTime.Format(time.DateTime)})
+		}
+		for _, e := range cl.Entries {
+			t.AppendRow(table.Row{e.Source, e.Type, e.Id, "", utils.FormatBytes(int64(e.Size)), "", "", ""})
+		}
+		for _, a := range cl.Artifacts {
+			t.AppendRow(table.Row{a.Source, ArtifactType, a.Id, a.Name, utils.FormatBytes(a.Size), "", "", a.Built.Format(time.DateTime)})
+		}
+		t.AppendFooter(table.Row{"TOTAL", len(cl.Records) + len(cl.Entries) + len(cl.Artifacts)}, table.RowConfig{AutoMerge: true})
+		t.Render()
+		return nil
+	},
+}
+
+var cacheStatCmd = &cobra.Command{
+	Use:   "stat",
+	Short: "summarize the cache usage",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cm, err := cacheManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		cs, err := cm.Stat()
+		if err != nil {
+			return err
+		}
+		t := newTable()
+		t.AppendHeader(table.Row{"", ""})
+		t.AppendRow(table.Row{"Records", cs.Records})
+		t.AppendRow(table.Row{"Records size", utils.FormatBytes(cs.RecordBs)})
+		t.AppendRow(table.Row{"Images", cs.Images})
+		t.AppendRow(table.Row{"Images size", utils.FormatBytes(cs.ImageBs)})
+		t.AppendRow(table.Row{"Artifacts", cs.Artifacts})
+		t.AppendRow(table.Row{"Artifacts size", utils.FormatBytes(cs.ArtifactBs)})
+		t.AppendRow(table.Row{"Entries size", utils.FormatBytes(cs.EntryBs)})
+		for source, m := range cs.Entries {
+			for typ, n := range m {
+				t.AppendRow(table.Row{fmt.Sprintf("Entries %s/%s", source, typ), n})
+			}
+		}
+		t.Render()
+		return nil
+	},
+}
+
+var cachePurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "remove cached records and kv entries, e.g. --type BookInfo --id 2336 to force-refresh one book's info",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fa := utils.GetKeyT[cacheFilterArgs](cmd, "args")
+		pa := utils.GetKeyT[cachePurgeArgs](cmd, "purge")
+		filter := fa.filter()
+		if filter.Empty() && !pa.All {
+			return errors.New("no filter given, use --all to purge everything")
+		}
+		cm, err := cacheManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		n, err := cm.Purge(filter)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("purged %d items\n", n)
+		return nil
+	},
+}
+
+var cacheGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "drop expired kv entries, unreferenced record images and stale artifacts",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cm, err := cacheManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		gc, err := cm.GC()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed %d expired entries, %d unreferenced images, %d stale artifacts\n", gc.Entries, gc.Images, gc.Artifacts)
+		return nil
+	},
+}
+
+func initCacheCmd(c *cobra.Command) {
+	c.AddCommand(cacheCmd)
+
+	cacheCmd.AddCommand(cacheLsCmd)
+	utils.BindKey(cacheLsCmd, "cfg", ptr(defaultCacheConfig()))
+	utils.BindKey(cacheLsCmd, "args", new(cacheFilterArgs))
+
+	cacheCmd.AddCommand(cacheStatCmd)
+	utils.BindKey(cacheStatCmd, "cfg", ptr(defaultCacheConfig()))
+
+	cacheCmd.AddCommand(cachePurgeCmd)
+	utils.BindKey(cachePurgeCmd, "cfg", ptr(defaultCacheConfig()))
+	utils.BindKey(cachePurgeCmd, "args", new(cacheFilterArgs))
+	utils.BindKey(cachePurgeCmd, "purge", new(cachePurgeArgs))
+
+	cacheCmd.AddCommand(cacheGCCmd)
+	utils.BindKey(cacheGCCmd, "cfg", ptr(defaultCacheConfig()))
+}
+
+func cacheManagerFromCmd(cmd *cobra.Command) (*CacheManager, error) {
+	cfg := utils.GetKeyT[CacheConfig](cmd, "cfg")
+	kv, err := newKVCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewCacheManager(kv, cfg.CacheDir), nil
+}
+
+func newTable() table.Writer {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.SetStyle(table.StyleColoredBright)
+	return t
+}
+
+func ptr[T any](t T) *T {
+	return &t
+}
@@ -0,0 +1,91 @@
+package web
+
+import (
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"sync"
+	"time"
+)
+
+const (
+	eventHistory = 512
+	eventBuffer  = 64
+)
+
+type JobEvent struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	JobId  string    `json:"jobId"`
+	Source string    `json:"source"`
+	BookId string    `json:"bookId"`
+	State  JobState  `json:"state,omitempty"`
+	model.Event
+}
+
+type EventFilter struct {
+	Source string
+	BookId string
+	JobId  string
+}
+
+func (f EventFilter) match(e *JobEvent) bool {
+	return (f.Source == "" || f.Source == e.Source) &&
+		(f.BookId == "" || f.BookId == e.BookId) &&
+		(f.JobId == "" || f.JobId == e.JobId)
+}
+
+// EventHub fan out job events to the subscribers and keep the recent ones for reconnecting clients.
+type EventHub struct {
+	mux     sync.Mutex
+	seq     uint64
+	history []*JobEvent
+	subs    map[chan *JobEvent]EventFilter
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subs: make(map[chan *JobEvent]EventFilter)}
+}
+
+func (h *EventHub) Publish(e *JobEvent) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.seq++
+	e.Seq = h.seq
+	e.Time = time.Now()
+	h.history = append(h.history, e)
+	if len(h.history) > eventHistory {
+		h.history = h.history[len(h.history)-eventHistory:]
+	}
+	for ch, filter := range h.subs {
+		if !filter.match(e) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			// too slow, drop it; the client reconnects with its last seq and replays from the history
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe return the kept events after seq and a channel for the following ones, the channel is closed by cancel or when the subscriber falls behind.
+func (h *EventHub) Subscribe(filter EventFilter, after uint64) (replay []*JobEvent, ch <-chan *JobEvent, cancel func()) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for _, e := range h.history {
+		if e.Seq > after && filter.match(e) {
+			replay = append(replay, e)
+		}
+	}
+	c := make(chan *JobEvent, eventBuffer)
+	h.subs[c] = filter
+	return replay, c, func() {
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		if _, ok := h.subs[c]; ok {
+			delete(h.subs, c)
+			close(c)
+		}
+	}
+}
@@ -29,3 +29,42 @@ export class VolumeInfo {
 export class ChapterInfo {
     name: string = "";
 }
+
+export class Issue {
+    kind: string = "";
+    volume: number = 0;
+    chapter: number = 0;
+    name: string = "";
+    ofVolume: number = 0;
+    ofChapter: number = 0;
+    ofName: string = "";
+    similarity: number = 0;
+}
+
+export class Metadata {
+    name: string = "";
+    author: string = "";
+    series: string = "";
+    description: string = "";
+    tags: string[] = [];
+    volumes: Record<number, string> = {};
+    cover: string = "";
+}
+
+export class JobEvent {
+    seq: number = 0;
+    time: string = "";
+    jobId: string = "";
+    source: string = "";
+    bookId: string = "";
+    state: string = "";
+    type: string = "";
+    volume: number = 0;
+    chapter: number = 0;
+    name: string = "";
+    url: string = "";
+    size: number = 0;
+    attempt: number = 0;
+    err: string = "";
+    progress: string = "";
+}
@@ -1,5 +1,5 @@
 import {type MsgContainer} from "./tool1.ts";
-import type {BookInfo, SearchResult} from '../model/model.ts'
+import type {BookInfo, Issue, Metadata, SearchResult} from '../model/model.ts'
 import type {Error} from "./err.ts";
 
 export class Api {
@@ -65,6 +65,43 @@ export class Api {
         return await res.json()
     }
 
+    async GetIssues(source: string, id: string): Promise<MsgContainer<Issue[]>> {
+        const url = new URL('/api/issues', window.location.origin);
+        url.searchParams.append('source', source);
+        url.searchParams.append('id', id);
+        const res = await fetch(url.toString())
+        if (!res.ok) {
+            await this.failedFunc(res)
+        }
+        return await res.json()
+    }
+
+    async GetMeta(source: string, id: string): Promise<MsgContainer<Metadata>> {
+        const url = new URL('/api/meta', window.location.origin);
+        url.searchParams.append('source', source);
+        url.searchParams.append('id', id);
+        const res = await fetch(url.toString())
+        if (!res.ok) {
+            await this.failedFunc(res)
+        }
+        return await res.json()
+    }
+
+    async SaveMeta(source: string, id: string, meta: Metadata): Promise<MsgContainer<Metadata>> {
+        const url = new URL('/api/meta/save', window.location.origin);
+        url.searchParams.append('source', source);
+        url.searchParams.append('id', id);
+        const res = await fetch(url.toString(), {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify(meta),
+        })
+        if (!res.ok) {
+            await this.failedFunc(res)
+        }
+        return await res.json()
+    }
+
     async Caching(source: string, id: string): Promise<Error> {
         const url = new URL('/api/caching', window.location.origin);
         url.searchParams.append('source', source);
@@ -76,11 +113,40 @@ export class Api {
         return await res.json()
     }
 
-    async Download(source: string, id: string, vols: number[]) {
+    Events(source: string, id: string): EventSource {
+        const url = new URL('/api/events', window.location.origin);
+        url.searchParams.append('source', source);
+        url.searchParams.append('id', id);
+        return new EventSource(url.toString())
+    }
+
+    ReadUrl(source: string, id: string): string {
+        return new URL(`/read/${encodeURIComponent(source)}/${encodeURIComponent(id)}`, window.location.origin).toString()
+    }
+
+    async Download(source: string, id: string, vols: number[], convert: string = '', filters: string[] = [], image: string = '', content: string = '', format: string = '', exclude: string[] = []) {
         const url = new URL('/api/download', window.location.origin);
         url.searchParams.append('source', source);
         url.searchParams.append('id', id);
         url.searchParams.append('vols', vols.join(','))
+        if (convert) {
+            url.searchParams.append('convert', convert)
+        }
+        for (const filter of filters) {
+            url.searchParams.append('filter', filter)
+        }
+        if (image) {
+            url.searchParams.append('image', image)
+        }
+        if (content) {
+            url.searchParams.append('content', content)
+        }
+        if (format) {
+            url.searchParams.append('format', format)
+        }
+        for (const kind of exclude) {
+            url.searchParams.append('exclude', kind)
+        }
         const res = await fetch(url);
         if (!res.ok) {
             await this.failedFunc(res)
@@ -0,0 +1,489 @@
+package web
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobQueued   JobState = "queued"
+	JobRunning  JobState = "running"
+	JobPaused   JobState = "paused"
+	JobFailed   JobState = "failed"
+	JobDone     JobState = "done"
+	JobCanceled JobState = "canceled"
+)
+
+const (
+	jobLogMax = 200
+	// jobKeep and jobKeepFor bound the finished jobs kept, the oldest go first.
+	jobKeep    = 500
+	jobKeepFor = 30 * 24 * time.Hour
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobState    = errors.New("job state does not allow this action")
+	ErrJobExists   = errors.New("an active job already exists for this book")
+
+	errJobPaused   = errors.New("job paused")
+	errJobCanceled = errors.New("job canceled")
+)
+
+type Job struct {
+	Id       string                  `json:"id"`
+	Source   string                  `json:"source"`
+	BookId   string                  `json:"bookId"`
+	Owner    string                  `json:"owner,omitempty"`
+	Priority int                     `json:"priority"`
+	State    JobState                `json:"state"`
+	Err      string                  `json:"err,omitempty"`
+	Attempts int                     `json:"attempts"`
+	Created  time.Time               `json:"created"`
+	Updated  time.Time               `json:"updated"`
+	Progress string                  `json:"progress"`
+	Snapshot *utils.ProgressSnapshot `json:"snapshot,omitempty"`
+	Logs     []string                `json:"logs,omitempty"`
+
+	jm     *JobManager
+	pr     *utils.Progress
+	cancel context.CancelCauseFunc
+}
+
+// Pr the progress the source should report to while running the job.
+func (j *Job) Pr() *utils.Progress {
+	return j.pr
+}
+
+// Logf append a line to the job log.
+func (j *Job) Logf(format string, a ...any) {
+	line := fmt.Sprintf(format, a...)
+	j.jm.mux.Lock()
+	defer j.jm.mux.Unlock()
+	j.log(line)
+}
+
+// log append a line to the job log, must be called with the manager lock held.
+func (j *Job) log(line string) {
+	j.Logs = append(j.Logs, time.Now().Format(time.DateTime)+" "+line)
+	if len(j.Logs) > jobLogMax {
+		j.Logs = j.Logs[len(j.Logs)-jobLogMax:]
+	}
+}
+
+// Emit publish an event of the job to the event stream.
+func (j *Job) Emit(e model.Event) {
+	j.jm.events.Publish(&JobEvent{JobId: j.Id, Source: j.Source, BookId: j.BookId, Event: e})
+}
+
+func (j *Job) active() bool {
+	return j.State == JobQueued || j.State == JobRunning || j.State == JobPaused
+}
+
+// snapshot copy the exported fields, must be called with the manager lock held.
+func (j *Job) snapshot(logs bool) *Job {
+	c := &Job{
+		Id:       j.Id,
+		Source:   j.Source,
+		BookId:   j.BookId,
+		Owner:    j.Owner,
+		Priority: j.Priority,
+		State:    j.State,
+		Err:      j.Err,
+		Attempts: j.Attempts,
+		Created:  j.Created,
+		Updated:  j.Updated,
+		Progress: j.Progress,
+	}
+	if j.pr != nil {
+		c.Progress = j.pr.String()
+		c.Snapshot = j.pr.Snapshot()
+	}
+	if logs {
+		c.Logs = slices.Clone(j.Logs)
+	}
+	return c
+}
+
+type JobRunner func(ctx context.Context, job *Job) error
+
+type JobManager struct {
+	ctx    context.Context
+	file   string
+	limit  int
+	runner JobRunner
+	events *EventHub
+
+	mux     sync.Mutex
+	jobs    map[string]*Job
+	running map[string]int
+	wake    chan struct{}
+}
+
+// NewJobManager load the persisted jobs from file, jobs interrupted by a restart are queued again.
+func NewJobManager(ctx context.Context, file string, limit int, runner JobRunner) (*JobManager, error) {
+	if limit <= 0 {
+		limit = 1
+	}
+	jm := &JobManager{
+		ctx:     ctx,
+		file:    file,
+		limit:   limit,
+		runner:  runner,
+		events:  NewEventHub(),
+		jobs:    make(map[string]*Job),
+		running: make(map[string]int),
+		wake:    make(chan struct{}, 1),
+	}
+	err := jm.load()
+	if err != nil {
+		return nil, err
+	}
+	go jm.loop()
+	jm.notify()
+	return jm, nil
+}
+
+func (jm *JobManager) Events() *EventHub {
+	return jm.events
+}
+
+// Submit queue a job for the owner, maxActive limits the unfinished jobs the owner may have (0 no limit).
+func (jm *JobManager) Submit(req JobRequest, owner string, maxActive int) (*Job, error) {
+	jm.mux.Lock()
+	defer jm.mux.Unlock()
+	active := 0
+	for _, job := range jm.jobs {
+		if !job.active() {
+			continue
+		}
+		if job.Source == req.Source && job.BookId == req.BookId {
+			return nil, ErrJobExists
+		}
+		if job.Owner == owner {
+			active++
+		}
+	}
+	if maxActive > 0 && active >= maxActive {
+		return nil, fmt.Errorf("%w: %d unfinished jobs", ErrQuota, maxActive)
+	}
+	now := time.Now()
+	job := &Job{
+		Id:       uuid.New().String(),
+		Source:   req.Source,
+		BookId:   req.BookId,
+		Owner:    owner,
+		Priority: req.Priority,
+		State:    JobQueued,
+		Created:  now,
+		Updated:  now,
+		jm:       jm,
+	}
+	jm.jobs[job.Id] = job
+	err := jm.save()
+	if err != nil {
+		// a job that would be lost on restart is not accepted
+		delete(jm.jobs, job.Id)
+		return nil, err
+	}
+	jm.notify()
+	return job.snapshot(false), nil
+}
+
+func (jm *JobManager) Get(id string) (*Job, error) {
+	jm.mux.Lock()
+	defer jm.mux.Unlock()
+	job, ok := jm.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job.snapshot(true), nil
+}
+
+// List the jobs of the source (all sources if empty) in scheduling order.
+func (jm *JobManager) List(source string) []*Job {
+	jm.mux.Lock()
+	defer jm.mux.Unlock()
+	list := make([]*Job, 0, len(jm.jobs))
+	for _, job := range jm.jobs {
+		if source != "" && job.Source != source {
+			continue
+		}
+		list = append(list, job.snapshot(false))
+	}
+	sortJobs(list)
+	return list
+}
+
+// Latest the most recent job of each book of the source.
+func (jm *JobManager) Latest(source string) map[string]*Job {
+	m := make(map[string]*Job)
+	for _, job := range jm.List(source) {
+		if old, ok := m[job.BookId]; !ok || job.Created.After(old.Created) {
+			m[job.BookId] = job
+		}
+	}
+	return m
+}
+
+func (jm *JobManager) Cancel(id string) error {
+	return jm.transit(id, func(job *Job) error {
+		switch job.State {
+		case JobRunning:
+			job.cancel(errJobCanceled)
+		case JobQueued, JobPaused:
+			job.State = JobCanceled
+		default:
+			return ErrJobState
+		}
+		return nil
+	})
+}
+
+func (jm *JobManager) Pause(id string) error {
+	return jm.transit(id, func(job *Job) error {
+		switch job.State {
+		case JobRunning:
+			job.cancel(errJobPaused)
+		case JobQueued:
+			job.State = JobPaused
+		default:
+			return ErrJobState
+		}
+		return nil
+	})
+}
+
+func (jm *JobManager) Resume(id string) error {
+	return jm.transit(id, func(job *Job) error {
+		if job.State != JobPaused {
+			return ErrJobState
+		}
+		job.State = JobQueued
+		return nil
+	})
+}
+
+func (jm *JobManager) Retry(id string) error {
+	return jm.transit(id, func(job *Job) error {
+		if job.State != JobFailed && job.State != JobCanceled {
+			return ErrJobState
+		}
+		for _, other := range jm.jobs {
+			if other != job && other.Source == job.Source && other.BookId == job.BookId && other.active() {
+				return ErrJobExists
+			}
+		}
+		job.State = JobQueued
+		job.Err = ""
+		return nil
+	})
+}
+
+func (jm *JobManager) transit(id string, fn func(job *Job) error) error {
+	jm.mux.Lock()
+	defer jm.mux.Unlock()
+	job, ok := jm.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	err := fn(job)
+	if err != nil {
+		return err
+	}
+	job.Updated = time.Now()
+	jm.persist(job)
+	jm.notify()
+	return nil
+}
+
+func (jm *JobManager) notify() {
+	select {
+	case jm.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (jm *JobManager) loop() {
+	for {
+		select {
+		case <-jm.ctx.Done():
+			return
+		case <-jm.wake:
+			jm.schedule()
+		}
+	}
+}
+
+func (jm *JobManager) schedule() {
+	jm.mux.Lock()
+	defer jm.mux.Unlock()
+	if jm.ctx.Err() != nil {
+		// shutting down, a wake left by a stopped job must not start it again
+		return
+	}
+	queued := make([]*Job, 0)
+	for _, job := range jm.jobs {
+		if job.State == JobQueued {
+			queued = append(queued, job)
+		}
+	}
+	sortJobs(queued)
+	var started []*Job
+	for _, job := range queued {
+		if jm.running[job.Source] >= jm.limit {
+			continue
+		}
+		jm.running[job.Source]++
+		job.State = JobRunning
+		job.Attempts++
+		job.Updated = time.Now()
+		job.pr = utils.NewProgress(-1)
+		ctx, cl := context.WithCancelCause(jm.ctx)
+		job.cancel = cl
+		go jm.run(ctx, job)
+		started = append(started, job)
+	}
+	if len(started) != 0 {
+		jm.persist(started...)
+	}
+}
+
+func (jm *JobManager) run(ctx context.Context, job *Job) {
+	job.Logf("job started, attempt %d", job.Attempts)
+	jm.events.Publish(&JobEvent{JobId: job.Id, Source: job.Source, BookId: job.BookId, State: JobRunning,
+		Event: model.Event{Type: model.EventJobStarted, Attempt: job.Attempts}})
+	err := jm.runner(ctx, job)
+
+	// under the lock of Cancel and Pause: one landing before counts, one landing after finds the job finished
+	jm.mux.Lock()
+	defer jm.mux.Unlock()
+	cause := context.Cause(ctx)
+	job.cancel(nil)
+	jm.running[job.Source]--
+	job.Updated = time.Now()
+	job.Progress = job.pr.String()
+	switch {
+	case jm.ctx.Err() != nil:
+		// shutting down, picked up again on restart
+		job.State = JobQueued
+	case errors.Is(cause, errJobPaused):
+		job.State = JobPaused
+	case errors.Is(cause, errJobCanceled):
+		job.State = JobCanceled
+	case err != nil:
+		job.State = JobFailed
+		job.Err = err.Error()
+		job.pr.SetError(err)
+	default:
+		job.State = JobDone
+	}
+	job.log("job " + string(job.State))
+	if job.State == JobFailed {
+		jm.events.Publish(&JobEvent{JobId: job.Id, Source: job.Source, BookId: job.BookId, State: job.State,
+			Event: model.Event{Type: model.EventError, Attempt: job.Attempts, Err: job.Err}})
+	}
+	jm.events.Publish(&JobEvent{JobId: job.Id, Source: job.Source, BookId: job.BookId, State: job.State,
+		Event: model.Event{Type: model.EventJobFinished, Attempt: job.Attempts, Progress: job.Progress, Err: job.Err}})
+	jm.persist(job)
+	jm.notify()
+}
+
+func (jm *JobManager) load() error {
+	file, err := os.Open(jm.file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	var jobs map[string]*Job
+	err = gob.NewDecoder(file).Decode(&jobs)
+	if err != nil {
+		return err
+	}
+	for id, job := range jobs {
+		job.jm = jm
+		if job.State == JobRunning {
+			job.State = JobQueued
+		}
+		jm.jobs[id] = job
+	}
+	return nil
+}
+
+// persist save the jobs after a change of the given ones, a failure is written to their logs.
+// Must be called with the lock held.
+func (jm *JobManager) persist(changed ...*Job) {
+	err := jm.save()
+	if err != nil {
+		for _, job := range changed {
+			job.log("jobs not saved, the change is lost on restart: " + err.Error())
+		}
+	}
+}
+
+// save drop the finished jobs past retention and persist the others, must be called with the lock held.
+func (jm *JobManager) save() error {
+	jm.prune()
+	tmp := jm.file + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(file).Encode(jm.jobs)
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, jm.file)
+}
+
+// prune keep the finished jobs updated within jobKeepFor, and at most jobKeep of them.
+func (jm *JobManager) prune() {
+	since := time.Now().Add(-jobKeepFor)
+	var finished []*Job
+	for id, job := range jm.jobs {
+		if job.active() {
+			continue
+		}
+		if job.Updated.Before(since) {
+			delete(jm.jobs, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if len(finished) <= jobKeep {
+		return
+	}
+	slices.SortFunc(finished, func(a, b *Job) int {
+		return b.Updated.Compare(a.Updated)
+	})
+	for _, job := range finished[jobKeep:] {
+		delete(jm.jobs, job.Id)
+	}
+}
+
+func sortJobs(list []*Job) {
+	slices.SortFunc(list, func(a, b *Job) int {
+		if a.Priority != b.Priority {
+			return b.Priority - a.Priority
+		}
+		return a.Created.Compare(b.Created)
+	})
+}
@@ -0,0 +1,270 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+)
+
+// testRunner a runner blocking until the job is stopped or given its result.
+type testRunner struct {
+	results chan error
+}
+
+func newTestRunner() *testRunner {
+	return &testRunner{results: make(chan error)}
+}
+
+func (tr *testRunner) run(ctx context.Context, job *Job) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-tr.results:
+		return err
+	}
+}
+
+// newTestJobManager a job manager stopped at the end of the test, once its running jobs are saved.
+func newTestJobManager(t *testing.T, ctx context.Context, file string, runner JobRunner) *JobManager {
+	ctx, cancel := context.WithCancel(ctx)
+	jm, err := NewJobManager(ctx, file, 1, runner)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		for {
+			jm.mux.Lock()
+			n := 0
+			for _, r := range jm.running {
+				n += r
+			}
+			jm.mux.Unlock()
+			if n == 0 {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+	return jm
+}
+
+func waitJob(t *testing.T, jm *JobManager, id string, state JobState) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := jm.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, not %s", id, job.State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJobTransitions(t *testing.T) {
+	tr := newTestRunner()
+	jm := newTestJobManager(t, context.Background(), path.Join(t.TempDir(), ".web.Jobs"), tr.run)
+	job, err := jm.Submit(JobRequest{Source: testSourceName, BookId: "1"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = jm.Submit(JobRequest{Source: testSourceName, BookId: "1"}, "", 0); !errors.Is(err, ErrJobExists) {
+		t.Fatal(err)
+	}
+	waitJob(t, jm, job.Id, JobRunning)
+
+	for _, step := range []struct {
+		action func(id string) error
+		err    error
+		state  JobState
+	}{
+		{jm.Resume, ErrJobState, JobRunning},
+		{jm.Retry, ErrJobState, JobRunning},
+		{jm.Pause, nil, JobPaused},
+		{jm.Pause, ErrJobState, JobPaused},
+		{jm.Resume, nil, JobRunning},
+		{jm.Cancel, nil, JobCanceled},
+		{jm.Resume, ErrJobState, JobCanceled},
+		{jm.Cancel, ErrJobState, JobCanceled},
+		{jm.Retry, nil, JobRunning},
+	} {
+		err = step.action(job.Id)
+		if !errors.Is(err, step.err) {
+			t.Fatal(step.state, err)
+		}
+		waitJob(t, jm, job.Id, step.state)
+	}
+
+	tr.results <- errors.New("broken")
+	failed := waitJob(t, jm, job.Id, JobFailed)
+	if failed.Err != "broken" || failed.Attempts != 3 {
+		t.Fatal(failed.Err, failed.Attempts)
+	}
+	if err = jm.Retry(job.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, jm, job.Id, JobRunning)
+	tr.results <- nil
+	done := waitJob(t, jm, job.Id, JobDone)
+	if done.Err != "" || done.Attempts != 4 {
+		t.Fatal(done.Err, done.Attempts)
+	}
+	for _, action := range []func(id string) error{jm.Cancel, jm.Pause, jm.Resume, jm.Retry} {
+		if err = action(job.Id); !errors.Is(err, ErrJobState) {
+			t.Fatal(err)
+		}
+	}
+	if err = jm.Cancel("none"); !errors.Is(err, ErrJobNotFound) {
+		t.Fatal(err)
+	}
+
+	// a queued job is paused and canceled without running
+	other, err := jm.Submit(JobRequest{Source: testSourceName, BookId: "2"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, jm, other.Id, JobRunning)
+	queued, err := jm.Submit(JobRequest{Source: testSourceName, BookId: "3"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = jm.Pause(queued.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err = jm.Cancel(queued.Id); err != nil {
+		t.Fatal(err)
+	}
+	if job := waitJob(t, jm, queued.Id, JobCanceled); job.Attempts != 0 {
+		t.Fatal(job.Attempts)
+	}
+}
+
+// TestJobPersist the jobs survive a restart, the interrupted ones are run again and the paused ones stay paused.
+func TestJobPersist(t *testing.T) {
+	file := path.Join(t.TempDir(), ".web.Jobs")
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := newTestRunner()
+	jm := newTestJobManager(t, ctx, file, tr.run)
+	running, err := jm.Submit(JobRequest{Source: testSourceName, BookId: "1", Priority: 1}, "reader", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, jm, running.Id, JobRunning)
+	paused, err := jm.Submit(JobRequest{Source: testSourceName, BookId: "2"}, "reader", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = jm.Pause(paused.Id); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	waitJob(t, jm, running.Id, JobQueued)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	tr = newTestRunner()
+	jm = newTestJobManager(t, ctx, file, tr.run)
+	job := waitJob(t, jm, running.Id, JobRunning)
+	if job.Attempts != 2 || job.Owner != "reader" || job.Priority != 1 || len(job.Logs) == 0 {
+		t.Fatal(job)
+	}
+	waitJob(t, jm, paused.Id, JobPaused)
+	tr.results <- nil
+	waitJob(t, jm, running.Id, JobDone)
+
+	// the finished job is saved too
+	jm = newTestJobManager(t, ctx, file, tr.run)
+	waitJob(t, jm, running.Id, JobDone)
+	waitJob(t, jm, paused.Id, JobPaused)
+}
+
+func TestJobSaveError(t *testing.T) {
+	jm := newTestJobManager(t, context.Background(), path.Join(t.TempDir(), "missing", ".web.Jobs"), newTestRunner().run)
+	_, err := jm.Submit(JobRequest{Source: testSourceName, BookId: "1"}, "", 0)
+	if err == nil || len(jm.List("")) != 0 {
+		t.Fatal("a job that can not be saved is accepted", err)
+	}
+}
+
+func TestJobRetention(t *testing.T) {
+	file := path.Join(t.TempDir(), ".web.Jobs")
+	jm := newTestJobManager(t, context.Background(), file, newTestRunner().run)
+	now := time.Now()
+	jm.mux.Lock()
+	for i := 0; i < jobKeep+10; i++ {
+		id := fmt.Sprintf("done-%d", i)
+		jm.jobs[id] = &Job{Id: id, State: JobDone, Updated: now.Add(-time.Duration(i) * time.Minute), jm: jm}
+	}
+	jm.jobs["old"] = &Job{Id: "old", State: JobFailed, Updated: now.Add(-jobKeepFor - time.Hour), jm: jm}
+	jm.jobs["paused"] = &Job{Id: "paused", State: JobPaused, Updated: now.Add(-jobKeepFor - time.Hour), jm: jm}
+	err := jm.save()
+	jm.mux.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jm = newTestJobManager(t, context.Background(), file, newTestRunner().run)
+	if n := len(jm.List("")); n != jobKeep+1 {
+		t.Fatal(n)
+	}
+	for id, kept := range map[string]bool{"done-0": true, fmt.Sprintf("done-%d", jobKeep-1): true,
+		fmt.Sprintf("done-%d", jobKeep): false, "old": false, "paused": true} {
+		if _, err = jm.Get(id); (err == nil) != kept {
+			t.Fatal(id, err)
+		}
+	}
+}
+
+// TestJobCancelFinishing a cancel landing while the runner returns either stops the job or fails, it never
+// succeeds on a job that then ends done.
+func TestJobCancelFinishing(t *testing.T) {
+	tr := newTestRunner()
+	jm := newTestJobManager(t, context.Background(), path.Join(t.TempDir(), ".web.Jobs"), tr.run)
+	for i := 0; i < 20; i++ {
+		job, err := jm.Submit(JobRequest{Source: testSourceName, BookId: fmt.Sprint(i)}, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitJob(t, jm, job.Id, JobRunning)
+
+		// the runner returns while the manager is busy, Cancel and the end of the run then race for the lock
+		jm.mux.Lock()
+		tr.results <- nil
+		time.Sleep(time.Millisecond)
+		errc := make(chan error)
+		go func() {
+			errc <- jm.Cancel(job.Id)
+		}()
+		time.Sleep(time.Millisecond)
+		jm.mux.Unlock()
+		err = <-errc
+
+		var final *Job
+		for final == nil {
+			j, err := jm.Get(job.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !j.active() {
+				final = j
+			}
+			time.Sleep(time.Millisecond)
+		}
+		switch {
+		case err == nil && final.State == JobCanceled:
+		case errors.Is(err, ErrJobState) && final.State == JobDone:
+		default:
+			t.Fatal(err, final.State)
+		}
+	}
+}
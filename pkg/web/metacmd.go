@@ -0,0 +1,173 @@
+package web
+
+import (
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"github.com/spf13/cobra"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type metaEditArgs struct {
+	Name        string   `json:"name" Barg:"name" Harg:"book title"`
+	Author      string   `json:"author" Barg:"author" Harg:"author"`
+	Series      string   `json:"series" Barg:"series" Harg:"series the book belongs to"`
+	Description string   `json:"description" Barg:"description" Harg:"description"`
+	Tags        []string `json:"tags" Barg:"tags" Harg:"tags, replacing the ones of the source"`
+	Cover       string   `json:"cover" Barg:"cover" Harg:"cover image file (jpeg, png, gif or webp)"`
+}
+
+var metaCmd = &cobra.Command{
+	Use:   "meta",
+	Short: "override the metadata of the cached books, every export uses it in place of the scraped one",
+}
+
+var metaShowCmd = &cobra.Command{
+	Use:   "show <source> <id>",
+	Short: "show the metadata set for the book",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := utils.GetKeyT[CacheConfig](cmd, "cfg")
+		m, err := loadMetadata(cfg.CacheDir, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		t := newTable()
+		t.AppendHeader(table.Row{"Field", "Value"})
+		t.AppendRow(table.Row{"Name", m.Name})
+		t.AppendRow(table.Row{"Author", m.Author})
+		t.AppendRow(table.Row{"Series", m.Series})
+		t.AppendRow(table.Row{"Description", m.Description})
+		t.AppendRow(table.Row{"Tags", strings.Join(m.Tags, ", ")})
+		cover := ""
+		if len(m.Cover) != 0 {
+			cover = fmt.Sprintf("%s, %s", http.DetectContentType(m.Cover), utils.FormatBytes(int64(len(m.Cover))))
+		}
+		t.AppendRow(table.Row{"Cover", cover})
+		ns := make([]int, 0, len(m.Volumes))
+		for n := range m.Volumes {
+			ns = append(ns, n)
+		}
+		slices.Sort(ns)
+		for _, n := range ns {
+			t.AppendRow(table.Row{fmt.Sprintf("Volume %d", n), m.Volumes[n]})
+		}
+		t.Render()
+		return nil
+	},
+}
+
+var metaEditCmd = &cobra.Command{
+	Use:   "edit <source> <id>",
+	Short: "set the given fields, a field given empty goes back to the scraped value",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := utils.GetKeyT[CacheConfig](cmd, "cfg")
+		ma := utils.GetKeyT[metaEditArgs](cmd, "args")
+		m, err := loadMetadata(cfg.CacheDir, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		flags := cmd.Flags()
+		if flags.Changed("name") {
+			m.Name = ma.Name
+		}
+		if flags.Changed("author") {
+			m.Author = ma.Author
+		}
+		if flags.Changed("series") {
+			m.Series = ma.Series
+		}
+		if flags.Changed("description") {
+			m.Description = ma.Description
+		}
+		if flags.Changed("tags") {
+			m.Tags = slices.DeleteFunc(ma.Tags, func(tag string) bool {
+				return strings.TrimSpace(tag) == ""
+			})
+		}
+		if flags.Changed("cover") {
+			m.Cover = nil
+			if ma.Cover != "" {
+				m.Cover, err = os.ReadFile(ma.Cover)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err = saveMetadata(cfg.CacheDir, args[0], args[1], m)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("metadata of %s %s saved\n", args[0], args[1])
+		return nil
+	},
+}
+
+var metaVolumeCmd = &cobra.Command{
+	Use:   "volume <source> <id> <number> [title]",
+	Short: "set the title of a volume counted from 1, without a title it goes back to the scraped one",
+	Args:  cobra.RangeArgs(3, 4),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := utils.GetKeyT[CacheConfig](cmd, "cfg")
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("%w: volume %s", model.ErrMetadata, args[2])
+		}
+		m, err := loadMetadata(cfg.CacheDir, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if len(args) == 4 && args[3] != "" {
+			if m.Volumes == nil {
+				m.Volumes = make(map[int]string)
+			}
+			m.Volumes[n] = args[3]
+		} else {
+			delete(m.Volumes, n)
+		}
+		err = saveMetadata(cfg.CacheDir, args[0], args[1], m)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("metadata of %s %s saved\n", args[0], args[1])
+		return nil
+	},
+}
+
+var metaRmCmd = &cobra.Command{
+	Use:   "rm <source> <id>",
+	Short: "remove the metadata set for the book",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := utils.GetKeyT[CacheConfig](cmd, "cfg")
+		err := saveMetadata(cfg.CacheDir, args[0], args[1], nil)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("metadata of %s %s removed\n", args[0], args[1])
+		return nil
+	},
+}
+
+func initMetaCmd(c *cobra.Command) {
+	c.AddCommand(metaCmd)
+
+	metaCmd.AddCommand(metaShowCmd)
+	utils.BindKey(metaShowCmd, "cfg", ptr(defaultCacheConfig()))
+
+	metaCmd.AddCommand(metaEditCmd)
+	utils.BindKey(metaEditCmd, "cfg", ptr(defaultCacheConfig()))
+	utils.BindKey(metaEditCmd, "args", new(metaEditArgs))
+
+	metaCmd.AddCommand(metaVolumeCmd)
+	utils.BindKey(metaVolumeCmd, "cfg", ptr(defaultCacheConfig()))
+
+	metaCmd.AddCommand(metaRmCmd)
+	utils.BindKey(metaRmCmd, "cfg", ptr(defaultCacheConfig()))
+}
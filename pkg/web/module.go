@@ -2,21 +2,32 @@ package web
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/peakedshout/novelpackager/pkg/epubx"
 	"github.com/peakedshout/novelpackager/pkg/model"
 	"github.com/peakedshout/novelpackager/pkg/rodx"
 	"github.com/peakedshout/novelpackager/pkg/utils"
+	"io"
 )
 
+var ErrUnknownSource = errors.New("unknown source")
+
 func getSource(name string) (Source, error) {
 	source, ok := sourceMap[name]
 	if !ok {
-		return nil, fmt.Errorf("unknown source: %s", name)
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSource, name)
 	}
 	return source, nil
 }
 
+func runJob(ctx context.Context, job *Job) error {
+	s, err := getSource(job.Source)
+	if err != nil {
+		return err
+	}
+	return s.Cache(ctx, job.BookId, job)
+}
+
 func buildSource(ctx *BuildContext) {
 	for _, s := range sourceList {
 		source := s(ctx)
@@ -44,8 +55,9 @@ type Source interface {
 	Name() string
 	GetInfo(ctx context.Context, id string, full bool) (*model.BookInfo, error)
 	Search(ctx context.Context, name string, full bool, noImg bool) ([]model.SearchResult, error)
-	Progress(ctx context.Context) map[string]string
-	Caching(ctx context.Context, id string) error
+	// Cache download the book into the cache dir, blocking until done; progress and logs go to the job.
+	Cache(ctx context.Context, id string, job *Job) error
 	EnableDownload(ctx context.Context, id string) ([]string, error)
-	Download(ctx context.Context, id string, vols ...int) (*epubx.FBytesData, error)
+	// Export stream the selected part of the cached book as one package of opts.Format (epub if empty), open is called with the file name before anything is written.
+	Export(ctx context.Context, id string, sel model.Selection, opts model.ExportOptions, open func(name string) (io.Writer, error)) error
 }
@@ -0,0 +1,648 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	opdsPrefix = "/opds"
+	opdsRecent = 50
+
+	opdsAtomNav    = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAtomAcq    = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsJSON       = "application/opds+json"
+	opdsPubJSON    = "application/opds-publication+json"
+	openSearchType = "application/opensearchdescription+xml"
+
+	relAcquisition = "http://opds-spec.org/acquisition"
+	relImage       = "http://opds-spec.org/image"
+	relThumbnail   = "http://opds-spec.org/image/thumbnail"
+)
+
+// opdsBook a cached book as the catalog shows it.
+type opdsBook struct {
+	Source  string
+	Id      string
+	Info    *model.BookInfo
+	Vols    []string
+	Updated time.Time
+}
+
+type opdsNav struct {
+	Title   string
+	Href    string
+	Count   int
+	Updated time.Time
+}
+
+// opdsFeed the format neutral feed, rendered as OPDS 1.2 (atom) or OPDS 2.0 (json).
+type opdsFeed struct {
+	Id      string
+	Title   string
+	Path    string
+	Updated time.Time
+	Nav     []opdsNav
+	Books   []*opdsBook
+	// Search the sources whose search is linked from the feed.
+	Search []string
+}
+
+// opdsCatalog the cached books, the records are only decoded again when they change on disk.
+type opdsCatalog struct {
+	cm    *CacheManager
+	mux   sync.Mutex
+	books map[string]*opdsCached
+}
+
+// opdsCached the book of a record as of its modTime, nil when the record is not fully cached or unreadable.
+type opdsCached struct {
+	modTime time.Time
+	book    *opdsBook
+}
+
+func newOPDSCatalog(cm *CacheManager) *opdsCatalog {
+	return &opdsCatalog{cm: cm, books: make(map[string]*opdsCached)}
+}
+
+// Books the books EnableDownload reports as cached, most recently updated first. The records being written or
+// unreadable are left out until they change.
+func (oc *opdsCatalog) Books(ctx context.Context) ([]*opdsBook, error) {
+	files, err := oc.cm.recordFiles(CacheFilter{Type: RecordType})
+	if err != nil {
+		return nil, err
+	}
+	oc.mux.Lock()
+	defer oc.mux.Unlock()
+	seen := make(map[string]bool, len(files))
+	var list []*opdsBook
+	for _, rf := range files {
+		seen[rf.Path] = true
+		c, ok := oc.books[rf.Path]
+		if !ok || !c.modTime.Equal(rf.ModTime) {
+			book, err := loadOPDSBook(ctx, rf)
+			if err != nil && ctx.Err() != nil {
+				// the request went away, the record is not at fault
+				return nil, ctx.Err()
+			}
+			c = &opdsCached{modTime: rf.ModTime, book: book}
+			oc.books[rf.Path] = c
+		}
+		if c.book != nil {
+			list = append(list, c.book)
+		}
+	}
+	for p := range oc.books {
+		if !seen[p] {
+			delete(oc.books, p)
+		}
+	}
+	slices.SortFunc(list, func(a, b *opdsBook) int {
+		return b.Updated.Compare(a.Updated)
+	})
+	return list, nil
+}
+
+// loadOPDSBook the book of the record, nil if it is not fully cached.
+func loadOPDSBook(ctx context.Context, rf recordFile) (*opdsBook, error) {
+	record, err := utils.LoadRecord(rf.Path)
+	if err != nil {
+		return nil, err
+	}
+	if record.Data == nil || !record.Data.Loaded {
+		return nil, nil
+	}
+	s, err := getSource(rf.Source)
+	if err != nil {
+		return nil, err
+	}
+	vols, err := s.EnableDownload(ctx, rf.Id)
+	if err != nil {
+		return nil, err
+	}
+	info := record.Info
+	if info == nil {
+		info = &model.BookInfo{Id: rf.Id}
+	}
+	return &opdsBook{Source: rf.Source, Id: rf.Id, Info: info, Vols: vols, Updated: rf.ModTime}, nil
+}
+
+func (sr *server) opdsHandler() http.Handler {
+	mux := http.NewServeMux()
+	for _, v2 := range []bool{false, true} {
+		base := opdsPrefix
+		if v2 {
+			base += "/v2"
+		}
+		feed := func(pattern string, fn func(r *http.Request, books []*opdsBook) (*opdsFeed, error)) {
+			mux.HandleFunc(http.MethodGet+" "+base+pattern, func(w http.ResponseWriter, r *http.Request) {
+				books, err := sr.opds.Books(r.Context())
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				f, err := fn(r, books)
+				if err != nil {
+					writeTextError(w, err)
+					return
+				}
+				if v2 {
+					f.writeJSON(w, base)
+				} else {
+					f.writeAtom(w, base)
+				}
+			})
+		}
+		feed("", sr.opdsRoot)
+		feed("/all", sr.opdsAll)
+		feed("/recent", sr.opdsRecent)
+		feed("/sources", sr.opdsSources)
+		feed("/sources/{source}", sr.opdsSource)
+		feed("/authors", sr.opdsAuthors)
+		feed("/authors/{author}", sr.opdsAuthor)
+		feed("/search/{source}", sr.opdsSearch)
+	}
+	mux.HandleFunc(http.MethodGet+" "+opdsPrefix+"/search/{source}/opensearch.xml", sr.openSearch)
+	mux.HandleFunc(http.MethodGet+" "+opdsPrefix+"/books/{source}/{id}/cover", sr.opdsCover)
+	mux.HandleFunc(http.MethodGet+" "+opdsPrefix+"/books/{source}/{id}/epub", sr.opdsEpub)
+	return mux
+}
+
+func (sr *server) opdsRoot(r *http.Request, books []*opdsBook) (*opdsFeed, error) {
+	f := &opdsFeed{Id: "root", Title: "novelpackager", Search: sourceNames()}
+	f.Nav = []opdsNav{
+		{Title: "Recently updated", Href: "/recent", Count: min(len(books), opdsRecent)},
+		{Title: "By source", Href: "/sources", Count: len(sourceNames())},
+		{Title: "By author", Href: "/authors", Count: len(groupAuthors(books))},
+		{Title: "All books", Href: "/all", Count: len(books)},
+	}
+	if len(books) > 0 {
+		f.Updated = books[0].Updated
+		for i := range f.Nav {
+			f.Nav[i].Updated = f.Updated
+		}
+	}
+	return f, nil
+}
+
+func (sr *server) opdsAll(r *http.Request, books []*opdsBook) (*opdsFeed, error) {
+	books = slices.Clone(books)
+	slices.SortFunc(books, func(a, b *opdsBook) int {
+		return strings.Compare(a.Info.Name, b.Info.Name)
+	})
+	return newBookFeed("all", "All books", books), nil
+}
+
+func (sr *server) opdsRecent(r *http.Request, books []*opdsBook) (*opdsFeed, error) {
+	return newBookFeed("recent", "Recently updated", books[:min(len(books), opdsRecent)]), nil
+}
+
+func (sr *server) opdsSources(r *http.Request, books []*opdsBook) (*opdsFeed, error) {
+	f := &opdsFeed{Id: "sources", Title: "By source"}
+	for _, name := range sourceNames() {
+		nav := opdsNav{Title: name, Href: "/sources/" + url.PathEscape(name)}
+		for _, book := range books {
+			if book.Source == name {
+				nav.Count++
+				nav.Updated = maxTime(nav.Updated, book.Updated)
+			}
+		}
+		f.Updated = maxTime(f.Updated, nav.Updated)
+		f.Nav = append(f.Nav, nav)
+	}
+	return f, nil
+}
+
+func (sr *server) opdsSource(r *http.Request, books []*opdsBook) (*opdsFeed, error) {
+	name := r.PathValue("source")
+	_, err := getSource(name)
+	if err != nil {
+		return nil, err
+	}
+	var list []*opdsBook
+	for _, book := range books {
+		if book.Source == name {
+			list = append(list, book)
+		}
+	}
+	f := newBookFeed("sources/"+name, name, list)
+	f.Path = "/sources/" + url.PathEscape(name)
+	f.Search = []string{name}
+	return f, nil
+}
+
+func (sr *server) opdsAuthors(r *http.Request, books []*opdsBook) (*opdsFeed, error) {
+	f := &opdsFeed{Id: "authors", Title: "By author"}
+	groups := groupAuthors(books)
+	authors := make([]string, 0, len(groups))
+	for author := range groups {
+		authors = append(authors, author)
+	}
+	slices.Sort(authors)
+	for _, author := range authors {
+		nav := opdsNav{Title: author, Href: "/authors/" + url.PathEscape(author), Count: len(groups[author])}
+		for _, book := range groups[author] {
+			nav.Updated = maxTime(nav.Updated, book.Updated)
+		}
+		f.Updated = maxTime(f.Updated, nav.Updated)
+		f.Nav = append(f.Nav, nav)
+	}
+	return f, nil
+}
+
+func (sr *server) opdsAuthor(r *http.Request, books []*opdsBook) (*opdsFeed, error) {
+	author := r.PathValue("author")
+	list, ok := groupAuthors(books)[author]
+	if !ok {
+		return nil, fmt.Errorf("author %s: %w", author, os.ErrNotExist)
+	}
+	f := newBookFeed("authors/"+author, author, list)
+	f.Path = "/authors/" + url.PathEscape(author)
+	return f, nil
+}
+
+// opdsSearch run the search of the source, only the results already cached can be acquired.
+func (sr *server) opdsSearch(r *http.Request, books []*opdsBook) (*opdsFeed, error) {
+	s, err := getSource(r.PathValue("source"))
+	if err != nil {
+		return nil, err
+	}
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		q = r.URL.Query().Get("query")
+	}
+	if q == "" {
+		return nil, badRequest(errors.New("empty search"))
+	}
+	results, err := s.Search(r.Context(), q, false, false)
+	if err != nil {
+		return nil, err
+	}
+	cached := make(map[string]*opdsBook)
+	for _, book := range books {
+		if book.Source == s.Name() {
+			cached[book.Id] = book
+		}
+	}
+	var list []*opdsBook
+	for _, result := range results {
+		book, ok := cached[result.Id]
+		if !ok {
+			book = &opdsBook{Source: s.Name(), Id: result.Id, Info: &model.BookInfo{
+				Name:        result.Name,
+				Id:          result.Id,
+				Author:      result.Author,
+				Cover:       result.Cover,
+				Description: result.Description,
+			}}
+		}
+		list = append(list, book)
+	}
+	f := newBookFeed("search/"+s.Name()+"/"+q, fmt.Sprintf("%s: %s", s.Name(), q), list)
+	f.Path = "/search/" + url.PathEscape(s.Name()) + "?q=" + url.QueryEscape(q)
+	f.Search = []string{s.Name()}
+	return f, nil
+}
+
+type openSearchDesc struct {
+	XMLName     xml.Name        `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName   string          `xml:"ShortName"`
+	Description string          `xml:"Description"`
+	Encoding    string          `xml:"InputEncoding"`
+	Urls        []openSearchUrl `xml:"Url"`
+}
+
+type openSearchUrl struct {
+	Type     string `xml:"type,attr"`
+	Template string `xml:"template,attr"`
+}
+
+func (sr *server) openSearch(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("source")
+	_, err := getSource(name)
+	if err != nil {
+		writeTextError(w, err)
+		return
+	}
+	search := "/search/" + url.PathEscape(name) + "?q={searchTerms}"
+	desc := openSearchDesc{
+		ShortName:   name,
+		Description: "search " + name,
+		Encoding:    "UTF-8",
+		Urls: []openSearchUrl{
+			{Type: opdsAtomAcq, Template: opdsPrefix + search},
+			{Type: opdsJSON, Template: opdsPrefix + "/v2" + search},
+		},
+	}
+	w.Header().Set("Content-Type", openSearchType)
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(desc)
+}
+
+func (sr *server) opdsCover(w http.ResponseWriter, r *http.Request) {
+	book, err := sr.opdsBook(r)
+	if err != nil {
+		writeTextError(w, err)
+		return
+	}
+	if len(book.Info.Cover) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(book.Info.Cover))
+	w.Header().Set("Cache-Control", "max-age=86400")
+	_, _ = w.Write(book.Info.Cover)
+}
+
+// opdsEpub stream the epub the same way the download api does, so it counts against the daily quota.
+func (sr *server) opdsEpub(w http.ResponseWriter, r *http.Request) {
+	_, err := sr.apiExport(w, r)
+	if err != nil {
+		writeTextError(w, err)
+	}
+}
+
+func (sr *server) opdsBook(r *http.Request) (*opdsBook, error) {
+	books, err := sr.opds.Books(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	source, id := r.PathValue("source"), r.PathValue("id")
+	for _, book := range books {
+		if book.Source == source && book.Id == id {
+			return book, nil
+		}
+	}
+	return nil, fmt.Errorf("book %s %s: %w", source, id, os.ErrNotExist)
+}
+
+func newBookFeed(id, title string, books []*opdsBook) *opdsFeed {
+	f := &opdsFeed{Id: id, Title: title, Books: books}
+	for _, book := range books {
+		f.Updated = maxTime(f.Updated, book.Updated)
+	}
+	return f
+}
+
+func groupAuthors(books []*opdsBook) map[string][]*opdsBook {
+	m := make(map[string][]*opdsBook)
+	for _, book := range books {
+		author := book.Info.Author
+		if author == "" {
+			author = "unknown"
+		}
+		m[author] = append(m[author], book)
+	}
+	return m
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+func (f *opdsFeed) path() string {
+	if f.Path != "" {
+		return f.Path
+	}
+	if f.Id == "root" {
+		return ""
+	}
+	return "/" + f.Id
+}
+
+func (f *opdsFeed) updated() time.Time {
+	if f.Updated.IsZero() {
+		return time.Now()
+	}
+	return f.Updated
+}
+
+func (b *opdsBook) urn() string {
+	return "urn:novelpackager:" + b.Source + ":" + b.Id
+}
+
+func (b *opdsBook) href(suffix string) string {
+	return opdsPrefix + "/books/" + url.PathEscape(b.Source) + "/" + url.PathEscape(b.Id) + suffix
+}
+
+// acquisitions the whole book first, then each volume on its own.
+func (b *opdsBook) acquisitions() []opdsLink {
+	if len(b.Vols) == 0 {
+		return nil
+	}
+	links := []opdsLink{{Rel: relAcquisition, Href: b.href("/epub"), Type: formatTypes[FormatEpub], Title: b.Info.Name}}
+	if len(b.Vols) > 1 {
+		for i, vol := range b.Vols {
+			links = append(links, opdsLink{
+				Rel: relAcquisition, Href: b.href("/epub?vols=" + strconv.Itoa(i+1)), Type: formatTypes[FormatEpub], Title: vol,
+			})
+		}
+	}
+	return links
+}
+
+type opdsLink struct {
+	Rel       string `xml:"rel,attr,omitempty" json:"rel,omitempty"`
+	Href      string `xml:"href,attr" json:"href"`
+	Type      string `xml:"type,attr,omitempty" json:"type,omitempty"`
+	Title     string `xml:"title,attr,omitempty" json:"title,omitempty"`
+	Count     int    `xml:"http://purl.org/syndication/thread/1.0 count,attr,omitempty" json:"-"`
+	Templated bool   `xml:"-" json:"templated,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []opdsLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Authors []atomName  `xml:"author"`
+	Content *atomText   `xml:"content,omitempty"`
+	Links   []opdsLink  `xml:"link"`
+	Subject []atomLabel `xml:"category,omitempty"`
+}
+
+type atomName struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomLabel struct {
+	Term string `xml:"term,attr"`
+}
+
+func (f *opdsFeed) writeAtom(w http.ResponseWriter, base string) {
+	kind := opdsAtomNav
+	if f.Nav == nil {
+		kind = opdsAtomAcq
+	}
+	af := &atomFeed{
+		Id:      "urn:novelpackager:opds:" + f.Id,
+		Title:   f.Title,
+		Updated: f.updated().Format(time.RFC3339),
+		Links: []opdsLink{
+			{Rel: "self", Href: base + f.path(), Type: kind},
+			{Rel: "start", Href: base, Type: opdsAtomNav},
+		},
+	}
+	for _, name := range f.Search {
+		af.Links = append(af.Links, opdsLink{
+			Rel: "search", Href: opdsPrefix + "/search/" + url.PathEscape(name) + "/opensearch.xml",
+			Type: openSearchType, Title: name,
+		})
+	}
+	for _, nav := range f.Nav {
+		if nav.Updated.IsZero() {
+			nav.Updated = f.updated()
+		}
+		af.Entries = append(af.Entries, atomEntry{
+			Id:      "urn:novelpackager:opds" + nav.Href,
+			Title:   nav.Title,
+			Updated: maxTime(nav.Updated, f.Updated).Format(time.RFC3339),
+			Content: &atomText{Type: "text", Text: fmt.Sprintf("%d", nav.Count)},
+			Links:   []opdsLink{{Rel: "subsection", Href: base + nav.Href, Type: kindOf(nav.Href), Count: nav.Count}},
+		})
+	}
+	for _, book := range f.Books {
+		updated := book.Updated
+		if updated.IsZero() {
+			updated = f.updated()
+		}
+		e := atomEntry{
+			Id:      book.urn(),
+			Title:   book.Info.Name,
+			Updated: updated.Format(time.RFC3339),
+			Links:   book.acquisitions(),
+		}
+		if book.Info.Author != "" {
+			e.Authors = []atomName{{Name: book.Info.Author}}
+		}
+		if book.Info.Description != "" {
+			e.Content = &atomText{Type: "text", Text: book.Info.Description}
+		}
+		for _, meta := range book.Info.Metas {
+			e.Subject = append(e.Subject, atomLabel{Term: meta})
+		}
+		if len(book.Info.Cover) > 0 && book.Vols != nil {
+			e.Links = append(e.Links,
+				opdsLink{Rel: relImage, Href: book.href("/cover"), Type: http.DetectContentType(book.Info.Cover)},
+				opdsLink{Rel: relThumbnail, Href: book.href("/cover"), Type: http.DetectContentType(book.Info.Cover)},
+			)
+		}
+		af.Entries = append(af.Entries, e)
+	}
+	w.Header().Set("Content-Type", kind+";charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(af)
+}
+
+// kindOf tell an acquisition feed from a navigation one by its path.
+func kindOf(href string) string {
+	if href == "/sources" || href == "/authors" {
+		return opdsAtomNav
+	}
+	return opdsAtomAcq
+}
+
+type opds2Feed struct {
+	Metadata     opds2Metadata `json:"metadata"`
+	Links        []opdsLink    `json:"links"`
+	Navigation   []opdsLink    `json:"navigation,omitempty"`
+	Publications []opds2Pub    `json:"publications,omitempty"`
+}
+
+type opds2Metadata struct {
+	Type          string    `json:"@type,omitempty"`
+	Title         string    `json:"title"`
+	Identifier    string    `json:"identifier,omitempty"`
+	Author        string    `json:"author,omitempty"`
+	Description   string    `json:"description,omitempty"`
+	Subject       []string  `json:"subject,omitempty"`
+	Modified      time.Time `json:"modified"`
+	NumberOfItems int       `json:"numberOfItems,omitempty"`
+}
+
+type opds2Pub struct {
+	Metadata opds2Metadata `json:"metadata"`
+	Links    []opdsLink    `json:"links"`
+	Images   []opdsLink    `json:"images,omitempty"`
+}
+
+func (f *opdsFeed) writeJSON(w http.ResponseWriter, base string) {
+	of := &opds2Feed{
+		Metadata: opds2Metadata{Title: f.Title, Modified: f.updated()},
+		Links: []opdsLink{
+			{Rel: "self", Href: base + f.path(), Type: opdsJSON},
+			{Rel: "start", Href: base, Type: opdsJSON},
+		},
+	}
+	if f.Nav == nil {
+		of.Metadata.NumberOfItems = len(f.Books)
+	}
+	for _, name := range f.Search {
+		of.Links = append(of.Links, opdsLink{
+			Rel: "search", Href: base + "/search/" + url.PathEscape(name) + "{?query}",
+			Type: opdsJSON, Title: name, Templated: true,
+		})
+	}
+	for _, nav := range f.Nav {
+		of.Navigation = append(of.Navigation, opdsLink{
+			Rel: "subsection", Href: base + nav.Href, Type: opdsJSON, Title: nav.Title,
+		})
+	}
+	for _, book := range f.Books {
+		updated := book.Updated
+		if updated.IsZero() {
+			updated = f.updated()
+		}
+		p := opds2Pub{
+			Metadata: opds2Metadata{
+				Type:        "http://schema.org/Book",
+				Title:       book.Info.Name,
+				Identifier:  book.urn(),
+				Author:      book.Info.Author,
+				Description: book.Info.Description,
+				Subject:     book.Info.Metas,
+				Modified:    updated,
+			},
+			Links: book.acquisitions(),
+		}
+		if p.Links == nil {
+			// not cached yet, clients still need one link per publication
+			p.Links = []opdsLink{{Rel: "self", Href: base + f.path(), Type: opdsPubJSON}}
+		}
+		if len(book.Info.Cover) > 0 && book.Vols != nil {
+			p.Images = []opdsLink{{Href: book.href("/cover"), Type: http.DetectContentType(book.Info.Cover)}}
+		}
+		of.Publications = append(of.Publications, p)
+	}
+	w.Header().Set("Content-Type", opdsJSON)
+	_ = json.NewEncoder(w).Encode(of)
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOPDSBooks a record being written or broken is left out of the catalog instead of failing it, and the
+// records are only decoded again once they change.
+func TestOPDSBooks(t *testing.T) {
+	sr, _ := newTestServer(t)
+	writeTestRecord(t, sr.cm.dir, "1", "Book")
+	err := os.WriteFile(path.Join(sr.cm.dir, "test_2.np"), []byte("torn"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	books, err := sr.opds.Books(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 || books[0].Id != "1" || len(books[0].Vols) != 2 {
+		t.Fatal(books)
+	}
+	again, err := sr.opds.Books(context.Background())
+	if err != nil || len(again) != 1 || again[0] != books[0] {
+		t.Fatal("the unchanged record was decoded again", err)
+	}
+
+	// the broken record is repaired
+	p := writeTestRecord(t, sr.cm.dir, "2", "Second")
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(p, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, err = sr.opds.Books(context.Background())
+	if err != nil || len(books) != 2 || books[0].Id != "2" {
+		t.Fatal(books, err)
+	}
+
+	w := httptest.NewRecorder()
+	sr.opdsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, opdsPrefix+"/recent", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Second") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
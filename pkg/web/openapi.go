@@ -0,0 +1,190 @@
+package web
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var pathParamRegexp = regexp.MustCompile(`\{(\w+)}`)
+
+// openAPI build the OpenAPI 3 document of the api routes, the schemas come from the Go types by reflection.
+func openAPI(prefix string, routes []*apiRoute) map[string]any {
+	sg := &schemaGen{schemas: make(map[string]any)}
+	paths := make(map[string]any)
+	for _, route := range routes {
+		p := prefix + route.Pattern
+		item, ok := paths[p].(map[string]any)
+		if !ok {
+			item = make(map[string]any)
+			paths[p] = item
+		}
+
+		var params []any
+		for _, m := range pathParamRegexp.FindAllStringSubmatch(route.Pattern, -1) {
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, q := range route.Query {
+			params = append(params, map[string]any{
+				"name": q.Name, "in": "query", "description": q.Desc, "schema": map[string]any{"type": q.Type},
+			})
+		}
+
+		status := route.status()
+		ok200 := map[string]any{"description": http.StatusText(status)}
+		switch {
+		case len(route.ContentTypes) != 0:
+			content := make(map[string]any, len(route.ContentTypes))
+			for _, ct := range route.ContentTypes {
+				content[ct] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}
+			}
+			ok200["content"] = content
+		case route.Resp != nil:
+			ok200["content"] = map[string]any{"application/json": map[string]any{
+				"schema": sg.schema(reflect.TypeOf(route.Resp)),
+			}}
+		}
+		op := map[string]any{
+			"operationId": route.Id,
+			"summary":     route.Summary,
+			"tags":        []string{route.Tag},
+			"responses": map[string]any{
+				strconv.Itoa(status): ok200,
+				"default": map[string]any{
+					"description": "error",
+					"content": map[string]any{"application/json": map[string]any{
+						"schema": sg.schema(reflect.TypeOf(APIError{})),
+					}},
+				},
+			},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if route.Public {
+			op["security"] = []any{}
+		}
+		if route.Body != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{"application/json": map[string]any{
+					"schema": sg.schema(reflect.TypeOf(route.Body)),
+				}},
+			}
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "novelpackager",
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": sg.schemas,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"basic":  map[string]any{"type": "http", "scheme": "basic"},
+			},
+		},
+		"security": []any{
+			map[string]any{"bearer": []string{}},
+			map[string]any{"apiKey": []string{}},
+			map[string]any{"basic": []string{}},
+		},
+	}
+}
+
+type schemaGen struct {
+	schemas map[string]any
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (sg *schemaGen) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]any{"type": "string", "format": "byte"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": sg.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": sg.schema(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		ref := map[string]any{"$ref": "#/components/schemas/" + name}
+		if _, ok := sg.schemas[name]; ok {
+			return ref
+		}
+		// placeholder first, the type may refer to itself
+		sg.schemas[name] = map[string]any{}
+		props := make(map[string]any)
+		sg.fields(t, props)
+		sg.schemas[name] = map[string]any{"type": "object", "properties": props}
+		return ref
+	default:
+		return map[string]any{}
+	}
+}
+
+func (sg *schemaGen) fields(t reflect.Type, props map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				sg.fields(ft, props)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = sg.schema(f.Type)
+	}
+}
+
+func schemaName(t reflect.Type) string {
+	pkg := t.PkgPath()
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		pkg = pkg[i+1:]
+	}
+	name := t.Name()
+	if i := strings.Index(name, "["); i >= 0 {
+		name = name[:i]
+	}
+	return pkg + "." + name
+}
@@ -0,0 +1,38 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAPIContentTypes(t *testing.T) {
+	sr, _ := newTestServer(t)
+	w := httptest.NewRecorder()
+	sr.apiHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, apiV1+"/openapi.json", nil))
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Responses map[string]struct {
+				Content map[string]any `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := doc.Paths[apiV1+"/exports/{source}/{id}"]["get"].Responses["200"].Content
+	if len(content) != len(formatTypes) {
+		t.Fatal(content)
+	}
+	for format, typ := range formatTypes {
+		if _, ok := content[typ]; !ok {
+			t.Fatal("the media type of", format, "is missing", content)
+		}
+	}
+	events := doc.Paths[apiV1+"/events"]["get"].Responses["200"].Content
+	if _, ok := events["text/event-stream"]; !ok || len(events) != 1 {
+		t.Fatal(events)
+	}
+}
@@ -0,0 +1,353 @@
+package web
+
+import (
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/textx"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	readerPrefix = "/read"
+	// readerBooks how many loaded records the reader keeps, a record holds every chapter and image of a book.
+	readerBooks = 4
+)
+
+type readerBook struct {
+	source  string
+	id      string
+	modTime time.Time
+	used    time.Time
+	record  *utils.Record
+	lc      *utils.LinkCache
+
+	// issues the flagged chapters, analysed once per loaded record
+	issuesOnce sync.Once
+	issues     []textx.Issue
+}
+
+// readerChapter a loaded chapter, Vol and Chapter count from 1 like the export vols.
+type readerChapter struct {
+	Vol     int
+	Chapter int
+	VolName string
+	Name    string
+}
+
+func (c readerChapter) Href() string {
+	return fmt.Sprintf("%d/%d", c.Vol, c.Chapter)
+}
+
+// bookReader serve the cached chapters as html, the records are kept loaded while they are unchanged on disk.
+type bookReader struct {
+	dir   string
+	mux   sync.Mutex
+	books map[string]*readerBook
+}
+
+func newBookReader(dir string) *bookReader {
+	return &bookReader{dir: dir, books: make(map[string]*readerBook)}
+}
+
+func (br *bookReader) load(source, id string) (*readerBook, error) {
+	_, err := getSource(source)
+	if err != nil {
+		return nil, err
+	}
+	p, err := recordPath(br.dir, source, id)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s %s", ErrNotCached, source, id)
+	}
+	br.mux.Lock()
+	defer br.mux.Unlock()
+	rb, ok := br.books[p]
+	if ok && rb.modTime.Equal(fi.ModTime()) {
+		rb.used = time.Now()
+		return rb, nil
+	}
+	record, err := utils.LoadRecord(p)
+	if err != nil {
+		return nil, err
+	}
+	if record.Info == nil || record.Data == nil {
+		return nil, fmt.Errorf("%w: %s %s", ErrNotCached, source, id)
+	}
+	lc := utils.NewLinkCache()
+	lc.Import(record.Cache)
+	rb = &readerBook{source: source, id: id, modTime: fi.ModTime(), used: time.Now(), record: record, lc: lc}
+	br.books[p] = rb
+	for len(br.books) > readerBooks {
+		var oldest string
+		for k, b := range br.books {
+			if oldest == "" || b.used.Before(br.books[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(br.books, oldest)
+	}
+	return rb, nil
+}
+
+// chapters the chapters that can be read, in reading order.
+func (rb *readerBook) chapters() []readerChapter {
+	var list []readerChapter
+	for i, vi := range rb.record.Info.Volumes {
+		if i >= len(rb.record.Data.Volumes) {
+			break
+		}
+		vd := rb.record.Data.Volumes[i]
+		for k, ci := range vi.Chapters {
+			if k >= len(vd.Chapters) || vd.Chapters[k] == nil || !vd.Chapters[k].Loaded {
+				continue
+			}
+			list = append(list, readerChapter{Vol: i + 1, Chapter: k + 1, VolName: vi.Name, Name: ci.Name})
+		}
+	}
+	return list
+}
+
+// bookIssues the chapters of the cached book flagged by textx.Analyze.
+func (sr *server) bookIssues(source, id string) ([]textx.Issue, error) {
+	rb, err := sr.reader.load(source, id)
+	if err != nil {
+		return nil, err
+	}
+	rb.issuesOnce.Do(func() {
+		rb.issues = textx.Analyze(rb.record.Info, rb.record.Data)
+		if rb.issues == nil {
+			rb.issues = []textx.Issue{}
+		}
+	})
+	return rb.issues, nil
+}
+
+func (rb *readerBook) base() string {
+	return readerPrefix + "/" + url.PathEscape(rb.source) + "/" + url.PathEscape(rb.id) + "/"
+}
+
+func (sr *server) readerHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+readerPrefix+"/{source}/{id}", sr.readStart)
+	mux.HandleFunc("GET "+readerPrefix+"/{source}/{id}/toc", sr.readToc)
+	mux.HandleFunc("GET "+readerPrefix+"/{source}/{id}/images/{img}", sr.readImage)
+	mux.HandleFunc("GET "+readerPrefix+"/{source}/{id}/{vol}/{chapter}", sr.readChapter)
+	return mux
+}
+
+// readStart continue where the user stopped, or open the first cached chapter.
+func (sr *server) readStart(w http.ResponseWriter, r *http.Request) {
+	rb, err := sr.reader.load(r.PathValue("source"), r.PathValue("id"))
+	if err != nil {
+		writeTextError(w, err)
+		return
+	}
+	chapters := rb.chapters()
+	if len(chapters) == 0 {
+		writeTextError(w, fmt.Errorf("%w: no chapter is cached", ErrNotCached))
+		return
+	}
+	next := chapters[0]
+	if pos, ok := sr.um.Position(userFrom(r).Name, rb.source, rb.id); ok {
+		for _, c := range chapters {
+			if c.Vol == pos.Vol && c.Chapter == pos.Chapter {
+				next = c
+				break
+			}
+		}
+	}
+	http.Redirect(w, r, rb.base()+next.Href(), http.StatusFound)
+}
+
+func (sr *server) readToc(w http.ResponseWriter, r *http.Request) {
+	rb, err := sr.reader.load(r.PathValue("source"), r.PathValue("id"))
+	if err != nil {
+		writeTextError(w, err)
+		return
+	}
+	type tocVolume struct {
+		Name     string
+		Chapters []readerChapter
+	}
+	var vols []*tocVolume
+	for _, c := range rb.chapters() {
+		if len(vols) == 0 || vols[len(vols)-1].Name != c.VolName {
+			vols = append(vols, &tocVolume{Name: c.VolName})
+		}
+		vols[len(vols)-1].Chapters = append(vols[len(vols)-1].Chapters, c)
+	}
+	renderReader(w, "toc", map[string]any{
+		"Book":    rb.record.Info.Name,
+		"Author":  rb.record.Info.Author,
+		"Base":    rb.base(),
+		"Volumes": vols,
+	})
+}
+
+func (sr *server) readChapter(w http.ResponseWriter, r *http.Request) {
+	rb, err := sr.reader.load(r.PathValue("source"), r.PathValue("id"))
+	if err != nil {
+		writeTextError(w, err)
+		return
+	}
+	vol, err1 := strconv.Atoi(r.PathValue("vol"))
+	chapter, err2 := strconv.Atoi(r.PathValue("chapter"))
+	if err1 != nil || err2 != nil {
+		http.NotFound(w, r)
+		return
+	}
+	chapters := rb.chapters()
+	i := -1
+	for k, c := range chapters {
+		if c.Vol == vol && c.Chapter == chapter {
+			i = k
+			break
+		}
+	}
+	if i < 0 {
+		writeTextError(w, fmt.Errorf("%w: chapter %d of volume %d", ErrNotCached, chapter, vol))
+		return
+	}
+	data := map[string]any{
+		"Book":    rb.record.Info.Name,
+		"Base":    rb.base(),
+		"Chapter": chapters[i],
+		"Content": template.HTML(strings.Join(rb.record.Data.Volumes[vol-1].Chapters[chapter-1].Data, "\n")),
+		"Save":    apiV1 + "/me/reading/" + url.PathEscape(rb.source) + "/" + url.PathEscape(rb.id),
+		"Offset":  0.0,
+		"Updated": int64(0),
+	}
+	if i > 0 {
+		data["Prev"] = chapters[i-1].Href()
+	}
+	if i+1 < len(chapters) {
+		data["Next"] = chapters[i+1].Href()
+	}
+	if pos, ok := sr.um.Position(userFrom(r).Name, rb.source, rb.id); ok && pos.Vol == vol && pos.Chapter == chapter {
+		data["Offset"] = pos.Offset
+		data["Updated"] = pos.Updated.UnixMilli()
+	}
+	renderReader(w, "chapter", data)
+}
+
+func (sr *server) readImage(w http.ResponseWriter, r *http.Request) {
+	rb, err := sr.reader.load(r.PathValue("source"), r.PathValue("id"))
+	if err != nil {
+		writeTextError(w, err)
+		return
+	}
+	data := rb.lc.Get(r.PathValue("img"))
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "max-age=86400")
+	_, _ = w.Write(data)
+}
+
+func renderReader(w http.ResponseWriter, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := readerTemplate.ExecuteTemplate(w, name, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var readerTemplate = template.Must(template.New("reader").Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.}}</title>
+<style>
+body { max-width: 46em; margin: 0 auto; padding: 1em; font: 1.1em/1.8 serif; color: #222; background: #fbf8f1; }
+nav { display: flex; justify-content: space-between; margin: 1em 0; font-family: sans-serif; }
+a { color: #2f6f9f; text-decoration: none; }
+a.off { visibility: hidden; }
+img { max-width: 100%; height: auto; display: block; margin: 1em auto; }
+h1, h2 { font-family: sans-serif; }
+ul { padding-left: 1.2em; }
+@media (prefers-color-scheme: dark) { body { color: #ccc; background: #1d1d1d; } a { color: #7fb3dd; } }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "toc"}}{{template "head" .Book}}
+<h1>{{.Book}}</h1>
+<p>{{.Author}}</p>
+{{range .Volumes}}<h2>{{.Name}}</h2>
+<ul>{{range .Chapters}}<li><a href="{{$.Base}}{{.Href}}">{{.Name}}</a></li>{{end}}</ul>
+{{else}}<p>no chapter is cached</p>{{end}}
+</body>
+</html>
+{{end}}
+
+{{define "nav"}}<nav>
+<a id="prev" href="{{if .Prev}}{{.Base}}{{.Prev}}{{end}}" {{if not .Prev}}class="off"{{end}}>&larr; prev</a>
+<a href="{{.Base}}toc">contents</a>
+<a id="next" href="{{if .Next}}{{.Base}}{{.Next}}{{end}}" {{if not .Next}}class="off"{{end}}>next &rarr;</a>
+</nav>
+{{end}}
+
+{{define "chapter"}}{{template "head" .Chapter.Name}}
+{{template "nav" .}}
+<h2>{{.Chapter.VolName}}</h2>
+<h1>{{.Chapter.Name}}</h1>
+<article>
+{{.Content}}
+</article>
+{{template "nav" .}}
+<script>
+(function () {
+  var pos = {vol: {{.Chapter.Vol}}, chapter: {{.Chapter.Chapter}}, offset: {{.Offset}}};
+  var key = "np_read:" + {{.Base}};
+  var local = JSON.parse(localStorage.getItem(key) || "null");
+  // without accounts the position only lives in the browser, and it is newer if the last save did not reach the server
+  if (local && local.vol === pos.vol && local.chapter === pos.chapter && local.time > {{.Updated}}) {
+    pos.offset = local.offset;
+  }
+  window.addEventListener("load", function () {
+    window.scrollTo(0, pos.offset * (document.body.scrollHeight - window.innerHeight));
+    save();
+  });
+  var timer = null;
+  function save() {
+    var max = document.body.scrollHeight - window.innerHeight;
+    pos.offset = max > 0 ? Math.min(1, window.scrollY / max) : 0;
+    localStorage.setItem(key, JSON.stringify({vol: pos.vol, chapter: pos.chapter, offset: pos.offset, time: Date.now()}));
+    fetch({{.Save}}, {
+      method: "PUT", credentials: "same-origin", keepalive: true,
+      headers: {"Content-Type": "application/json"}, body: JSON.stringify(pos)
+    }).catch(function () {});
+  }
+  window.addEventListener("scroll", function () {
+    clearTimeout(timer);
+    timer = setTimeout(save, 2000);
+  });
+  document.addEventListener("visibilitychange", function () {
+    if (document.visibilityState === "hidden") save();
+  });
+  document.addEventListener("keydown", function (e) {
+    var a = e.key === "ArrowLeft" ? "prev" : e.key === "ArrowRight" ? "next" : "";
+    var link = a && document.getElementById(a);
+    if (link && link.getAttribute("href")) location.href = link.getAttribute("href");
+  });
+})();
+</script>
+</body>
+</html>
+{{end}}
+`))
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readerGet(sr *server, target string, u *User) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if u != nil {
+		r = withUser(r, u)
+	}
+	w := httptest.NewRecorder()
+	sr.readerHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestReaderChapter(t *testing.T) {
+	sr, _ := newTestServer(t)
+	writeTestRecord(t, sr.cm.dir, "1", "Book")
+	base := readerPrefix + "/test/1/"
+
+	w := readerGet(sr, base+"1/2", nil)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "<p>C1-2</p>") {
+		t.Fatal(w.Code, body)
+	}
+	// the next chapter is in the next volume
+	if !strings.Contains(body, `href="`+base+`1/1"`) || !strings.Contains(body, `href="`+base+`2/1"`) {
+		t.Fatal("prev or next is wrong:", body)
+	}
+
+	w = readerGet(sr, base+"1/1", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `id="prev" href="" class="off"`) {
+		t.Fatal("the first chapter has a prev:", w.Body.String())
+	}
+	w = readerGet(sr, base+"2/2", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `id="next" href="" class="off"`) {
+		t.Fatal("the last chapter has a next:", w.Body.String())
+	}
+
+	w = readerGet(sr, base+"toc", nil)
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), "<li>") != 4 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	for target, code := range map[string]int{
+		base + "3/1":                    http.StatusConflict,
+		base + "x/1":                    http.StatusNotFound,
+		readerPrefix + "/test/9/1/1":    http.StatusConflict,
+		readerPrefix + "/unknown/1/1/1": http.StatusNotFound,
+	} {
+		w = readerGet(sr, target, nil)
+		if w.Code != code {
+			t.Fatal(target, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestReaderImage(t *testing.T) {
+	sr, _ := newTestServer(t)
+	writeTestRecord(t, sr.cm.dir, "1", "Book")
+
+	w := readerGet(sr, readerPrefix+"/test/1/1/1", nil)
+	if !strings.Contains(w.Body.String(), `src="../images/res_img.png"`) {
+		t.Fatal(w.Body.String())
+	}
+	// the chapter is served at .../1/1, so its relative images are under .../1/images
+	w = readerGet(sr, readerPrefix+"/test/1/images/res_img.png", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || !strings.HasSuffix(w.Body.String(), "image") {
+		t.Fatal(w.Code, w.Header(), w.Body.String())
+	}
+	w = readerGet(sr, readerPrefix+"/test/1/images/res_none.png", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatal(w.Code)
+	}
+}
+
+func TestReaderPosition(t *testing.T) {
+	sr, _ := newTestServer(t)
+	writeTestRecord(t, sr.cm.dir, "1", "Book")
+	u, err := sr.um.Add("reader", "password", RoleReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := readerPrefix + "/test/1/"
+
+	// nothing saved yet, the first chapter is opened
+	w := readerGet(sr, readerPrefix+"/test/1", u)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != base+"1/1" {
+		t.Fatal(w.Code, w.Header())
+	}
+
+	r := httptest.NewRequest(http.MethodPut, apiV1+"/me/reading/test/1", strings.NewReader(`{"vol":2,"chapter":1,"offset":0.25}`))
+	r.SetBasicAuth("reader", "password")
+	w = httptest.NewRecorder()
+	sr.apiHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	w = readerGet(sr, readerPrefix+"/test/1", u)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != base+"2/1" {
+		t.Fatal(w.Code, w.Header())
+	}
+	w = readerGet(sr, base+"2/1", u)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "offset:  0.25 ") {
+		t.Fatal(w.Body.String())
+	}
+	// the offset belongs to the saved chapter only
+	w = readerGet(sr, base+"1/1", u)
+	if !strings.Contains(w.Body.String(), "offset:  0 ") {
+		t.Fatal(w.Body.String())
+	}
+	// another user starts from the beginning
+	w = readerGet(sr, readerPrefix+"/test/1", &User{Name: "other"})
+	if w.Header().Get("Location") != base+"1/1" {
+		t.Fatal(w.Header())
+	}
+}
+
+// TestReaderLoad only readerBooks records stay loaded, the least recently read goes first, and a record
+// changed on disk is loaded again.
+func TestReaderLoad(t *testing.T) {
+	sr, _ := newTestServer(t)
+	ids := []string{"1", "2", "3", "4", "5"}
+	paths := make(map[string]string)
+	for _, id := range ids {
+		paths[id] = writeTestRecord(t, sr.cm.dir, id, "Book "+id)
+	}
+	loaded := make(map[string]*readerBook)
+	for _, id := range ids[:4] {
+		rb, err := sr.reader.load(testSourceName, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded[id] = rb
+	}
+	rb, err := sr.reader.load(testSourceName, "1")
+	if err != nil || rb != loaded["1"] {
+		t.Fatal("the loaded record was decoded again", err)
+	}
+	_, err = sr.reader.load(testSourceName, "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sr.reader.books) != readerBooks {
+		t.Fatal(len(sr.reader.books))
+	}
+	if _, ok := sr.reader.books[paths["2"]]; ok {
+		t.Fatal("the least recently read record is kept")
+	}
+	if _, ok := sr.reader.books[paths["1"]]; !ok {
+		t.Fatal("the record read again is dropped")
+	}
+
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(paths["3"], later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb, err = sr.reader.load(testSourceName, "3")
+	if err != nil || rb == loaded["3"] || !rb.modTime.Equal(later) {
+		t.Fatal("the changed record is not loaded again", err)
+	}
+}
@@ -1,49 +1,95 @@
 package web
 
 import (
+	"errors"
 	"fmt"
 	"github.com/peakedshout/go-pandorasbox/tool/hjson"
 	"github.com/peakedshout/go-pandorasbox/xnet/xtool/xhttp"
+	"github.com/peakedshout/novelpackager/pkg/imagex"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/textx"
+	"github.com/peakedshout/novelpackager/pkg/zhconv"
+	"io"
 	"io/fs"
 	"net/http"
 	"net/url"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type server struct {
 	*xhttp.Server
+	cm *CacheManager
+	jm *JobManager
+	um *UserManager
+
+	opds   *opdsCatalog
+	reader *bookReader
 }
 
-func newServer(cfg *xhttp.Config) *server {
+func newServer(cm *CacheManager, jm *JobManager, um *UserManager, cfg *xhttp.Config) *server {
 	sr := xhttp.NewServer(cfg)
 	sub, err := fs.Sub(embedFs, "frontend/dist")
 	if err != nil {
 		panic(err)
 	}
-	s := &server{Server: sr}
+	s := &server{Server: sr, cm: cm, jm: jm, um: um, opds: newOPDSCatalog(cm), reader: newBookReader(cm.dir)}
 
 	sh := http.FileServerFS(sub)
-	s.Set("", func(context *xhttp.Context) error {
+	s.handle("", false, func(context *xhttp.Context, u *User) error {
 		sh.ServeHTTP(context.Raw())
 		return nil
 	})
-	s.Set("/api/source_list", func(context *xhttp.Context) error {
-		sl := make([]string, 0, len(sourceMap))
-		for k := range sourceMap {
-			sl = append(sl, k)
-		}
-		slices.Sort(sl)
-		_, err = context.Write(hjson.MustMarshal(sl))
+	s.handle("/api/source_list", false, func(context *xhttp.Context, u *User) error {
+		_, err := context.Write(hjson.MustMarshal(sourceNames()))
 		return err
 	})
-	sr.Set("/api/get_info", s.getInfo)
-	sr.Set("/api/search", s.search)
-	sr.Set("/api/progress", s.progress)
-	sr.Set("/api/caching", s.caching)
-	sr.Set("/api/enable_download", s.enableDownload)
-	sr.Set("/api/download", s.download)
+	s.handle("/api/get_info", false, plain(s.getInfo))
+	s.handle("/api/search", false, plain(s.search))
+	s.handle("/api/progress", false, plain(s.progress))
+	s.handle("/api/caching", false, s.caching)
+	s.handle("/api/enable_download", false, plain(s.enableDownload))
+	s.handle("/api/download", false, s.download)
+	s.handle("/api/issues", false, plain(s.issues))
+	s.handle("/api/meta", false, plain(s.meta))
+	s.handle("/api/meta/save", true, plain(s.saveMeta))
+	s.handle("/api/cache/ls", false, plain(s.cacheLs))
+	s.handle("/api/cache/stat", false, plain(s.cacheStat))
+	s.handle("/api/cache/purge", true, plain(s.cachePurge))
+	s.handle("/api/cache/gc", true, plain(s.cacheGC))
+	s.handle("/api/jobs", false, plain(s.jobs))
+	s.handle("/api/job", false, plain(s.job))
+	s.handle("/api/job/cancel", false, s.jobAction(jm.Cancel))
+	s.handle("/api/job/pause", false, s.jobAction(jm.Pause))
+	s.handle("/api/job/resume", false, s.jobAction(jm.Resume))
+	s.handle("/api/job/retry", false, s.jobAction(jm.Retry))
+	s.handle("/api/events", false, plain(s.events))
+
+	// e-readers mostly speak basic auth, which handle asks for
+	oh := s.opdsHandler()
+	opds := func(context *xhttp.Context, u *User) error {
+		w, r := context.Raw()
+		oh.ServeHTTP(w, withUser(r, u))
+		return nil
+	}
+	s.handle(opdsPrefix, false, opds)
+	s.handle(opdsPrefix+"/", false, opds)
+
+	rh := s.readerHandler()
+	s.handle(readerPrefix+"/", false, func(context *xhttp.Context, u *User) error {
+		w, r := context.Raw()
+		rh.ServeHTTP(w, withUser(r, u))
+		return nil
+	})
+
+	// authenticated per route, the login route is public
+	ah := s.apiHandler()
+	sr.Set(apiV1+"/", func(context *xhttp.Context) error {
+		ah.ServeHTTP(context.Raw())
+		return nil
+	})
 	return s
 }
 
@@ -78,25 +124,50 @@ func (sr *server) search(context *xhttp.Context) error {
 	return context.WriteAny(NewMsg(s.Search(context, name, full, false)))
 }
 
+// progress the state of the latest job of each book, kept in the "xx.xx%" / "err: ..." form the frontend knows.
 func (sr *server) progress(context *xhttp.Context) error {
 	source := context.Query().Get("source")
-	s, err := getSource(source)
+	_, err := getSource(source)
 	if err != nil {
 		return context.WriteAny(NewError(err))
 	}
 
-	return context.WriteAny(NewMsg(s.Progress(context)))
+	latest := sr.jm.Latest(source)
+	m := make(map[string]string, len(latest))
+	for id, job := range latest {
+		switch job.State {
+		case JobRunning:
+			m[id] = job.Progress
+		case JobDone:
+			m[id] = "100.00%"
+		case JobFailed:
+			m[id] = "err: " + job.Err
+		case JobCanceled:
+			m[id] = "err: " + errJobCanceled.Error()
+		default:
+			m[id] = string(job.State)
+		}
+	}
+	return context.WriteAny(NewMsg(m))
 }
 
-func (sr *server) caching(context *xhttp.Context) error {
+func (sr *server) caching(context *xhttp.Context, u *User) error {
 	source := context.Query().Get("source")
-	s, err := getSource(source)
+	_, err := getSource(source)
 	if err != nil {
 		return context.WriteAny(NewError(err))
 	}
 
 	id := context.Query().Get("id")
-	return context.WriteAny(NewError(s.Caching(context, id)))
+	priority := 0
+	if ps := context.Query().Get("priority"); ps != "" {
+		priority, err = strconv.Atoi(ps)
+		if err != nil {
+			return context.WriteAny(NewError(err))
+		}
+	}
+	req := JobRequest{Source: source, BookId: id, Priority: priority}
+	return context.WriteAny(NewMsg(sr.jm.Submit(req, u.Name, u.Quota.MaxJobs)))
 }
 
 func (sr *server) enableDownload(context *xhttp.Context) error {
@@ -110,7 +181,7 @@ func (sr *server) enableDownload(context *xhttp.Context) error {
 	return context.WriteAny(NewMsg(s.EnableDownload(context, id)))
 }
 
-func (sr *server) download(context *xhttp.Context) error {
+func (sr *server) download(context *xhttp.Context, u *User) error {
 	source := context.Query().Get("source")
 	s, err := getSource(source)
 	if err != nil {
@@ -119,49 +190,221 @@ func (sr *server) download(context *xhttp.Context) error {
 
 	id := context.Query().Get("id")
 
-	volsStr := context.Query().Get("vols")
-	vols, err := parseVols(volsStr)
+	sel, err := parseSelect(context.Query().Get("vols"))
+	if err != nil {
+		return err
+	}
+	format, err := parseFormat(context.Query())
+	if err != nil {
+		return err
+	}
+	opts, err := parseOptions(context.Query())
 	if err != nil {
 		return err
 	}
 
-	fd, err := s.Download(context, id, vols...)
+	w, r := context.Raw()
+	return sr.serveArtifact(w, withUser(r, u), ArtifactKey{Source: s.Name(), Id: id, Select: sel, Format: format, Options: opts})
+}
+
+func (sr *server) issues(context *xhttp.Context) error {
+	return context.WriteAny(NewMsg(sr.bookIssues(context.Query().Get("source"), context.Query().Get("id"))))
+}
+
+func (sr *server) meta(context *xhttp.Context) error {
+	return context.WriteAny(NewMsg(loadMetadata(sr.cm.dir, context.Query().Get("source"), context.Query().Get("id"))))
+}
+
+// saveMeta replace the metadata of the book by the json body, an empty one removes it.
+func (sr *server) saveMeta(context *xhttp.Context) error {
+	_, r := context.Raw()
+	m := new(model.Metadata)
+	err := decodeBody(r, m)
+	if err == nil {
+		err = saveMetadata(sr.cm.dir, context.Query().Get("source"), context.Query().Get("id"), m)
+	}
+	return context.WriteAny(NewMsg(m, err))
+}
+
+// parseSelect check the selection and return its canonical text, so that `1,2,3` and `1-3` share one artifact.
+func parseSelect(s string) (string, error) {
+	sel, err := model.ParseSelection(s)
+	if err != nil {
+		return "", err
+	}
+	return sel.String(), nil
+}
+
+// parseFormat the package format of the query, epub if not given.
+func parseFormat(query url.Values) (string, error) {
+	format := query.Get("format")
+	if format == "" {
+		return FormatEpub, nil
+	}
+	if _, ok := formatTypes[format]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+	return format, nil
+}
+
+// parseOptions check the export options of the query and return them encoded for the artifact key.
+// The rules file is a local path and can only be given on the command line.
+func parseOptions(query url.Values) (string, error) {
+	opts := model.ExportOptions{Convert: query.Get("convert"), Content: query.Get("content")}
+	// the format is part of the key on its own, it is only given here to be checked with the content
+	err := model.ExportOptions{Content: opts.Content, Format: query.Get("format")}.Validate()
+	if err != nil {
+		return "", err
+	}
+	_, err = zhconv.Get(opts.Convert)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range query["filter"] {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				opts.Filters = append(opts.Filters, name)
+			}
+		}
+	}
+	_, err = textx.New(opts.Filters, "")
+	if err != nil {
+		return "", err
+	}
+	for _, e := range query["exclude"] {
+		for _, kind := range strings.Split(e, ",") {
+			if kind = strings.TrimSpace(kind); kind != "" && !slices.Contains(opts.Exclude, kind) {
+				opts.Exclude = append(opts.Exclude, kind)
+			}
+		}
+	}
+	// sorted, the order of the kinds makes no difference to the package
+	slices.Sort(opts.Exclude)
+	_, err = textx.NewExclusion(opts.Exclude)
+	if err != nil {
+		return "", err
+	}
+	if image := query.Get("image"); image != "" {
+		// the canonical spec, so that `kindle` and `jpeg,1072x1448,gray,q=75` share one artifact
+		o, err := imagex.Parse(image)
+		if err != nil {
+			return "", err
+		}
+		opts.Image = o.String()
+	}
+	return encodeOptions(opts), nil
+}
+
+func (sr *server) cacheLs(context *xhttp.Context) error {
+	filter := cacheFilter(context.Query())
+	return context.WriteAny(NewMsg(sr.cm.List(filter)))
+}
+
+func (sr *server) cacheStat(context *xhttp.Context) error {
+	return context.WriteAny(NewMsg(sr.cm.Stat()))
+}
+
+func (sr *server) cachePurge(context *xhttp.Context) error {
+	filter := cacheFilter(context.Query())
+	if filter.Empty() {
+		return context.WriteAny(NewError(errors.New("purge everything is only allowed from the cli")))
+	}
+	return context.WriteAny(NewMsg(sr.cm.Purge(filter)))
+}
+
+func (sr *server) cacheGC(context *xhttp.Context) error {
+	return context.WriteAny(NewMsg(sr.cm.GC()))
+}
+
+func (sr *server) jobs(context *xhttp.Context) error {
+	return context.WriteAny(NewMsg(sr.listJobs(context.Query())))
+}
+
+func (sr *server) job(context *xhttp.Context) error {
+	return context.WriteAny(NewMsg(sr.jm.Get(context.Query().Get("id"))))
+}
+
+func (sr *server) jobAction(fn func(id string) error) userHandler {
+	return func(context *xhttp.Context, u *User) error {
+		return context.WriteAny(NewError(sr.manageJob(u, context.Query().Get("id"), fn)))
+	}
+}
+
+// manageJob run the action on the job if the user owns it or is an admin.
+func (sr *server) manageJob(u *User, id string, fn func(id string) error) error {
+	job, err := sr.jm.Get(id)
 	if err != nil {
 		return err
 	}
+	if !canManage(u, job.Owner) {
+		return ErrForbidden
+	}
+	return fn(id)
+}
 
-	var filename string
-	if len(vols) <= 1 {
-		volsStr = ""
-		filename = fd.Name
-	} else {
-		volsStr = fmt.Sprintf("[%s]", volsStr)
-		fd.Name, _ = strings.CutSuffix(fd.Name, ".epub")
-		filename = fmt.Sprintf("%s%s.epub", fd.Name, volsStr)
-	}
-	encodedFilename := url.PathEscape(filename)
-	context.WHeader().Set("Content-Type", "application/epub+zip")
-	context.WHeader().Set("Content-Disposition",
-		fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, filename, encodedFilename))
-	context.WHeader().Set("Content-Length", strconv.Itoa(len(fd.Data)))
-	_, err = context.Write(fd.Data)
-	return err
+// events stream the job events as server-sent events, filtered by source, id (book) and job.
+// A reconnecting client sends Last-Event-ID (or lastEventId) to replay what it missed.
+func (sr *server) events(context *xhttp.Context) error {
+	return sr.streamEvents(context.Raw())
 }
 
-func parseVols(volsStr string) ([]int, error) {
-	if volsStr == "" {
-		return []int{}, nil
+func (sr *server) streamEvents(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	filter := EventFilter{
+		Source: q.Get("source"),
+		BookId: q.Get("id"),
+		JobId:  q.Get("job"),
+	}
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = q.Get("lastEventId")
+	}
+	after, _ := strconv.ParseUint(last, 10, 64)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	replay, ch, cancel := sr.jm.Events().Subscribe(filter, after)
+	defer cancel()
+	for _, e := range replay {
+		err := writeEvent(w, e)
+		if err != nil {
+			return err
+		}
+	}
+	err := rc.Flush()
+	if err != nil {
+		return err
 	}
-	parts := strings.Split(volsStr, ",")
-	vols := make([]int, 0, len(parts))
 
-	for _, part := range parts {
-		vol, err := strconv.Atoi(part)
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case e, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			err = writeEvent(w, e)
+		}
+		if err != nil {
+			return err
+		}
+		err = rc.Flush()
 		if err != nil {
-			return nil, fmt.Errorf("invalid number: %s", part)
+			return err
 		}
-		vols = append(vols, vol)
 	}
+}
 
-	return vols, nil
+func writeEvent(w io.Writer, e *JobEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, hjson.MustMarshal(e))
+	return err
 }
@@ -0,0 +1,586 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Role string
+
+const (
+	RoleAdmin  Role = "admin"
+	RoleReader Role = "reader"
+)
+
+func (r Role) valid() bool {
+	return r == RoleAdmin || r == RoleReader
+}
+
+const (
+	passwordIter   = 100_000
+	sessionTTL     = 7 * 24 * time.Hour
+	historyMax     = 200
+	sessionPrefix  = "nps_"
+	apiKeyPrefix   = "npk_"
+	basicCacheTTL  = 5 * time.Minute
+	minPasswordLen = 6
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+	ErrQuota        = errors.New("quota exceeded")
+	ErrNoAccounts   = errors.New("accounts are not enabled")
+	ErrLastAdmin    = errors.New("the last admin can not be removed")
+)
+
+type PasswordHash struct {
+	Salt []byte
+	Hash []byte
+	Iter int
+}
+
+// checkPassword the rule for passwords set through the api and the cli.
+func checkPassword(password string) error {
+	if len(password) < minPasswordLen {
+		return fmt.Errorf("password shorter than %d", minPasswordLen)
+	}
+	return nil
+}
+
+func newPasswordHash(password string) (PasswordHash, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return PasswordHash{}, err
+	}
+	return PasswordHash{Salt: salt, Hash: utils.PBKDF2([]byte(password), salt, passwordIter, 32), Iter: passwordIter}, nil
+}
+
+func (ph PasswordHash) match(password string) bool {
+	if len(ph.Hash) == 0 {
+		return false
+	}
+	hash := utils.PBKDF2([]byte(password), ph.Salt, ph.Iter, len(ph.Hash))
+	return subtle.ConstantTimeCompare(hash, ph.Hash) == 1
+}
+
+// Quota the limits of a user, zero means unlimited.
+type Quota struct {
+	MaxJobs        int `json:"maxJobs"`
+	DailyDownloads int `json:"dailyDownloads"`
+}
+
+type BookRef struct {
+	Source string    `json:"source"`
+	Id     string    `json:"id"`
+	Name   string    `json:"name,omitempty"`
+	Added  time.Time `json:"added"`
+}
+
+type DownloadEntry struct {
+	Source string    `json:"source"`
+	Id     string    `json:"id"`
+	Name   string    `json:"name"`
+	Select string    `json:"select,omitempty"`
+	Time   time.Time `json:"time"`
+	// Bytes served of the Size of the export, a resumed download adds its ranges to the same entry
+	Bytes int64 `json:"bytes,omitempty"`
+	Size  int64 `json:"size,omitempty"`
+}
+
+// ReadPosition where the user stopped reading a book in the web reader, Offset is the scrolled fraction of the chapter.
+type ReadPosition struct {
+	Source  string    `json:"source"`
+	Id      string    `json:"id"`
+	Vol     int       `json:"vol"`
+	Chapter int       `json:"chapter"`
+	Offset  float64   `json:"offset"`
+	Updated time.Time `json:"updated"`
+}
+
+type APIKey struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"-"`
+	Created time.Time `json:"created"`
+}
+
+type User struct {
+	Name     string          `json:"name"`
+	Role     Role            `json:"role"`
+	Password PasswordHash    `json:"-"`
+	Quota    Quota           `json:"quota"`
+	Keys     []APIKey        `json:"keys,omitempty"`
+	Follows  []BookRef       `json:"follows,omitempty"`
+	History  []DownloadEntry `json:"history,omitempty"`
+	Reading  []ReadPosition  `json:"reading,omitempty"`
+	Created  time.Time       `json:"created"`
+}
+
+// anonymous the caller when no account exists, everything is allowed as before accounts were added.
+var anonymous = &User{Role: RoleAdmin}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+func (u *User) clone() *User {
+	c := *u
+	c.Keys = slices.Clone(u.Keys)
+	c.Follows = slices.Clone(u.Follows)
+	c.History = slices.Clone(u.History)
+	c.Reading = slices.Clone(u.Reading)
+	return &c
+}
+
+// downloads served to the user since the time, an entry counts the share of the export it served.
+func (u *User) downloads(since time.Time) float64 {
+	n := 0.0
+	for _, e := range u.History {
+		if !e.Time.After(since) {
+			continue
+		}
+		if e.Size > 0 {
+			n += float64(e.Bytes) / float64(e.Size)
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+type session struct {
+	User    string
+	Expires time.Time
+}
+
+type usersFile struct {
+	Users    map[string]*User
+	Sessions map[string]*session
+}
+
+// UserManager the accounts of the web server, persisted in a gob file, tokens and keys are only kept hashed.
+type UserManager struct {
+	file string
+
+	mux      sync.Mutex
+	users    map[string]*User
+	sessions map[string]*session
+	basic    map[string]time.Time
+}
+
+func NewUserManager(file string) (*UserManager, error) {
+	um := &UserManager{
+		file:     file,
+		users:    make(map[string]*User),
+		sessions: make(map[string]*session),
+		basic:    make(map[string]time.Time),
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return um, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var uf usersFile
+	err = gob.NewDecoder(f).Decode(&uf)
+	if err != nil {
+		return nil, err
+	}
+	if uf.Users != nil {
+		um.users = uf.Users
+	}
+	if uf.Sessions != nil {
+		um.sessions = uf.Sessions
+	}
+	return um, nil
+}
+
+// Enabled whether any account exists, without one the server stays open.
+func (um *UserManager) Enabled() bool {
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	return len(um.users) > 0
+}
+
+func (um *UserManager) Add(name, password string, role Role) (*User, error) {
+	err := checkPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return um.add(name, password, role)
+}
+
+// add create the account without checking the password, for the admin of the legacy flags.
+func (um *UserManager) add(name, password string, role Role) (*User, error) {
+	if name == "" || strings.ContainsAny(name, ":/ ") {
+		return nil, fmt.Errorf("invalid user name: %q", name)
+	}
+	if !role.valid() {
+		return nil, fmt.Errorf("invalid role: %q", role)
+	}
+	ph, err := newPasswordHash(password)
+	if err != nil {
+		return nil, err
+	}
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	if _, ok := um.users[name]; ok {
+		return nil, ErrUserExists
+	}
+	u := &User{Name: name, Role: role, Password: ph, Created: time.Now()}
+	um.users[name] = u
+	return u.clone(), um.save()
+}
+
+// Remove delete the account with its sessions. The last admin stays, without it the server would fall back to
+// serving everyone as admin.
+func (um *UserManager) Remove(name string) error {
+	return um.update(name, func(u *User) error {
+		if um.lastAdmin(u) {
+			return ErrLastAdmin
+		}
+		delete(um.users, name)
+		um.revoke(name)
+		return nil
+	})
+}
+
+// lastAdmin whether u is the only admin, must be called with the lock held.
+func (um *UserManager) lastAdmin(u *User) bool {
+	if !u.IsAdmin() {
+		return false
+	}
+	for _, o := range um.users {
+		if o != u && o.IsAdmin() {
+			return false
+		}
+	}
+	return true
+}
+
+// revoke close the sessions of the user and forget the checked basic auth, must be called with the lock held.
+func (um *UserManager) revoke(name string) {
+	for k, s := range um.sessions {
+		if s.User == name {
+			delete(um.sessions, k)
+		}
+	}
+	clear(um.basic)
+}
+
+func (um *UserManager) Get(name string) (*User, error) {
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	u, ok := um.users[name]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return u.clone(), nil
+}
+
+func (um *UserManager) List() []*User {
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	list := make([]*User, 0, len(um.users))
+	for _, u := range um.users {
+		c := u.clone()
+		c.History = nil
+		list = append(list, c)
+	}
+	slices.SortFunc(list, func(a, b *User) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
+// SetPassword replace the password, the open sessions of the user are closed.
+func (um *UserManager) SetPassword(name, password string) error {
+	err := checkPassword(password)
+	if err != nil {
+		return err
+	}
+	return um.setPassword(name, password)
+}
+
+// setPassword replace the password without checking it, for the admin of the legacy flags.
+func (um *UserManager) setPassword(name, password string) error {
+	ph, err := newPasswordHash(password)
+	if err != nil {
+		return err
+	}
+	return um.update(name, func(u *User) error {
+		u.Password = ph
+		um.revoke(name)
+		return nil
+	})
+}
+
+func (um *UserManager) SetRole(name string, role Role) error {
+	if !role.valid() {
+		return fmt.Errorf("invalid role: %q", role)
+	}
+	return um.update(name, func(u *User) error {
+		if role != RoleAdmin && um.lastAdmin(u) {
+			return ErrLastAdmin
+		}
+		u.Role = role
+		return nil
+	})
+}
+
+func (um *UserManager) SetQuota(name string, quota Quota) error {
+	return um.update(name, func(u *User) error {
+		u.Quota = quota
+		return nil
+	})
+}
+
+// Login check the password and open a session, return its token.
+func (um *UserManager) Login(name, password string) (string, time.Time, error) {
+	u, err := um.Get(name)
+	if err != nil || !u.Password.match(password) {
+		return "", time.Time{}, ErrUnauthorized
+	}
+	token, err := newToken(sessionPrefix)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(sessionTTL)
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	for k, s := range um.sessions {
+		if time.Now().After(s.Expires) {
+			delete(um.sessions, k)
+		}
+	}
+	um.sessions[hashToken(token)] = &session{User: name, Expires: expires}
+	return token, expires, um.save()
+}
+
+func (um *UserManager) Logout(token string) error {
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	delete(um.sessions, hashToken(token))
+	return um.save()
+}
+
+// AddKey create a named api key of the user, the key is only returned here.
+func (um *UserManager) AddKey(name, keyName string) (string, error) {
+	key, err := newToken(apiKeyPrefix)
+	if err != nil {
+		return "", err
+	}
+	return key, um.update(name, func(u *User) error {
+		if slices.ContainsFunc(u.Keys, func(k APIKey) bool { return k.Name == keyName }) {
+			return fmt.Errorf("key %q already exists", keyName)
+		}
+		u.Keys = append(u.Keys, APIKey{Name: keyName, Hash: hashToken(key), Created: time.Now()})
+		return nil
+	})
+}
+
+func (um *UserManager) RemoveKey(name, keyName string) error {
+	return um.update(name, func(u *User) error {
+		n := len(u.Keys)
+		u.Keys = slices.DeleteFunc(u.Keys, func(k APIKey) bool { return k.Name == keyName })
+		if n == len(u.Keys) {
+			return fmt.Errorf("key %q not found", keyName)
+		}
+		return nil
+	})
+}
+
+// Token resolve a session token or an api key.
+func (um *UserManager) Token(token string) (*User, error) {
+	h := hashToken(token)
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	if strings.HasPrefix(token, sessionPrefix) {
+		s, ok := um.sessions[h]
+		if !ok || time.Now().After(s.Expires) {
+			return nil, ErrUnauthorized
+		}
+		u, ok := um.users[s.User]
+		if !ok {
+			return nil, ErrUnauthorized
+		}
+		return u.clone(), nil
+	}
+	for _, u := range um.users {
+		for _, k := range u.Keys {
+			if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(h)) == 1 {
+				return u.clone(), nil
+			}
+		}
+	}
+	return nil, ErrUnauthorized
+}
+
+// Basic check a name and password, successful checks are remembered for a while to spare the key derivation.
+func (um *UserManager) Basic(name, password string) (*User, error) {
+	h := hashToken(name + ":" + password)
+	um.mux.Lock()
+	expires, ok := um.basic[h]
+	um.mux.Unlock()
+	if ok && time.Now().Before(expires) {
+		return um.Get(name)
+	}
+	u, err := um.Get(name)
+	if err != nil || !u.Password.match(password) {
+		return nil, ErrUnauthorized
+	}
+	um.mux.Lock()
+	um.basic[h] = time.Now().Add(basicCacheTTL)
+	um.mux.Unlock()
+	return u, nil
+}
+
+func (um *UserManager) Follow(name string, ref BookRef) error {
+	return um.update(name, func(u *User) error {
+		if slices.ContainsFunc(u.Follows, func(b BookRef) bool { return b.Source == ref.Source && b.Id == ref.Id }) {
+			return nil
+		}
+		ref.Added = time.Now()
+		u.Follows = append(u.Follows, ref)
+		return nil
+	})
+}
+
+func (um *UserManager) Unfollow(name, source, id string) error {
+	return um.update(name, func(u *User) error {
+		u.Follows = slices.DeleteFunc(u.Follows, func(b BookRef) bool { return b.Source == source && b.Id == id })
+		return nil
+	})
+}
+
+// SetPosition remember where the user is reading the book, the latest read book comes first.
+func (um *UserManager) SetPosition(name string, pos ReadPosition) error {
+	return um.update(name, func(u *User) error {
+		u.Reading = slices.DeleteFunc(u.Reading, func(p ReadPosition) bool { return p.Source == pos.Source && p.Id == pos.Id })
+		pos.Updated = time.Now()
+		u.Reading = slices.Insert(u.Reading, 0, pos)
+		if len(u.Reading) > historyMax {
+			u.Reading = u.Reading[:historyMax]
+		}
+		return nil
+	})
+}
+
+// Position where the user stopped reading the book, false if never read or without accounts.
+func (um *UserManager) Position(name, source, id string) (ReadPosition, bool) {
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	u, ok := um.users[name]
+	if !ok {
+		return ReadPosition{}, false
+	}
+	i := slices.IndexFunc(u.Reading, func(p ReadPosition) bool { return p.Source == source && p.Id == id })
+	if i < 0 {
+		return ReadPosition{}, false
+	}
+	return u.Reading[i], true
+}
+
+// CheckDownload tell whether the daily quota of the user allows another download.
+func (um *UserManager) CheckDownload(name string) error {
+	if name == "" {
+		return nil
+	}
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	u, ok := um.users[name]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if u.Quota.DailyDownloads > 0 && u.downloads(time.Now().Add(-24*time.Hour)) >= float64(u.Quota.DailyDownloads) {
+		return fmt.Errorf("%w: %d downloads per day", ErrQuota, u.Quota.DailyDownloads)
+	}
+	return nil
+}
+
+// Download record the bytes served in the history, a range of the export still being resumed adds to its entry.
+func (um *UserManager) Download(name string, entry DownloadEntry) error {
+	if name == "" {
+		return nil
+	}
+	return um.update(name, func(u *User) error {
+		entry.Time = time.Now()
+		if i := len(u.History) - 1; i >= 0 {
+			last := &u.History[i]
+			if last.Source == entry.Source && last.Id == entry.Id && last.Name == entry.Name && last.Select == entry.Select &&
+				last.Bytes < last.Size && last.Time.After(entry.Time.Add(-24*time.Hour)) {
+				last.Bytes += entry.Bytes
+				last.Time = entry.Time
+				return nil
+			}
+		}
+		u.History = append(u.History, entry)
+		if len(u.History) > historyMax {
+			u.History = u.History[len(u.History)-historyMax:]
+		}
+		return nil
+	})
+}
+
+func (um *UserManager) update(name string, fn func(u *User) error) error {
+	if name == "" {
+		return ErrNoAccounts
+	}
+	um.mux.Lock()
+	defer um.mux.Unlock()
+	u, ok := um.users[name]
+	if !ok {
+		return ErrUserNotFound
+	}
+	err := fn(u)
+	if err != nil {
+		return err
+	}
+	return um.save()
+}
+
+// save persist the accounts, must be called with the lock held.
+func (um *UserManager) save() error {
+	tmp := um.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&usersFile{Users: um.users, Sessions: um.sessions})
+	_ = f.Close()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, um.file)
+}
+
+func newToken(prefix string) (string, error) {
+	bs := make([]byte, 24)
+	_, err := rand.Read(bs)
+	if err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(bs), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,94 @@
+package web
+
+import (
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestUserPassword(t *testing.T) {
+	um, err := NewUserManager(path.Join(t.TempDir(), ".web.Users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = um.Add("admin", "short", RoleAdmin)
+	if err == nil {
+		t.Fatal("a short password is taken")
+	}
+	err = ensureAdmin(um, "admin", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := um.Login("admin", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new password in the flags replaces the old one and closes its sessions
+	err = ensureAdmin(um, "admin", "password2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = um.Basic("admin", "password1"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal(err)
+	}
+	if _, err = um.Basic("admin", "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = um.Token(token); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal(err)
+	}
+	if err = um.SetPassword("admin", "short"); err == nil {
+		t.Fatal("a short password is taken")
+	}
+
+	// the flag password of an existing deployment may be shorter than the rule
+	for _, password := range []string{"abc", "xyz"} {
+		err = ensureAdmin(um, "admin", password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = um.Basic("admin", password); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ensureAdmin(um, "old", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := um.Basic("old", "abc"); err != nil || !u.IsAdmin() {
+		t.Fatal(err)
+	}
+}
+
+func TestUserLastAdmin(t *testing.T) {
+	um, err := NewUserManager(path.Join(t.TempDir(), ".web.Users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		_, err = um.Add(name, "password", RoleAdmin)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = um.Add("r", "password", RoleReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = um.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = um.Remove("b"); !errors.Is(err, ErrLastAdmin) {
+		t.Fatal(err)
+	}
+	if err = um.SetRole("b", RoleReader); !errors.Is(err, ErrLastAdmin) {
+		t.Fatal(err)
+	}
+	if err = um.Remove("r"); err != nil {
+		t.Fatal(err)
+	}
+	if !um.Enabled() {
+		t.Fatal("the accounts are gone")
+	}
+}
@@ -0,0 +1,209 @@
+package web
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"github.com/spf13/cobra"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type userArgs struct {
+	Password string `json:"password" Barg:"p" Harg:"password, read from stdin when empty"`
+	Role     string `json:"role" Barg:"role" Harg:"role (admin, reader)"`
+}
+
+type userQuotaArgs struct {
+	MaxJobs        int `json:"maxJobs" Barg:"maxJobs" Harg:"max unfinished caching jobs, 0 is unlimited"`
+	DailyDownloads int `json:"dailyDownloads" Barg:"daily" Harg:"max downloads per day, 0 is unlimited"`
+}
+
+type userKeyArgs struct {
+	Remove bool `json:"remove" Barg:"rm" Harg:"revoke the key instead of creating it"`
+}
+
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "manage the web accounts",
+}
+
+var userLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "list the accounts",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		um, err := userManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		t := newTable()
+		t.AppendHeader(table.Row{"Name", "Role", "MaxJobs", "DailyDownloads", "Keys", "Follows", "Downloads", "Created"})
+		for _, u := range um.List() {
+			t.AppendRow(table.Row{u.Name, u.Role, u.Quota.MaxJobs, u.Quota.DailyDownloads,
+				len(u.Keys), len(u.Follows), len(u.History), u.Created.Format(time.DateTime)})
+		}
+		t.Render()
+		return nil
+	},
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add <name>",
+	Short: "create an account",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ua := utils.GetKeyT[userArgs](cmd, "args")
+		um, err := userManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		password, err := readPassword(ua.Password)
+		if err != nil {
+			return err
+		}
+		_, err = um.Add(args[0], password, Role(ua.Role))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("user %s added\n", args[0])
+		return nil
+	},
+}
+
+var userRmCmd = &cobra.Command{
+	Use:   "rm <name>",
+	Short: "remove an account",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		um, err := userManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		return um.Remove(args[0])
+	},
+}
+
+var userPasswdCmd = &cobra.Command{
+	Use:   "passwd <name>",
+	Short: "change the password of an account, its sessions are closed",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ua := utils.GetKeyT[userArgs](cmd, "args")
+		um, err := userManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		password, err := readPassword(ua.Password)
+		if err != nil {
+			return err
+		}
+		return um.SetPassword(args[0], password)
+	},
+}
+
+var userRoleCmd = &cobra.Command{
+	Use:   "role <name> <admin|reader>",
+	Short: "change the role of an account",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		role := Role(args[1])
+		if !role.valid() {
+			return fmt.Errorf("invalid role: %q", role)
+		}
+		um, err := userManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		return um.SetRole(args[0], role)
+	},
+}
+
+var userQuotaCmd = &cobra.Command{
+	Use:   "quota <name>",
+	Short: "set the job and download quota of an account",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		qa := utils.GetKeyT[userQuotaArgs](cmd, "quota")
+		um, err := userManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		return um.SetQuota(args[0], Quota{MaxJobs: qa.MaxJobs, DailyDownloads: qa.DailyDownloads})
+	},
+}
+
+var userKeyCmd = &cobra.Command{
+	Use:   "key <name> <key name>",
+	Short: "create an api key for an account, it is only printed once",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ka := utils.GetKeyT[userKeyArgs](cmd, "key")
+		um, err := userManagerFromCmd(cmd)
+		if err != nil {
+			return err
+		}
+		if ka.Remove {
+			return um.RemoveKey(args[0], args[1])
+		}
+		key, err := um.AddKey(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	},
+}
+
+func initUserCmd(c *cobra.Command) {
+	c.AddCommand(userCmd)
+
+	userCmd.AddCommand(userLsCmd)
+	utils.BindKey(userLsCmd, "cfg", ptr(defaultCacheConfig()))
+
+	userCmd.AddCommand(userAddCmd)
+	utils.BindKey(userAddCmd, "cfg", ptr(defaultCacheConfig()))
+	utils.BindKey(userAddCmd, "args", &userArgs{Role: string(RoleReader)})
+
+	userCmd.AddCommand(userRmCmd)
+	utils.BindKey(userRmCmd, "cfg", ptr(defaultCacheConfig()))
+
+	userCmd.AddCommand(userPasswdCmd)
+	utils.BindKey(userPasswdCmd, "cfg", ptr(defaultCacheConfig()))
+	utils.BindKey(userPasswdCmd, "args", new(userArgs))
+
+	userCmd.AddCommand(userRoleCmd)
+	utils.BindKey(userRoleCmd, "cfg", ptr(defaultCacheConfig()))
+
+	userCmd.AddCommand(userQuotaCmd)
+	utils.BindKey(userQuotaCmd, "cfg", ptr(defaultCacheConfig()))
+	utils.BindKey(userQuotaCmd, "quota", new(userQuotaArgs))
+
+	userCmd.AddCommand(userKeyCmd)
+	utils.BindKey(userKeyCmd, "cfg", ptr(defaultCacheConfig()))
+	utils.BindKey(userKeyCmd, "key", new(userKeyArgs))
+}
+
+func userManagerFromCmd(cmd *cobra.Command) (*UserManager, error) {
+	cfg := utils.GetKeyT[CacheConfig](cmd, "cfg")
+	err := os.MkdirAll(cfg.CacheDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return NewUserManager(path.Join(cfg.CacheDir, ".web.Users"))
+}
+
+// readPassword use the flag value or the first line of stdin, so it stays out of the shell history.
+func readPassword(password string) (string, error) {
+	if password == "" {
+		fmt.Fprint(os.Stderr, "password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	return password, checkPassword(password)
+}
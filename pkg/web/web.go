@@ -4,19 +4,22 @@ import (
 	"context"
 	"crypto/tls"
 	"embed"
+	"fmt"
 	"github.com/peakedshout/go-pandorasbox/pcrypto"
 	"github.com/peakedshout/go-pandorasbox/xnet/xtool/xhttp"
 	"github.com/peakedshout/novelpackager/pkg/rodx"
 	"github.com/peakedshout/novelpackager/pkg/utils"
 	"github.com/spf13/cobra"
 	"net"
+	"os"
 	"path"
+	"time"
 )
 
 //go:embed frontend/dist
 var embedFs embed.FS
 
-func Serve(ctx context.Context, cfg *webConfig) error {
+func Serve(ctx context.Context, cfg *webConfig, cm *CacheManager, jm *JobManager, um *UserManager) error {
 	var tcfg *tls.Config
 	if cfg.Tls {
 		tc, err := pcrypto.MakeTlsConfigFromFile(cfg.CertFile, cfg.KeyFile)
@@ -32,21 +35,11 @@ func Serve(ctx context.Context, cfg *webConfig) error {
 	if cfg.Address == "" {
 		cfg.Address = ":8080"
 	}
-	var auth func(u string, p string) bool
-	if cfg.Username != "" && cfg.Password != "" {
-		auth = func(u, p string) bool {
-			if u != cfg.Username || p != cfg.Password {
-				return false
-			}
-			return true
-		}
-	}
 
-	sr := newServer(&xhttp.Config{
+	sr := newServer(cm, jm, um, &xhttp.Config{
 		Ctx:    ctx,
 		Type:   xhttp.TypeNone,
 		TlsCfg: tcfg,
-		Auth:   auth,
 		Prefix: "",
 	})
 
@@ -58,19 +51,44 @@ func Serve(ctx context.Context, cfg *webConfig) error {
 	return sr.Serve(ln)
 }
 
-type webConfig struct {
+type CacheConfig struct {
 	CacheDir   string `json:"cacheDir" Barg:"cacheDir" Harg:"cache dir"`
 	MaxCacheBs int64  `json:"maxCacheBs" Barg:"maxCacheBs" Harg:"kv cache max size"`
+	CacheType  string `json:"cacheType" Barg:"cacheType" Harg:"kv cache backend (file, mem, redis)"`
+
+	RedisAddr     string        `json:"redisAddr" Barg:"redis.addr" Harg:"redis address, used by cacheType redis"`
+	RedisPassword string        `json:"redisPassword" Barg:"redis.p" Harg:"redis password"`
+	RedisDB       int           `json:"redisDB" Barg:"redis.db" Harg:"redis db index"`
+	RedisPrefix   string        `json:"redisPrefix" Barg:"redis.prefix" Harg:"redis key prefix, instances sharing the same prefix share the cache"`
+	RedisTimeout  time.Duration `json:"redisTimeout" Barg:"redis.timeout" Harg:"redis dial and command timeout"`
+}
+
+func defaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		CacheDir:     "./.np_cache",
+		MaxCacheBs:   10 * 1024 * 1024,
+		CacheType:    CacheTypeFile,
+		RedisAddr:    "127.0.0.1:6379",
+		RedisPrefix:  "np:",
+		RedisTimeout: 5 * time.Second,
+	}
+}
+
+type webConfig struct {
+	CacheConfig
 
 	Network  string `Barg:"web.nk" Harg:"cmd network"`
 	Address  string `Barg:"web.addr" Harg:"cmd address"`
-	Username string `Barg:"web.u" Harg:"cmd username" Garg:"up"`
-	Password string `Barg:"web.p" Harg:"cmd password" Garg:"up"`
+	Username string `Barg:"web.u" Harg:"cmd admin username, created on start if missing" Garg:"up"`
+	Password string `Barg:"web.p" Harg:"cmd admin password" Garg:"up"`
 	Tls      bool   `Barg:"web.tls" Harg:"cmd tls enable"`
 	Insecure bool   `Barg:"web.i" Harg:"cmd tls insecure"`
 
 	CertFile string `Barg:"web.cert" Harg:"cmd tls cert file" Garg:"ck"`
 	KeyFile  string `Barg:"web.key" Harg:"cmd tls key file" Garg:"ck"`
+
+	JobLimit int    `Barg:"web.jobLimit" Harg:"max running caching jobs per source"`
+	Prebuild string `Barg:"web.prebuild" Harg:"exports built once a caching job finishes (none, book, volumes)"`
 }
 
 var rootCmd = &cobra.Command{
@@ -86,7 +104,7 @@ var rootCmd = &cobra.Command{
 		defer rc.Close()
 
 		cfg := utils.GetKeyT[webConfig](cmd, "cfg")
-		kvCache, err := utils.NewKVCache(path.Join(cfg.CacheDir, ".web.KVCache"), cfg.MaxCacheBs)
+		kvCache, err := newKVCache(&cfg.CacheConfig)
 		if err != nil {
 			return err
 		}
@@ -98,12 +116,93 @@ var rootCmd = &cobra.Command{
 			CacheDir:   cfg.CacheDir,
 		})
 
-		return Serve(cmd.Context(), cfg)
+		err = os.MkdirAll(cfg.CacheDir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+		cm := NewCacheManager(kvCache, cfg.CacheDir)
+		go cm.Artifacts().Run(cmd.Context())
+		jm, err := NewJobManager(cmd.Context(), path.Join(cfg.CacheDir, ".web.Jobs"), cfg.JobLimit,
+			func(ctx context.Context, job *Job) error {
+				err := runJob(ctx, job)
+				if err == nil {
+					cm.Artifacts().Prebuild(cmd.Context(), cfg.Prebuild, job.Source, job.BookId, job.Logf)
+				}
+				return err
+			})
+		if err != nil {
+			return err
+		}
+
+		um, err := NewUserManager(path.Join(cfg.CacheDir, ".web.Users"))
+		if err != nil {
+			return err
+		}
+		err = ensureAdmin(um, cfg.Username, cfg.Password)
+		if err != nil {
+			return err
+		}
+
+		return Serve(cmd.Context(), cfg, cm, jm, um)
 	},
 }
 
+// ensureAdmin keep the old single username/password flags working by creating that admin on first start,
+// a password changed in the flags replaces the stored one on the next start. The flag password predates the
+// password rule, one that breaks it is only warned about so that existing deployments still start.
+func ensureAdmin(um *UserManager, name, password string) error {
+	if name == "" || password == "" {
+		return nil
+	}
+	if err := checkPassword(password); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: --web.p: %v, set a longer one\n", err)
+	}
+	u, err := um.Get(name)
+	if err == nil {
+		if u.Password.match(password) {
+			return nil
+		}
+		return um.setPassword(name, password)
+	}
+	_, err = um.add(name, password, RoleAdmin)
+	return err
+}
+
+func newKVCache(cfg *CacheConfig) (utils.KVCache, error) {
+	switch cfg.CacheType {
+	case "", CacheTypeFile:
+		err := os.MkdirAll(cfg.CacheDir, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+		return utils.NewKVCache(path.Join(cfg.CacheDir, ".web.KVCache"), cfg.MaxCacheBs)
+	case CacheTypeMem:
+		return utils.NewMemKVCache(cfg.MaxCacheBs), nil
+	case CacheTypeRedis:
+		return utils.NewRespKVCache(&utils.RespConfig{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+			Prefix:   cfg.RedisPrefix,
+			Timeout:  cfg.RedisTimeout,
+		})
+	default:
+		return nil, fmt.Errorf("unknown cache type: %s", cfg.CacheType)
+	}
+}
+
+const (
+	CacheTypeFile  = "file"
+	CacheTypeMem   = "mem"
+	CacheTypeRedis = "redis"
+)
+
 func Init(c *cobra.Command) {
 	c.AddCommand(rootCmd)
 	utils.BindKey(rootCmd, "rodx", new(rodx.RodConfig))
-	utils.BindKey(rootCmd, "cfg", &webConfig{CacheDir: "./.np_cache", MaxCacheBs: 10 * 1024 * 1024})
+	utils.BindKey(rootCmd, "cfg", &webConfig{CacheConfig: defaultCacheConfig(), JobLimit: 1, Prebuild: PrebuildBook})
+
+	initCacheCmd(c)
+	initUserCmd(c)
+	initMetaCmd(c)
 }
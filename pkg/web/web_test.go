@@ -0,0 +1,156 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"github.com/peakedshout/novelpackager/pkg/model"
+	"github.com/peakedshout/novelpackager/pkg/utils"
+	"io"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testSourceName = "test"
+
+// testSource a source serving the records of the cache dir, its exports are the text of the record and the
+// metadata repeated, so that they are large enough to be read in ranges.
+type testSource struct {
+	dir string
+	// exports the exports started
+	exports atomic.Int32
+	// export if set, called with the writer of each export instead of writing the text
+	export func(ctx context.Context, w io.Writer) error
+	// cache if set, run by Cache
+	cache func(ctx context.Context, id string, job *Job) error
+}
+
+func init() {
+	RegisterRecord(testSourceName, "test_%s.np")
+}
+
+// newTestSource register a test source serving dir for the test.
+func newTestSource(t *testing.T, dir string) *testSource {
+	ts := &testSource{dir: dir}
+	sourceMap[testSourceName] = ts
+	t.Cleanup(func() {
+		delete(sourceMap, testSourceName)
+	})
+	return ts
+}
+
+func (ts *testSource) Name() string {
+	return testSourceName
+}
+
+func (ts *testSource) GetInfo(ctx context.Context, id string, full bool) (*model.BookInfo, error) {
+	record, err := utils.LoadRecord(ts.path(id))
+	if err != nil {
+		return nil, err
+	}
+	return record.Info, nil
+}
+
+func (ts *testSource) Search(ctx context.Context, name string, full bool, noImg bool) ([]model.SearchResult, error) {
+	return nil, nil
+}
+
+func (ts *testSource) Cache(ctx context.Context, id string, job *Job) error {
+	if ts.cache != nil {
+		return ts.cache(ctx, id, job)
+	}
+	return nil
+}
+
+func (ts *testSource) EnableDownload(ctx context.Context, id string) ([]string, error) {
+	record, err := utils.LoadRecord(ts.path(id))
+	if err != nil {
+		return nil, err
+	}
+	if record.Data == nil || !record.Data.Loaded {
+		return nil, fmt.Errorf("%w: %s", ErrNotCached, id)
+	}
+	var sl []string
+	for _, volume := range record.Data.Volumes {
+		sl = append(sl, volume.Name)
+	}
+	return sl, nil
+}
+
+func (ts *testSource) Export(ctx context.Context, id string, sel model.Selection, opts model.ExportOptions, open func(name string) (io.Writer, error)) error {
+	ts.exports.Add(1)
+	record, err := utils.LoadRecord(ts.path(id))
+	if err != nil {
+		return err
+	}
+	meta, err := utils.LoadMetadata(ts.path(id))
+	if err != nil {
+		return err
+	}
+	info := meta.Apply(record.Info)
+	w, err := open(info.Name + ".epub")
+	if err != nil {
+		return err
+	}
+	if ts.export != nil {
+		return ts.export(ctx, w)
+	}
+	_, err = io.WriteString(w, testExport(info.Name, sel.String()))
+	return err
+}
+
+func (ts *testSource) path(id string) string {
+	return path.Join(ts.dir, fmt.Sprintf("test_%s.np", id))
+}
+
+// testExport what the test source exports for the book name and the selection.
+func testExport(name, sel string) string {
+	return strings.Repeat(name+"|"+sel+"\n", 1000)
+}
+
+// writeTestRecord save a loaded record of a book of two volumes with two chapters each, the first chapter
+// has an image.
+func writeTestRecord(t *testing.T, dir, id, name string) string {
+	lc := utils.NewLinkCache()
+	img, err := lc.SetX("img", "https://example.com/img.png", []byte("\x89PNG\r\n\x1a\nimage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &model.BookInfo{Name: name, Id: id, Author: "A"}
+	data := &model.BookData{Loaded: true}
+	for i := 1; i <= 2; i++ {
+		vi := model.VolumeInfo{Name: fmt.Sprintf("V%d", i), Id: fmt.Sprintf("v%d", i)}
+		vd := &model.VolumeData{Name: vi.Name, Id: vi.Id, Loaded: true}
+		for k := 1; k <= 2; k++ {
+			cname := fmt.Sprintf("C%d-%d", i, k)
+			cd := &model.ChapterData{Loaded: true, Name: cname, Data: []string{"<p>" + cname + "</p>"}}
+			if i == 1 && k == 1 {
+				cd.Imgs = []string{img}
+				cd.Data = append(cd.Data, `<img src="../images/`+img+`" alt="`+img+`"/>`)
+			}
+			vi.Chapters = append(vi.Chapters, model.ChapterInfo{Name: cname})
+			vd.Chapters = append(vd.Chapters, cd)
+		}
+		info.Volumes = append(info.Volumes, vi)
+		data.Volumes = append(data.Volumes, vd)
+	}
+	p := path.Join(dir, fmt.Sprintf("test_%s.np", id))
+	err = utils.SaveRecord(p, &utils.Record{Info: info, Data: data}, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// newTestServer a server over a fresh cache dir without accounts, where everyone is admin.
+func newTestServer(t *testing.T) (*server, *testSource) {
+	dir := t.TempDir()
+	um, err := NewUserManager(path.Join(dir, ".web.Users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := NewCacheManager(utils.NewMemKVCache(1<<20), dir)
+	sr := &server{cm: cm, um: um, opds: newOPDSCatalog(cm), reader: newBookReader(dir)}
+	return sr, newTestSource(t, dir)
+}
@@ -0,0 +1,174 @@
+package zhconv
+
+import (
+	"bufio"
+	"embed"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// the tables use the format of the OpenCC dictionaries, one key per line followed by a tab and the candidates
+// separated by spaces; the first candidate is used and the phrases win over the characters.
+//
+//go:embed data/*.txt
+var dataFs embed.FS
+
+const (
+	None = ""
+	// T2S Traditional to Simplified Chinese.
+	T2S = "t2s"
+	// S2T Simplified to Traditional Chinese.
+	S2T = "s2t"
+)
+
+var ErrUnknownConversion = errors.New("unknown conversion")
+
+var conversions = map[string][]string{
+	T2S: {"data/TSPhrases.txt", "data/TSCharacters.txt"},
+	S2T: {"data/STPhrases.txt", "data/STCharacters.txt"},
+}
+
+var (
+	cmux       sync.Mutex
+	converters = make(map[string]*Converter)
+)
+
+// Converter a phrase-level conversion, the text is matched from left to right against the longest known phrase.
+type Converter struct {
+	dict   map[string]string
+	maxLen int
+}
+
+// Names the supported conversions.
+func Names() []string {
+	return []string{T2S, S2T}
+}
+
+// Get the converter of the conversion name, the tables are loaded on first use. None returns nil, which converts nothing.
+func Get(name string) (*Converter, error) {
+	if name == None {
+		return nil, nil
+	}
+	files, ok := conversions[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownConversion, name)
+	}
+	cmux.Lock()
+	defer cmux.Unlock()
+	if c, ok := converters[name]; ok {
+		return c, nil
+	}
+	c := &Converter{dict: make(map[string]string)}
+	for _, file := range files {
+		err := c.load(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	converters[name] = c
+	return c, nil
+}
+
+func (c *Converter) load(file string) error {
+	f, err := dataFs.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), "\t")
+		if !ok || key == "" {
+			continue
+		}
+		value, _, _ = strings.Cut(value, " ")
+		if _, ok := c.dict[key]; ok {
+			// the phrases are loaded first
+			continue
+		}
+		c.dict[key] = value
+		if n := utf8.RuneCountInString(key); n > c.maxLen {
+			c.maxLen = n
+		}
+	}
+	return sc.Err()
+}
+
+// Convert the text, a nil converter returns it unchanged.
+func (c *Converter) Convert(s string) string {
+	if c == nil || s == "" {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s))
+	c.convert(&sb, s)
+	return sb.String()
+}
+
+// ConvertHTML convert the text of an html fragment, tags and their attributes are kept as they are.
+func (c *Converter) ConvertHTML(s string) string {
+	if c == nil || s == "" {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for s != "" {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			c.convert(&sb, s)
+			break
+		}
+		c.convert(&sb, s[:i])
+		s = s[i:]
+		k := strings.IndexByte(s, '>')
+		if k < 0 {
+			sb.WriteString(s)
+			break
+		}
+		sb.WriteString(s[:k+1])
+		s = s[k+1:]
+	}
+	return sb.String()
+}
+
+func (c *Converter) convert(sb *strings.Builder, s string) {
+	ends := make([]int, 0, c.maxLen)
+	for s != "" {
+		if s[0] < utf8.RuneSelf {
+			// there is no ascii in the tables
+			sb.WriteByte(s[0])
+			s = s[1:]
+			continue
+		}
+		// the byte offsets where the next 1..maxLen runes end, the longest candidate is tried first
+		ends = ends[:0]
+		for i := range s {
+			if i > 0 {
+				ends = append(ends, i)
+				if len(ends) == c.maxLen {
+					break
+				}
+			}
+		}
+		if len(ends) < c.maxLen {
+			ends = append(ends, len(s))
+		}
+		n := ends[0]
+		matched := false
+		for k := len(ends) - 1; k >= 0; k-- {
+			if v, ok := c.dict[s[:ends[k]]]; ok {
+				sb.WriteString(v)
+				n = ends[k]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			sb.WriteString(s[:n])
+		}
+		s = s[n:]
+	}
+}
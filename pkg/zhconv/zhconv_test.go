@@ -0,0 +1,40 @@
+package zhconv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{T2S, "頭髮", "头发"},
+		{T2S, "乾隆著作", "乾隆著作"},
+		{T2S, `<p class="說明">說明</p>`, `<p class="說明">说明</p>`},
+		{S2T, "头发", "頭髮"},
+		{S2T, "以后在里面干什么", "以後在裏面幹什麼"},
+		{S2T, "干净的关系", "乾淨的關係"},
+		{S2T, "abc 123", "abc 123"},
+	}
+	for _, tt := range tests {
+		c, err := Get(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ConvertHTML(tt.in); got != tt.out {
+			t.Fatal(tt.name, tt.in, got)
+		}
+	}
+
+	c, err := Get(None)
+	if err != nil || c != nil || c.Convert("頭髮") != "頭髮" {
+		t.Fatal(c, err)
+	}
+	_, err = Get("x")
+	if !errors.Is(err, ErrUnknownConversion) {
+		t.Fatal(err)
+	}
+}